@@ -66,10 +66,13 @@ func main() {
 		keepalivedConfig = &agent.ConfigManager{
 			Service: fileCfg.Keepalived.Service,
 			Generator: &agent.KeepalivedConfigGenerator{
-				VRIDBase:     fileCfg.Keepalived.VRIDBase,
-				VRRPPassword: fileCfg.Keepalived.VRRPPassword,
-				Interface:    fileCfg.Keepalived.Interface,
-				Priority:     fileCfg.Keepalived.Priority,
+				VRIDBase:           fileCfg.Keepalived.VRIDBase,
+				VRRPPassword:       fileCfg.Keepalived.VRRPPassword,
+				Interface:          fileCfg.Keepalived.Interface,
+				Priority:           fileCfg.Keepalived.Priority,
+				Peers:              fileCfg.Keepalived.Peers,
+				NodeName:           fileCfg.Keepalived.NodeName,
+				InstancePerAddress: fileCfg.Keepalived.InstancePerAddress,
 			},
 		}
 	}
@@ -79,11 +82,16 @@ func main() {
 		nftablesConfig.Reload()
 	}
 
-	http.Handle("/v1/apply", &agent.ApplyHandlerv1{
+	applyHandler := &agent.ApplyHandlerv1{
 		MaxRequestSize:   1048576,
 		SharedSecret:     sharedSecret,
 		KeepalivedConfig: keepalivedConfig,
 		NftablesConfig:   nftablesConfig,
+	}
+	http.Handle("/v1/apply", applyHandler)
+	http.Handle("/v1/applied", &agent.AppliedHandlerv1{
+		Apply:        applyHandler,
+		SharedSecret: sharedSecret,
 	})
 
 	http.Handle("/metrics", promhttp.Handler())
@@ -26,6 +26,7 @@ import (
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/static"
 
+	"k8s.io/client-go/dynamic"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
@@ -34,6 +35,7 @@ import (
 	// Uncomment the following line to load the gcp plugin (only required to authenticate against GKE clusters).
 	// _ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
@@ -77,6 +79,15 @@ func main() {
 		klog.Fatalf("invalid configuration: %s", err.Error())
 	}
 
+	var allocationStatus *controller.AllocationStatusReconciler
+	if fileCfg.AllocationResources {
+		dynamicClient, err := dynamic.NewForConfig(cfg)
+		if err != nil {
+			klog.Fatalf("Error building dynamic kubernetes client: %s", err.Error())
+		}
+		allocationStatus = controller.NewAllocationStatusReconciler(dynamicClient)
+	}
+
 	var l3portmanager controller.L3PortManager
 
 	if fileCfg.PortManager == config.PortManagerOpenstack {
@@ -89,6 +100,7 @@ func main() {
 			&fileCfg.OpenStack.Networking,
 			fileCfg.Agents.Agents,
 			fileCfg.Agents.AdditionalIps,
+			openstack.WithClusterIdentity(fileCfg.Identity),
 		)
 		if err != nil {
 			klog.Fatalf("Failed to create openstack L3 port manager: %s", err.Error())
@@ -104,6 +116,11 @@ func main() {
 	if err != nil {
 		klog.Fatalf("Failed to configure agent controller: %s", err.Error())
 	}
+	prometheus.MustRegister(agentController.Registry)
+
+	// Agents may also poll the configuration instead of waiting for it to
+	// be pushed.
+	configStore := controller.NewConfigStore(agentController)
 
 	servicesInformer := kubeInformerFactory.Core().V1().Services()
 	nodesInformer := kubeInformerFactory.Core().V1().Nodes()
@@ -127,24 +144,22 @@ func main() {
 		nodesInformer = nil
 	}
 
-	if fileCfg.BackendLayer != config.BackendLayerPod {
-		// Setting the endpoints informer to nil causes the controller
-		// not to subscribe to it, saving cycles.
-		endpointsInformer = nil
+	// The endpoints informer is used by all backend layers: it decides
+	// whether services with a minimum backend count are ready.
+
+	portMapperOpts := []controller.PortMapperOption{
+		controller.WithReservedPorts(fileCfg.ReservedPorts),
+		controller.WithIdlePortFloor(fileCfg.IdlePortFloor),
+		controller.WithL4PortCeiling(fileCfg.L4PortCeiling),
+		controller.WithMaxServicesPerPort(fileCfg.MaxServicesPerPort),
+		controller.WithIdlePortGracePeriod(time.Duration(fileCfg.IdlePortGracePeriod) * time.Second),
+		controller.WithPlacementAge(controller.PlacementAge(fileCfg.PlacementAge)),
+		controller.WithProvisionRetries(fileCfg.ProvisionAttempts, time.Duration(fileCfg.ProvisionRetryDelay)*time.Second),
+		controller.WithMissingPortPolicy(controller.MissingPortPolicy(fileCfg.MissingPortPolicy)),
+		controller.WithPortRanges(fileCfg.BackendLayer == config.BackendLayerPod),
 	}
-
-	lbcontroller, err := controller.NewController(
-		kubeClient,
-		servicesInformer,
-		nodesInformer,
-		endpointsInformer,
-		networkPoliciesInformer,
-		l3portmanager,
-		agentController,
-		modelGenerator,
-	)
-	if err != nil {
-		klog.Fatalf("Failed to configure controller: %s", err.Error())
+	if fileCfg.PortAllocationPolicy == config.PortAllocationPolicyReuseOnly {
+		portMapperOpts = append(portMapperOpts, controller.WithPortAllocator(controller.ReuseOnlyPortAllocator{}))
 	}
 
 	http.Handle("/metrics", promhttp.Handler())
@@ -160,8 +175,63 @@ func main() {
 	// Start method is non-blocking and runs all registered informers in a dedicated goroutine.
 	kubeInformerFactory.Start(stopCh)
 
-	if err = lbcontroller.Run(2, stopCh); err != nil {
-		klog.Fatalf("Error running controller: %s", err.Error())
+	// The controller is only created once it is allowed to run, so that a
+	// replica waiting for the leader lease neither queues jobs nor holds any
+	// port mapper state. Registering the event handlers on the already
+	// synced informers replays all services, from which the port mapper is
+	// rebuilt.
+	runController := func(stopCh <-chan struct{}) {
+		lbcontroller, err := controller.NewController(
+			kubeClient,
+			servicesInformer,
+			nodesInformer,
+			endpointsInformer,
+			networkPoliciesInformer,
+			l3portmanager,
+			configStore,
+			modelGenerator,
+			portMapperOpts...,
+		)
+		if err != nil {
+			klog.Fatalf("Failed to configure controller: %s", err.Error())
+		}
+		lbcontroller.DrainTimeout = time.Duration(fileCfg.ShutdownTimeout) * time.Second
+		lbcontroller.Identity = fileCfg.Identity
+		lbcontroller.RevalidationInterval = time.Duration(fileCfg.PortRevalidationInterval) * time.Second
+		lbcontroller.AddressPairs = controller.AddressPairBudget{
+			Static:           len(fileCfg.Agents.AdditionalIps),
+			WarningThreshold: fileCfg.AddressPairWarningThreshold,
+		}
+		lbcontroller.AllocationStatus = allocationStatus
+		lbcontroller.MaxMappingAttempts = fileCfg.MaxMappingAttempts
+
+		if fileCfg.AdminToken != "" {
+			http.Handle("/resync", &controller.ResyncHandler{
+				Resyncer: lbcontroller,
+				Token:    fileCfg.AdminToken,
+			})
+			http.Handle("/config/diff", &controller.ConfigDiffHandler{
+				Store:   configStore,
+				Agents:  agentController,
+				L3Ports: l3portmanager,
+				Token:   fileCfg.AdminToken,
+			})
+		}
+
+		http.Handle("/v1/config", &controller.ConfigHandler{
+			Store: configStore,
+			Token: fileCfg.Agents.SharedSecret,
+		})
+
+		if err = lbcontroller.Run(2, stopCh); err != nil {
+			klog.Fatalf("Error running controller: %s", err.Error())
+		}
+	}
+
+	if fileCfg.LeaderElection.Enabled {
+		runAsLeader(kubeClient, fileCfg.LeaderElection, stopCh, runController)
+	} else {
+		runController(stopCh)
 	}
 }
 
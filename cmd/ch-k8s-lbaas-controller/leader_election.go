@@ -0,0 +1,112 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
+)
+
+// Call run only while this replica holds the leader lease, passing it a
+// channel which is closed when stopCh is closed or the lease is lost.
+//
+// The lease is released once run has returned. If the lease is lost, the
+// process exits, so that the replica restarts with an empty port mapper and
+// rebuilds it from the cluster state when it becomes leader again.
+func runAsLeader(kubeClient kubernetes.Interface, cfg config.LeaderElection, stopCh <-chan struct{}, run func(stopCh <-chan struct{})) {
+	holder, err := os.Hostname()
+	if err != nil {
+		klog.Fatalf("Failed to determine the leader election identity: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var leading atomic.Bool
+	finished := make(chan struct{})
+	go func() {
+		<-stopCh
+		// while leading, the lease is only released after run has
+		// returned
+		if !leading.Load() {
+			cancel()
+		}
+	}()
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      cfg.LeaseName,
+				Namespace: cfg.LeaseNamespace,
+			},
+			Client: kubeClient.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity: holder,
+			},
+		},
+		LeaseDuration:   time.Duration(cfg.LeaseDuration) * time.Second,
+		RenewDeadline:   time.Duration(cfg.RenewDeadline) * time.Second,
+		RetryPeriod:     time.Duration(cfg.RetryPeriod) * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				leading.Store(true)
+				defer close(finished)
+				defer cancel()
+
+				runStopCh := make(chan struct{})
+				go func() {
+					select {
+					case <-stopCh:
+					case <-leaderCtx.Done():
+					}
+					close(runStopCh)
+				}()
+
+				klog.Infof("Acquired lease %s/%s as %s", cfg.LeaseNamespace, cfg.LeaseName, holder)
+				run(runStopCh)
+			},
+			OnStoppedLeading: func() {
+				klog.Infof("Stopped leading as %s", holder)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != holder {
+					klog.Infof("Waiting for leader %s to release the lease", identity)
+				}
+			},
+		},
+	})
+
+	if !leading.Load() {
+		return
+	}
+	<-finished
+
+	select {
+	case <-stopCh:
+	default:
+		klog.Fatalf("Lost lease %s/%s, exiting", cfg.LeaseNamespace, cfg.LeaseName)
+	}
+}
@@ -15,6 +15,7 @@
 package agent
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -60,6 +61,9 @@ type ApplyHandlerv1 struct {
 	NftablesConfig   *ConfigManager
 	MaxRequestSize   int64
 	SharedSecret     []byte
+
+	// configuration applied last, reported to the controller
+	applied *model.LoadBalancer
 }
 
 type ConfigManager struct {
@@ -313,9 +317,21 @@ func (h *ApplyHandlerv1) ProcessRequest(lbcfg *model.LoadBalancer) (int, string)
 		klog.Infof("Applied configuration update: %#v", lbcfg)
 	}
 
+	h.mutex.Lock()
+	h.applied = lbcfg
+	h.mutex.Unlock()
+
 	return 200, "success"
 }
 
+// Applied returns the configuration applied last, or nil if none was applied
+// since the agent started.
+func (h *ApplyHandlerv1) Applied() *model.LoadBalancer {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.applied
+}
+
 func (h *ApplyHandlerv1) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	klog.V(5).Infof("incoming request from %s", r.RemoteAddr)
 
@@ -365,3 +381,41 @@ func (h *ApplyHandlerv1) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(body))
 	metricLastUpdateTimestamp.With(prometheus.Labels{"status": strconv.FormatInt(int64(status), 10)}).Set(float64(time.Now().UnixNano()) / 1000000000)
 }
+
+// AppliedHandlerv1 serves GET requests for the configuration applied last by
+// the ApplyHandlerv1, so that the controller can detect drift. Requests have
+// to carry a JWT signed with the shared secret as bearer token.
+type AppliedHandlerv1 struct {
+	Apply        *ApplyHandlerv1
+	SharedSecret []byte
+}
+
+func (h *AppliedHandlerv1) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(405) // Method Not Allowed
+		return
+	}
+
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.WriteHeader(401) // Unauthorized
+		return
+	}
+	token, err := jwt.ParseWithClaims(raw, &jwt.StandardClaims{}, func(*jwt.Token) (interface{}, error) {
+		return h.SharedSecret, nil
+	})
+	if err != nil || !token.Valid {
+		klog.V(5).Infof("unauthorized request for the applied config from %s", r.RemoteAddr)
+		w.WriteHeader(401) // Unauthorized
+		return
+	}
+
+	applied := h.Apply.Applied()
+	if applied == nil {
+		w.WriteHeader(404) // Not Found
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(applied)
+}
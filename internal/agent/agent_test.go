@@ -0,0 +1,110 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+func newTestApplyHandler(t *testing.T) (*ApplyHandlerv1, string) {
+	configFile := filepath.Join(t.TempDir(), "nftables.conf")
+	return &ApplyHandlerv1{
+		NftablesConfig: &ConfigManager{
+			Generator: newNftablesGenerator(),
+			Service: config.ServiceConfig{
+				ConfigFile:    configFile,
+				ReloadCommand: []string{"true"},
+			},
+		},
+	}, configFile
+}
+
+func TestProcessRequestAppliesSCTPForwardsAndPolicies(t *testing.T) {
+	h, configFile := newTestApplyHandler(t)
+
+	port := int32(3868)
+	m := &model.LoadBalancer{
+		Ingress: []model.IngressIP{
+			{
+				Address: "172.23.42.1",
+				Ports: []model.PortForward{
+					{
+						InboundPort:          3868,
+						Protocol:             corev1.ProtocolSCTP,
+						DestinationPort:      30868,
+						DestinationAddresses: []string{"192.168.0.1"},
+					},
+				},
+			},
+		},
+		NetworkPolicies: []model.NetworkPolicy{
+			{
+				Name: "allow-diameter",
+				AllowedIngresses: []model.AllowedIngress{
+					{
+						PortFilters: []model.PortFilter{
+							{Protocol: corev1.ProtocolSCTP, Port: &port},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	status, msg := h.ProcessRequest(m)
+	assert.Equal(t, 200, status, msg)
+	assert.Equal(t, m, h.Applied())
+
+	rendered, err := os.ReadFile(configFile)
+	assert.Nil(t, err)
+	assert.Contains(t, string(rendered), "ip daddr 172.23.42.1 sctp dport 3868 ")
+	assert.Contains(t, string(rendered), "sctp dport {3868}")
+}
+
+func TestProcessRequestRejectsUnknownProtocol(t *testing.T) {
+	h, configFile := newTestApplyHandler(t)
+
+	m := &model.LoadBalancer{
+		Ingress: []model.IngressIP{
+			{
+				Address: "172.23.42.1",
+				Ports: []model.PortForward{
+					{
+						InboundPort:          80,
+						Protocol:             corev1.Protocol("ICMP"),
+						DestinationPort:      30080,
+						DestinationAddresses: []string{"192.168.0.1"},
+					},
+				},
+			},
+		},
+	}
+
+	status, _ := h.ProcessRequest(m)
+	assert.Equal(t, 400, status)
+	assert.Nil(t, h.Applied())
+
+	_, err := os.Stat(configFile)
+	assert.True(t, os.IsNotExist(err))
+}
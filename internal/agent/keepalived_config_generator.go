@@ -15,6 +15,8 @@
 package agent
 
 import (
+	"fmt"
+	"hash/fnv"
 	"io"
 	"sort"
 	"text/template"
@@ -47,6 +49,9 @@ vrrp_instance LBaaS_{{ .Name }} {
 `))
 )
 
+// The largest virtual router ID permitted by VRRP.
+const maxVRID = 255
+
 type keepalivedVRRPAddress struct {
 	Address string
 	Device  string
@@ -70,6 +75,111 @@ type KeepalivedConfigGenerator struct {
 	VRRPPassword string
 	VRIDBase     int
 	Interface    string
+	// Peers lists the names of all nodes running the agent. If set, the
+	// priority is derived from the position of NodeName in the sorted list
+	// instead of being taken as is, see peerPriority.
+	Peers    []string
+	NodeName string
+	// InstancePerAddress places every address into a VRRP instance of its
+	// own instead of putting all of them into a single one, so that the
+	// addresses can be spread across the peers.
+	InstancePerAddress bool
+}
+
+// Derive the VRRP priority of node from its position in the sorted set of
+// peers. The first node gets base+len(peers)-1, the last one gets base, so
+// every node ends up with a distinct priority which does not depend on the
+// order in which the peers were configured. Nodes which are not in the set
+// get base.
+func peerPriority(base int, peers []string, node string) int {
+	return rotatedPeerPriority(base, peers, node, 0)
+}
+
+// Like peerPriority, but the ranking of the sorted peers is rotated by shift
+// positions, so that a different node gets the highest priority for each
+// shift.
+func rotatedPeerPriority(base int, peers []string, node string, shift int) int {
+	sorted := make([]string, 0, len(peers))
+	seen := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		if !seen[peer] {
+			seen[peer] = true
+			sorted = append(sorted, peer)
+		}
+	}
+	sort.Strings(sorted)
+
+	for i, peer := range sorted {
+		if peer == node {
+			return base + len(sorted) - 1 - (i+shift)%len(sorted)
+		}
+	}
+	return base
+}
+
+func (g *KeepalivedConfigGenerator) priority() int {
+	if len(g.Peers) == 0 {
+		return g.Priority
+	}
+	return peerPriority(g.Priority, g.Peers, g.NodeName)
+}
+
+// Assign a virtual router ID from [base, maxVRID] to each of the sorted
+// addresses. The preferred ID of an address is derived from a hash of the
+// address, collisions are resolved by taking the next free one. This way, the
+// ID of an address does not depend on the other addresses unless they
+// collide.
+func assignVRIDs(base int, addresses []string) (map[string]int, error) {
+	available := maxVRID - base + 1
+	if len(addresses) > available {
+		return nil, fmt.Errorf(
+			"cannot configure %d addresses: only %d virtual router IDs (%d to %d) are available",
+			len(addresses), available, base, maxVRID,
+		)
+	}
+
+	result := make(map[string]int, len(addresses))
+	used := make(map[int]bool, len(addresses))
+	for _, address := range addresses {
+		h := fnv.New32a()
+		h.Write([]byte(address))
+		offset := int(h.Sum32() % uint32(available))
+		for used[base+offset] {
+			offset = (offset + 1) % available
+		}
+		used[base+offset] = true
+		result[address] = base + offset
+	}
+	return result, nil
+}
+
+func (g *KeepalivedConfigGenerator) generateInstancePerAddress(addresses []string) (*keepalivedConfig, error) {
+	vrids, err := assignVRIDs(g.VRIDBase, addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &keepalivedConfig{
+		Instances: make([]keepalivedVRRPInstance, 0, len(addresses)),
+	}
+	for _, address := range addresses {
+		vrid := vrids[address]
+		priority := g.Priority
+		if len(g.Peers) > 0 {
+			priority = rotatedPeerPriority(g.Priority, g.Peers, g.NodeName, vrid)
+		}
+		result.Instances = append(result.Instances, keepalivedVRRPInstance{
+			Name:      fmt.Sprintf("VIP_%d", vrid),
+			Interface: g.Interface,
+			Priority:  priority,
+			VRID:      vrid,
+			Password:  g.VRRPPassword,
+			Addresses: []keepalivedVRRPAddress{
+				{Address: address, Device: g.Interface},
+			},
+		})
+	}
+	return result, nil
 }
 
 func (g *KeepalivedConfigGenerator) GenerateStructuredConfig(lb *model.LoadBalancer) (*keepalivedConfig, error) {
@@ -79,12 +189,25 @@ func (g *KeepalivedConfigGenerator) GenerateStructuredConfig(lb *model.LoadBalan
 		}, nil
 	}
 
+	if g.InstancePerAddress {
+		addresses := make([]string, 0, len(lb.Ingress))
+		seen := make(map[string]bool, len(lb.Ingress))
+		for _, ingress := range lb.Ingress {
+			if !seen[ingress.Address] {
+				seen[ingress.Address] = true
+				addresses = append(addresses, ingress.Address)
+			}
+		}
+		sort.Strings(addresses)
+		return g.generateInstancePerAddress(addresses)
+	}
+
 	result := &keepalivedConfig{
 		Instances: []keepalivedVRRPInstance{
 			{
 				Name:      "VIPs",
 				Interface: g.Interface,
-				Priority:  g.Priority,
+				Priority:  g.priority(),
 				VRID:      g.VRIDBase,
 				Password:  g.VRRPPassword,
 				Addresses: []keepalivedVRRPAddress{},
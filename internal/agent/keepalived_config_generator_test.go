@@ -139,3 +139,128 @@ func TestKeepalivedGenerateConfigFromNonEmptyLBModel(t *testing.T) {
 	err := g.GenerateConfig(m, out)
 	assert.Nil(t, err)
 }
+
+func TestKeepalivedPeerPriorityDoesNotDependOnPeerOrder(t *testing.T) {
+	orderings := [][]string{
+		{"node-a", "node-b", "node-c"},
+		{"node-c", "node-a", "node-b"},
+		{"node-b", "node-c", "node-a", "node-b"},
+	}
+
+	for _, peers := range orderings {
+		assert.Equal(t, 102, peerPriority(100, peers, "node-a"))
+		assert.Equal(t, 101, peerPriority(100, peers, "node-b"))
+		assert.Equal(t, 100, peerPriority(100, peers, "node-c"))
+		assert.Equal(t, 100, peerPriority(100, peers, "node-x"))
+	}
+}
+
+func TestKeepalivedGenerateStructuredConfigDerivesPriorityFromPeers(t *testing.T) {
+	g := newKeepalivedGenerator()
+	g.Peers = []string{"node-c", "node-b", "node-a"}
+	g.NodeName = "node-b"
+
+	m := &model.LoadBalancer{
+		Ingress: []model.IngressIP{
+			{Address: "172.23.42.1"},
+		},
+	}
+
+	scfg, err := g.GenerateStructuredConfig(m)
+	assert.Nil(t, err)
+	assert.Equal(t, 24, scfg.Instances[0].Priority)
+}
+
+func TestKeepalivedGenerateStructuredConfigWithInstancePerAddress(t *testing.T) {
+	g := newKeepalivedGenerator()
+	g.InstancePerAddress = true
+
+	m := &model.LoadBalancer{
+		Ingress: []model.IngressIP{
+			{Address: "172.23.42.2"},
+			{Address: "172.23.42.1"},
+		},
+	}
+
+	scfg, err := g.GenerateStructuredConfig(m)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(scfg.Instances))
+
+	vrids := map[int]bool{}
+	for i, address := range []string{"172.23.42.1", "172.23.42.2"} {
+		instance := scfg.Instances[i]
+		assert.Equal(t, []keepalivedVRRPAddress{
+			{Address: address, Device: g.Interface},
+		}, instance.Addresses)
+		assert.GreaterOrEqual(t, instance.VRID, g.VRIDBase)
+		assert.LessOrEqual(t, instance.VRID, maxVRID)
+		assert.Equal(t, g.Priority, instance.Priority)
+		vrids[instance.VRID] = true
+	}
+	assert.Equal(t, 2, len(vrids))
+}
+
+func TestKeepalivedInstancePerAddressIsDeterministic(t *testing.T) {
+	g := newKeepalivedGenerator()
+	g.InstancePerAddress = true
+	g.Peers = []string{"node-a", "node-b", "node-c"}
+	g.NodeName = "node-a"
+
+	generate := func(addresses ...string) string {
+		m := &model.LoadBalancer{}
+		for _, address := range addresses {
+			m.Ingress = append(m.Ingress, model.IngressIP{Address: address})
+		}
+		var buf bytes.Buffer
+		assert.Nil(t, g.GenerateConfig(m, &buf))
+		return buf.String()
+	}
+
+	expected := generate("172.23.42.1", "172.23.42.2", "172.23.42.3")
+	assert.Equal(t, expected, generate("172.23.42.3", "172.23.42.1", "172.23.42.2"))
+	assert.Equal(t, expected, generate("172.23.42.2", "172.23.42.3", "172.23.42.1"))
+}
+
+func TestKeepalivedInstancePerAddressKeepsVRIDOfAddress(t *testing.T) {
+	vrids, err := assignVRIDs(10, []string{"172.23.42.1"})
+	assert.Nil(t, err)
+
+	moreVRIDs, err := assignVRIDs(10, []string{"172.23.42.1", "172.23.42.7", "172.23.42.9"})
+	assert.Nil(t, err)
+	assert.Equal(t, vrids["172.23.42.1"], moreVRIDs["172.23.42.1"])
+}
+
+func TestKeepalivedInstancePerAddressRotatesPriorityAcrossPeers(t *testing.T) {
+	peers := []string{"node-a", "node-b", "node-c"}
+
+	for shift := 0; shift < 3; shift++ {
+		priorities := map[int]bool{}
+		for _, node := range peers {
+			priorities[rotatedPeerPriority(100, peers, node, shift)] = true
+		}
+		assert.Equal(t, map[int]bool{100: true, 101: true, 102: true}, priorities)
+	}
+
+	assert.Equal(t, 102, rotatedPeerPriority(100, peers, "node-a", 0))
+	assert.Equal(t, 102, rotatedPeerPriority(100, peers, "node-c", 1))
+	assert.Equal(t, 102, rotatedPeerPriority(100, peers, "node-b", 2))
+}
+
+func TestKeepalivedInstancePerAddressRejectsTooManyAddresses(t *testing.T) {
+	g := newKeepalivedGenerator()
+	g.InstancePerAddress = true
+	g.VRIDBase = 254
+
+	m := &model.LoadBalancer{
+		Ingress: []model.IngressIP{
+			{Address: "172.23.42.1"},
+			{Address: "172.23.42.2"},
+			{Address: "172.23.42.3"},
+		},
+	}
+
+	scfg, err := g.GenerateStructuredConfig(m)
+	assert.Nil(t, scfg)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "only 2 virtual router IDs (254 to 255) are available")
+}
@@ -47,6 +47,10 @@ var funcMap = template.FuncMap{
 	"replaceColons": func (ipString string) string {
 		return strings.ReplaceAll(ipString, ":", "-")
 	},
+	// Bundle a forward with the marks of the config for the forward template
+	"forwardRule": func (cfg *nftablesConfig, fwd nftablesForward) nftablesForwardRule {
+		return nftablesForwardRule{Forward: fwd, FWMarkBits: cfg.FWMarkBits, FWMarkMask: cfg.FWMarkMask}
+	},
 }
 
 var (
@@ -120,15 +124,28 @@ table {{ .FilterTableType }} {{ .FilterTableName }} {
 }
 
 table ip {{ .NATTableName }} {
+{{- range $set := $cfg.BackendSets }}
+	map {{ $set.Name }} {
+		type mark : ipv4_addr;
+		elements = { {{- range $index, $daddr := $set.Addresses }}{{ if $index }}, {{ end }}{{ $index }} : {{ $daddr }}{{ end -}} };
+	}
+{{ end }}
 	chain {{ .NATPreroutingChainName }} {
+{{- range $chain := .IngressChains }}
+		ip daddr {{ $chain.Address }} jump {{ $chain.Name }};
+{{- end }}
 {{- range $fwd := .Forwards }}
-{{- if ne ($fwd.DestinationAddresses | len) 0 }}
-		ip daddr {{ $fwd.InboundIP }} {{ $fwd.Protocol }} dport {{ $fwd.InboundPort }} mark set {{ $cfg.FWMarkBits | printf "0x%x" }} and {{ $cfg.FWMarkMask | printf "0x%x" }} ct mark set meta mark dnat to numgen inc mod {{ $fwd.DestinationAddresses | len }} map {
-{{- range $index, $daddr := $fwd.DestinationAddresses }}{{ $index }} : {{ $daddr }}, {{ end -}}
-		} : {{ $fwd.DestinationPort }};
+{{- template "forward" (forwardRule $cfg $fwd) }}
 {{- end }}
+	}
+{{- range $chain := .IngressChains }}
+
+	chain {{ $chain.Name }} {
+{{- range $fwd := $chain.Forwards }}
+{{- template "forward" (forwardRule $cfg $fwd) }}
 {{- end }}
 	}
+{{- end }}
 
 {{- if $cfg.EnableSNAT }}
 	chain {{ .NATPostroutingChainName }} {
@@ -136,6 +153,23 @@ table ip {{ .NATTableName }} {
 	}
 {{- end }}
 }
+
+{{- define "forward" }}
+{{- $fwd := .Forward }}
+{{- if ne ($fwd.WeightedDestinations | len) 0 }}
+		ip daddr {{ $fwd.InboundIP }} {{ $fwd.Protocol }} dport {{ $fwd.InboundPort }} mark set {{ .FWMarkBits | printf "0x%x" }} and {{ .FWMarkMask | printf "0x%x" }} ct mark set meta mark dnat ip to numgen inc mod {{ $fwd.WeightedDestinations | len }} map {
+{{- range $index, $dest := $fwd.WeightedDestinations }}{{ $index }} : {{ $dest.Address }} . {{ $dest.Port }}, {{ end -}}
+		};
+{{- else if ne $fwd.BackendSet "" }}
+		ip daddr {{ $fwd.InboundIP }} {{ $fwd.Protocol }} dport {{ $fwd.InboundPort }} mark set {{ .FWMarkBits | printf "0x%x" }} and {{ .FWMarkMask | printf "0x%x" }} ct mark set meta mark dnat to numgen inc mod {{ $fwd.DestinationAddresses | len }} map @{{ $fwd.BackendSet }} : {{ $fwd.DestinationPort }};
+{{- else if ne ($fwd.DestinationAddresses | len) 0 }}
+		ip daddr {{ $fwd.InboundIP }} {{ $fwd.Protocol }} dport {{ $fwd.InboundPort }} mark set {{ .FWMarkBits | printf "0x%x" }} and {{ .FWMarkMask | printf "0x%x" }} ct mark set meta mark dnat to numgen inc mod {{ $fwd.DestinationAddresses | len }} map {
+{{- range $index, $daddr := $fwd.DestinationAddresses }}{{ $index }} : {{ $daddr }}, {{ end -}}
+		} : {{ $fwd.DestinationPort }};
+{{- else }}
+		ip daddr {{ $fwd.InboundIP }} {{ $fwd.Protocol }} dport {{ $fwd.InboundPort }} drop;
+{{- end }}
+{{- end }}
 `))
 
 	ErrProtocolNotSupported = fmt.Errorf("Protocol is not supported")
@@ -175,12 +209,45 @@ type policyAssignment struct {
 	NetworkPolicies []string
 }
 
+type nftablesDestination struct {
+	Address string
+	Port    int32
+}
+
 type nftablesForward struct {
 	Protocol             string
 	InboundIP            string
 	InboundPort          int32
 	DestinationAddresses []string
 	DestinationPort      int32
+	// Only set if multiple forwards of a shared listener group were merged
+	// into this one. Each entry is one slot of the round robin; destinations
+	// occur as often as their weight demands.
+	WeightedDestinations []nftablesDestination
+	// Name of the shared backend set holding the destination addresses, if
+	// the addresses are not rendered into the rule itself
+	BackendSet string
+}
+
+// A named nftables map from round robin slot to destination address, shared
+// by all forwards with the same set of destination addresses.
+type nftablesBackendSet struct {
+	Name      string
+	Addresses []string
+}
+
+// A chain in the NAT table holding the forwards of a single inbound address,
+// to which the prerouting chain jumps.
+type nftablesIngressChain struct {
+	Name     string
+	Address  string
+	Forwards []nftablesForward
+}
+
+type nftablesForwardRule struct {
+	Forward    nftablesForward
+	FWMarkBits uint32
+	FWMarkMask uint32
 }
 
 type nftablesConfig struct {
@@ -194,6 +261,8 @@ type nftablesConfig struct {
 	FWMarkBits              uint32
 	FWMarkMask              uint32
 	Forwards                []nftablesForward
+	BackendSets             []nftablesBackendSet
+	IngressChains           []nftablesIngressChain
 	NetworkPolicies         map[string]networkPolicy
 	PolicyAssignments       []policyAssignment
 	ExistingPolicyChains    []string
@@ -386,6 +455,8 @@ func mapProtocol(k8sproto corev1.Protocol) (string, error) {
 		return "tcp", nil
 	case corev1.ProtocolUDP:
 		return "udp", nil
+	case corev1.ProtocolSCTP:
+		return "sctp", nil
 	default:
 		return "", ErrProtocolNotSupported
 	}
@@ -450,6 +521,134 @@ func getExistingPolicyChains(nftCommand []string, filterTableName string, filter
 	return existingChains, nil
 }
 
+type nftablesListener struct {
+	Protocol    string
+	InboundPort int32
+}
+
+type weightedForward struct {
+	forward nftablesForward
+	weight  int32
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// Merge forwards which share the same inbound IP, protocol and port into a
+// single forward.
+//
+// A single forward is returned unchanged. Otherwise, the traffic is split
+// between the forwards according to their weights and evenly between the
+// destination addresses of each forward.
+func mergeForwards(forwards []weightedForward) nftablesForward {
+	if len(forwards) == 1 {
+		return forwards[0].forward
+	}
+
+	// find the least common multiple of the address counts so that each
+	// address of a forward can get the same integral number of slots
+	lcm := 1
+	for _, fwd := range forwards {
+		n := len(fwd.forward.DestinationAddresses)
+		if n == 0 {
+			continue
+		}
+		lcm = lcm / gcd(lcm, n) * n
+	}
+
+	slots := make([]int, len(forwards))
+	slotGCD := 0
+	for i, fwd := range forwards {
+		n := len(fwd.forward.DestinationAddresses)
+		if n == 0 {
+			continue
+		}
+		weight := int(fwd.weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		slots[i] = weight * lcm / n
+		slotGCD = gcd(slotGCD, slots[i])
+	}
+
+	result := forwards[0].forward
+	result.DestinationAddresses = []string{}
+	result.DestinationPort = 0
+	result.WeightedDestinations = []nftablesDestination{}
+	for i, fwd := range forwards {
+		for _, addr := range fwd.forward.DestinationAddresses {
+			result.DestinationAddresses = append(result.DestinationAddresses, addr)
+			for j := 0; j < slots[i]/slotGCD; j++ {
+				result.WeightedDestinations = append(result.WeightedDestinations, nftablesDestination{
+					Address: addr,
+					Port:    fwd.forward.DestinationPort,
+				})
+			}
+		}
+	}
+	return result
+}
+
+// Move destination address lists which are used by more than one forward into
+// shared backend sets and let the forwards reference them.
+//
+// Merged forwards of shared listener groups keep their weighted destinations
+// and are not considered. The sets are named in the order of their first use.
+func shareBackendSets(forwards []nftablesForward) []nftablesBackendSet {
+	uses := map[string]int{}
+	for _, fwd := range forwards {
+		if len(fwd.WeightedDestinations) == 0 && len(fwd.DestinationAddresses) > 0 {
+			uses[strings.Join(fwd.DestinationAddresses, ",")]++
+		}
+	}
+
+	result := []nftablesBackendSet{}
+	names := map[string]string{}
+	for i := range forwards {
+		fwd := &forwards[i]
+		if len(fwd.WeightedDestinations) != 0 || len(fwd.DestinationAddresses) == 0 {
+			continue
+		}
+		key := strings.Join(fwd.DestinationAddresses, ",")
+		if uses[key] < 2 {
+			continue
+		}
+		name, ok := names[key]
+		if !ok {
+			name = fmt.Sprintf("lbaas-backends-%d", len(result))
+			names[key] = name
+			result = append(result, nftablesBackendSet{
+				Name:      name,
+				Addresses: copyAddresses(fwd.DestinationAddresses),
+			})
+		}
+		fwd.BackendSet = name
+	}
+	return result
+}
+
+// Move the sorted forwards into one chain per inbound address. The chains are
+// named after the address and keep the order of the forwards.
+func groupIngressChains(forwards []nftablesForward) []nftablesIngressChain {
+	result := []nftablesIngressChain{}
+	for _, fwd := range forwards {
+		if len(result) == 0 || result[len(result)-1].Address != fwd.InboundIP {
+			result = append(result, nftablesIngressChain{
+				Name:     "lbaas-ingress-" + strings.ReplaceAll(fwd.InboundIP, ":", "-"),
+				Address:  fwd.InboundIP,
+				Forwards: []nftablesForward{},
+			})
+		}
+		chain := &result[len(result)-1]
+		chain.Forwards = append(chain.Forwards, fwd)
+	}
+	return result
+}
+
 // Generates a config suitable for nftablesTemplate from a LoadBalancer model
 func (g *NftablesGenerator) GenerateStructuredConfig(m *model.LoadBalancer) (*nftablesConfig, error) {
 	result := &nftablesConfig{
@@ -463,6 +662,8 @@ func (g *NftablesGenerator) GenerateStructuredConfig(m *model.LoadBalancer) (*nf
 		FWMarkBits:              g.Cfg.FWMarkBits,
 		FWMarkMask:              g.Cfg.FWMarkMask,
 		Forwards:                []nftablesForward{},
+		BackendSets:             []nftablesBackendSet{},
+		IngressChains:           []nftablesIngressChain{},
 		NetworkPolicies:         map[string]networkPolicy{},
 		PolicyAssignments:       []policyAssignment{},
 		ExistingPolicyChains:    []string{},
@@ -471,6 +672,8 @@ func (g *NftablesGenerator) GenerateStructuredConfig(m *model.LoadBalancer) (*nf
 	}
 
 	for _, ingress := range m.Ingress {
+		listeners := map[nftablesListener][]weightedForward{}
+		order := []nftablesListener{}
 		for _, port := range ingress.Ports {
 			mappedProtocol, err := mapProtocol(port.Protocol)
 			if err != nil {
@@ -480,14 +683,25 @@ func (g *NftablesGenerator) GenerateStructuredConfig(m *model.LoadBalancer) (*nf
 			addrs := copyAddresses(port.DestinationAddresses)
 			sort.Strings(addrs)
 
-			result.Forwards = append(result.Forwards, nftablesForward{
-				Protocol:             mappedProtocol,
-				InboundIP:            ingress.Address,
-				InboundPort:          port.InboundPort,
-				DestinationAddresses: addrs,
-				DestinationPort:      port.DestinationPort,
+			listener := nftablesListener{Protocol: mappedProtocol, InboundPort: port.InboundPort}
+			if _, ok := listeners[listener]; !ok {
+				order = append(order, listener)
+			}
+			listeners[listener] = append(listeners[listener], weightedForward{
+				forward: nftablesForward{
+					Protocol:             mappedProtocol,
+					InboundIP:            ingress.Address,
+					InboundPort:          port.InboundPort,
+					DestinationAddresses: addrs,
+					DestinationPort:      port.DestinationPort,
+				},
+				weight: port.Weight,
 			})
 		}
+
+		for _, listener := range order {
+			result.Forwards = append(result.Forwards, mergeForwards(listeners[listener]))
+		}
 	}
 
 	sort.SliceStable(result.Forwards, func(i, j int) bool {
@@ -504,6 +718,15 @@ func (g *NftablesGenerator) GenerateStructuredConfig(m *model.LoadBalancer) (*nf
 		return fwdA.InboundPort < fwdB.InboundPort
 	})
 
+	if g.Cfg.ShareBackendSets {
+		result.BackendSets = shareBackendSets(result.Forwards)
+	}
+
+	if g.Cfg.ChainPerAddress {
+		result.IngressChains = groupIngressChains(result.Forwards)
+		result.Forwards = []nftablesForward{}
+	}
+
 	result.PolicyAssignments = copyPolicyAssignment(m.PolicyAssignments)
 	policies, err := copyNetworkPolicies(m.NetworkPolicies)
 	if err != nil {
@@ -15,6 +15,8 @@
 package agent
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
@@ -297,6 +299,205 @@ func TestNftablesStructuredConfigSortsAddresses(t *testing.T) {
 	assert.Equal(t, m.Ingress[1].Ports[0].DestinationAddresses, fwd.DestinationAddresses)
 }
 
+func TestNftablesStructuredConfigMergesSharedListeners(t *testing.T) {
+	g := newNftablesGenerator()
+
+	m := &model.LoadBalancer{
+		Ingress: []model.IngressIP{
+			{
+				Address: "172.23.42.1",
+				Ports: []model.PortForward{
+					{
+						InboundPort:          80,
+						Protocol:             corev1.ProtocolTCP,
+						DestinationPort:      30080,
+						DestinationAddresses: []string{"192.168.0.1", "192.168.0.2"},
+						Weight:               1,
+					},
+					{
+						InboundPort:          80,
+						Protocol:             corev1.ProtocolTCP,
+						DestinationPort:      31080,
+						DestinationAddresses: []string{"192.168.0.3"},
+						Weight:               2,
+					},
+					{
+						InboundPort:          80,
+						Protocol:             corev1.ProtocolUDP,
+						DestinationPort:      30081,
+						DestinationAddresses: []string{"192.168.0.1"},
+					},
+				},
+			},
+		},
+	}
+
+	scfg, err := g.GenerateStructuredConfig(m)
+	assert.Nil(t, err)
+	assert.NotNil(t, scfg)
+	assert.Equal(t, 2, len(scfg.Forwards))
+
+	fwd := scfg.Forwards[0]
+	assert.Equal(t, "tcp", fwd.Protocol)
+	assert.Equal(t, int32(80), fwd.InboundPort)
+	assert.Equal(t, []string{"192.168.0.1", "192.168.0.2", "192.168.0.3"}, fwd.DestinationAddresses)
+	assert.Equal(t, []nftablesDestination{
+		{Address: "192.168.0.1", Port: 30080},
+		{Address: "192.168.0.2", Port: 30080},
+		{Address: "192.168.0.3", Port: 31080},
+		{Address: "192.168.0.3", Port: 31080},
+		{Address: "192.168.0.3", Port: 31080},
+		{Address: "192.168.0.3", Port: 31080},
+	}, fwd.WeightedDestinations)
+
+	fwd = scfg.Forwards[1]
+	assert.Equal(t, "udp", fwd.Protocol)
+	assert.Equal(t, int32(30081), fwd.DestinationPort)
+	assert.Nil(t, fwd.WeightedDestinations)
+}
+
+func newBackendSetsLBModel() *model.LoadBalancer {
+	return &model.LoadBalancer{
+		Ingress: []model.IngressIP{
+			{
+				Address: "172.23.42.1",
+				Ports: []model.PortForward{
+					{
+						InboundPort:          80,
+						Protocol:             corev1.ProtocolTCP,
+						DestinationPort:      30080,
+						DestinationAddresses: []string{"192.168.0.2", "192.168.0.1"},
+					},
+					{
+						InboundPort:          53,
+						Protocol:             corev1.ProtocolUDP,
+						DestinationPort:      30053,
+						DestinationAddresses: []string{"192.168.0.3"},
+					},
+				},
+			},
+			{
+				Address: "172.23.42.2",
+				Ports: []model.PortForward{
+					{
+						InboundPort:          443,
+						Protocol:             corev1.ProtocolTCP,
+						DestinationPort:      30443,
+						DestinationAddresses: []string{"192.168.0.1", "192.168.0.2"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestNftablesStructuredConfigSharesIdenticalBackendSets(t *testing.T) {
+	g := newNftablesGenerator()
+	g.Cfg.ShareBackendSets = true
+
+	scfg, err := g.GenerateStructuredConfig(newBackendSetsLBModel())
+	assert.Nil(t, err)
+	assert.Equal(t, []nftablesBackendSet{
+		{Name: "lbaas-backends-0", Addresses: []string{"192.168.0.1", "192.168.0.2"}},
+	}, scfg.BackendSets)
+
+	assert.Equal(t, 3, len(scfg.Forwards))
+	assert.Equal(t, int32(53), scfg.Forwards[0].InboundPort)
+	assert.Equal(t, "", scfg.Forwards[0].BackendSet)
+	assert.Equal(t, int32(80), scfg.Forwards[1].InboundPort)
+	assert.Equal(t, "lbaas-backends-0", scfg.Forwards[1].BackendSet)
+	assert.Equal(t, int32(443), scfg.Forwards[2].InboundPort)
+	assert.Equal(t, "lbaas-backends-0", scfg.Forwards[2].BackendSet)
+}
+
+func TestNftablesStructuredConfigDoesNotShareBackendSetsByDefault(t *testing.T) {
+	g := newNftablesGenerator()
+
+	scfg, err := g.GenerateStructuredConfig(newBackendSetsLBModel())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(scfg.BackendSets))
+	for _, fwd := range scfg.Forwards {
+		assert.Equal(t, "", fwd.BackendSet)
+	}
+}
+
+func TestNftablesConfigRendersSharedBackendSetOnce(t *testing.T) {
+	g := newNftablesGenerator()
+	g.Cfg.ShareBackendSets = true
+
+	var buf bytes.Buffer
+	err := g.GenerateConfig(newBackendSetsLBModel(), &buf)
+	assert.Nil(t, err)
+
+	assert.Contains(t, buf.String(), `
+table ip nat {
+	map lbaas-backends-0 {
+		type mark : ipv4_addr;
+		elements = {0 : 192.168.0.1, 1 : 192.168.0.2};
+	}
+
+	chain prerouting {
+		ip daddr 172.23.42.1 udp dport 53 mark set 0x1 and 0x1 ct mark set meta mark dnat to numgen inc mod 1 map {0 : 192.168.0.3, } : 30053;
+		ip daddr 172.23.42.1 tcp dport 80 mark set 0x1 and 0x1 ct mark set meta mark dnat to numgen inc mod 2 map @lbaas-backends-0 : 30080;
+		ip daddr 172.23.42.2 tcp dport 443 mark set 0x1 and 0x1 ct mark set meta mark dnat to numgen inc mod 2 map @lbaas-backends-0 : 30443;
+	}
+`)
+	assert.Equal(t, 1, strings.Count(buf.String(), "192.168.0.1"))
+}
+
+func TestNftablesConfigDropsTrafficOfForwardWithoutDestinations(t *testing.T) {
+	g := newNftablesGenerator()
+
+	m := &model.LoadBalancer{
+		Ingress: []model.IngressIP{
+			{
+				Address: "172.23.42.1",
+				Ports: []model.PortForward{
+					{
+						InboundPort:          80,
+						Protocol:             corev1.ProtocolTCP,
+						DestinationAddresses: []string{},
+					},
+				},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	err := g.GenerateConfig(m, &buf)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), `
+	chain prerouting {
+		ip daddr 172.23.42.1 tcp dport 80 drop;
+	}
+`)
+}
+
+func TestNftablesConfigForwardsSCTP(t *testing.T) {
+	g := newNftablesGenerator()
+
+	m := &model.LoadBalancer{
+		Ingress: []model.IngressIP{
+			{
+				Address: "172.23.42.1",
+				Ports: []model.PortForward{
+					{
+						InboundPort:          3868,
+						Protocol:             corev1.ProtocolSCTP,
+						DestinationPort:      30868,
+						DestinationAddresses: []string{"192.168.0.1"},
+					},
+				},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	err := g.GenerateConfig(m, &buf)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "ip daddr 172.23.42.1 sctp dport 3868 ")
+}
+
 func TestFilterNftablesChainListByPrefix(t *testing.T) {
 	chainResultEntry1 := nftablesChainListResultEntry{ // Correct
 		Chain: nftablesChainListResultChain{
@@ -342,3 +543,60 @@ func TestFilterNftablesChainListByPrefix(t *testing.T) {
 
 	assert.Equal(t, []string{"Prefix-TestChain1"}, filteredChains)
 }
+
+func TestNftablesStructuredConfigGroupsForwardsIntoChainPerAddress(t *testing.T) {
+	g := newNftablesGenerator()
+	g.Cfg.ChainPerAddress = true
+
+	scfg, err := g.GenerateStructuredConfig(newBackendSetsLBModel())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(scfg.Forwards))
+	assert.Equal(t, 2, len(scfg.IngressChains))
+
+	chain := scfg.IngressChains[0]
+	assert.Equal(t, "lbaas-ingress-172.23.42.1", chain.Name)
+	assert.Equal(t, "172.23.42.1", chain.Address)
+	assert.Equal(t, 2, len(chain.Forwards))
+	assert.Equal(t, int32(53), chain.Forwards[0].InboundPort)
+	assert.Equal(t, int32(80), chain.Forwards[1].InboundPort)
+
+	chain = scfg.IngressChains[1]
+	assert.Equal(t, "lbaas-ingress-172.23.42.2", chain.Name)
+	assert.Equal(t, "172.23.42.2", chain.Address)
+	assert.Equal(t, 1, len(chain.Forwards))
+	assert.Equal(t, int32(443), chain.Forwards[0].InboundPort)
+}
+
+func TestNftablesStructuredConfigHasNoChainPerAddressByDefault(t *testing.T) {
+	g := newNftablesGenerator()
+
+	scfg, err := g.GenerateStructuredConfig(newBackendSetsLBModel())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(scfg.IngressChains))
+	assert.Equal(t, 3, len(scfg.Forwards))
+}
+
+func TestNftablesConfigRendersChainPerAddress(t *testing.T) {
+	g := newNftablesGenerator()
+	g.Cfg.ChainPerAddress = true
+
+	var buf bytes.Buffer
+	err := g.GenerateConfig(newBackendSetsLBModel(), &buf)
+	assert.Nil(t, err)
+
+	assert.Contains(t, buf.String(), `
+	chain prerouting {
+		ip daddr 172.23.42.1 jump lbaas-ingress-172.23.42.1;
+		ip daddr 172.23.42.2 jump lbaas-ingress-172.23.42.2;
+	}
+
+	chain lbaas-ingress-172.23.42.1 {
+		ip daddr 172.23.42.1 udp dport 53 mark set 0x1 and 0x1 ct mark set meta mark dnat to numgen inc mod 1 map {0 : 192.168.0.3, } : 30053;
+		ip daddr 172.23.42.1 tcp dport 80 mark set 0x1 and 0x1 ct mark set meta mark dnat to numgen inc mod 2 map {0 : 192.168.0.1, 1 : 192.168.0.2, } : 30080;
+	}
+
+	chain lbaas-ingress-172.23.42.2 {
+		ip daddr 172.23.42.2 tcp dport 443 mark set 0x1 and 0x1 ct mark set meta mark dnat to numgen inc mod 2 map {0 : 192.168.0.1, 1 : 192.168.0.2, } : 30443;
+	}
+`)
+}
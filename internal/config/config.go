@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"slices"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/static"
 
@@ -39,6 +40,28 @@ const (
 	PortManagerStatic    PortManager = "static"
 )
 
+type PortAllocationPolicy string
+
+const (
+	PortAllocationPolicyFirstFit  PortAllocationPolicy = "FirstFit"
+	PortAllocationPolicyReuseOnly PortAllocationPolicy = "ReuseOnly"
+)
+
+type PlacementAge string
+
+const (
+	PlacementAgeAny    PlacementAge = ""
+	PlacementAgeOldest PlacementAge = "oldest"
+	PlacementAgeNewest PlacementAge = "newest"
+)
+
+type MissingPortPolicy string
+
+const (
+	MissingPortPolicyRemap MissingPortPolicy = "remap"
+	MissingPortPolicyFail  MissingPortPolicy = "fail"
+)
+
 type Agent struct {
 	URL    string `toml:"url"`
 	PortId string `toml:"port-id"`
@@ -61,6 +84,12 @@ type Keepalived struct {
 	Priority  int    `toml:"priority"`
 	VRIDBase  int    `toml:"virtual-router-id-base"`
 	Interface string `toml:"interface"`
+	// Names of all nodes running the agent; if set, the priority of this
+	// node is derived from its position among them, with Priority as base.
+	Peers    []string `toml:"peers"`
+	NodeName string   `toml:"node-name"`
+	// Configure one VRRP instance per address instead of a single one.
+	InstancePerAddress bool `toml:"instance-per-address"`
 
 	Service ServiceConfig `toml:"service"`
 }
@@ -76,6 +105,8 @@ type Nftables struct {
 	NftCommand              []string `toml:"nft-command"`
 	PartialReload           bool     `toml:"partial-reload"`
 	EnableSNAT              bool     `toml:"enable-snat"`
+	ShareBackendSets        bool     `toml:"share-backend-sets"`
+	ChainPerAddress         bool     `toml:"chain-per-address"`
 	FWMarkBits              uint32   `toml:"fwmark-bits"`
 	FWMarkMask              uint32   `toml:"fwmark-mask"`
 
@@ -85,10 +116,24 @@ type Nftables struct {
 type Agents struct {
 	SharedSecret  string   `toml:"shared-secret"`
 	TokenLifetime int      `toml:"token-lifetime"`
+	StaleAfter    int      `toml:"stale-after"`
 	AdditionalIps []string `toml:"additional-address-pairs"`
 	Agents        []Agent  `toml:"agent"`
 }
 
+type LeaderElection struct {
+	Enabled bool `toml:"enabled"`
+
+	// Name and namespace of the Lease object used as lock
+	LeaseName      string `toml:"lease-name"`
+	LeaseNamespace string `toml:"lease-namespace"`
+
+	// Durations in seconds, see k8s.io/client-go/tools/leaderelection
+	LeaseDuration int `toml:"lease-duration"`
+	RenewDeadline int `toml:"renew-deadline"`
+	RetryPeriod   int `toml:"retry-period"`
+}
+
 type ControllerConfig struct {
 	BindAddress string `toml:"bind-address"`
 	BindPort    int32  `toml:"bind-port"`
@@ -96,9 +141,74 @@ type ControllerConfig struct {
 	PortManager  PortManager  `toml:"port-manager"`
 	BackendLayer BackendLayer `toml:"backend-layer"`
 
-	OpenStack Config        `toml:"openstack"`
-	Static    static.Config `toml:"static"`
-	Agents    Agents        `toml:"agents"`
+	// How services are placed on L3 ports; ReuseOnly never provisions new
+	// ports
+	PortAllocationPolicy PortAllocationPolicy `toml:"port-allocation-policy"`
+
+	// Whether services are preferably placed on the oldest or newest L3 ports
+	PlacementAge PlacementAge `toml:"placement-age"`
+
+	// What happens to a service whose annotation names an L3 port which does
+	// not exist anymore when it is mapped after a restart
+	MissingPortPolicy MissingPortPolicy `toml:"missing-port-policy"`
+
+	// L4 ports which must never be allocated to services
+	ReservedPorts []int32 `toml:"reserved-ports"`
+
+	// Number of L3 ports without services which are kept instead of being
+	// released
+	IdlePortFloor int `toml:"idle-port-floor"`
+
+	// Number of seconds an L3 port has to be without services before it is
+	// released
+	IdlePortGracePeriod int `toml:"idle-port-grace-period"`
+
+	// Highest L4 port number counted when reporting the free capacity of an
+	// L3 port; zero counts all ports
+	L4PortCeiling int32 `toml:"l4-port-ceiling"`
+
+	// Number of services an L3 port hosts at most; zero means unlimited
+	MaxServicesPerPort int `toml:"max-services-per-port"`
+
+	// Number of times provisioning an L3 port is attempted if the backend
+	// fails with a transient error
+	ProvisionAttempts int `toml:"provision-attempts"`
+
+	// Number of seconds to wait before retrying to provision an L3 port; the
+	// delay doubles with each further attempt
+	ProvisionRetryDelay int `toml:"provision-retry-delay"`
+
+	// Number of seconds between checks that the L3 ports in use still exist;
+	// zero disables the check
+	PortRevalidationInterval int `toml:"port-revalidation-interval"`
+
+	// Number of allowed address pairs per agent port at which a warning is
+	// emitted; zero disables the warning
+	AddressPairWarningThreshold int `toml:"address-pair-warning-threshold"`
+
+	// Number of consecutive failed attempts to map a service after which it
+	// is not retried until it changes; zero retries forever
+	MaxMappingAttempts int `toml:"max-mapping-attempts"`
+
+	// Maintain a LoadBalancerAllocation resource mirroring the placement of
+	// each mapped service
+	AllocationResources bool `toml:"allocation-resources"`
+
+	// Number of seconds to wait for in-flight operations on shutdown
+	ShutdownTimeout int `toml:"shutdown-timeout"`
+
+	// Identity of this controller, used to detect services owned by another
+	// load balancer controller
+	Identity string `toml:"identity"`
+
+	// Bearer token required by the POST /resync endpoint; the endpoint is
+	// not served if empty
+	AdminToken string `toml:"admin-token"`
+
+	OpenStack      Config         `toml:"openstack"`
+	Static         static.Config  `toml:"static"`
+	Agents         Agents         `toml:"agents"`
+	LeaderElection LeaderElection `toml:"leader-election"`
 }
 
 type AgentConfig struct {
@@ -200,6 +310,18 @@ func FillControllerConfig(cfg *ControllerConfig) {
 	cfg.PortManager = PortManagerOpenstack
 	cfg.BindPort = 15203
 	cfg.BackendLayer = BackendLayerNodePort
+	cfg.PortAllocationPolicy = PortAllocationPolicyFirstFit
+	cfg.OpenStack.Networking.FIPCacheTTL = 60
+	cfg.ShutdownTimeout = 30
+	cfg.Identity = "default"
+	cfg.ProvisionAttempts = 3
+	cfg.ProvisionRetryDelay = 1
+	cfg.MissingPortPolicy = MissingPortPolicyRemap
+	cfg.LeaderElection.LeaseName = "ch-k8s-lbaas-controller"
+	cfg.LeaderElection.LeaseNamespace = "kube-system"
+	cfg.LeaderElection.LeaseDuration = 15
+	cfg.LeaderElection.RenewDeadline = 10
+	cfg.LeaderElection.RetryPeriod = 2
 }
 
 func ValidateControllerConfig(cfg *ControllerConfig) error {
@@ -214,6 +336,93 @@ func ValidateControllerConfig(cfg *ControllerConfig) error {
 		return fmt.Errorf("backend-layer has an invalid value: %q", cfg.BackendLayer)
 	}
 
+	switch cfg.PortAllocationPolicy {
+	case PortAllocationPolicyFirstFit:
+		break
+	case PortAllocationPolicyReuseOnly:
+		break
+	default:
+		return fmt.Errorf("port-allocation-policy has an invalid value: %q", cfg.PortAllocationPolicy)
+	}
+
+	switch cfg.PlacementAge {
+	case PlacementAgeAny:
+		break
+	case PlacementAgeOldest:
+		break
+	case PlacementAgeNewest:
+		break
+	default:
+		return fmt.Errorf("placement-age has an invalid value: %q", cfg.PlacementAge)
+	}
+
+	switch cfg.MissingPortPolicy {
+	case MissingPortPolicyRemap:
+		break
+	case MissingPortPolicyFail:
+		break
+	default:
+		return fmt.Errorf("missing-port-policy has an invalid value: %q", cfg.MissingPortPolicy)
+	}
+
+	if cfg.IdlePortFloor < 0 {
+		return fmt.Errorf("idle-port-floor must not be negative: %d", cfg.IdlePortFloor)
+	}
+
+	if cfg.L4PortCeiling < 0 || cfg.L4PortCeiling > 65535 {
+		return fmt.Errorf("l4-port-ceiling must be between 0 and 65535: %d", cfg.L4PortCeiling)
+	}
+
+	if cfg.MaxServicesPerPort < 0 {
+		return fmt.Errorf("max-services-per-port must not be negative: %d", cfg.MaxServicesPerPort)
+	}
+
+	if cfg.ProvisionAttempts < 1 {
+		return fmt.Errorf("provision-attempts must be at least 1: %d", cfg.ProvisionAttempts)
+	}
+
+	if cfg.ProvisionRetryDelay < 0 {
+		return fmt.Errorf("provision-retry-delay must not be negative: %d", cfg.ProvisionRetryDelay)
+	}
+
+	if cfg.PortRevalidationInterval < 0 {
+		return fmt.Errorf("port-revalidation-interval must not be negative: %d", cfg.PortRevalidationInterval)
+	}
+
+	if cfg.AddressPairWarningThreshold < 0 {
+		return fmt.Errorf("address-pair-warning-threshold must not be negative: %d", cfg.AddressPairWarningThreshold)
+	}
+
+	if cfg.MaxMappingAttempts < 0 {
+		return fmt.Errorf("max-mapping-attempts must not be negative: %d", cfg.MaxMappingAttempts)
+	}
+
+	if cfg.LeaderElection.Enabled {
+		le := &cfg.LeaderElection
+		if le.LeaseName == "" || le.LeaseNamespace == "" {
+			return fmt.Errorf("leader-election.lease-name and leader-election.lease-namespace must be set")
+		}
+		if le.RetryPeriod <= 0 {
+			return fmt.Errorf("leader-election.retry-period must be greater than zero: %d", le.RetryPeriod)
+		}
+		if le.RenewDeadline <= le.RetryPeriod {
+			return fmt.Errorf("leader-election.renew-deadline must be greater than leader-election.retry-period: %d", le.RenewDeadline)
+		}
+		if le.LeaseDuration <= le.RenewDeadline {
+			return fmt.Errorf("leader-election.lease-duration must be greater than leader-election.renew-deadline: %d", le.LeaseDuration)
+		}
+	}
+
+	if cfg.IdlePortGracePeriod < 0 {
+		return fmt.Errorf("idle-port-grace-period must not be negative: %d", cfg.IdlePortGracePeriod)
+	}
+
+	for _, port := range cfg.ReservedPorts {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("reserved-ports contains an invalid port: %d", port)
+		}
+	}
+
 	if cfg.PortManager == PortManagerOpenstack {
 		// TODO: Add openstack config validation.
 	} else if cfg.PortManager == PortManagerStatic {
@@ -240,10 +449,18 @@ func ValidateAgentConfig(cfg *AgentConfig) error {
 			return fmt.Errorf("keepalived.virtual-router-id-base must be greater than zero")
 		}
 
+		if cfg.Keepalived.VRIDBase > 255 {
+			return fmt.Errorf("keepalived.virtual-router-id-base must not be greater than 255")
+		}
+
 		if cfg.Keepalived.Priority < 0 {
 			return fmt.Errorf("keepalived.priority must be non-negative")
 		}
 
+		if len(cfg.Keepalived.Peers) > 0 && !slices.Contains(cfg.Keepalived.Peers, cfg.Keepalived.NodeName) {
+			return fmt.Errorf("keepalived.node-name must be one of keepalived.peers")
+		}
+
 		if cfg.Keepalived.Interface == "" {
 			return fmt.Errorf("keepalived.interface must be set")
 		}
@@ -261,6 +478,15 @@ func ValidateAgentConfig(cfg *AgentConfig) error {
 		if cfg.Nftables.PolicyPrefix == "" {
 			return fmt.Errorf("nftables.policy-prefix must be set if partial-reload is enabled")
 		}
+		// a partial reload would merge the elements into the existing maps
+		// instead of replacing them
+		if cfg.Nftables.ShareBackendSets {
+			return fmt.Errorf("nftables.share-backend-sets cannot be used if partial-reload is enabled")
+		}
+		// the chains of addresses which are gone would be left behind
+		if cfg.Nftables.ChainPerAddress {
+			return fmt.Errorf("nftables.chain-per-address cannot be used if partial-reload is enabled")
+		}
 	}
 
 	if cfg.SharedSecret == "" {
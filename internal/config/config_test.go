@@ -27,6 +27,7 @@ const (
 bind-address = "127.0.0.1"
 bind-port = 1234
 backend-layer = "Pod"
+reserved-ports = [22, 8022]
 
 [static]
 ipv4-addresses=["203.0.113.113"]
@@ -104,6 +105,8 @@ func TestCanReadControllerConfig(t *testing.T) {
 	err := ReadControllerConfig(r, &cfg)
 	assert.Nil(t, err)
 
+	assert.Equal(t, []int32{22, 8022}, cfg.ReservedPorts)
+
 	// check openstack options
 	osa := &cfg.OpenStack.Global
 	assert.Equal(t, "http://foo", osa.AuthURL)
@@ -223,5 +226,46 @@ func TestFillControllerConfig(t *testing.T) {
 
 	assert.Equal(t, PortManagerOpenstack, cfg.PortManager)
 	assert.Equal(t, BackendLayerNodePort, cfg.BackendLayer)
+	assert.Equal(t, PortAllocationPolicyFirstFit, cfg.PortAllocationPolicy)
 	assert.Equal(t, int32(15203), cfg.BindPort)
+	assert.Equal(t, 30, cfg.ShutdownTimeout)
+	assert.Equal(t, "default", cfg.Identity)
+	assert.Equal(t, 3, cfg.ProvisionAttempts)
+	assert.Equal(t, 1, cfg.ProvisionRetryDelay)
+	assert.Equal(t, MissingPortPolicyRemap, cfg.MissingPortPolicy)
+
+	le := &cfg.LeaderElection
+	assert.False(t, le.Enabled)
+	assert.Equal(t, "ch-k8s-lbaas-controller", le.LeaseName)
+	assert.Equal(t, "kube-system", le.LeaseNamespace)
+	assert.Equal(t, 15, le.LeaseDuration)
+	assert.Equal(t, 10, le.RenewDeadline)
+	assert.Equal(t, 2, le.RetryPeriod)
+	assert.Nil(t, ValidateControllerConfig(&cfg))
+}
+
+func TestValidateControllerConfigChecksLeaderElectionDurations(t *testing.T) {
+	cfg := ControllerConfig{}
+	FillControllerConfig(&cfg)
+	cfg.LeaderElection.Enabled = true
+	assert.Nil(t, ValidateControllerConfig(&cfg))
+
+	cfg.LeaderElection.RenewDeadline = cfg.LeaderElection.LeaseDuration
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+}
+
+func TestValidateAgentConfigRejectsChainPerAddressWithPartialReload(t *testing.T) {
+	cfg := AgentConfig{}
+	FillAgentConfig(&cfg)
+	cfg.Keepalived.Enabled = false
+	cfg.Nftables.Service.ConfigFile = "/etc/nft.d/lbaas.conf"
+	cfg.Nftables.PolicyPrefix = "lbaas-"
+	cfg.SharedSecret = "secret"
+	cfg.BindAddress = "127.0.0.1"
+	cfg.BindPort = 15203
+	cfg.Nftables.ChainPerAddress = true
+	assert.Nil(t, ValidateAgentConfig(&cfg))
+
+	cfg.Nftables.PartialReload = true
+	assert.NotNil(t, ValidateAgentConfig(&cfg))
 }
@@ -47,6 +47,8 @@ type NetworkingOpts struct {
 	UseFloatingIPs      bool   `toml:"use-floating-ips"`
 	FloatingIPNetworkID string `toml:"floating-ip-network-id"`
 	SubnetID            string `toml:"subnet-id"`
+	// Number of seconds for which the floating IP of a port is cached
+	FIPCacheTTL int `toml:"fip-cache-ttl"`
 }
 
 type Config struct {
@@ -0,0 +1,44 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+// AddressPairBudget describes the allowed address pairs needed on each agent
+// port. Every agent carries the fixed IP of every L3 port plus the statically
+// configured address pairs, so the number grows with the number of L3 ports
+// and can hit the Neutron limit for allowed address pairs.
+type AddressPairBudget struct {
+	// Number of address pairs configured independently of the L3 ports
+	Static int
+	// Number of address pairs per agent port at which to warn; zero
+	// disables the warning
+	WarningThreshold int
+}
+
+// Enabled returns true if a warning threshold is configured.
+func (b AddressPairBudget) Enabled() bool {
+	return b.WarningThreshold > 0
+}
+
+// Estimate returns the number of address pairs each agent port needs for
+// the given number of L3 ports, assuming one fixed IP per L3 port.
+func (b AddressPairBudget) Estimate(l3PortCount int) int {
+	return b.Static + l3PortCount
+}
+
+// Exceeded returns true if the estimate for the given number of L3 ports
+// reaches the warning threshold.
+func (b AddressPairBudget) Exceeded(l3PortCount int) bool {
+	return b.Enabled() && b.Estimate(l3PortCount) >= b.WarningThreshold
+}
@@ -0,0 +1,37 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressPairBudgetExceededAtThreshold(t *testing.T) {
+	b := AddressPairBudget{Static: 2, WarningThreshold: 5}
+
+	assert.Equal(t, 4, b.Estimate(2))
+	assert.False(t, b.Exceeded(2))
+	assert.True(t, b.Exceeded(3))
+	assert.True(t, b.Exceeded(4))
+}
+
+func TestAddressPairBudgetWithoutThresholdIsNeverExceeded(t *testing.T) {
+	b := AddressPairBudget{Static: 2}
+
+	assert.False(t, b.Enabled())
+	assert.False(t, b.Exceeded(100))
+}
@@ -16,6 +16,7 @@ package controller
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	goerrors "errors"
 	"fmt"
 	"io"
@@ -35,6 +36,7 @@ type AgentController interface {
 
 type SimplifiedHTTPClient interface {
 	Post(url, contentType string, body io.Reader) (resp *http.Response, err error)
+	Do(req *http.Request) (*http.Response, error)
 }
 
 type HTTPAgentController struct {
@@ -42,6 +44,9 @@ type HTTPAgentController struct {
 	SharedSecret  []byte
 	Client        SimplifiedHTTPClient
 	TimeTolerance int
+	// Registry records each successful push as a heartbeat of the agent;
+	// may be nil
+	Registry *AgentRegistry
 }
 
 func NewHTTPAgentController(cfg config.Agents) (*HTTPAgentController, error) {
@@ -78,11 +83,21 @@ func NewHTTPAgentController(cfg config.Agents) (*HTTPAgentController, error) {
 		return nil, fmt.Errorf("token-lifetime must be between 1 and 120 (got %d)", timeTolerance)
 	}
 
+	staleAfter := cfg.StaleAfter
+	if staleAfter == 0 {
+		staleAfter = 900
+	}
+
+	if staleAfter < 0 {
+		return nil, fmt.Errorf("stale-after must not be negative (got %d)", staleAfter)
+	}
+
 	return &HTTPAgentController{
 		AgentURLs:     agentURLs,
 		SharedSecret:  sharedSecret,
 		Client:        &http.Client{},
 		TimeTolerance: timeTolerance,
+		Registry:      NewAgentRegistry(agentURLs, time.Duration(staleAfter)*time.Second),
 	}, nil
 }
 
@@ -124,6 +139,9 @@ func (c *HTTPAgentController) PushConfig(m *model.LoadBalancer) error {
 				resp.StatusCode))
 			continue
 		}
+		if c.Registry != nil {
+			c.Registry.Heartbeat(agentUrl)
+		}
 	}
 
 	switch len(errors) {
@@ -141,3 +159,45 @@ func (c *HTTPAgentController) PushConfig(m *model.LoadBalancer) error {
 		return goerrors.New(msg.String())
 	}
 }
+
+func (c *HTTPAgentController) Agents() []string {
+	return c.AgentURLs
+}
+
+// FetchAppliedConfig returns the configuration which the agent reports as
+// applied last.
+func (c *HTTPAgentController) FetchAppliedConfig(agentURL string) (*model.LoadBalancer, error) {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(time.Duration(c.TimeTolerance) * time.Second).Unix(),
+	}).SignedString(c.SharedSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	fullUrl := fmt.Sprintf("%s/v1/applied", agentURL)
+	req, err := http.NewRequest(http.MethodGet, fullUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf(
+			"failed to fetch applied config from agent %q: HTTP status %d",
+			fullUrl,
+			resp.StatusCode)
+	}
+
+	result := &model.LoadBalancer{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,97 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// AgentRegistry keeps track of when each agent last accepted a configuration
+// push. Agents which have not been seen within the timeout are considered
+// stale.
+type AgentRegistry struct {
+	lock     sync.Mutex
+	urls     []string
+	lastSeen map[string]time.Time
+	timeout  time.Duration
+	now      func() time.Time
+
+	agentsMetric *prometheus.GaugeVec
+}
+
+func NewAgentRegistry(urls []string, timeout time.Duration) *AgentRegistry {
+	return &AgentRegistry{
+		urls:     urls,
+		lastSeen: make(map[string]time.Time),
+		timeout:  timeout,
+		now:      time.Now,
+		agentsMetric: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lbaas_agents_total",
+				Help: "Number of configured agents by state",
+			},
+			[]string{"state"},
+		),
+	}
+}
+
+// Record that the agent with the given URL was just seen.
+func (r *AgentRegistry) Heartbeat(url string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lastSeen[url] = r.now()
+}
+
+// Return the status of all configured agents, in the order of the
+// configuration. Agents which were never seen are stale.
+func (r *AgentRegistry) GetAgents() []model.AgentStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	result := make([]model.AgentStatus, len(r.urls))
+	for i, url := range r.urls {
+		lastSeen, seen := r.lastSeen[url]
+		result[i] = model.AgentStatus{
+			URL:      url,
+			LastSeen: lastSeen,
+			Stale:    !seen || now.Sub(lastSeen) > r.timeout,
+		}
+	}
+	return result
+}
+
+func (r *AgentRegistry) Describe(out chan<- *prometheus.Desc) {
+	r.agentsMetric.Describe(out)
+}
+
+func (r *AgentRegistry) Collect(out chan<- prometheus.Metric) {
+	alive, stale := 0, 0
+	for _, agent := range r.GetAgents() {
+		if agent.Stale {
+			stale++
+		} else {
+			alive++
+		}
+	}
+	r.agentsMetric.With(prometheus.Labels{"state": "alive"}).Set(float64(alive))
+	r.agentsMetric.With(prometheus.Labels{"state": "stale"}).Set(float64(stale))
+	r.agentsMetric.Collect(out)
+}
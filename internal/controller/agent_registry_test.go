@@ -0,0 +1,76 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAgentRegistry() (*AgentRegistry, *time.Time) {
+	now := time.Unix(1000, 0)
+	r := NewAgentRegistry([]string{"http://agent-1", "http://agent-2"}, 60*time.Second)
+	r.now = func() time.Time { return now }
+	return r, &now
+}
+
+func TestAgentRegistryHeartbeatRegistersAgent(t *testing.T) {
+	r, now := newTestAgentRegistry()
+
+	r.Heartbeat("http://agent-1")
+
+	agents := r.GetAgents()
+	assert.Equal(t, 2, len(agents))
+	assert.Equal(t, "http://agent-1", agents[0].URL)
+	assert.Equal(t, *now, agents[0].LastSeen)
+	assert.False(t, agents[0].Stale)
+
+	// never seen
+	assert.Equal(t, "http://agent-2", agents[1].URL)
+	assert.True(t, agents[1].LastSeen.IsZero())
+	assert.True(t, agents[1].Stale)
+}
+
+func TestAgentRegistryDetectsStalenessAfterTimeout(t *testing.T) {
+	r, now := newTestAgentRegistry()
+
+	r.Heartbeat("http://agent-1")
+
+	*now = now.Add(60 * time.Second)
+	assert.False(t, r.GetAgents()[0].Stale)
+
+	*now = now.Add(time.Second)
+	assert.True(t, r.GetAgents()[0].Stale)
+
+	r.Heartbeat("http://agent-1")
+	assert.False(t, r.GetAgents()[0].Stale)
+}
+
+func TestAgentRegistryReportsAgentsByState(t *testing.T) {
+	r, _ := newTestAgentRegistry()
+	r.Heartbeat("http://agent-2")
+
+	err := testutil.CollectAndCompare(r, strings.NewReader(`
+# HELP lbaas_agents_total Number of configured agents by state
+# TYPE lbaas_agents_total gauge
+lbaas_agents_total{state="alive"} 1
+lbaas_agents_total{state="stale"} 1
+`))
+	assert.Nil(t, err)
+}
@@ -19,7 +19,9 @@ import (
 	"crypto/rand"
 	"io"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 
@@ -69,6 +71,15 @@ func (m *mockSimplifiedHTTPClient) Post(url, contentType string, body io.Reader)
 	return resp_untyped.(*http.Response), a.Error(1)
 }
 
+func (m *mockSimplifiedHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	a := m.Called(req.Method, req.URL.String())
+	resp_untyped := a.Get(0)
+	if resp_untyped == nil {
+		return nil, a.Error(1)
+	}
+	return resp_untyped.(*http.Response), a.Error(1)
+}
+
 type acFixture struct {
 	t *testing.T
 
@@ -130,3 +141,42 @@ func TestPushJWTViaHTTP(t *testing.T) {
 		assert.Nil(t, err)
 	})
 }
+
+func TestPushConfigRecordsHeartbeatOnlyForSuccessfulAgents(t *testing.T) {
+	f := newACFixture(t)
+	m := &model.LoadBalancer{}
+
+	f.client.On("Post", "http://127.1.0.1/v1/apply", "application/jwt", *m).Return(&http.Response{StatusCode: 200, Body: &dummyBody{}}, nil).Times(1)
+	f.client.On("Post", "http://127.1.0.2/subpath/v1/apply", "application/jwt", *m).Return(&http.Response{StatusCode: 500, Body: &dummyBody{}}, nil).Times(1)
+
+	f.run(func(c *HTTPAgentController) {
+		c.Registry = NewAgentRegistry(f.agents, time.Minute)
+
+		err := c.PushConfig(m)
+		assert.NotNil(t, err)
+
+		agents := c.Registry.GetAgents()
+		assert.Equal(t, 2, len(agents))
+		assert.False(t, agents[0].Stale)
+		assert.False(t, agents[0].LastSeen.IsZero())
+		assert.True(t, agents[1].Stale)
+		assert.True(t, agents[1].LastSeen.IsZero())
+	})
+}
+
+func TestFetchAppliedConfigDecodesAgentResponse(t *testing.T) {
+	f := newACFixture(t)
+	body := `{"ingress": [{"address": "10.0.0.1", "ports": []}], "network-policies": [], "policy-assignments": []}`
+
+	f.client.On("Do", http.MethodGet, "http://127.1.0.1/v1/applied").Return(&http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body))}, nil).Times(1)
+	f.client.On("Do", http.MethodGet, "http://127.1.0.2/subpath/v1/applied").Return(&http.Response{StatusCode: 404, Body: &dummyBody{}}, nil).Times(1)
+
+	f.run(func(c *HTTPAgentController) {
+		applied, err := c.FetchAppliedConfig("http://127.1.0.1")
+		assert.Nil(t, err)
+		assert.Equal(t, "10.0.0.1", applied.Ingress[0].Address)
+
+		_, err = c.FetchAppliedConfig("http://127.1.0.2/subpath")
+		assert.NotNil(t, err)
+	})
+}
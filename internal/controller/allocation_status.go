@@ -0,0 +1,193 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	goerrors "errors"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+const (
+	AllocationGroup   = "cah-loadbalancer.k8s.cloudandheat.com"
+	AllocationVersion = "v1alpha1"
+	AllocationKind    = "LoadBalancerAllocation"
+
+	// The service is in conflict with its preferred placement, see
+	// PortMapper.GetConflicts
+	AllocationConditionConflicted = "Conflicted"
+	AllocationReasonNoConflict    = "NoConflict"
+)
+
+var AllocationResource = schema.GroupVersionResource{
+	Group:    AllocationGroup,
+	Version:  AllocationVersion,
+	Resource: "loadbalancerallocations",
+}
+
+type AllocationPort struct {
+	Protocol corev1.Protocol `json:"protocol"`
+	Port     int32           `json:"port"`
+}
+
+// AllocationStatus is the status of a LoadBalancerAllocation resource. It
+// mirrors the placement decision of the port mapper for the service of the
+// same name.
+type AllocationStatus struct {
+	L3PortID        string             `json:"l3PortID"`
+	ExternalAddress string             `json:"externalAddress,omitempty"`
+	Ports           []AllocationPort   `json:"ports"`
+	Conditions      []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// Build the allocation status of a mapped service from the port mapper state.
+//
+// Returns ErrServiceNotMapped if the service is currently not mapped.
+func buildAllocationStatus(id model.ServiceIdentifier, portmapper PortMapper, l3portmanager L3PortManager) (AllocationStatus, error) {
+	portID, err := portmapper.GetServiceL3Port(id)
+	if err != nil {
+		return AllocationStatus{}, err
+	}
+	l4ports, err := portmapper.GetServiceL4Ports(id)
+	if err != nil {
+		return AllocationStatus{}, err
+	}
+	address, _, err := l3portmanager.GetExternalAddress(portID)
+	if err != nil {
+		return AllocationStatus{}, err
+	}
+
+	status := AllocationStatus{
+		L3PortID:        portID,
+		ExternalAddress: address,
+		Ports:           make([]AllocationPort, len(l4ports)),
+	}
+	for i, l4port := range l4ports {
+		status.Ports[i] = AllocationPort{Protocol: l4port.Protocol, Port: l4port.Port}
+	}
+
+	conflicted := metav1.Condition{
+		Type:   AllocationConditionConflicted,
+		Status: metav1.ConditionFalse,
+		Reason: AllocationReasonNoConflict,
+	}
+	for _, conflict := range portmapper.GetConflicts() {
+		if conflict.Service == id {
+			conflicted.Status = metav1.ConditionTrue
+			conflicted.Reason = string(conflict.Type)
+			conflicted.Message = conflict.Details
+			break
+		}
+	}
+	status.Conditions = []metav1.Condition{conflicted}
+	return status, nil
+}
+
+// AllocationStatusReconciler maintains one LoadBalancerAllocation resource
+// per mapped service. The resources are owned by their service, so that they
+// are garbage collected together with it.
+type AllocationStatusReconciler struct {
+	client dynamic.Interface
+}
+
+func NewAllocationStatusReconciler(client dynamic.Interface) *AllocationStatusReconciler {
+	return &AllocationStatusReconciler{client: client}
+}
+
+func newAllocationObject(svc *corev1.Service) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(AllocationResource.GroupVersion().String())
+	obj.SetKind(AllocationKind)
+	obj.SetNamespace(svc.Namespace)
+	obj.SetName(svc.Name)
+	obj.SetOwnerReferences([]metav1.OwnerReference{
+		*metav1.NewControllerRef(svc, corev1.SchemeGroupVersion.WithKind("Service")),
+	})
+	return obj
+}
+
+// Create the LoadBalancerAllocation of the service if needed and update its
+// status. The status is only written if it changed.
+func (r *AllocationStatusReconciler) Sync(svc *corev1.Service, status AllocationStatus) error {
+	client := r.client.Resource(AllocationResource).Namespace(svc.Namespace)
+
+	obj, err := client.Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		obj, err = client.Create(context.TODO(), newAllocationObject(svc), metav1.CreateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	existing := AllocationStatus{}
+	if raw, found, _ := unstructured.NestedMap(obj.Object, "status"); found {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &existing); err != nil {
+			return err
+		}
+	}
+
+	// keep the transition times of conditions which did not change
+	conditions := append([]metav1.Condition{}, existing.Conditions...)
+	for _, condition := range status.Conditions {
+		meta.SetStatusCondition(&conditions, condition)
+	}
+	status.Conditions = conditions
+
+	if equality.Semantic.DeepEqual(existing, status) {
+		return nil
+	}
+
+	raw, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		return err
+	}
+	obj.Object["status"] = raw
+	_, err = client.UpdateStatus(context.TODO(), obj, metav1.UpdateOptions{})
+	return err
+}
+
+// Delete the LoadBalancerAllocation of the service, if it exists.
+func (r *AllocationStatusReconciler) Delete(id model.ServiceIdentifier) error {
+	err := r.client.Resource(AllocationResource).Namespace(id.Namespace).Delete(context.TODO(), id.Name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Bring the LoadBalancerAllocation of the service in line with the port
+// mapper: update it if the service is mapped and delete it otherwise.
+func (r *AllocationStatusReconciler) Reconcile(svc *corev1.Service, portmapper PortMapper, l3portmanager L3PortManager) error {
+	id := model.FromService(svc)
+	status, err := buildAllocationStatus(id, portmapper, l3portmanager)
+	if goerrors.Is(err, ErrServiceNotMapped) {
+		return r.Delete(id)
+	}
+	if err != nil {
+		return err
+	}
+	return r.Sync(svc, status)
+}
@@ -0,0 +1,123 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+func newAllocationStatusFixture() (*portMapperFixture, *dynamicfake.FakeDynamicClient, *AllocationStatusReconciler) {
+	f := newPortMapperFixture()
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{AllocationResource: AllocationKind + "List"},
+	)
+	return f, client, NewAllocationStatusReconciler(client)
+}
+
+func getAllocationStatus(t *testing.T, client *dynamicfake.FakeDynamicClient, svc *corev1.Service) (*unstructured.Unstructured, AllocationStatus) {
+	obj, err := client.Resource(AllocationResource).Namespace(svc.Namespace).Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	assert.Nil(t, err)
+	status := AllocationStatus{}
+	raw, _, _ := unstructured.NestedMap(obj.Object, "status")
+	assert.Nil(t, runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &status))
+	return obj, status
+}
+
+func TestAllocationStatusMirrorsMappedService(t *testing.T) {
+	f, client, r := newAllocationStatusFixture()
+	s := newPortMapperService("test-service-1")
+	s.UID = "test-service-1-uid"
+	id := model.FromService(s)
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("GetExternalAddress", "port-id-1").Return("203.0.113.1", "", nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	assert.Nil(t, r.Reconcile(s, f.portmapper, f.l3portmanager))
+
+	portID, err := f.portmapper.GetServiceL3Port(id)
+	assert.Nil(t, err)
+	l4ports, err := f.portmapper.GetServiceL4Ports(id)
+	assert.Nil(t, err)
+
+	obj, status := getAllocationStatus(t, client, s)
+	assert.Equal(t, portID, status.L3PortID)
+	assert.Equal(t, "203.0.113.1", status.ExternalAddress)
+	assert.Equal(t, len(l4ports), len(status.Ports))
+	for i, l4port := range l4ports {
+		assert.Equal(t, AllocationPort{Protocol: l4port.Protocol, Port: l4port.Port}, status.Ports[i])
+	}
+	assert.Equal(t, 1, len(status.Conditions))
+	assert.Equal(t, AllocationConditionConflicted, status.Conditions[0].Type)
+	assert.Equal(t, metav1.ConditionFalse, status.Conditions[0].Status)
+
+	owners := obj.GetOwnerReferences()
+	assert.Equal(t, 1, len(owners))
+	assert.Equal(t, "Service", owners[0].Kind)
+	assert.Equal(t, s.UID, owners[0].UID)
+}
+
+func TestAllocationStatusIsNotRewrittenIfUnchanged(t *testing.T) {
+	f, client, r := newAllocationStatusFixture()
+	s := newPortMapperService("test-service-1")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("GetExternalAddress", "port-id-1").Return("203.0.113.1", "", nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	assert.Nil(t, r.Reconcile(s, f.portmapper, f.l3portmanager))
+	client.ClearActions()
+
+	assert.Nil(t, r.Reconcile(s, f.portmapper, f.l3portmanager))
+	assert.Equal(t, 1, len(client.Actions()))
+	for _, action := range client.Actions() {
+		assert.Equal(t, "get", action.GetVerb())
+	}
+}
+
+func TestAllocationStatusIsDeletedOnUnmap(t *testing.T) {
+	f, client, r := newAllocationStatusFixture()
+	s := newPortMapperService("test-service-1")
+	id := model.FromService(s)
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("GetExternalAddress", "port-id-1").Return("203.0.113.1", "", nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	assert.Nil(t, r.Reconcile(s, f.portmapper, f.l3portmanager))
+
+	assert.Nil(t, f.portmapper.UnmapService(id))
+	assert.Nil(t, r.Reconcile(s, f.portmapper, f.l3portmanager))
+
+	_, err := client.Resource(AllocationResource).Namespace(s.Namespace).Get(context.TODO(), s.Name, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	// deleting again is not an error
+	assert.Nil(t, r.Delete(id))
+}
@@ -0,0 +1,77 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"time"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// AllocationStore keeps allocation changes for long-term reporting, e.g. of
+// the historical usage of floating IPs, without an external time series
+// database. Implementations may be backed by an embedded database.
+type AllocationStore interface {
+	// Add a record to the store.
+	Append(record model.AllocationRecord) error
+	// Return the records with a time in [from, to), oldest first.
+	Query(from time.Time, to time.Time) ([]model.AllocationRecord, error)
+}
+
+type NoopAllocationStore struct{}
+
+func (s NoopAllocationStore) Append(record model.AllocationRecord) error {
+	return nil
+}
+
+func (s NoopAllocationStore) Query(from time.Time, to time.Time) ([]model.AllocationRecord, error) {
+	return []model.AllocationRecord{}, nil
+}
+
+// StoreEventPublisher appends every allocation change published by the port
+// mapper to an AllocationStore.
+type StoreEventPublisher struct {
+	store AllocationStore
+	now   func() time.Time
+}
+
+func NewStoreEventPublisher(store AllocationStore) *StoreEventPublisher {
+	return &StoreEventPublisher{
+		store: store,
+		now:   time.Now,
+	}
+}
+
+func (p *StoreEventPublisher) append(transitionType model.TransitionType, event model.AllocationEvent) error {
+	return p.store.Append(model.AllocationRecord{
+		Time:     p.now(),
+		Type:     transitionType,
+		Service:  event.Service,
+		L3PortID: event.L3PortID,
+		Ports:    event.Ports,
+	})
+}
+
+func (p *StoreEventPublisher) PublishMapped(event model.AllocationEvent) error {
+	return p.append(model.TransitionMap, event)
+}
+
+func (p *StoreEventPublisher) PublishUnmapped(event model.AllocationEvent) error {
+	return p.append(model.TransitionUnmap, event)
+}
+
+func (p *StoreEventPublisher) PublishEvicted(event model.AllocationEvent) error {
+	return p.append(model.TransitionEvict, event)
+}
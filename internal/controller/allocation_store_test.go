@@ -0,0 +1,72 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	controllertesting "github.com/cloudandheat/ch-k8s-lbaas/internal/controller/testing"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	ostesting "github.com/cloudandheat/ch-k8s-lbaas/internal/openstack/testing"
+)
+
+func TestStoreEventPublisherPersistsMapAndUnmap(t *testing.T) {
+	store := controllertesting.NewInMemoryAllocationStore()
+	publisher := NewStoreEventPublisher(store)
+	clock := &fakeClock{current: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	publisher.now = clock.now
+	start := clock.current
+
+	l3portmanager := ostesting.NewMockL3PortManager()
+	l3portmanager.On("GetAvailablePorts").Return([]string{}, nil).Times(1)
+	l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	l3portmanager.On("ReleasePort", "port-id-1").Return(nil).Times(1)
+	portmapper, err := NewPortMapper(l3portmanager, WithEventPublisher(publisher))
+	assert.Nil(t, err)
+
+	s := newPortMapperServiceWithPort("test-service-1", corev1.ProtocolTCP, 80)
+	assert.Nil(t, mapError(portmapper.MapService(s)))
+	clock.advance(time.Hour)
+	assert.Nil(t, portmapper.UnmapService(model.FromService(s)))
+
+	ports := []model.L4Port{{Protocol: corev1.ProtocolTCP, Port: 80}}
+	records, err := store.Query(start, start.Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, []model.AllocationRecord{
+		{Time: start, Type: model.TransitionMap, Service: model.FromService(s), L3PortID: "port-id-1", Ports: ports},
+		{Time: start.Add(time.Hour), Type: model.TransitionUnmap, Service: model.FromService(s), L3PortID: "port-id-1", Ports: ports},
+	}, records)
+
+	// only the records of the queried time range are returned
+	records, err = store.Query(start.Add(time.Minute), start.Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, model.TransitionUnmap, records[0].Type)
+}
+
+func TestNoopAllocationStoreReturnsNoRecords(t *testing.T) {
+	store := NoopAllocationStore{}
+	assert.Nil(t, store.Append(model.AllocationRecord{Time: time.Now(), Type: model.TransitionMap}))
+
+	records, err := store.Query(time.Time{}, time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, []model.AllocationRecord{}, records)
+}
@@ -0,0 +1,177 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"k8s.io/klog"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// ConfigSnapshot is the load balancer configuration served to agents which
+// poll the controller, together with its generation.
+type ConfigSnapshot struct {
+	Generation uint64             `json:"generation"`
+	Config     model.LoadBalancer `json:"load-balancer-config"`
+}
+
+// ConfigStore is an AgentController which remembers the most recently pushed
+// configuration, so that it can be served to agents polling the controller,
+// and passes it on to the wrapped AgentController, if any. The generation is
+// incremented whenever the configuration changes.
+type ConfigStore struct {
+	next AgentController
+
+	mu        sync.RWMutex
+	snapshot  ConfigSnapshot
+	canonical []byte
+}
+
+func NewConfigStore(next AgentController) *ConfigStore {
+	return &ConfigStore{next: next}
+}
+
+// Return a copy of the configuration with all lists sorted, so that
+// configurations which only differ in the order of their elements compare
+// equal. The model generators iterate over maps.
+func canonicalConfig(m *model.LoadBalancer) model.LoadBalancer {
+	result := model.LoadBalancer{
+		Ingress:           make([]model.IngressIP, len(m.Ingress)),
+		NetworkPolicies:   append([]model.NetworkPolicy{}, m.NetworkPolicies...),
+		PolicyAssignments: make([]model.PolicyAssignment, len(m.PolicyAssignments)),
+	}
+
+	for i, ingress := range m.Ingress {
+		ports := make([]model.PortForward, len(ingress.Ports))
+		for k, port := range ingress.Ports {
+			port.DestinationAddresses = append([]string{}, port.DestinationAddresses...)
+			sort.Strings(port.DestinationAddresses)
+			ports[k] = port
+		}
+		sort.SliceStable(ports, func(a, b int) bool {
+			if ports[a].Protocol != ports[b].Protocol {
+				return ports[a].Protocol < ports[b].Protocol
+			}
+			if ports[a].InboundPort != ports[b].InboundPort {
+				return ports[a].InboundPort < ports[b].InboundPort
+			}
+			return ports[a].DestinationPort < ports[b].DestinationPort
+		})
+		result.Ingress[i] = model.IngressIP{Address: ingress.Address, Ports: ports}
+	}
+	sort.SliceStable(result.Ingress, func(a, b int) bool {
+		return result.Ingress[a].Address < result.Ingress[b].Address
+	})
+
+	sort.SliceStable(result.NetworkPolicies, func(a, b int) bool {
+		return result.NetworkPolicies[a].Name < result.NetworkPolicies[b].Name
+	})
+
+	for i, assignment := range m.PolicyAssignments {
+		policies := append([]string{}, assignment.NetworkPolicies...)
+		sort.Strings(policies)
+		result.PolicyAssignments[i] = model.PolicyAssignment{Address: assignment.Address, NetworkPolicies: policies}
+	}
+	sort.SliceStable(result.PolicyAssignments, func(a, b int) bool {
+		return result.PolicyAssignments[a].Address < result.PolicyAssignments[b].Address
+	})
+
+	return result
+}
+
+func (s *ConfigStore) update(m *model.LoadBalancer) {
+	config := canonicalConfig(m)
+	canonical, err := json.Marshal(config)
+	if err != nil {
+		klog.Warningf("failed to encode the configuration for polling agents: %s", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshot.Generation > 0 && bytes.Equal(canonical, s.canonical) {
+		return
+	}
+	s.snapshot = ConfigSnapshot{
+		Generation: s.snapshot.Generation + 1,
+		Config:     config,
+	}
+	s.canonical = canonical
+}
+
+func (s *ConfigStore) PushConfig(m *model.LoadBalancer) error {
+	// polling agents get the configuration even if pushing it to one of
+	// the other agents fails
+	s.update(m)
+	if s.next == nil {
+		return nil
+	}
+	return s.next.PushConfig(m)
+}
+
+// Snapshot returns the current configuration and its generation. It returns
+// false if no configuration was pushed yet.
+func (s *ConfigStore) Snapshot() (ConfigSnapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.snapshot, s.snapshot.Generation > 0
+}
+
+// ConfigHandler serves GET requests for the current configuration as JSON.
+// Requests have to carry the Token as bearer token. If the client already has
+// the current generation, as indicated by the If-None-Match header or the
+// generation query parameter, the response is 304 Not Modified.
+type ConfigHandler struct {
+	Store *ConfigStore
+	Token string
+}
+
+func (h *ConfigHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(405) // Method Not Allowed
+		return
+	}
+	if !hasBearerToken(r, h.Token) {
+		klog.V(5).Infof("unauthorized config request from %s", r.RemoteAddr)
+		w.WriteHeader(401) // Unauthorized
+		return
+	}
+
+	snapshot, ok := h.Store.Snapshot()
+	if !ok {
+		w.WriteHeader(503) // Service Unavailable
+		return
+	}
+
+	generation := strconv.FormatUint(snapshot.Generation, 10)
+	etag := fmt.Sprintf("%q", generation)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag || r.URL.Query().Get("generation") == generation {
+		w.WriteHeader(304) // Not Modified
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
@@ -0,0 +1,149 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	controllertesting "github.com/cloudandheat/ch-k8s-lbaas/internal/controller/testing"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+func newConfigRequest(token string, query string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/v1/config"+query, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func newTestConfig(addresses ...string) *model.LoadBalancer {
+	m := &model.LoadBalancer{}
+	for _, address := range addresses {
+		m.Ingress = append(m.Ingress, model.IngressIP{
+			Address: address,
+			Ports: []model.PortForward{
+				{Protocol: corev1.ProtocolTCP, InboundPort: 443, DestinationPort: 30443, DestinationAddresses: []string{"192.168.1.2", "192.168.1.1"}},
+				{Protocol: corev1.ProtocolTCP, InboundPort: 80, DestinationPort: 30080, DestinationAddresses: []string{"192.168.1.2", "192.168.1.1"}},
+			},
+		})
+	}
+	return m
+}
+
+func TestConfigStorePassesConfigOn(t *testing.T) {
+	next := controllertesting.NewMockAgentController()
+	m := newTestConfig("10.0.0.1")
+	next.On("PushConfig", m).Return(fmt.Errorf("agent unreachable")).Times(1)
+	s := NewConfigStore(next)
+
+	_, ok := s.Snapshot()
+	assert.False(t, ok)
+
+	assert.NotNil(t, s.PushConfig(m))
+	snapshot, ok := s.Snapshot()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), snapshot.Generation)
+	next.AssertExpectations(t)
+}
+
+func TestConfigStoreOnlyIncrementsGenerationOnChange(t *testing.T) {
+	s := NewConfigStore(nil)
+
+	assert.Nil(t, s.PushConfig(newTestConfig("10.0.0.1", "10.0.0.2")))
+	snapshot, _ := s.Snapshot()
+	assert.Equal(t, uint64(1), snapshot.Generation)
+
+	// the same configuration in another order
+	reordered := newTestConfig("10.0.0.2", "10.0.0.1")
+	reordered.Ingress[0].Ports[0], reordered.Ingress[0].Ports[1] = reordered.Ingress[0].Ports[1], reordered.Ingress[0].Ports[0]
+	reordered.Ingress[1].Ports[0].DestinationAddresses = []string{"192.168.1.1", "192.168.1.2"}
+	assert.Nil(t, s.PushConfig(reordered))
+	snapshot, _ = s.Snapshot()
+	assert.Equal(t, uint64(1), snapshot.Generation)
+
+	assert.Nil(t, s.PushConfig(newTestConfig("10.0.0.1")))
+	snapshot, _ = s.Snapshot()
+	assert.Equal(t, uint64(2), snapshot.Generation)
+	assert.Equal(t, 1, len(snapshot.Config.Ingress))
+}
+
+func TestConfigHandlerServesCurrentConfig(t *testing.T) {
+	s := NewConfigStore(nil)
+	h := &ConfigHandler{Store: s, Token: "secret"}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newConfigRequest("secret", ""))
+	assert.Equal(t, 503, rec.Code)
+
+	s.PushConfig(newTestConfig("10.0.0.1"))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newConfigRequest("secret", ""))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, `"1"`, rec.Header().Get("ETag"))
+	snapshot := ConfigSnapshot{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &snapshot))
+	assert.Equal(t, uint64(1), snapshot.Generation)
+	assert.Equal(t, "10.0.0.1", snapshot.Config.Ingress[0].Address)
+	assert.Equal(t, int32(80), snapshot.Config.Ingress[0].Ports[0].InboundPort)
+}
+
+func TestConfigHandlerReturnsNotModifiedForCurrentGeneration(t *testing.T) {
+	s := NewConfigStore(nil)
+	h := &ConfigHandler{Store: s, Token: "secret"}
+	s.PushConfig(newTestConfig("10.0.0.1"))
+
+	rec := httptest.NewRecorder()
+	r := newConfigRequest("secret", "")
+	r.Header.Set("If-None-Match", `"1"`)
+	h.ServeHTTP(rec, r)
+	assert.Equal(t, 304, rec.Code)
+	assert.Empty(t, rec.Body.Bytes())
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newConfigRequest("secret", "?generation=1"))
+	assert.Equal(t, 304, rec.Code)
+
+	s.PushConfig(newTestConfig("10.0.0.2"))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newConfigRequest("secret", "?generation=1"))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, `"2"`, rec.Header().Get("ETag"))
+}
+
+func TestConfigHandlerRejectsUnauthenticatedRequests(t *testing.T) {
+	s := NewConfigStore(nil)
+	h := &ConfigHandler{Store: s, Token: "secret"}
+	s.PushConfig(newTestConfig("10.0.0.1"))
+
+	for _, token := range []string{"", "wrong"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newConfigRequest(token, ""))
+		assert.Equal(t, 401, rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/config", nil))
+	assert.Equal(t, 405, rec.Code)
+}
@@ -0,0 +1,160 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+
+	"k8s.io/klog"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// AppliedConfigSource provides the configuration which the agents report as
+// applied.
+type AppliedConfigSource interface {
+	Agents() []string
+	FetchAppliedConfig(agentURL string) (*model.LoadBalancer, error)
+}
+
+// AgentConfigDiff lists the forwards of one L3 port which differ between the
+// desired configuration and the configuration applied by an agent.
+type AgentConfigDiff struct {
+	Agent string `json:"agent"`
+	// Forwards which are desired but not applied
+	Missing []model.PortForward `json:"missing"`
+	// Forwards which are applied but not desired
+	Unexpected []model.PortForward `json:"unexpected"`
+	// Error from fetching the applied configuration, if any
+	Error string `json:"error,omitempty"`
+}
+
+// ConfigDiff is the difference between the desired and the applied
+// configuration of an L3 port, per agent.
+type ConfigDiff struct {
+	Port    string            `json:"port"`
+	Address string            `json:"address"`
+	Agents  []AgentConfigDiff `json:"agents"`
+}
+
+// Return true if no agent deviates from the desired configuration.
+func (d *ConfigDiff) Empty() bool {
+	for _, agent := range d.Agents {
+		if len(agent.Missing) > 0 || len(agent.Unexpected) > 0 || agent.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the forwards of the ingress IP with the given address, in canonical
+// order.
+func ingressForwards(m *model.LoadBalancer, address string) []model.PortForward {
+	if m == nil {
+		return nil
+	}
+	for _, ingress := range canonicalConfig(m).Ingress {
+		if ingress.Address == address {
+			return ingress.Ports
+		}
+	}
+	return nil
+}
+
+// Return the forwards of a which have no equal counterpart in b.
+func subtractForwards(a, b []model.PortForward) []model.PortForward {
+	used := make([]bool, len(b))
+	result := []model.PortForward{}
+	for _, forward := range a {
+		found := false
+		for i, other := range b {
+			if !used[i] && reflect.DeepEqual(forward, other) {
+				used[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, forward)
+		}
+	}
+	return result
+}
+
+// Compare the forwards for the given ingress address in the desired and the
+// applied configuration.
+func diffForwards(desired, applied *model.LoadBalancer, address string) (missing []model.PortForward, unexpected []model.PortForward) {
+	desiredForwards := ingressForwards(desired, address)
+	appliedForwards := ingressForwards(applied, address)
+	return subtractForwards(desiredForwards, appliedForwards), subtractForwards(appliedForwards, desiredForwards)
+}
+
+// ConfigDiffHandler serves GET requests comparing the desired configuration
+// of the L3 port given by the port query parameter with the configuration
+// applied by each agent. Requests have to carry the Token as bearer token.
+type ConfigDiffHandler struct {
+	Store   *ConfigStore
+	Agents  AppliedConfigSource
+	L3Ports L3PortManager
+	Token   string
+}
+
+func (h *ConfigDiffHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(405) // Method Not Allowed
+		return
+	}
+	if !hasBearerToken(r, h.Token) {
+		klog.V(5).Infof("unauthorized config diff request from %s", r.RemoteAddr)
+		w.WriteHeader(401) // Unauthorized
+		return
+	}
+
+	portID := r.URL.Query().Get("port")
+	if portID == "" {
+		w.WriteHeader(400) // Bad Request
+		return
+	}
+	address, err := h.L3Ports.GetInternalAddress(portID)
+	if err != nil {
+		klog.V(5).Infof("config diff requested for unknown port %q: %s", portID, err.Error())
+		w.WriteHeader(404) // Not Found
+		return
+	}
+
+	snapshot, ok := h.Store.Snapshot()
+	if !ok {
+		w.WriteHeader(503) // Service Unavailable
+		return
+	}
+
+	diff := ConfigDiff{Port: portID, Address: address, Agents: []AgentConfigDiff{}}
+	for _, agentURL := range h.Agents.Agents() {
+		agentDiff := AgentConfigDiff{Agent: agentURL}
+		applied, err := h.Agents.FetchAppliedConfig(agentURL)
+		if err != nil {
+			agentDiff.Error = err.Error()
+		} else {
+			agentDiff.Missing, agentDiff.Unexpected = diffForwards(&snapshot.Config, applied, address)
+		}
+		diff.Agents = append(diff.Agents, agentDiff)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
@@ -0,0 +1,178 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	ostesting "github.com/cloudandheat/ch-k8s-lbaas/internal/openstack/testing"
+)
+
+type fakeAppliedConfigSource struct {
+	applied map[string]*model.LoadBalancer
+	errors  map[string]error
+}
+
+func (s *fakeAppliedConfigSource) Agents() []string {
+	return []string{"http://agent-1", "http://agent-2"}
+}
+
+func (s *fakeAppliedConfigSource) FetchAppliedConfig(agentURL string) (*model.LoadBalancer, error) {
+	return s.applied[agentURL], s.errors[agentURL]
+}
+
+func TestDiffForwardsOfIdenticalConfigsIsEmpty(t *testing.T) {
+	desired := newTestConfig("10.0.0.1", "10.0.0.2")
+	// the same configuration in another order
+	applied := newTestConfig("10.0.0.2", "10.0.0.1")
+	applied.Ingress[0].Ports[0], applied.Ingress[0].Ports[1] = applied.Ingress[0].Ports[1], applied.Ingress[0].Ports[0]
+
+	missing, unexpected := diffForwards(desired, applied, "10.0.0.1")
+	assert.Empty(t, missing)
+	assert.Empty(t, unexpected)
+}
+
+func TestDiffForwardsReportsDrift(t *testing.T) {
+	desired := newTestConfig("10.0.0.1", "10.0.0.2")
+	applied := newTestConfig("10.0.0.1", "10.0.0.2")
+	applied.Ingress[0].Ports[0].DestinationAddresses = []string{"192.168.1.1"}
+
+	missing, unexpected := diffForwards(desired, applied, "10.0.0.1")
+	assert.Equal(t, 1, len(missing))
+	assert.Equal(t, int32(443), missing[0].InboundPort)
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.2"}, missing[0].DestinationAddresses)
+	assert.Equal(t, 1, len(unexpected))
+	assert.Equal(t, []string{"192.168.1.1"}, unexpected[0].DestinationAddresses)
+
+	// the other port is not affected
+	missing, unexpected = diffForwards(desired, applied, "10.0.0.2")
+	assert.Empty(t, missing)
+	assert.Empty(t, unexpected)
+}
+
+func TestDiffForwardsReportsPortMissingOnAgent(t *testing.T) {
+	missing, unexpected := diffForwards(newTestConfig("10.0.0.1"), &model.LoadBalancer{}, "10.0.0.1")
+	assert.Equal(t, 2, len(missing))
+	assert.Empty(t, unexpected)
+}
+
+func newConfigDiffFixture(t *testing.T, source *fakeAppliedConfigSource) (*ConfigDiffHandler, *ostesting.MockL3PortManager) {
+	l3portmanager := ostesting.NewMockL3PortManager()
+	store := NewConfigStore(nil)
+	store.PushConfig(newTestConfig("10.0.0.1"))
+	return &ConfigDiffHandler{
+		Store:   store,
+		Agents:  source,
+		L3Ports: l3portmanager,
+		Token:   "secret",
+	}, l3portmanager
+}
+
+func serveConfigDiff(t *testing.T, h *ConfigDiffHandler, token string, query string) (int, ConfigDiff) {
+	r := httptest.NewRequest(http.MethodGet, "/config/diff"+query, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	diff := ConfigDiff{}
+	if rec.Code == 200 {
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &diff))
+	}
+	return rec.Code, diff
+}
+
+func TestConfigDiffHandlerReportsDriftPerAgent(t *testing.T) {
+	drifted := newTestConfig("10.0.0.1")
+	drifted.Ingress[0].Ports = drifted.Ingress[0].Ports[:1]
+	h, l3portmanager := newConfigDiffFixture(t, &fakeAppliedConfigSource{
+		applied: map[string]*model.LoadBalancer{
+			"http://agent-1": newTestConfig("10.0.0.1"),
+			"http://agent-2": drifted,
+		},
+	})
+	l3portmanager.On("GetInternalAddress", "port-id-1").Return("10.0.0.1", nil).Times(1)
+
+	code, diff := serveConfigDiff(t, h, "secret", "?port=port-id-1")
+	assert.Equal(t, 200, code)
+	assert.False(t, diff.Empty())
+	assert.Equal(t, "port-id-1", diff.Port)
+	assert.Equal(t, "10.0.0.1", diff.Address)
+	assert.Equal(t, 2, len(diff.Agents))
+	assert.Empty(t, diff.Agents[0].Missing)
+	assert.Empty(t, diff.Agents[0].Unexpected)
+	assert.Equal(t, []model.PortForward{{
+		Protocol:             corev1.ProtocolTCP,
+		InboundPort:          80,
+		DestinationPort:      30080,
+		DestinationAddresses: []string{"192.168.1.1", "192.168.1.2"},
+	}}, diff.Agents[1].Missing)
+	assert.Empty(t, diff.Agents[1].Unexpected)
+	l3portmanager.AssertExpectations(t)
+}
+
+func TestConfigDiffHandlerReportsNoDriftForIdenticalConfigs(t *testing.T) {
+	h, l3portmanager := newConfigDiffFixture(t, &fakeAppliedConfigSource{
+		applied: map[string]*model.LoadBalancer{
+			"http://agent-1": newTestConfig("10.0.0.1"),
+			"http://agent-2": newTestConfig("10.0.0.1"),
+		},
+	})
+	l3portmanager.On("GetInternalAddress", "port-id-1").Return("10.0.0.1", nil).Times(1)
+
+	code, diff := serveConfigDiff(t, h, "secret", "?port=port-id-1")
+	assert.Equal(t, 200, code)
+	assert.True(t, diff.Empty())
+}
+
+func TestConfigDiffHandlerReportsUnreachableAgents(t *testing.T) {
+	h, l3portmanager := newConfigDiffFixture(t, &fakeAppliedConfigSource{
+		applied: map[string]*model.LoadBalancer{
+			"http://agent-1": newTestConfig("10.0.0.1"),
+		},
+		errors: map[string]error{
+			"http://agent-2": fmt.Errorf("connection refused"),
+		},
+	})
+	l3portmanager.On("GetInternalAddress", "port-id-1").Return("10.0.0.1", nil).Times(1)
+
+	code, diff := serveConfigDiff(t, h, "secret", "?port=port-id-1")
+	assert.Equal(t, 200, code)
+	assert.False(t, diff.Empty())
+	assert.Equal(t, "connection refused", diff.Agents[1].Error)
+}
+
+func TestConfigDiffHandlerRejectsInvalidRequests(t *testing.T) {
+	h, l3portmanager := newConfigDiffFixture(t, &fakeAppliedConfigSource{})
+	l3portmanager.On("GetInternalAddress", "unknown-port-id").Return("", fmt.Errorf("port not found")).Times(1)
+
+	code, _ := serveConfigDiff(t, h, "", "?port=port-id-1")
+	assert.Equal(t, 401, code)
+	code, _ = serveConfigDiff(t, h, "wrong", "?port=port-id-1")
+	assert.Equal(t, 401, code)
+	code, _ = serveConfigDiff(t, h, "secret", "")
+	assert.Equal(t, 400, code)
+	code, _ = serveConfigDiff(t, h, "secret", "?port=unknown-port-id")
+	assert.Equal(t, 404, code)
+	l3portmanager.AssertExpectations(t)
+}
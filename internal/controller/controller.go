@@ -74,6 +74,31 @@ type Controller struct {
 	recorder record.EventRecorder
 
 	worker *Worker
+
+	// DrainTimeout is the maximum time to wait for the job in progress to
+	// finish when shutting down.
+	DrainTimeout time.Duration
+
+	// Identity distinguishes this controller from other load balancer
+	// controllers in the same cluster.
+	Identity string
+
+	// RevalidationInterval is the interval at which the existence of the L3
+	// ports in use is checked. Zero disables the check.
+	RevalidationInterval time.Duration
+
+	// AddressPairs is used to warn when the agent ports approach the limit
+	// of allowed address pairs.
+	AddressPairs AddressPairBudget
+
+	// AllocationStatus maintains a LoadBalancerAllocation resource per
+	// mapped service; nil if disabled.
+	AllocationStatus *AllocationStatusReconciler
+
+	// MaxMappingAttempts is the number of consecutive failed attempts to map
+	// a service after which it is parked until it changes; 0 retries
+	// forever.
+	MaxMappingAttempts int
 }
 
 // NewController returns a new sample controller
@@ -86,6 +111,7 @@ func NewController(
 	l3portmanager L3PortManager,
 	agentController AgentController,
 	generator LoadBalancerModelGenerator,
+	portMapperOpts ...PortMapperOption,
 ) (*Controller, error) {
 
 	// Create event broadcaster
@@ -97,7 +123,7 @@ func NewController(
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
 
-	portmapper, err := NewPortMapper(l3portmanager)
+	portmapper, err := NewPortMapper(l3portmanager, portMapperOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -113,6 +139,8 @@ func NewController(
 		workqueue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Jobs"),
 		recorder:       recorder,
 		worker:         NewWorker(l3portmanager, portmapper, kubeclientset, serviceInformer.Lister(), generator, agentController),
+		DrainTimeout:   30 * time.Second,
+		Identity:       DefaultControllerIdentity,
 	}
 
 	klog.Info("Setting up event handlers")
@@ -155,8 +183,9 @@ func NewController(
 	}
 
 	if endpointsInformer != nil {
+		controller.worker.Endpoints = endpointsInformer.Lister()
 		endpointsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-			AddFunc: controller.handleAuxUpdated,
+			AddFunc: controller.handleEndpointsUpdated,
 			UpdateFunc: func(old, new interface{}) {
 				oldEndpoints := old.(*corev1.Endpoints)
 				newEndpoints := new.(*corev1.Endpoints)
@@ -166,9 +195,9 @@ func NewController(
 					return
 				}
 
-				controller.handleAuxUpdated(newEndpoints)
+				controller.handleEndpointsUpdated(newEndpoints)
 			},
-			DeleteFunc: controller.handleAuxUpdated,
+			DeleteFunc: controller.handleEndpointsUpdated,
 		})
 	}
 
@@ -205,6 +234,13 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	klog.Info("Informer caches are synchronized, enqueueing job to remove the cleanup barrier")
 
 	klog.Info("Starting workers")
+	c.worker.Identity = c.Identity
+	c.recorder = newIdentityRecorder(c.recorder, c.Identity)
+	c.worker.recorder = newIdentityRecorder(c.worker.recorder, c.Identity)
+	setControllerInfo(c.Identity)
+	c.worker.AddressPairs = c.AddressPairs
+	c.worker.AllocationStatus = c.AllocationStatus
+	c.worker.MaxMappingAttempts = c.MaxMappingAttempts
 	go wait.Until(c.worker.Run, time.Second, stopCh)
 
 	// 907s is chosen because:
@@ -230,13 +266,27 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 
 	go wait.Until(c.ensureAgentsState, 300*time.Second, stopCh)
 
+	if c.RevalidationInterval > 0 {
+		go wait.Until(c.revalidatePorts, c.RevalidationInterval, stopCh)
+	}
+
 	klog.Info("Started workers")
 	<-stopCh
 	klog.Info("Shutting down workers")
+	// The configuration on the agents is deliberately left in place so that
+	// traffic keeps flowing while the controller is away.
+	if !c.worker.Drain(c.DrainTimeout) {
+		klog.Warningf("Job still in progress after %s, exiting anyway", c.DrainTimeout)
+	}
 
 	return nil
 }
 
+// Resync checks the L3 ports in use and syncs all services, see ResyncJob.
+func (c *Controller) Resync(timeout time.Duration) (ResyncSummary, error) {
+	return c.worker.Resync(timeout)
+}
+
 func (c *Controller) periodicCleanup() {
 	// This is called "immediately" after the workers have started. We do not
 	// want to schedule a cleanup immediately, though (observe the long comment
@@ -259,6 +309,10 @@ func (c *Controller) ensureAgentsState() {
 	c.worker.EnqueueJob(&EnsureAgentsStateJob{})
 }
 
+func (c *Controller) revalidatePorts() {
+	c.worker.EnqueueJob(&RevalidatePortsJob{})
+}
+
 // handleObject will take any resource implementing metav1.Object and attempt
 // to find the Foo resource that 'owns' it. It does this by looking at the
 // objects metadata.ownerReferences field for an appropriate OwnerReference.
@@ -320,3 +374,28 @@ func (c *Controller) handleAuxUpdated(obj interface{}) {
 	// updating on all changes.
 	c.worker.EnqueueJob(&UpdateConfigJob{})
 }
+
+// Changes of the endpoints of a service with a minimum backend count may
+// change whether it is ready, so the service is synced in addition to
+// updating the configuration.
+func (c *Controller) handleEndpointsUpdated(obj interface{}) {
+	c.handleAuxUpdated(obj)
+
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		if object, ok = tombstone.Obj.(metav1.Object); !ok {
+			return
+		}
+	}
+	svc, err := c.servicesLister.Services(object.GetNamespace()).Get(object.GetName())
+	if err != nil {
+		return
+	}
+	if minBackends, _ := getMinBackends(svc); minBackends > 0 {
+		c.worker.EnqueueJob(&SyncServiceJob{model.FromService(svc)})
+	}
+}
@@ -150,6 +150,8 @@ func filterInformerActions(actions []core.Action) []core.Action {
 		if len(action.GetNamespace()) == 0 &&
 			(action.Matches("list", "services") ||
 				action.Matches("watch", "services") ||
+				action.Matches("list", "endpoints") ||
+				action.Matches("watch", "endpoints") ||
 				action.Matches("create", "events")) {
 			continue
 		}
@@ -0,0 +1,64 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"sync"
+	"time"
+)
+
+// convergenceTimer measures how long the controller takes to converge after
+// a change: from the first job enqueued while converged to the successful
+// configuration push after which no job is left in the queue.
+//
+// The zero value is ready to use.
+type convergenceTimer struct {
+	mu sync.Mutex
+	// Clock of the timer; time.Now if nil
+	now func() time.Time
+	// Time of the first change since the last convergence; zero while
+	// converged
+	start time.Time
+}
+
+func (t *convergenceTimer) clock() time.Time {
+	if t.now == nil {
+		return time.Now()
+	}
+	return t.now()
+}
+
+// Record a change. Only the first change since the last convergence starts
+// the timer.
+func (t *convergenceTimer) changed() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.start.IsZero() {
+		t.start = t.clock()
+	}
+}
+
+// Record that the controller has converged and return the time since the
+// first change. Returns false if no change was recorded.
+func (t *convergenceTimer) converged() (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.start.IsZero() {
+		return 0, false
+	}
+	elapsed := t.clock().Sub(t.start)
+	t.start = time.Time{}
+	return elapsed, true
+}
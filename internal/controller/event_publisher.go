@@ -0,0 +1,47 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// EventPublisher is notified by the port mapper about changes of the
+// allocations, e.g. to forward them to a message queue.
+//
+// Errors returned by the publisher are logged, but do not affect the
+// allocation itself.
+type EventPublisher interface {
+	// A service has been mapped to a port or its mapping has changed.
+	PublishMapped(event model.AllocationEvent) error
+	// A service has been unmapped on request.
+	PublishUnmapped(event model.AllocationEvent) error
+	// A service lost its mapping because its port is not available anymore.
+	PublishEvicted(event model.AllocationEvent) error
+}
+
+type NoopEventPublisher struct{}
+
+func (p NoopEventPublisher) PublishMapped(event model.AllocationEvent) error {
+	return nil
+}
+
+func (p NoopEventPublisher) PublishUnmapped(event model.AllocationEvent) error {
+	return nil
+}
+
+func (p NoopEventPublisher) PublishEvicted(event model.AllocationEvent) error {
+	return nil
+}
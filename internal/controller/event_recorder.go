@@ -0,0 +1,48 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// identityRecorder attaches the identity of the controller to all events, so
+// that the events of several load balancer controllers can be told apart.
+type identityRecorder struct {
+	record.EventRecorder
+	identity string
+}
+
+func newIdentityRecorder(recorder record.EventRecorder, identity string) record.EventRecorder {
+	return &identityRecorder{EventRecorder: recorder, identity: identity}
+}
+
+func (r *identityRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.AnnotatedEventf(object, nil, eventtype, reason, "%s", message)
+}
+
+func (r *identityRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.AnnotatedEventf(object, nil, eventtype, reason, messageFmt, args...)
+}
+
+func (r *identityRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	merged := make(map[string]string, len(annotations)+1)
+	for key, value := range annotations {
+		merged[key] = value
+	}
+	merged[EventAnnotationControllerIdentity] = r.identity
+	r.EventRecorder.AnnotatedEventf(object, merged, eventtype, reason, messageFmt, args...)
+}
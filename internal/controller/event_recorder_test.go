@@ -0,0 +1,61 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+func TestEmittedEventsCarryControllerIdentity(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = map[string]string{AnnotationManaged: "true"}
+	f.addService(s)
+
+	reservedError := fmt.Errorf("%w: %d", ErrReservedPort, 22)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, reservedError).Times(1)
+
+	j := &SyncServiceJob{model.FromService(s)}
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.recorder = newIdentityRecorder(recorder, "prod-1")
+		_, err := j.Run(w)
+		assert.Equal(t, reservedError, err)
+	})
+
+	assert.Equal(t, 1, len(recorder.Events))
+	event := <-recorder.Events
+	assert.Contains(t, event, EventServiceRejected)
+	assert.Contains(t, event, EventAnnotationControllerIdentity+":prod-1")
+}
+
+func TestIdentityRecorderKeepsOtherAnnotations(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	s := newService("test-service")
+
+	newIdentityRecorder(recorder, "prod-1").AnnotatedEventf(s, map[string]string{"example.com/key": "value"}, "Normal", "Reason", "message %d", 1)
+
+	assert.Equal(t, fmt.Sprintf("Normal Reason message 1 %v", map[string]string{
+		"example.com/key":                 "value",
+		EventAnnotationControllerIdentity: "prod-1",
+	}), <-recorder.Events)
+}
@@ -0,0 +1,86 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// mappingFailures counts the consecutive failed attempts to map a service
+// and remembers what the service looked like at the last attempt.
+type mappingFailures struct {
+	count       int
+	spec        corev1.ServiceSpec
+	annotations map[string]string
+}
+
+// mappingAttempts parks services which failed to map too often. A parked
+// service is not retried until its spec or its annotations change.
+//
+// The zero value is ready to use.
+type mappingAttempts struct {
+	failures map[string]*mappingFailures
+}
+
+// Return the failures recorded for the service, forgetting them if the
+// service has changed since.
+func (a *mappingAttempts) get(svc *corev1.Service) *mappingFailures {
+	key := model.FromService(svc).ToKey()
+	failures, ok := a.failures[key]
+	if !ok {
+		return nil
+	}
+	if !apiequality.Semantic.DeepEqual(failures.spec, svc.Spec) ||
+		!apiequality.Semantic.DeepEqual(failures.annotations, svc.Annotations) {
+		delete(a.failures, key)
+		return nil
+	}
+	return failures
+}
+
+// Return true if the service failed to map at least max times and has not
+// changed since. max <= 0 disables parking.
+func (a *mappingAttempts) isParked(svc *corev1.Service, max int) bool {
+	if max <= 0 {
+		return false
+	}
+	failures := a.get(svc)
+	return failures != nil && failures.count >= max
+}
+
+// Record a failed attempt to map the service. Returns the number of
+// consecutive failures.
+func (a *mappingAttempts) recordFailure(svc *corev1.Service) int {
+	failures := a.get(svc)
+	if failures == nil {
+		if a.failures == nil {
+			a.failures = make(map[string]*mappingFailures)
+		}
+		failures = &mappingFailures{
+			spec:        *svc.Spec.DeepCopy(),
+			annotations: svc.DeepCopy().Annotations,
+		}
+		a.failures[model.FromService(svc).ToKey()] = failures
+	}
+	failures.count++
+	return failures.count
+}
+
+func (a *mappingAttempts) reset(id model.ServiceIdentifier) {
+	delete(a.failures, id.ToKey())
+}
@@ -0,0 +1,54 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+func TestMappingAttemptsParkAfterMaxFailures(t *testing.T) {
+	a := mappingAttempts{}
+	s := newService("test-service")
+
+	assert.False(t, a.isParked(s, 2))
+	assert.Equal(t, 1, a.recordFailure(s))
+	assert.False(t, a.isParked(s, 2))
+	assert.Equal(t, 2, a.recordFailure(s))
+	assert.True(t, a.isParked(s, 2))
+
+	// disabled
+	assert.False(t, a.isParked(s, 0))
+
+	a.reset(model.FromService(s))
+	assert.False(t, a.isParked(s, 2))
+}
+
+func TestMappingAttemptsResetOnAnnotationChange(t *testing.T) {
+	a := mappingAttempts{}
+	s := newService("test-service")
+	s.Annotations = map[string]string{AnnotationInboundPort: "port-id-1"}
+
+	a.recordFailure(s)
+	assert.True(t, a.isParked(s, 1))
+
+	changed := s.DeepCopy()
+	changed.Annotations[AnnotationInboundPort] = "port-id-2"
+	assert.False(t, a.isParked(changed, 1))
+	assert.Equal(t, 1, a.recordFailure(changed))
+}
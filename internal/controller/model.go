@@ -16,6 +16,8 @@ package controller
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	corelisters "k8s.io/client-go/listers/core/v1"
 	networkinglisters "k8s.io/client-go/listers/networking/v1"
@@ -25,9 +27,60 @@ import (
 )
 
 type LoadBalancerModelGenerator interface {
+	// Generate the load balancer configuration for the given service keys
+	// and their L3 port IDs.
+	//
+	// If the configuration of some services cannot be generated, those
+	// services are left out and a *PartialModelError is returned together
+	// with the model of the remaining services.
 	GenerateModel(portAssignment map[string]string) (*model.LoadBalancer, error)
 }
 
+// PartialModelError lists the services which had to be left out of a
+// generated load balancer model.
+type PartialModelError struct {
+	// Failed maps the keys of the skipped services to the reason.
+	Failed map[string]error
+}
+
+func (e *PartialModelError) Error() string {
+	keys := e.Services()
+	reasons := make([]string, len(keys))
+	for i, key := range keys {
+		reasons[i] = fmt.Sprintf("%s: %s", key, e.Failed[key].Error())
+	}
+	return fmt.Sprintf(
+		"failed to generate the configuration of %d service(s): %s",
+		len(keys),
+		strings.Join(reasons, "; "),
+	)
+}
+
+// Return the sorted keys of the skipped services
+func (e *PartialModelError) Services() []string {
+	keys := make([]string, 0, len(e.Failed))
+	for key := range e.Failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e *PartialModelError) add(serviceKey string, err error) {
+	if e.Failed == nil {
+		e.Failed = make(map[string]error)
+	}
+	e.Failed[serviceKey] = err
+}
+
+// Return the error to be returned by GenerateModel along with the model
+func (e *PartialModelError) orNil() error {
+	if len(e.Failed) == 0 {
+		return nil
+	}
+	return e
+}
+
 func NewLoadBalancerModelGenerator(
 	backendLayer config.BackendLayer,
 	l3portmanager L3PortManager,
@@ -39,7 +92,7 @@ func NewLoadBalancerModelGenerator(
 	switch backendLayer {
 	case config.BackendLayerNodePort:
 		return NewNodePortLoadBalancerModelGenerator(
-			l3portmanager, services, nodes,
+			l3portmanager, services, nodes, endpoints,
 		), nil
 	case config.BackendLayerClusterIP:
 		return NewClusterIPLoadBalancerModelGenerator(
@@ -16,6 +16,7 @@ package controller
 
 import (
 	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
 )
@@ -38,19 +39,24 @@ func (g *ClusterIPLoadBalancerModelGenerator) GenerateModel(portAssignment map[s
 	result := &model.LoadBalancer{}
 
 	ingressMap := map[string]model.IngressIP{}
+	failed := &PartialModelError{}
 
 	for serviceKey, portID := range portAssignment {
 		id, _ := model.FromKey(serviceKey)
 		svc, err := g.services.Services(id.Namespace).Get(id.Name)
 		if err != nil {
-			return nil, err
+			klog.Warningf("leaving service %q out of the configuration: %s", serviceKey, err.Error())
+			failed.add(serviceKey, err)
+			continue
 		}
 
 		ingress, ok := ingressMap[portID]
 		if !ok {
 			ingressIP, err := g.l3portmanager.GetInternalAddress(portID)
 			if err != nil {
-				return nil, err
+				klog.Warningf("leaving service %q out of the configuration: %s", serviceKey, err.Error())
+				failed.add(serviceKey, err)
+				continue
 			}
 			ingress = model.IngressIP{
 				Address: ingressIP,
@@ -58,12 +64,22 @@ func (g *ClusterIPLoadBalancerModelGenerator) GenerateModel(portAssignment map[s
 			}
 		}
 
+		// invalid weights are rejected when mapping the service; zero means 1
+		weight, _ := getSharedListenerWeight(svc)
+		// the port mapper rejects services with a port range unless the pod
+		// backend layer is used, so this only catches misconfigurations
+		if _, ok := svc.Annotations[AnnotationPortRange]; ok {
+			klog.Warningf(
+				"port range of service %q is not forwarded: port ranges require the pod backend layer",
+				serviceKey)
+		}
 		for _, svcPort := range svc.Spec.Ports {
 			ingress.Ports = append(ingress.Ports, model.PortForward{
 				Protocol:             svcPort.Protocol,
 				InboundPort:          svcPort.Port,
 				DestinationPort:      svcPort.Port,
 				DestinationAddresses: []string{svc.Spec.ClusterIP},
+				Weight:               weight,
 			})
 		}
 
@@ -77,5 +93,5 @@ func (g *ClusterIPLoadBalancerModelGenerator) GenerateModel(portAssignment map[s
 		i++
 	}
 
-	return result, nil
+	return result, failed.orNil()
 }
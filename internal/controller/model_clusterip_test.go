@@ -15,6 +15,8 @@
 package controller
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
@@ -268,3 +270,54 @@ func TestClusterIPMultiPortMultiServiceAssignment(t *testing.T) {
 		})
 	})
 }
+
+func TestClusterIPSkipsServicesWhichCannotBeRendered(t *testing.T) {
+	f := newClusterIPGeneratorFixture(t)
+
+	svc1 := newService("svc-1")
+	svc1.Spec.ClusterIP = "10.0.0.1"
+	svc1.Spec.Ports = []corev1.ServicePort{
+		{Port: 80, Protocol: corev1.ProtocolTCP},
+	}
+	f.addService(svc1)
+
+	svc2 := newService("svc-2")
+	svc2.Spec.ClusterIP = "10.0.0.2"
+	svc2.Spec.Ports = []corev1.ServicePort{
+		{Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+	f.addService(svc2)
+
+	// not known to the lister
+	svc3 := newService("svc-3")
+
+	a := map[string]string{
+		model.FromService(svc1).ToKey(): "port-id-1",
+		model.FromService(svc2).ToKey(): "port-id-2",
+		model.FromService(svc3).ToKey(): "port-id-1",
+	}
+
+	someError := fmt.Errorf("port vanished")
+	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("ingress-ip-1", nil).Times(1)
+	f.l3portmanager.On("GetInternalAddress", "port-id-2").Return("", someError).Times(1)
+
+	f.runWith(func(g *ClusterIPLoadBalancerModelGenerator) {
+		m, err := g.GenerateModel(a)
+		var partialErr *PartialModelError
+		assert.True(t, errors.As(err, &partialErr))
+		assert.Equal(t, []string{
+			model.FromService(svc2).ToKey(),
+			model.FromService(svc3).ToKey(),
+		}, partialErr.Services())
+		assert.Equal(t, someError, partialErr.Failed[model.FromService(svc2).ToKey()])
+
+		assert.NotNil(t, m)
+		assert.Equal(t, 1, len(m.Ingress))
+		anyIngressIP(t, m.Ingress, "ingress-ip-1", func(t *testing.T, i model.IngressIP) {
+			assert.Equal(t, 1, len(i.Ports))
+			anyPort(t, i.Ports, 80, corev1.ProtocolTCP, func(t *testing.T, p model.PortForward) {
+				assert.Equal(t, []string{"10.0.0.1"}, p.DestinationAddresses)
+			})
+		})
+	})
+}
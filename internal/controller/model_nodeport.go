@@ -20,6 +20,7 @@ import (
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/klog"
@@ -35,16 +36,19 @@ type NodePortLoadBalancerModelGenerator struct {
 	l3portmanager L3PortManager
 	services      corelisters.ServiceLister
 	nodes         corelisters.NodeLister
+	endpoints     corelisters.EndpointsLister
 }
 
 func NewNodePortLoadBalancerModelGenerator(
 	l3portmanager L3PortManager,
 	services corelisters.ServiceLister,
-	nodes corelisters.NodeLister) *NodePortLoadBalancerModelGenerator {
+	nodes corelisters.NodeLister,
+	endpoints corelisters.EndpointsLister) *NodePortLoadBalancerModelGenerator {
 	return &NodePortLoadBalancerModelGenerator{
 		l3portmanager: l3portmanager,
 		services:      services,
 		nodes:         nodes,
+		endpoints:     endpoints,
 	}
 }
 
@@ -64,13 +68,18 @@ func isIPv6Address(ipString string) bool {
 	return strings.Count(ipString, ":") >= 2
 }
 
-func (g *NodePortLoadBalancerModelGenerator) getDestinationAddresses() (addressesV4 []string, addressesV6 []string, err error) {
+// Return the internal addresses of the nodes. If include is not nil, only
+// the nodes for which it returns true are considered.
+func (g *NodePortLoadBalancerModelGenerator) getDestinationAddresses(include func(nodeName string) bool) (addressesV4 []string, addressesV6 []string, err error) {
 	nodes, err := g.nodes.List(labels.Everything())
 	if err != nil {
 		return nil, nil, err
 	}
 
 	for _, node := range nodes {
+		if include != nil && !include(node.Name) {
+			continue
+		}
 		for _, addr := range node.Status.Addresses {
 			if addr.Type != corev1.NodeInternalIP {
 				continue
@@ -91,8 +100,31 @@ func (g *NodePortLoadBalancerModelGenerator) getDestinationAddresses() (addresse
 	return addressesV4, addressesV6, nil
 }
 
+// Return the names of the nodes which host a ready endpoint of the service.
+// With the Local external traffic policy, only these nodes accept traffic on
+// the node ports of the service.
+func (g *NodePortLoadBalancerModelGenerator) getEndpointNodes(svc *corev1.Service) (map[string]bool, error) {
+	result := map[string]bool{}
+	ep, err := g.endpoints.Endpoints(svc.Namespace).Get(svc.Name)
+	if apierrors.IsNotFound(err) {
+		// no endpoints exist during bootstrapping of a service
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			if addr.NodeName != nil {
+				result[*addr.NodeName] = true
+			}
+		}
+	}
+	return result, nil
+}
+
 func (g *NodePortLoadBalancerModelGenerator) GenerateModel(portAssignment map[string]string) (*model.LoadBalancer, error) {
-	addressesV4, addressesV6, err := g.getDestinationAddresses()
+	addressesV4, addressesV6, err := g.getDestinationAddresses(nil)
 	if err != nil {
 		return nil, err
 	}
@@ -100,19 +132,24 @@ func (g *NodePortLoadBalancerModelGenerator) GenerateModel(portAssignment map[st
 	result := &model.LoadBalancer{}
 
 	ingressMap := map[string]model.IngressIP{}
+	failed := &PartialModelError{}
 
 	for serviceKey, portID := range portAssignment {
 		id, _ := model.FromKey(serviceKey)
 		svc, err := g.services.Services(id.Namespace).Get(id.Name)
 		if err != nil {
-			return nil, err
+			klog.Warningf("leaving service %q out of the configuration: %s", serviceKey, err.Error())
+			failed.add(serviceKey, err)
+			continue
 		}
 
 		ingress, ok := ingressMap[portID]
 		if !ok {
 			ingressIP, err := g.l3portmanager.GetInternalAddress(portID)
 			if err != nil {
-				return nil, err
+				klog.Warningf("leaving service %q out of the configuration: %s", serviceKey, err.Error())
+				failed.add(serviceKey, err)
+				continue
 			}
 			ingress = model.IngressIP{
 				Address: ingressIP,
@@ -124,12 +161,30 @@ func (g *NodePortLoadBalancerModelGenerator) GenerateModel(portAssignment map[st
 			continue
 		}
 
+		svcAddressesV4, svcAddressesV6 := addressesV4, addressesV6
+		if getExternalTrafficPolicy(svc) == corev1.ServiceExternalTrafficPolicyTypeLocal {
+			// the policy may change in place; it is evaluated on every
+			// generation, so that flipping it only needs a config update
+			endpointNodes, err := g.getEndpointNodes(svc)
+			if err != nil {
+				klog.Warningf("leaving service %q out of the configuration: %s", serviceKey, err.Error())
+				failed.add(serviceKey, err)
+				continue
+			}
+			svcAddressesV4, svcAddressesV6, err = g.getDestinationAddresses(func(nodeName string) bool {
+				return endpointNodes[nodeName]
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		var destAddresses []string
 
 		if isIPv4Address(ingress.Address) {
-			destAddresses = append(destAddresses, addressesV4...)
+			destAddresses = append(destAddresses, svcAddressesV4...)
 		} else if isIPv6Address(ingress.Address) {
-			destAddresses = append(destAddresses, addressesV6...)
+			destAddresses = append(destAddresses, svcAddressesV6...)
 		} else {
 			klog.Warningf(
 				"could not determine address family of ingress IP %q for service %q",
@@ -138,12 +193,26 @@ func (g *NodePortLoadBalancerModelGenerator) GenerateModel(portAssignment map[st
 			continue
 		}
 
+		if len(destAddresses) == 0 && !keepsEmptyBackends(svc) {
+			continue
+		}
+
+		// invalid weights are rejected when mapping the service; zero means 1
+		weight, _ := getSharedListenerWeight(svc)
+		// the port mapper rejects services with a port range unless the pod
+		// backend layer is used, so this only catches misconfigurations
+		if _, ok := svc.Annotations[AnnotationPortRange]; ok {
+			klog.Warningf(
+				"port range of service %q is not forwarded: port ranges require the pod backend layer",
+				serviceKey)
+		}
 		for _, svcPort := range svc.Spec.Ports {
 			ingress.Ports = append(ingress.Ports, model.PortForward{
 				Protocol:             svcPort.Protocol,
 				InboundPort:          svcPort.Port,
 				DestinationPort:      svcPort.NodePort,
 				DestinationAddresses: destAddresses,
+				Weight:               weight,
 			})
 		}
 
@@ -157,5 +226,5 @@ func (g *NodePortLoadBalancerModelGenerator) GenerateModel(portAssignment map[st
 		i++
 	}
 
-	return result, nil
+	return result, failed.orNil()
 }
@@ -38,7 +38,10 @@ type nodePortGeneratorFixture struct {
 	kubeclient    *k8sfake.Clientset
 	serviceLister []*corev1.Service
 	nodeLister    []*corev1.Node
+	epLister      []*corev1.Endpoints
 	kubeobjects   []runtime.Object
+
+	k8sI kubeinformers.SharedInformerFactory
 }
 
 func newNodePortGeneratorFixture(t *testing.T) *nodePortGeneratorFixture {
@@ -47,6 +50,7 @@ func newNodePortGeneratorFixture(t *testing.T) *nodePortGeneratorFixture {
 	f.l3portmanager = ostesting.NewMockL3PortManager()
 	f.serviceLister = []*corev1.Service{}
 	f.nodeLister = []*corev1.Node{}
+	f.epLister = []*corev1.Endpoints{}
 	f.kubeobjects = []runtime.Object{}
 
 	for i := 1; i <= 5; i++ {
@@ -78,6 +82,7 @@ func (f *nodePortGeneratorFixture) newGenerator() (*NodePortLoadBalancerModelGen
 	k8sI := kubeinformers.NewSharedInformerFactory(f.kubeclient, noResyncPeriodFunc())
 	services := k8sI.Core().V1().Services()
 	nodes := k8sI.Core().V1().Nodes()
+	endpoints := k8sI.Core().V1().Endpoints()
 
 	for _, s := range f.serviceLister {
 		services.Informer().GetIndexer().Add(s)
@@ -87,11 +92,17 @@ func (f *nodePortGeneratorFixture) newGenerator() (*NodePortLoadBalancerModelGen
 		nodes.Informer().GetIndexer().Add(n)
 	}
 
+	for _, ep := range f.epLister {
+		endpoints.Informer().GetIndexer().Add(ep)
+	}
+
 	g := NewNodePortLoadBalancerModelGenerator(
 		f.l3portmanager,
 		services.Lister(),
 		nodes.Lister(),
+		endpoints.Lister(),
 	)
+	f.k8sI = k8sI
 	return g, k8sI
 }
 
@@ -100,6 +111,31 @@ func (f *nodePortGeneratorFixture) addService(svc *corev1.Service) {
 	f.kubeobjects = append(f.kubeobjects, svc)
 }
 
+func (f *nodePortGeneratorFixture) updateService(svc *corev1.Service) {
+	f.k8sI.Core().V1().Services().Informer().GetIndexer().Update(svc)
+}
+
+func (f *nodePortGeneratorFixture) addEndpoints(ep *corev1.Endpoints) {
+	f.epLister = append(f.epLister, ep)
+	f.kubeobjects = append(f.kubeobjects, ep)
+}
+
+func newEndpointsOnNodes(svc *corev1.Service, nodeNames ...string) *corev1.Endpoints {
+	ep := &corev1.Endpoints{
+		TypeMeta:   metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{Name: svc.Name, Namespace: svc.Namespace},
+		Subsets:    []corev1.EndpointSubset{{}},
+	}
+	for i, nodeName := range nodeNames {
+		nodeName := nodeName
+		ep.Subsets[0].Addresses = append(ep.Subsets[0].Addresses, corev1.EndpointAddress{
+			IP:       fmt.Sprintf("10.244.0.%d", i+1),
+			NodeName: &nodeName,
+		})
+	}
+	return ep
+}
+
 func (f *nodePortGeneratorFixture) runWith(body func(g *NodePortLoadBalancerModelGenerator)) {
 	g, k8sI := f.newGenerator()
 	stopCh := make(chan struct{})
@@ -199,6 +235,31 @@ func TestNodePortSinglePortSingleServiceAssignment(t *testing.T) {
 	})
 }
 
+func TestNodePortRemovesServiceWithoutNodesIfRequested(t *testing.T) {
+	f := newNodePortGeneratorFixture(t)
+	f.nodeLister = []*corev1.Node{}
+	f.kubeobjects = []runtime.Object{}
+
+	svc := newService("svc-1")
+	svc.Annotations = map[string]string{AnnotationEmptyBackends: EmptyBackendsRemove}
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Port: 80, NodePort: 31234, Protocol: corev1.ProtocolTCP},
+	}
+	f.addService(svc)
+
+	a := map[string]string{
+		model.FromService(svc).ToKey(): "port-id-1",
+	}
+
+	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("10.0.0.2", nil).Times(1)
+
+	f.runWith(func(g *NodePortLoadBalancerModelGenerator) {
+		m, err := g.GenerateModel(a)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(m.Ingress))
+	})
+}
+
 func TestNodePortSinglePortMultiServiceAssignment(t *testing.T) {
 	f := newNodePortGeneratorFixture(t)
 
@@ -387,3 +448,103 @@ func TestNodePortMultiPortMultiServiceAssignment(t *testing.T) {
 		})
 	})
 }
+
+func TestNodePortLocalPolicyOnlyTargetsNodesWithEndpoints(t *testing.T) {
+	f := newNodePortGeneratorFixture(t)
+
+	svc := newService("svc-1")
+	svc.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyLocal
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Port: 80, NodePort: 31234, Protocol: corev1.ProtocolTCP},
+	}
+	f.addService(svc)
+	f.addEndpoints(newEndpointsOnNodes(svc, "kubernetes-node-2", "kubernetes-node-4", "kubernetes-node-4"))
+
+	a := map[string]string{
+		model.FromService(svc).ToKey(): "port-id-1",
+	}
+
+	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("10.0.0.2", nil).Times(1)
+
+	f.runWith(func(g *NodePortLoadBalancerModelGenerator) {
+		m, err := g.GenerateModel(a)
+		assert.Nil(t, err)
+
+		anyIngressIP(t, m.Ingress, "10.0.0.2", func(t *testing.T, i model.IngressIP) {
+			anyPort(t, i.Ports, 80, corev1.ProtocolTCP, func(t *testing.T, p model.PortForward) {
+				assert.ElementsMatch(t, []string{"192.168.1.2", "192.168.1.4"}, p.DestinationAddresses)
+			})
+		})
+	})
+}
+
+func TestNodePortLocalPolicyWithoutEndpointsDropsTraffic(t *testing.T) {
+	f := newNodePortGeneratorFixture(t)
+
+	svc := newService("svc-1")
+	svc.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyLocal
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Port: 80, NodePort: 31234, Protocol: corev1.ProtocolTCP},
+	}
+	f.addService(svc)
+
+	a := map[string]string{
+		model.FromService(svc).ToKey(): "port-id-1",
+	}
+
+	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("10.0.0.2", nil).Times(1)
+
+	f.runWith(func(g *NodePortLoadBalancerModelGenerator) {
+		m, err := g.GenerateModel(a)
+		assert.Nil(t, err)
+
+		anyIngressIP(t, m.Ingress, "10.0.0.2", func(t *testing.T, i model.IngressIP) {
+			anyPort(t, i.Ports, 80, corev1.ProtocolTCP, func(t *testing.T, p model.PortForward) {
+				assert.Empty(t, p.DestinationAddresses)
+			})
+		})
+	})
+}
+
+func TestNodePortFlippingExternalTrafficPolicyUpdatesDestinations(t *testing.T) {
+	f := newNodePortGeneratorFixture(t)
+
+	svc := newService("svc-1")
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Port: 80, NodePort: 31234, Protocol: corev1.ProtocolTCP},
+	}
+	f.addService(svc)
+	f.addEndpoints(newEndpointsOnNodes(svc, "kubernetes-node-3"))
+
+	a := map[string]string{
+		model.FromService(svc).ToKey(): "port-id-1",
+	}
+
+	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("10.0.0.2", nil)
+
+	destinations := func(g *NodePortLoadBalancerModelGenerator) (result []string) {
+		m, err := g.GenerateModel(a)
+		assert.Nil(t, err)
+		anyIngressIP(t, m.Ingress, "10.0.0.2", func(t *testing.T, i model.IngressIP) {
+			anyPort(t, i.Ports, 80, corev1.ProtocolTCP, func(t *testing.T, p model.PortForward) {
+				assert.Equal(t, int32(31234), p.DestinationPort)
+				result = p.DestinationAddresses
+			})
+		})
+		return result
+	}
+
+	f.runWith(func(g *NodePortLoadBalancerModelGenerator) {
+		assert.Equal(t, len(f.nodeLister), len(destinations(g)))
+
+		local := svc.DeepCopy()
+		local.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyLocal
+		f.updateService(local)
+		assert.Equal(t, []string{"192.168.1.3"}, destinations(g))
+
+		cluster := local.DeepCopy()
+		cluster.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyCluster
+		f.updateService(cluster)
+		assert.Equal(t, len(f.nodeLister), len(destinations(g)))
+	})
+}
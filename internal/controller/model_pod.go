@@ -115,6 +115,24 @@ func buildAllowedIngress(ingress *networkingv1.NetworkPolicyIngressRule) (rule m
 	return rule
 }
 
+// Append a forward for each port of the range to the same port on the
+// destination addresses. portRange may be nil.
+func appendPortRangeForwards(forwards []model.PortForward, portRange *PortRange, addresses []string, weight int32) []model.PortForward {
+	if portRange == nil {
+		return forwards
+	}
+	for _, l4port := range portRange.L4Ports() {
+		forwards = append(forwards, model.PortForward{
+			Protocol:             l4port.Protocol,
+			InboundPort:          l4port.Port,
+			DestinationPort:      l4port.Port,
+			DestinationAddresses: addresses,
+			Weight:               weight,
+		})
+	}
+	return forwards
+}
+
 func hasFromWithIPBlock(ingress *networkingv1.NetworkPolicyIngressRule) bool {
 	if len(ingress.From) == 0 {
 		return false
@@ -195,40 +213,33 @@ func (g *PodLoadBalancerModelGenerator) GenerateModel(portAssignment map[string]
 	klog.Infof("Done getting %d policies applying to %d addresses", len(allPolicies), len(policyMap))
 
 	ingressMap := map[string]model.IngressIP{}
+	failed := &PartialModelError{}
 
 	for serviceKey, portID := range portAssignment {
 		id, _ := model.FromKey(serviceKey)
 		svc, err := g.services.Services(id.Namespace).Get(id.Name)
 		if err != nil {
-			return nil, err
+			klog.Warningf("leaving service %q out of the configuration: %s", serviceKey, err.Error())
+			failed.add(serviceKey, err)
+			continue
 		}
 
+		// no endpoints may exist or be retrievable during bootstrapping of a
+		// service or if it is scaled to zero
 		ep, err := g.endpoints.Endpoints(id.Namespace).Get(id.Name)
-		if err != nil {
-			// no endpoints exist or are not retrievable -> we ignore that for
-			// now because this may happen during bootstrapping of a service
+		hasBackends := err == nil && len(ep.Subsets) > 0
+		if !hasBackends && !keepsEmptyBackends(svc) {
 			continue
 		}
-		if len(ep.Subsets) < 1 {
-			// no point in doing anything with the service here
-			continue
-		}
-		// TODO: handle multiple subsets. This is tricky because our model
-		// currently does not support different ports per destination IP.
-		epSubset := ep.Subsets[0]
-		if len(ep.Subsets) > 1 {
-			klog.Warningf(
-				"LB model for service %s will be inaccurate: more than one subset",
-				serviceKey,
-			)
-		}
 
 		ingress, ok := ingressMap[portID]
 		if !ok {
 			klog.Infof("Calling GetInternalAddress for portID=%q, serviceKey=%q", portID, serviceKey)
 			ingressIP, err := g.l3portmanager.GetInternalAddress(portID)
 			if err != nil {
-				return nil, err
+				klog.Warningf("leaving service %q out of the configuration: %s", serviceKey, err.Error())
+				failed.add(serviceKey, err)
+				continue
 			}
 			ingress = model.IngressIP{
 				Address: ingressIP,
@@ -236,6 +247,36 @@ func (g *PodLoadBalancerModelGenerator) GenerateModel(portAssignment map[string]
 			}
 		}
 
+		// invalid weights and port ranges are rejected when mapping the
+		// service; zero means 1
+		weight, _ := getSharedListenerWeight(svc)
+		portRange, _ := getPortRange(svc)
+
+		if !hasBackends {
+			// keep the forwards so that the traffic is dropped
+			for _, svcPort := range svc.Spec.Ports {
+				ingress.Ports = append(ingress.Ports, model.PortForward{
+					Protocol:             svcPort.Protocol,
+					InboundPort:          svcPort.Port,
+					DestinationAddresses: []string{},
+					Weight:               weight,
+				})
+			}
+			ingress.Ports = appendPortRangeForwards(ingress.Ports, portRange, []string{}, weight)
+			ingressMap[portID] = ingress
+			continue
+		}
+
+		// TODO: handle multiple subsets. This is tricky because our model
+		// currently does not support different ports per destination IP.
+		epSubset := ep.Subsets[0]
+		if len(ep.Subsets) > 1 {
+			klog.Warningf(
+				"LB model for service %s will be inaccurate: more than one subset",
+				serviceKey,
+			)
+		}
+
 		for _, svcPort := range svc.Spec.Ports {
 			targetPort := int32(svcPort.TargetPort.IntValue())
 			portName := svcPort.Name
@@ -260,15 +301,27 @@ func (g *PodLoadBalancerModelGenerator) GenerateModel(portAssignment map[string]
 			for i, addr := range epSubset.Addresses {
 				addresses[i] = addr.IP
 			}
+			if len(addresses) == 0 && !keepsEmptyBackends(svc) {
+				continue
+			}
 
 			ingress.Ports = append(ingress.Ports, model.PortForward{
 				Protocol:             svcPort.Protocol,
 				InboundPort:          svcPort.Port,
 				DestinationPort:      destinationPort,
 				DestinationAddresses: addresses,
+				Weight:               weight,
 			})
 		}
 
+		addresses := make([]string, len(epSubset.Addresses))
+		for i, addr := range epSubset.Addresses {
+			addresses[i] = addr.IP
+		}
+		if len(addresses) > 0 || keepsEmptyBackends(svc) {
+			ingress.Ports = appendPortRangeForwards(ingress.Ports, portRange, addresses, weight)
+		}
+
 		ingressMap[portID] = ingress
 	}
 
@@ -287,5 +340,5 @@ func (g *PodLoadBalancerModelGenerator) GenerateModel(portAssignment map[string]
 		i++
 	}
 
-	return result, nil
+	return result, failed.orNil()
 }
@@ -287,6 +287,53 @@ func TestPodSinglePortSingleServiceAssignment(t *testing.T) {
 	})
 }
 
+func TestPodForwardsPortRangeToTheSamePorts(t *testing.T) {
+	f := newPodGeneratorFixture(t)
+
+	ep1 := newEndpoints("svc-1")
+	ep1.Subsets = []corev1.EndpointSubset{
+		{
+			Addresses: []corev1.EndpointAddress{
+				{IP: "10.224.0.1"},
+			},
+			Ports: []corev1.EndpointPort{
+				{Port: 21, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	f.addEndpoints(ep1)
+
+	svc := newService("svc-1")
+	svc.Annotations = map[string]string{AnnotationPortRange: "30000-30002"}
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Port: 21, Protocol: corev1.ProtocolTCP},
+	}
+	f.addService(svc)
+
+	a := map[string]string{
+		model.FromService(svc).ToKey(): "port-id-1",
+	}
+
+	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("ingress-ip-1", nil).Times(1)
+
+	f.runWith(func(g *PodLoadBalancerModelGenerator) {
+		m, err := g.GenerateModel(a)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(m.Ingress))
+
+		anyIngressIP(t, m.Ingress, "ingress-ip-1", func(t *testing.T, i model.IngressIP) {
+			assert.Equal(t, 4, len(i.Ports))
+
+			for _, port := range []int32{30000, 30001, 30002} {
+				anyPort(t, i.Ports, port, corev1.ProtocolTCP, func(t *testing.T, p model.PortForward) {
+					assert.Equal(t, port, p.DestinationPort)
+					assert.Equal(t, []string{"10.224.0.1"}, p.DestinationAddresses)
+				})
+			}
+		})
+	})
+}
+
 func TestPodSinglePortSingleServiceAssignmentByName(t *testing.T) {
 	f := newPodGeneratorFixture(t)
 
@@ -596,6 +643,100 @@ func TestPodMultiPortMultiServiceAssignment(t *testing.T) {
 	})
 }
 
+func TestPodKeepsForwardsOfServiceWithoutEndpointsByDefault(t *testing.T) {
+	f := newPodGeneratorFixture(t)
+
+	f.addEndpoints(newEndpoints("svc-1"))
+
+	svc := newService("svc-1")
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Port: 80, Protocol: corev1.ProtocolTCP, TargetPort: intstr.FromInt(8080)},
+	}
+	f.addService(svc)
+
+	a := map[string]string{
+		model.FromService(svc).ToKey(): "port-id-1",
+	}
+
+	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("ingress-ip-1", nil).Times(1)
+
+	f.runWith(func(g *PodLoadBalancerModelGenerator) {
+		m, err := g.GenerateModel(a)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(m.Ingress))
+
+		anyIngressIP(t, m.Ingress, "ingress-ip-1", func(t *testing.T, i model.IngressIP) {
+			assert.Equal(t, 1, len(i.Ports))
+
+			anyPort(t, i.Ports, 80, corev1.ProtocolTCP, func(t *testing.T, p model.PortForward) {
+				assert.Equal(t, []string{}, p.DestinationAddresses)
+			})
+		})
+	})
+}
+
+func TestPodRemovesForwardsOfServiceWithoutEndpointsIfRequested(t *testing.T) {
+	f := newPodGeneratorFixture(t)
+
+	f.addEndpoints(newEndpoints("svc-1"))
+
+	svc := newService("svc-1")
+	svc.Annotations = map[string]string{AnnotationEmptyBackends: EmptyBackendsRemove}
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Port: 80, Protocol: corev1.ProtocolTCP, TargetPort: intstr.FromInt(8080)},
+	}
+	f.addService(svc)
+
+	a := map[string]string{
+		model.FromService(svc).ToKey(): "port-id-1",
+	}
+
+	f.runWith(func(g *PodLoadBalancerModelGenerator) {
+		m, err := g.GenerateModel(a)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(m.Ingress))
+	})
+}
+
+func TestPodRemovesForwardsWithoutReadyAddressesIfRequested(t *testing.T) {
+	f := newPodGeneratorFixture(t)
+
+	ep1 := newEndpoints("svc-1")
+	ep1.Subsets = []corev1.EndpointSubset{
+		{
+			NotReadyAddresses: []corev1.EndpointAddress{
+				{IP: "10.224.0.1"},
+			},
+			Ports: []corev1.EndpointPort{
+				{Port: 8080, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	f.addEndpoints(ep1)
+
+	svc := newService("svc-1")
+	svc.Annotations = map[string]string{AnnotationEmptyBackends: EmptyBackendsRemove}
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Port: 80, Protocol: corev1.ProtocolTCP, TargetPort: intstr.FromInt(8080)},
+	}
+	f.addService(svc)
+
+	a := map[string]string{
+		model.FromService(svc).ToKey(): "port-id-1",
+	}
+
+	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("ingress-ip-1", nil).Times(1)
+
+	f.runWith(func(g *PodLoadBalancerModelGenerator) {
+		m, err := g.GenerateModel(a)
+		assert.Nil(t, err)
+
+		anyIngressIP(t, m.Ingress, "ingress-ip-1", func(t *testing.T, i model.IngressIP) {
+			assert.Equal(t, 0, len(i.Ports))
+		})
+	})
+}
+
 func TestNetworkPolicyAssignments(t *testing.T) {
 	f := newPodGeneratorFixture(t)
 
@@ -0,0 +1,37 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PlacementPolicy decides whether a service may be placed at all.
+//
+// It allows enforcing rules which span several annotations or other parts of
+// the service and thus cannot be expressed by validating each annotation on
+// its own.
+type PlacementPolicy interface {
+	// Return an error to reject the service. The error is recorded as a
+	// conflict of the service and the service is not placed.
+	Validate(svc *corev1.Service, annotations ServiceAnnotations) error
+}
+
+// NoopPlacementPolicy accepts all services.
+type NoopPlacementPolicy struct{}
+
+func (p NoopPlacementPolicy) Validate(svc *corev1.Service, annotations ServiceAnnotations) error {
+	return nil
+}
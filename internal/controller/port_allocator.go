@@ -0,0 +1,120 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// AllocationOptions carries information about the service which is being
+// placed.
+type AllocationOptions struct {
+	// Key of the service; allocations of this service itself never conflict.
+	// Empty if the service must not reuse its own allocations.
+	ServiceKey string
+	// Shared listener group of the service, if any
+	SharedListenerGroup string
+	// Number of other services an L3 port may host at most for the service
+	// to be placed on it; zero means unlimited
+	MaxServices int
+}
+
+// PortAllocator decides on which L3 port a service is placed.
+type PortAllocator interface {
+	// Select one of the existing L3 ports for the given set of L4 ports.
+	//
+	// Return provisionNew = true to request a new L3 port instead. The
+	// existing ports are ordered by preference: by ID, or by age if a
+	// placement age is configured.
+	SelectPort(existing []model.L3Port, ports []model.L4Port, opts AllocationOptions) (portID string, provisionNew bool)
+}
+
+// FirstFitPortAllocator selects the first existing L3 port which can satisfy
+// all L4 port allocations and requests a new port if there is none.
+type FirstFitPortAllocator struct{}
+
+func (a FirstFitPortAllocator) SelectPort(existing []model.L3Port, ports []model.L4Port, opts AllocationOptions) (string, bool) {
+	for _, l3port := range existing {
+		if IsPortSuitableFor(l3port, ports, opts) {
+			return l3port.ID, false
+		}
+	}
+	return "", true
+}
+
+// ReuseOnlyPortAllocator selects the first existing L3 port which can
+// satisfy all L4 port allocations, like FirstFitPortAllocator, but never
+// requests new ports. Services which do not fit on any existing port cannot
+// be placed.
+type ReuseOnlyPortAllocator struct{}
+
+func (a ReuseOnlyPortAllocator) SelectPort(existing []model.L3Port, ports []model.L4Port, opts AllocationOptions) (string, bool) {
+	portID, provisionNew := FirstFitPortAllocator{}.SelectPort(existing, ports, opts)
+	if provisionNew {
+		return "", false
+	}
+	return portID, false
+}
+
+// Return true if the shared allocation is used by no other service than the
+// given one.
+func isSharedOnlyBy(shared model.SharedAllocation, serviceKey string) bool {
+	for _, user := range shared.Services {
+		if user != serviceKey {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the number of distinct services with allocations on the L3 port,
+// not counting the service with the given key.
+func serviceCount(l3port model.L3Port, exceptKey string) int {
+	services := map[string]bool{}
+	for _, user := range l3port.Allocations {
+		services[user] = true
+	}
+	for _, shared := range l3port.SharedAllocations {
+		for _, user := range shared.Services {
+			services[user] = true
+		}
+	}
+	delete(services, exceptKey)
+	return len(services)
+}
+
+// IsPortSuitableFor returns true if and only if the L3 port can satisfy all of
+// the L4 port allocations.
+//
+// L4 ports are compared by protocol and port number; an allocation of TCP/53
+// does not block UDP/53. L4 ports which are shared within a shared listener
+// group are only suitable for services of the same group. A port which hosts
+// opts.MaxServices other services already is not suitable either.
+func IsPortSuitableFor(l3port model.L3Port, ports []model.L4Port, opts AllocationOptions) bool {
+	if opts.MaxServices > 0 && serviceCount(l3port, opts.ServiceKey) >= opts.MaxServices {
+		return false
+	}
+	for _, l4port := range ports {
+		existing, inUse := l3port.Allocations[l4port]
+		if inUse && existing != opts.ServiceKey {
+			return false
+		}
+		shared, inUse := l3port.SharedAllocations[l4port]
+		if inUse && (opts.SharedListenerGroup == "" || shared.Group != opts.SharedListenerGroup) && !isSharedOnlyBy(shared, opts.ServiceKey) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	ostesting "github.com/cloudandheat/ch-k8s-lbaas/internal/openstack/testing"
+)
+
+type fixedPortAllocator struct {
+	portID       string
+	provisionNew bool
+
+	calls [][]model.L3Port
+}
+
+func (a *fixedPortAllocator) SelectPort(existing []model.L3Port, ports []model.L4Port, opts AllocationOptions) (string, bool) {
+	a.calls = append(a.calls, existing)
+	return a.portID, a.provisionNew
+}
+
+func newPortMapperWithAllocator(t *testing.T, allocator PortAllocator, availablePorts []string, opts ...PortMapperOption) (PortMapper, *ostesting.MockL3PortManager) {
+	l3portmanager := ostesting.NewMockL3PortManager()
+	l3portmanager.On("GetAvailablePorts").Return(availablePorts, nil).Times(1)
+	l3portmanager.On("ReleasePort", mock.Anything).Return(nil).Maybe()
+
+	portmapper, err := NewPortMapper(l3portmanager, append([]PortMapperOption{WithPortAllocator(allocator)}, opts...)...)
+	assert.Nil(t, err)
+	return portmapper, l3portmanager
+}
+
+func TestFirstFitPortAllocatorSelectsFirstSuitablePort(t *testing.T) {
+	a := FirstFitPortAllocator{}
+	ports := []model.L4Port{{Protocol: corev1.ProtocolTCP, Port: 80}}
+
+	portID, provisionNew := a.SelectPort([]model.L3Port{
+		{ID: "port-id-1", Allocations: map[model.L4Port]string{{Protocol: corev1.ProtocolTCP, Port: 80}: "default/other"}},
+		{ID: "port-id-2", Allocations: map[model.L4Port]string{{Protocol: corev1.ProtocolTCP, Port: 443}: "default/other"}},
+		{ID: "port-id-3", Allocations: map[model.L4Port]string{}},
+	}, ports, AllocationOptions{})
+	assert.Equal(t, "port-id-2", portID)
+	assert.False(t, provisionNew)
+}
+
+func TestFirstFitPortAllocatorRequestsNewPortIfNoneFits(t *testing.T) {
+	a := FirstFitPortAllocator{}
+	ports := []model.L4Port{{Protocol: corev1.ProtocolTCP, Port: 80}}
+
+	_, provisionNew := a.SelectPort([]model.L3Port{
+		{ID: "port-id-1", Allocations: map[model.L4Port]string{{Protocol: corev1.ProtocolTCP, Port: 80}: "default/other"}},
+	}, ports, AllocationOptions{})
+	assert.True(t, provisionNew)
+}
+
+func TestReuseOnlyPortAllocatorNeverRequestsNewPort(t *testing.T) {
+	a := ReuseOnlyPortAllocator{}
+	ports := []model.L4Port{{Protocol: corev1.ProtocolTCP, Port: 80}}
+
+	portID, provisionNew := a.SelectPort([]model.L3Port{
+		{ID: "port-id-1", Allocations: map[model.L4Port]string{{Protocol: corev1.ProtocolTCP, Port: 80}: "default/other"}},
+		{ID: "port-id-2", Allocations: map[model.L4Port]string{}},
+	}, ports, AllocationOptions{})
+	assert.Equal(t, "port-id-2", portID)
+	assert.False(t, provisionNew)
+
+	portID, provisionNew = a.SelectPort([]model.L3Port{
+		{ID: "port-id-1", Allocations: map[model.L4Port]string{{Protocol: corev1.ProtocolTCP, Port: 80}: "default/other"}},
+	}, ports, AllocationOptions{})
+	assert.Equal(t, "", portID)
+	assert.False(t, provisionNew)
+}
+
+func TestIsPortSuitableForTreatsProtocolsIndependently(t *testing.T) {
+	l3port := model.L3Port{
+		ID: "port-id-1",
+		Allocations: map[model.L4Port]string{
+			{Protocol: corev1.ProtocolTCP, Port: 53}: "default/tcp",
+		},
+		SharedAllocations: map[model.L4Port]model.SharedAllocation{
+			{Protocol: corev1.ProtocolUDP, Port: 80}: {Group: "group", Services: []string{"default/udp"}},
+		},
+	}
+
+	assert.False(t, IsPortSuitableFor(l3port, []model.L4Port{{Protocol: corev1.ProtocolTCP, Port: 53}}, AllocationOptions{}))
+	assert.True(t, IsPortSuitableFor(l3port, []model.L4Port{{Protocol: corev1.ProtocolUDP, Port: 53}}, AllocationOptions{}))
+	assert.False(t, IsPortSuitableFor(l3port, []model.L4Port{{Protocol: corev1.ProtocolUDP, Port: 80}}, AllocationOptions{}))
+	assert.True(t, IsPortSuitableFor(l3port, []model.L4Port{{Protocol: corev1.ProtocolTCP, Port: 80}}, AllocationOptions{}))
+}
+
+func TestIsPortSuitableForRespectsMaxServices(t *testing.T) {
+	l3port := model.L3Port{
+		ID: "port-id-1",
+		Allocations: map[model.L4Port]string{
+			{Protocol: corev1.ProtocolTCP, Port: 53}: "default/tcp",
+			{Protocol: corev1.ProtocolTCP, Port: 54}: "default/tcp",
+		},
+		SharedAllocations: map[model.L4Port]model.SharedAllocation{
+			{Protocol: corev1.ProtocolUDP, Port: 80}: {Group: "group", Services: []string{"default/udp"}},
+		},
+	}
+	ports := []model.L4Port{{Protocol: corev1.ProtocolTCP, Port: 8080}}
+
+	assert.True(t, IsPortSuitableFor(l3port, ports, AllocationOptions{}))
+	assert.True(t, IsPortSuitableFor(l3port, ports, AllocationOptions{MaxServices: 3}))
+	assert.False(t, IsPortSuitableFor(l3port, ports, AllocationOptions{MaxServices: 2}))
+	// the service itself does not count
+	assert.True(t, IsPortSuitableFor(l3port, ports, AllocationOptions{ServiceKey: "default/tcp", MaxServices: 2}))
+}
+
+func TestMapServiceUsesDecisionOfCustomAllocator(t *testing.T) {
+	allocator := &fixedPortAllocator{portID: "port-id-2"}
+	portmapper, l3portmanager := newPortMapperWithAllocator(t, allocator, []string{"port-id-2", "port-id-1"})
+	s := newPortMapperService("test-service")
+
+	_, err := portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	portID, err := portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", portID)
+
+	assert.Equal(t, 1, len(allocator.calls))
+	assert.Equal(t, "port-id-1", allocator.calls[0][0].ID)
+	assert.Equal(t, "port-id-2", allocator.calls[0][1].ID)
+	l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+}
+
+func TestMapServiceProvisionsPortIfCustomAllocatorRequestsIt(t *testing.T) {
+	allocator := &fixedPortAllocator{provisionNew: true}
+	portmapper, l3portmanager := newPortMapperWithAllocator(t, allocator, []string{"port-id-1"})
+	s := newPortMapperService("test-service")
+
+	l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	_, err := portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	portID, err := portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", portID)
+	l3portmanager.AssertExpectations(t)
+}
+
+func TestMapServiceRejectsUnknownPortFromCustomAllocator(t *testing.T) {
+	allocator := &fixedPortAllocator{portID: "port-id-x"}
+	portmapper, _ := newPortMapperWithAllocator(t, allocator, []string{"port-id-1"})
+	s := newPortMapperService("test-service")
+
+	_, err := portmapper.MapService(s)
+	assert.Equal(t, ErrNoSuitablePort, err)
+}
@@ -1,10 +1,17 @@
 package controller
 
 type L3PortManager interface {
-	// ProvisionPort creates a new L3 port and returns its id
-	ProvisionPort() (string, error)
-	// CleanUnusedPorts deletes all L3 ports that are currently not used
-	CleanUnusedPorts(usedPorts []string) error
+	// ProvisionPort creates a new L3 port and returns its id. The key of the
+	// service which caused the port to be created is recorded on the port,
+	// if the backend supports that.
+	ProvisionPort(serviceKey string) (string, error)
+	// CleanOrphanedPorts deletes all L3 ports of this cluster which are not
+	// among the given known ports and returns the IDs of the deleted ports.
+	// Ports of other clusters are left alone.
+	CleanOrphanedPorts(knownIDs []string) ([]string, error)
+	// ReleasePort deletes a single L3 port which is not used anymore. Ports
+	// which were not created by the port manager are left alone.
+	ReleasePort(portID string) error
 	// EnsureAgentsState ensures that all agents are configured correctly
 	EnsureAgentsState() error
 	// GetAvailablePorts returns all L3 ports that are available
@@ -17,18 +17,53 @@ package controller
 import (
 	"errors"
 	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/klog"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/openstack"
 )
 
 var (
-	ErrServiceNotMapped = errors.New("Service not mapped")
-	ErrNoSuitablePort   = errors.New("No suitable port available")
+	ErrServiceNotMapped     = errors.New("Service not mapped")
+	ErrNoSuitablePort       = errors.New("No suitable port available")
+	ErrReservedPort         = errors.New("Port is reserved")
+	ErrUnknownL3Port        = errors.New("L3 port not managed by the port mapper")
+	ErrL3PortInUse          = errors.New("Provisioned L3 port is already in use")
+	ErrNodePortConflict     = errors.New("NodePort is used more than once")
+	ErrUnsupportedProtocol  = errors.New("Protocol is not supported")
+	ErrPreferredPortMissing = errors.New("Preferred L3 port does not exist")
+	ErrSharedIPConflict     = errors.New("L4 ports conflict within the shared IP group")
+	ErrPortRangeUnsupported = errors.New("Port ranges are not supported by the backend layer")
+	ErrListenerGroupFull    = errors.New("Service does not fit on the L3 port of its shared listener group")
 )
 
+// Number of times ProvisionPort is called before giving up if it keeps
+// returning ports which are already in use.
+const maxProvisionAttempts = 3
+
+// Defaults for retrying ProvisionPort on transient backend errors
+const (
+	defaultProvisionRetryAttempts = 3
+	defaultProvisionRetryDelay    = time.Second
+	maxProvisionRetryDelay        = 30 * time.Second
+)
+
+// Highest L4 port number
+const maxL4Port = 65535
+
+// Protocols which the agents can forward
+var supportedProtocols = []corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.ProtocolSCTP}
+
+// Protocols counted when reporting the free capacity of an L3 port
+var capacityProtocols = []corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP}
+
 type PortMapper interface {
 	// Map the given service to a port
 	//
@@ -37,7 +72,23 @@ type PortMapper interface {
 	//
 	// Any errors occuring during port provisioning will be reported back by
 	// this method. If this method reports an error, the service is not mapped.
-	MapService(svc *corev1.Service) error
+	// Otherwise, the result tells where the service ended up and whether a
+	// port had to be provisioned for it.
+	MapService(svc *corev1.Service) (model.MapResult, error)
+
+	// Map all given services
+	//
+	// Services are mapped in the order of their identifiers, independent of
+	// the order in which they are passed. This makes the outcome
+	// reproducible if several services prefer the same port, but cannot all
+	// be placed on it. Services which fail to map do not prevent the others
+	// from being mapped; all errors are returned together.
+	MapServices(svcs []*corev1.Service) error
+
+	// Return the number of L3 ports which would be provisioned if the given
+	// services were passed to MapServices, without changing any state or
+	// provisioning anything.
+	EstimateProvisions(svcs []*corev1.Service) (int, error)
 
 	// Remove all allocations of the service from the bookkeeping and release
 	// L3 ports which are not used anymore
@@ -51,10 +102,18 @@ type PortMapper interface {
 	// Returns ErrServiceNotMapped if the service is currently not mapped.
 	GetServiceL3Port(id model.ServiceIdentifier) (string, error)
 
+	// Return the L4 ports allocated to the service, in the order of the
+	// service's ports
+	//
+	// Returns ErrServiceNotMapped if the service is currently not mapped.
+	GetServiceL4Ports(id model.ServiceIdentifier) ([]model.L4Port, error)
+
 	GetModel() map[string]string
 
 	// Return the list of IDs of the L3 ports which currently have at least one
-	// mapped service.
+	// mapped service or are kept as warm idle ports.
+	//
+	// All other ports are released by the port mapper.
 	GetUsedL3Ports() ([]string, error)
 
 	// Set the list with available L3 port IDs.
@@ -63,19 +122,297 @@ type PortMapper interface {
 	// of IDs passed to this method will be unmapped. The identifiers of the
 	// affected services will be returned in the return value.
 	SetAvailableL3Ports(portIDs []string) ([]model.ServiceIdentifier, error)
+
+	// Like SetAvailableL3Ports, but also suggest one of the remaining L3
+	// ports for each evicted service.
+	//
+	// The suggestions are chosen by the port allocator and are free of
+	// conflicts with the services which are still mapped and with each
+	// other, provided that the services are mapped again unchanged and in
+	// the order of their identifiers. A service which fits on none of the
+	// remaining ports gets no suggestion. No service is mapped by this
+	// method.
+	SetAvailableL3PortsWithSuggestions(portIDs []string) ([]model.Eviction, error)
+	// Return the number of L3 ports currently held by the port mapper,
+	// including ports which have no allocations left but were not released
+	// yet.
+	GetL3PortCount() int
+
+	// Return the number of L4 ports in use across all L3 ports, by protocol.
+	GetAllocationCounts() map[corev1.Protocol]int
+
+	// Return the number of L4 ports in use on each L3 port currently held
+	// by the port mapper, by L3 port ID.
+	GetAllocationCountsByPort() map[string]int
+
+	// Return how many more L4 ports the L3 port can host: the number of
+	// TCP and UDP ports up to the configured ceiling which are neither
+	// allocated nor reserved. Degraded ports have no free capacity.
+	//
+	// Returns ErrUnknownL3Port if the port is not held by the port mapper.
+	GetPortFreeCapacity(portID string) (int, error)
+
+	// Return all L3 ports held by the port mapper together with their
+	// external address and the services mapped to them.
+	//
+	// The result is ordered by port ID and, within a port, by service key.
+	GetFullAssignment() ([]model.FIPAssignment, error)
+
+	// Return the number of services which could not be mapped the last time
+	// they were attempted because no suitable L3 port was available.
+	GetUnplaceableServiceCount() int
+
+	// Return the current placement conflicts, ordered by service key.
+	//
+	// A service is in conflict if it was relocated away from its preferred
+	// port and is still on the port it was relocated to, or if its last
+	// mapping attempt failed.
+	GetConflicts() []model.Conflict
+
+	// Mark the L3 port as degraded and move all services away from it.
+	//
+	// Degraded ports are never selected for any service until they are
+	// cleared with ClearDegradedPort. Returns the services which were
+	// moved. If a service cannot be moved, the services moved so far are
+	// returned together with the error.
+	EvacuatePort(portID string) ([]model.ServiceIdentifier, error)
+
+	// Allow a port previously marked as degraded to be used again.
+	ClearDegradedPort(portID string)
+
+	// Check that all L3 ports in use still exist in the backend and move the
+	// services of vanished ports to other ports.
+	//
+	// Returns the services which were moved. If a service cannot be moved,
+	// the services moved so far are returned together with the error.
+	RevalidatePorts() ([]model.ServiceIdentifier, error)
+
+	// Repack the services onto fewer L3 ports.
+	//
+	// A port is only emptied if all of its services fit on the remaining
+	// ports; otherwise its services stay where they are. Returns the
+	// services whose L3 port changed.
+	Consolidate() ([]model.ServiceIdentifier, error)
+
+	// Return up to n of the most recent allocation state transitions,
+	// oldest first.
+	GetRecentTransitions(n int) []model.Transition
+
+	// Return a counter which is incremented whenever the allocations
+	// change: a service is mapped, moved or unmapped, or evicted by
+	// SetAvailableL3Ports. Calls which change nothing, like mapping an
+	// unchanged service again, leave it as it is.
+	Generation() uint64
 }
 
 type PortMapperImpl struct {
 	l3manager L3PortManager
+	publisher EventPublisher
+	reserved  map[int32]bool
+	allocator PortAllocator
+	policy    PlacementPolicy
 	services  map[string]model.ServiceModel
 	l3ports   map[string]model.L3Port
+	degraded  map[string]bool
+	// current placement conflicts by service key
+	conflicts map[string]model.Conflict
+	// point in time at which an L3 port was first seen without allocations
+	idleSince map[string]time.Time
+	now       func() time.Time
+	sleep     func(time.Duration)
+	// recent allocation state transitions for post-mortem analysis
+	transitions *transitionLog
+	// incremented on every change of the allocations
+	generation uint64
+	// set on copies which only simulate provisioning, see EstimateProvisions
+	estimating bool
+
+	trustPreferredPort  bool
+	idlePortFloor       int
+	idlePortGracePeriod time.Duration
+	placementAge        PlacementAge
+	l4PortCeiling       int32
+	maxServicesPerPort  int
+	provisionAttempts   int
+	provisionRetryDelay time.Duration
+	missingPortPolicy   MissingPortPolicy
+	portRanges          bool
 }
 
-func NewPortMapper(l3manager L3PortManager) (PortMapper, error) {
+type PortMapperOption func(*PortMapperImpl)
+
+// PlacementAge decides which of the equally suitable L3 ports is preferred
+// when placing a service.
+type PlacementAge string
+
+const (
+	// Prefer ports by ID (the default)
+	PlacementAgeAny PlacementAge = ""
+	// Prefer the oldest ports, so that newer ones drain and can be released
+	PlacementAgeOldest PlacementAge = "oldest"
+	// Prefer the newest ports
+	PlacementAgeNewest PlacementAge = "newest"
+)
+
+// MissingPortPolicy decides what happens to a service which is not mapped yet
+// and whose annotation names an L3 port which does not exist anymore, e.g.
+// because the port was deleted while the controller was restarting.
+type MissingPortPolicy string
+
+const (
+	// Map the service to another port (the default)
+	MissingPortRemap MissingPortPolicy = "remap"
+	// Refuse to map the service with ErrPreferredPortMissing
+	MissingPortFail MissingPortPolicy = "fail"
+)
+
+// Publish allocation changes to the given EventPublisher. By default, changes
+// are not published anywhere.
+func WithEventPublisher(publisher EventPublisher) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		c.publisher = publisher
+	}
+}
+
+// Never allocate the given L4 ports. Services requesting any of them are
+// rejected with ErrReservedPort.
+func WithReservedPorts(ports []int32) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		for _, port := range ports {
+			c.reserved[port] = true
+		}
+	}
+}
+
+// Use the given PortAllocator to place services on L3 ports instead of the
+// FirstFitPortAllocator.
+func WithPortAllocator(allocator PortAllocator) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		c.allocator = allocator
+	}
+}
+
+// Check each service against the given PlacementPolicy before placing it. By
+// default, all services with valid annotations are accepted.
+func WithPlacementPolicy(policy PlacementPolicy) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		c.policy = policy
+	}
+}
+
+// Allow services to bring a preferred port which is not known to the port
+// mapper (e.g. via the annotation). By default, such ports are not taken over
+// and the service is placed on a different port instead.
+func WithTrustPreferredPort(trust bool) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		c.trustPreferredPort = trust
+	}
+}
+
+// Keep at least n L3 ports without allocations around instead of releasing
+// them, so that new services can be mapped without provisioning a port.
+func WithIdlePortFloor(n int) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		c.idlePortFloor = n
+	}
+}
+
+// Only release L3 ports which have been without allocations for at least the
+// given duration.
+func WithIdlePortGracePeriod(d time.Duration) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		c.idlePortGracePeriod = d
+	}
+}
+
+// Prefer older or newer L3 ports when placing services. Ports created outside
+// of the port mapper count as the oldest ones; ties are broken by ID.
+func WithPlacementAge(age PlacementAge) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		c.placementAge = age
+	}
+}
+
+// Only count L4 ports up to and including the given port number when
+// reporting the free capacity of an L3 port. Zero means all ports.
+func WithL4PortCeiling(ceiling int32) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		if ceiling > 0 && ceiling < maxL4Port {
+			c.l4PortCeiling = ceiling
+		} else {
+			c.l4PortCeiling = maxL4Port
+		}
+	}
+}
+
+// Do not place a service on an L3 port which hosts the given number of
+// services already. Zero means unlimited. The services of a shared IP group
+// are never split up to respect the limit.
+func WithMaxServicesPerPort(n int) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		c.maxServicesPerPort = n
+	}
+}
+
+// Call ProvisionPort up to the given number of times if it fails with a
+// transient backend error, waiting the given delay before the first retry and
+// twice as long before each further one (up to 30s). Attempts below 1 mean 1.
+func WithProvisionRetries(attempts int, delay time.Duration) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		c.provisionAttempts = max(attempts, 1)
+		c.provisionRetryDelay = delay
+	}
+}
+
+// Decide how services whose annotation names a missing L3 port are restored,
+// see MissingPortPolicy. The default is MissingPortRemap.
+func WithMissingPortPolicy(policy MissingPortPolicy) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		c.missingPortPolicy = policy
+	}
+}
+
+// Keep the last n allocation state transitions instead of the default of 100.
+// Zero disables the transition log.
+func WithTransitionLogSize(n int) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		c.transitions = newTransitionLog(n)
+	}
+}
+
+// Accept services with a port range annotation. Only the pod backend layer
+// forwards port ranges, so they are rejected by default instead of taking up
+// ports which never receive traffic.
+func WithPortRanges(enabled bool) PortMapperOption {
+	return func(c *PortMapperImpl) {
+		c.portRanges = enabled
+	}
+}
+
+func NewPortMapper(l3manager L3PortManager, opts ...PortMapperOption) (PortMapper, error) {
 	portManager := &PortMapperImpl{
 		l3manager: l3manager,
+		publisher: NoopEventPublisher{},
+		reserved:  make(map[int32]bool),
+		allocator: FirstFitPortAllocator{},
+		policy:    NoopPlacementPolicy{},
 		services:  make(map[string]model.ServiceModel),
 		l3ports:   make(map[string]model.L3Port),
+		degraded:  make(map[string]bool),
+
+		conflicts: make(map[string]model.Conflict),
+		idleSince: make(map[string]time.Time),
+		now:       time.Now,
+		sleep:     time.Sleep,
+
+		transitions:         newTransitionLog(defaultTransitionLogSize),
+		l4PortCeiling:       maxL4Port,
+		provisionAttempts:   defaultProvisionRetryAttempts,
+		provisionRetryDelay: defaultProvisionRetryDelay,
+		missingPortPolicy:   MissingPortRemap,
+	}
+	for _, opt := range opts {
+		opt(portManager)
 	}
 
 	// Load all available ports
@@ -85,7 +422,7 @@ func NewPortMapper(l3manager L3PortManager) (PortMapper, error) {
 	}
 
 	for _, l3portID := range l3portIDs {
-		portManager.emplaceL3Port(l3portID)
+		portManager.emplaceL3Port(l3portID, time.Time{})
 	}
 
 	return portManager, nil
@@ -95,68 +432,456 @@ func (c *PortMapperImpl) getServiceKey(svc *corev1.Service) string {
 	return model.FromService(svc).ToKey()
 }
 
-func (c *PortMapperImpl) createNewL3Port() (string, error) {
-	portID, err := c.l3manager.ProvisionPort()
+func newAllocationEvent(key string, svcModel model.ServiceModel) model.AllocationEvent {
+	id, err := model.FromKey(key)
 	if err != nil {
-		return "", err
+		panic(fmt.Sprintf("internal error: key %q is not valid", key))
 	}
-	klog.Infof("created new port with portID=%v", portID)
-	c.emplaceL3Port(portID)
-	return portID, nil
+	ports := make([]model.L4Port, len(svcModel.Ports))
+	copy(ports, svcModel.Ports)
+	return model.AllocationEvent{
+		Service:  id,
+		L3PortID: svcModel.L3PortID,
+		Ports:    ports,
+	}
+}
+
+func (c *PortMapperImpl) recordTransition(transitionType model.TransitionType, key string, portID string) {
+	id, _ := model.FromKey(key)
+	c.transitions.record(model.Transition{
+		Time:     c.now(),
+		Type:     transitionType,
+		Service:  id,
+		L3PortID: portID,
+	})
 }
 
-func (c *PortMapperImpl) emplaceL3Port(portID string) {
+func logPublishError(kind string, key string, err error) {
+	if err != nil {
+		klog.Warningf("failed to publish %s event for service %q: %s", kind, key, err.Error())
+	}
+}
+
+// Provision a new L3 port through the backend.
+//
+// If the backend returns a port which is already known and in use (e.g.
+// because of a race with another controller), its allocations are left
+// untouched and provisioning is retried.
+func (c *PortMapperImpl) createNewL3Port(serviceKey string) (string, error) {
+	for attempt := 0; attempt < maxProvisionAttempts; attempt++ {
+		portID, err := c.provisionPort(serviceKey)
+		if err != nil {
+			return "", err
+		}
+		if existing, known := c.l3ports[portID]; known {
+			if !existing.IsUnused() {
+				klog.Warningf("provisioned port %s is already in use, retrying", portID)
+				continue
+			}
+			klog.Infof("provisioned port %s is already known", portID)
+			return portID, nil
+		}
+		klog.Infof("created new port with portID=%v", portID)
+		c.emplaceL3Port(portID, c.now())
+		c.recordTransition(model.TransitionProvision, serviceKey, portID)
+		return portID, nil
+	}
+	return "", ErrL3PortInUse
+}
+
+// Call ProvisionPort, retrying with exponential backoff as long as it fails
+// with a transient error.
+func (c *PortMapperImpl) provisionPort(serviceKey string) (string, error) {
+	delay := c.provisionRetryDelay
+	for attempt := 1; ; attempt++ {
+		portID, err := c.l3manager.ProvisionPort(serviceKey)
+		if !c.estimating {
+			countProvisioningAttempt(err)
+		}
+		if err == nil {
+			return portID, nil
+		}
+		if !openstack.IsRetryableError(err) {
+			return "", err
+		}
+		if attempt >= c.provisionAttempts {
+			return "", fmt.Errorf("provisioning a port failed after %d attempts: %w", attempt, err)
+		}
+
+		klog.Warningf("provisioning a port for service %q failed (attempt %d of %d), retrying in %s: %s",
+			serviceKey, attempt, c.provisionAttempts, delay, err.Error())
+		c.sleep(delay)
+		delay = min(2*delay, maxProvisionRetryDelay)
+	}
+}
+
+func (c *PortMapperImpl) emplaceL3Port(portID string, createdAt time.Time) {
 	c.l3ports[portID] = model.L3Port{
-		Allocations: make(map[int32]string),
+		ID:                portID,
+		CreatedAt:         createdAt,
+		Allocations:       make(map[model.L4Port]string),
+		SharedAllocations: make(map[model.L4Port]model.SharedAllocation),
 	}
 }
 
-// An L3 port is suitable for a set of L4 port allocations if and only if it can
-// satisfy all of them.
-func (c *PortMapperImpl) isPortSuitableFor(l3port model.L3Port, ports []model.L4Port, serviceKey string) bool {
-	for _, l4port := range ports {
-		existing, inUse := l3port.Allocations[l4port.Port]
-		if inUse && existing != serviceKey {
-			return false
+// Record the service model and add its allocations to its L3 port.
+func (c *PortMapperImpl) allocate(key string, svcModel model.ServiceModel) {
+	c.generation++
+	c.services[key] = svcModel
+	delete(c.idleSince, svcModel.L3PortID)
+	l3port := c.l3ports[svcModel.L3PortID]
+	klog.Infof("Lookup l3port[%v]=%v", svcModel.L3PortID, l3port)
+	addAllocations(l3port, key, svcModel)
+}
+
+// Add the allocations of the service to the L3 port.
+func addAllocations(l3port model.L3Port, key string, svcModel model.ServiceModel) {
+	for _, port := range svcModel.Ports {
+		klog.Infof("Allocating port %v to service %v", port, key)
+		if svcModel.SharedListenerGroup == "" {
+			l3port.Allocations[port] = key
+			continue
 		}
+		shared := l3port.SharedAllocations[port]
+		shared.Group = svcModel.SharedListenerGroup
+		shared.Services = append(shared.Services, key)
+		l3port.SharedAllocations[port] = shared
 	}
-	return true
 }
 
-// Check if any of the managed L3 ports is suitable for the given set of L4
-// ports and return the first one which matches.
+// Return all managed L3 ports, ordered by ID.
+func (c *PortMapperImpl) sortedL3Ports() []model.L3Port {
+	result := make([]model.L3Port, 0, len(c.l3ports))
+	for _, l3port := range c.l3ports {
+		result = append(result, l3port)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// Return the L3 ports which may be offered to the allocator, in the order of
+// preference.
+func (c *PortMapperImpl) placementCandidates() []model.L3Port {
+	candidates := []model.L3Port{}
+	for _, l3port := range c.sortedL3Ports() {
+		if !c.degraded[l3port.ID] {
+			candidates = append(candidates, l3port)
+		}
+	}
+	switch c.placementAge {
+	case PlacementAgeOldest:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].CreatedAt.Before(candidates[j].CreatedAt)
+		})
+	case PlacementAgeNewest:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].CreatedAt.After(candidates[j].CreatedAt)
+		})
+	}
+	return candidates
+}
+
+// Return the non-degraded L3 port on which other services than the one with
+// the given key hold the shared listener group, if any.
+func (c *PortMapperImpl) sharedListenerPortOf(key string, group string) (string, bool) {
+	if group == "" {
+		return "", false
+	}
+	for _, l3port := range c.sortedL3Ports() {
+		if c.degraded[l3port.ID] {
+			continue
+		}
+		for _, shared := range l3port.SharedAllocations {
+			if shared.Group == group && !isSharedOnlyBy(shared, key) {
+				return l3port.ID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Let the allocator pick an L3 port for the service with the given key and
+// set of L4 ports and provision a new one if requested.
 //
-// If none matches, returns an ErrNoSuitablePort.
-func (c *PortMapperImpl) findL3PortFor(ports []model.L4Port) (string, error) {
-	for portID, l3port := range c.l3ports {
-		if c.isPortSuitableFor(l3port, ports, "") {
-			return portID, nil
+// A member of a shared listener group which is placed already always goes to
+// the port of the group, so that all members share the listener; if it does
+// not fit there, returns an ErrListenerGroupFull. Degraded ports are not
+// offered to the allocator. If the allocator selects a port which is not
+// managed by the port mapper or is degraded, returns an ErrNoSuitablePort.
+func (c *PortMapperImpl) selectL3PortFor(key string, ports []model.L4Port, group string) (string, error) {
+	if groupPortID, ok := c.sharedListenerPortOf(key, group); ok {
+		opts := AllocationOptions{ServiceKey: key, SharedListenerGroup: group, MaxServices: c.maxServicesPerPort}
+		if !IsPortSuitableFor(c.l3ports[groupPortID], ports, opts) {
+			return "", fmt.Errorf("%w: %q", ErrListenerGroupFull, group)
+		}
+		return groupPortID, nil
+	}
+
+	portID, provisionNew := c.allocator.SelectPort(
+		c.placementCandidates(),
+		ports,
+		AllocationOptions{SharedListenerGroup: group, MaxServices: c.maxServicesPerPort},
+	)
+	if provisionNew {
+		return c.createNewL3Port(key)
+	}
+	if _, known := c.l3ports[portID]; !known || c.degraded[portID] {
+		return "", ErrNoSuitablePort
+	}
+	return portID, nil
+}
+
+// Return the keys of the mapped services of the shared IP group other than
+// the service with the given key, ordered.
+func (c *PortMapperImpl) sharedIPMembers(key string, sharedIPKey string) []string {
+	members := []string{}
+	for otherKey, other := range c.services {
+		if otherKey != key && other.SharedIPKey == sharedIPKey {
+			members = append(members, otherKey)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Return the L3 port of the other mapped services of the shared IP group of
+// the service, or the empty string if there are none.
+//
+// If the service does not fit next to the other services on that port, a
+// port on which the whole group fits is returned together with the keys of
+// the other services, which the caller has to move there once the service
+// itself is placed. Returns an ErrSharedIPConflict if the L4 ports of the
+// service conflict with those of the group itself, because then no port fits
+// them.
+func (c *PortMapperImpl) sharedIPPortFor(key string, svcModel model.ServiceModel) (string, []string, error) {
+	if svcModel.SharedIPKey == "" {
+		return "", nil, nil
+	}
+	members := c.sharedIPMembers(key, svcModel.SharedIPKey)
+	if len(members) == 0 {
+		return "", nil, nil
+	}
+
+	group := model.L3Port{
+		Allocations:       make(map[model.L4Port]string),
+		SharedAllocations: make(map[model.L4Port]model.SharedAllocation),
+	}
+	for _, member := range members {
+		addAllocations(group, member, c.services[member])
+	}
+	opts := AllocationOptions{ServiceKey: key, SharedListenerGroup: svcModel.SharedListenerGroup}
+	if !IsPortSuitableFor(group, svcModel.Ports, opts) {
+		return "", nil, fmt.Errorf("%w: %q", ErrSharedIPConflict, svcModel.SharedIPKey)
+	}
+
+	portID := c.services[members[0]].L3PortID
+	opts.MaxServices = c.maxServicesPerPort
+	if !c.degraded[portID] && IsPortSuitableFor(c.l3ports[portID], svcModel.Ports, opts) {
+		return portID, nil, nil
+	}
+
+	newPortID, err := c.selectL3PortFor(key, c.withMemberPorts(svcModel.Ports, members), svcModel.SharedListenerGroup)
+	if err != nil {
+		return "", nil, err
+	}
+	return newPortID, members, nil
+}
+
+// Return the L4 ports of the service followed by those of the given members
+// of its shared IP group.
+func (c *PortMapperImpl) withMemberPorts(ports []model.L4Port, members []string) []model.L4Port {
+	result := slices.Clone(ports)
+	for _, member := range members {
+		result = append(result, c.services[member].Ports...)
+	}
+	return result
+}
+
+// Move the given members of the shared IP group of the service with the
+// given key onto the L3 port of that service and return them.
+func (c *PortMapperImpl) moveSharedIPMembers(key string, sharedIPKey string, members []string, portID string) []model.ServiceIdentifier {
+	reason := fmt.Sprintf("moved together with service %q of shared IP group %q", key, sharedIPKey)
+	moved := make([]model.ServiceIdentifier, 0, len(members))
+	for _, member := range members {
+		memberModel := c.services[member]
+		klog.Infof("moving service %q from port %s to %s: %s", member, memberModel.L3PortID, portID, reason)
+		c.releaseAllocations(member)
+		memberModel.L3PortID = portID
+		c.allocate(member, memberModel)
+		c.setConflict(member, model.ConflictRelocated, portID, reason)
+
+		event := newAllocationEvent(member, memberModel)
+		moved = append(moved, event.Service)
+		c.recordTransition(model.TransitionMap, member, portID)
+		logPublishError("mapped", member, c.publisher.PublishMapped(event))
+	}
+	return moved
+}
+
+// Return an ErrNodePortConflict if a NodePort is used more than once by the
+// service or is already used by another mapped service. Traffic would end up
+// at the wrong backends otherwise.
+func (c *PortMapperImpl) checkNodePorts(key string, nodePorts []model.L4Port) error {
+	seen := make(map[model.L4Port]bool, len(nodePorts))
+	for _, nodePort := range nodePorts {
+		if seen[nodePort] {
+			return fmt.Errorf("%w: %s %d is used twice by the service", ErrNodePortConflict, nodePort.Protocol, nodePort.Port)
 		}
+		seen[nodePort] = true
 	}
 
-	return "", ErrNoSuitablePort
+	for otherKey, other := range c.services {
+		if otherKey == key {
+			continue
+		}
+		for _, nodePort := range other.NodePorts {
+			if seen[nodePort] {
+				return fmt.Errorf("%w: %s %d is also used by service %q", ErrNodePortConflict, nodePort.Protocol, nodePort.Port, otherKey)
+			}
+		}
+	}
+	return nil
 }
 
-func (c *PortMapperImpl) MapService(svc *corev1.Service) error {
+func (c *PortMapperImpl) MapService(svc *corev1.Service) (model.MapResult, error) {
 	var err error
 	id := model.FromService(svc)
 	key := id.ToKey()
 
+	annotations, err := parseServiceAnnotations(svc)
+	if err != nil {
+		c.setConflict(key, model.ConflictRejected, "", err.Error())
+		return model.MapResult{}, err
+	}
+
+	if err := c.policy.Validate(svc, annotations); err != nil {
+		klog.Warningf("refusing to map service %q: %s", key, err.Error())
+		c.setConflict(key, model.ConflictRejected, "", err.Error())
+		return model.MapResult{}, err
+	}
+
 	svcModel := model.ServiceModel{
-		L3PortID: "",
-		Ports:    make([]model.L4Port, len(svc.Spec.Ports)),
+		L3PortID:              "",
+		Ports:                 make([]model.L4Port, len(svc.Spec.Ports)),
+		SharedListenerGroup:   annotations.SharedListenerGroup,
+		SharedIPKey:           annotations.SharedIPKey,
+		ExternalTrafficPolicy: getExternalTrafficPolicy(svc),
 	}
 	for i, k8sPort := range svc.Spec.Ports {
+		if !slices.Contains(supportedProtocols, k8sPort.Protocol) {
+			err := fmt.Errorf("%w: %q", ErrUnsupportedProtocol, k8sPort.Protocol)
+			c.setConflict(key, model.ConflictRejected, "", err.Error())
+			return model.MapResult{}, err
+		}
+		if c.reserved[k8sPort.Port] {
+			err := fmt.Errorf("%w: %d", ErrReservedPort, k8sPort.Port)
+			c.setConflict(key, model.ConflictRejected, "", err.Error())
+			return model.MapResult{}, err
+		}
 		svcModel.Ports[i] = model.L4Port{Protocol: k8sPort.Protocol, Port: k8sPort.Port}
+		if k8sPort.NodePort != 0 {
+			svcModel.NodePorts = append(svcModel.NodePorts, model.L4Port{Protocol: k8sPort.Protocol, Port: k8sPort.NodePort})
+		}
+	}
+	if annotations.PortRange != nil && !c.portRanges {
+		err := fmt.Errorf("%w: %s", ErrPortRangeUnsupported, AnnotationPortRange)
+		c.setConflict(key, model.ConflictRejected, "", err.Error())
+		return model.MapResult{}, err
+	}
+	if annotations.PortRange != nil {
+		// the range is allocated together with the service ports, so it is
+		// either placed as a whole or not at all
+		for _, l4port := range annotations.PortRange.L4Ports() {
+			if c.reserved[l4port.Port] {
+				err := fmt.Errorf("%w: %d", ErrReservedPort, l4port.Port)
+				c.setConflict(key, model.ConflictRejected, "", err.Error())
+				return model.MapResult{}, err
+			}
+			if slices.Contains(svcModel.Ports, l4port) {
+				err := fmt.Errorf("invalid %s annotation: overlaps with service port %s/%d", AnnotationPortRange, l4port.Protocol, l4port.Port)
+				c.setConflict(key, model.ConflictRejected, "", err.Error())
+				return model.MapResult{}, err
+			}
+			svcModel.Ports = append(svcModel.Ports, l4port)
+		}
+	}
+	if err := c.checkNodePorts(key, svcModel.NodePorts); err != nil {
+		klog.Warningf("refusing to map service %q: %s", key, err.Error())
+		c.setConflict(key, model.ConflictRejected, "", err.Error())
+		return model.MapResult{}, err
 	}
 
 	existingSvc, hasExistingService := c.services[key]
+	// port which is known to be gone from the backend already
+	stalePortID := ""
+	if hasExistingService {
+		// if nothing changed and the port is still there, there is nothing to
+		// do; a service left behind on a degraded port is relocated below
+		svcModel.L3PortID = existingSvc.L3PortID
+		if reflect.DeepEqual(existingSvc, svcModel) && !c.degraded[existingSvc.L3PortID] {
+			exists, err := c.l3manager.CheckPortExists(existingSvc.L3PortID)
+			if err != nil {
+				return model.MapResult{}, err
+			}
+			if exists {
+				klog.V(4).Infof("service %q is unchanged, keeping port %s", key, existingSvc.L3PortID)
+				return model.MapResult{Outcome: model.MapOutcomeUnchanged, L3PortID: existingSvc.L3PortID}, nil
+			}
+			klog.Warningf(
+				"relocating service %q because it has an invalid port %s",
+				key,
+				existingSvc.L3PortID)
+			stalePortID = existingSvc.L3PortID
+		}
+		svcModel.L3PortID = ""
+	}
+
+	// the other services of the shared IP group, if any, determine the port;
+	// members which have to follow the service are only moved once the
+	// service itself is placed
+	portCount := len(c.l3ports)
+	groupPortID, groupMembers, err := c.sharedIPPortFor(key, svcModel)
+	if err != nil {
+		if errors.Is(err, ErrSharedIPConflict) {
+			klog.Warningf("refusing to map service %q: %s", key, err.Error())
+			c.setConflict(key, model.ConflictRejected, "", err.Error())
+		} else if errors.Is(err, ErrNoSuitablePort) {
+			c.setConflict(key, model.ConflictCapacityBlocked, "", "no L3 port with sufficient free capacity is available")
+		}
+		return model.MapResult{}, err
+	}
+	provisioned := len(c.l3ports) > portCount
+
 	var portID string
+	// reason for moving the service away from its preferred port, if any
+	relocation := ""
 	if hasExistingService {
 		portID = existingSvc.L3PortID
 	}
+	if groupPortID != "" {
+		portID = groupPortID
+	}
 	if portID == "" {
-		portID = getPortAnnotation(svc)
+		portID = annotations.InboundPort
+	}
+	if listenerPortID, ok := c.sharedListenerPortOf(key, svcModel.SharedListenerGroup); ok && groupPortID == "" && portID != "" && portID != listenerPortID {
+		// the members of a shared listener group must share the listener
+		relocation = fmt.Sprintf("shared listener group %q is on port %s", svcModel.SharedListenerGroup, listenerPortID)
+		portID = ""
+	}
+	if portID != "" && portID == stalePortID {
+		relocation = fmt.Sprintf("port %s does not exist anymore", portID)
+		portID = ""
+	}
+	if c.degraded[portID] {
+		klog.Warningf(
+			"relocating service %q because its port %s is degraded",
+			key,
+			portID)
+		relocation = fmt.Sprintf("port %s is degraded", portID)
+		portID = ""
 	}
 
 	if portID != "" {
@@ -165,7 +890,7 @@ func (c *PortMapperImpl) MapService(svc *corev1.Service) error {
 		// Check if port exists in backend
 		exists, err := c.l3manager.CheckPortExists(portID)
 		if err != nil {
-			return err
+			return model.MapResult{}, err
 		}
 
 		if exists {
@@ -173,26 +898,47 @@ func (c *PortMapperImpl) MapService(svc *corev1.Service) error {
 			if known {
 				// the port is already known and thus may have allocations. we have
 				// to check if any allocations conflict
-				if !c.isPortSuitableFor(l3port, svcModel.Ports, key) {
+				opts := AllocationOptions{ServiceKey: key, SharedListenerGroup: svcModel.SharedListenerGroup, MaxServices: c.maxServicesPerPort}
+				if !IsPortSuitableFor(l3port, svcModel.Ports, opts) {
 					// and they do! so we have to relocate the service to a
 					// different port
-					// TODO: it would be good if that caused an event on the Service
 					klog.Warningf(
 						"relocating service %q to a new port due to conflict on old port %s",
 						key,
 						portID)
+					relocation = fmt.Sprintf("L4 ports conflict with other services on port %s", portID)
+					if c.maxServicesPerPort > 0 && serviceCount(l3port, key) >= c.maxServicesPerPort {
+						relocation = fmt.Sprintf("port %s hosts the maximum of %d services", portID, c.maxServicesPerPort)
+					}
 					portID = ""
 				}
-			} else {
+			} else if c.trustPreferredPort {
 				// the port is not known yet, emplace an empty l3 port with the given ID
-				c.emplaceL3Port(portID)
+				c.emplaceL3Port(portID, time.Time{})
+			} else {
+				// the port exists, but was not provided to us by the backend;
+				// we must not take it over
+				klog.Warningf(
+					"relocating service %q because its port %s is not managed by us",
+					key,
+					portID)
+				relocation = fmt.Sprintf("port %s is not managed by the controller", portID)
+				portID = ""
 			}
+		} else if !hasExistingService && c.missingPortPolicy == MissingPortFail {
+			klog.Warningf(
+				"refusing to map service %q because its port %s does not exist anymore",
+				key,
+				portID)
+			c.setConflict(key, model.ConflictRejected, "", fmt.Sprintf("port %s does not exist anymore", portID))
+			return model.MapResult{}, fmt.Errorf("%w: %s", ErrPreferredPortMissing, portID)
 		} else {
 			// the port does not exist in the backend, we need to relocate the service
 			klog.Warningf(
 				"relocating service %q because it has an invalid port %s",
 				key,
 				portID)
+			relocation = fmt.Sprintf("port %s does not exist anymore", portID)
 			portID = ""
 		}
 	}
@@ -203,43 +949,177 @@ func (c *PortMapperImpl) MapService(svc *corev1.Service) error {
 	// if the service did not give us a specific port to use, we have to look
 	// further
 	if portID == "" {
-		// second, try to find an existing port with non-conflicting allocations
-		portID, err = c.findL3PortFor(svcModel.Ports)
-		if err == ErrNoSuitablePort {
-			// if no existing port can fit the bill, we move on to create a new
-			// port
-			portID, err = c.createNewL3Port()
-			if err != nil {
-				// if that fails too, we simply cannot map the service.
-				return err
+		// second, let the allocator find an existing port with
+		// non-conflicting allocations or request a new port
+		knownPorts := len(c.l3ports)
+		portID, err = c.selectL3PortFor(key, c.withMemberPorts(svcModel.Ports, groupMembers), svcModel.SharedListenerGroup)
+		provisioned = len(c.l3ports) > knownPorts
+		if err != nil {
+			// we simply cannot map the service.
+			if errors.Is(err, ErrNoSuitablePort) {
+				c.setConflict(key, model.ConflictCapacityBlocked, "", "no L3 port with sufficient free capacity is available")
+			} else if errors.Is(err, ErrListenerGroupFull) {
+				c.setConflict(key, model.ConflictCapacityBlocked, "", err.Error())
 			}
-		} else if err != nil {
-			return err
+			return model.MapResult{}, err
 		}
 	}
 
+	if relocation != "" {
+		c.setConflict(key, model.ConflictRelocated, portID, relocation)
+	} else if conflict, ok := c.conflicts[key]; !ok || conflict.Type != model.ConflictRelocated || conflict.L3PortID != portID {
+		// the service is not on the port it was relocated to anymore
+		delete(c.conflicts, key)
+	}
+
 	svcModel.L3PortID = portID
 
 	if hasExistingService {
 		// we have to unmap the existing service first
 		klog.Infof("Trying to unmap service %q", id)
-		err = c.UnmapService(id)
-		if err != nil {
-			panic(fmt.Sprintf("UnmapService during MapService failed. Invariants are now broken."))
-		}
+		c.releaseAllocations(key)
 	}
 
-	c.services[key] = svcModel
-	l3port := c.l3ports[portID]
-	klog.Infof("Lookup l3port[%v]=%v", portID, l3port)
-	for _, port := range svcModel.Ports {
-		klog.Infof("Allocating port %v to service %v", port, key)
-		l3port.Allocations[port.Port] = key
+	c.allocate(key, svcModel)
+
+	if !hasExistingService || !reflect.DeepEqual(existingSvc, svcModel) {
+		c.recordTransition(model.TransitionMap, key, portID)
+		logPublishError("mapped", key, c.publisher.PublishMapped(newAllocationEvent(key, svcModel)))
+		c.logMapping(key, svcModel, provisioned)
+	}
+
+	var moved []model.ServiceIdentifier
+	if len(groupMembers) > 0 {
+		moved = c.moveSharedIPMembers(key, svcModel.SharedIPKey, groupMembers, portID)
+	}
+
+	result := model.MapResult{Outcome: model.MapOutcomeUnchanged, L3PortID: portID, Provisioned: provisioned, Relocation: relocation, Moved: moved}
+	if !hasExistingService {
+		result.Outcome = model.MapOutcomeNew
+	} else if existingSvc.L3PortID != portID {
+		result.Outcome = model.MapOutcomeMoved
 	}
+	return result, nil
+}
+
+// Log a single line with the allocation of a freshly mapped service. The
+// external address is only looked up if the line is actually logged.
+func (c *PortMapperImpl) logMapping(key string, svcModel model.ServiceModel, provisioned bool) {
+	vlog := klog.V(2)
+	if !vlog {
+		return
+	}
+
+	address, _, err := c.l3manager.GetExternalAddress(svcModel.L3PortID)
+	if err != nil {
+		klog.Warningf("failed to look up the external address of port %s: %s", svcModel.L3PortID, err)
+	}
+
+	ports := make([]string, len(svcModel.Ports))
+	for i, l4port := range svcModel.Ports {
+		ports[i] = fmt.Sprintf("%s/%d", l4port.Protocol, l4port.Port)
+	}
+
+	vlog.Infof(
+		"mapped service service=%q l3-port=%q address=%q ports=%q provisioned=%t",
+		key, svcModel.L3PortID, address, strings.Join(ports, ","), provisioned,
+	)
+}
+
+func (c *PortMapperImpl) MapServices(svcs []*corev1.Service) error {
+	sorted := make([]*corev1.Service, len(svcs))
+	copy(sorted, svcs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return model.FromService(sorted[i]).ToKey() < model.FromService(sorted[j]).ToKey()
+	})
+
+	var errs []error
+	for _, svc := range sorted {
+		if _, err := c.MapService(svc); err != nil {
+			errs = append(errs, fmt.Errorf("failed to map service %q: %w", model.FromService(svc).ToKey(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// estimatingL3PortManager pretends to provision ports and counts how many
+// ports it was asked for. All read-only calls are passed on to the wrapped
+// port manager.
+type estimatingL3PortManager struct {
+	L3PortManager
+	provisioned map[string]bool
+}
+
+func (m *estimatingL3PortManager) ProvisionPort(serviceKey string) (string, error) {
+	portID := fmt.Sprintf("estimated-port-%d", len(m.provisioned)+1)
+	m.provisioned[portID] = true
+	return portID, nil
+}
 
+func (m *estimatingL3PortManager) ReleasePort(portID string) error {
 	return nil
 }
 
+func (m *estimatingL3PortManager) CheckPortExists(portID string) (bool, error) {
+	if m.provisioned[portID] {
+		return true, nil
+	}
+	return m.L3PortManager.CheckPortExists(portID)
+}
+
+// Return a deep copy of the port mapper which uses the given port manager and
+// does not publish events.
+func (c *PortMapperImpl) cloneWith(l3manager L3PortManager) *PortMapperImpl {
+	clone := *c
+	clone.l3manager = l3manager
+	clone.publisher = NoopEventPublisher{}
+	clone.services = make(map[string]model.ServiceModel, len(c.services))
+	for key, svcModel := range c.services {
+		clone.services[key] = svcModel
+	}
+	clone.l3ports = make(map[string]model.L3Port, len(c.l3ports))
+	for id, l3port := range c.l3ports {
+		copied := model.L3Port{
+			ID:                id,
+			CreatedAt:         l3port.CreatedAt,
+			Allocations:       make(map[model.L4Port]string, len(l3port.Allocations)),
+			SharedAllocations: make(map[model.L4Port]model.SharedAllocation, len(l3port.SharedAllocations)),
+		}
+		for port, key := range l3port.Allocations {
+			copied.Allocations[port] = key
+		}
+		for port, shared := range l3port.SharedAllocations {
+			shared.Services = append([]string{}, shared.Services...)
+			copied.SharedAllocations[port] = shared
+		}
+		clone.l3ports[id] = copied
+	}
+	clone.degraded = make(map[string]bool, len(c.degraded))
+	for id := range c.degraded {
+		clone.degraded[id] = true
+	}
+	clone.conflicts = make(map[string]model.Conflict)
+	clone.transitions = &transitionLog{}
+	clone.idleSince = make(map[string]time.Time, len(c.idleSince))
+	for id, since := range c.idleSince {
+		clone.idleSince[id] = since
+	}
+	return &clone
+}
+
+func (c *PortMapperImpl) EstimateProvisions(svcs []*corev1.Service) (int, error) {
+	estimator := &estimatingL3PortManager{
+		L3PortManager: c.l3manager,
+		provisioned:   make(map[string]bool),
+	}
+	clone := c.cloneWith(estimator)
+	clone.estimating = true
+	if err := clone.MapServices(svcs); err != nil {
+		return 0, err
+	}
+	return len(estimator.provisioned), nil
+}
+
 func (c *PortMapperImpl) GetServiceL3Port(id model.ServiceIdentifier) (string, error) {
 	svcModel, ok := c.services[id.ToKey()]
 	if !ok {
@@ -248,6 +1128,14 @@ func (c *PortMapperImpl) GetServiceL3Port(id model.ServiceIdentifier) (string, e
 	return svcModel.L3PortID, nil
 }
 
+func (c *PortMapperImpl) GetServiceL4Ports(id model.ServiceIdentifier) ([]model.L4Port, error) {
+	svcModel, ok := c.services[id.ToKey()]
+	if !ok {
+		return nil, ErrServiceNotMapped
+	}
+	return append([]model.L4Port{}, svcModel.Ports...), nil
+}
+
 func (c *PortMapperImpl) GetModel() map[string]string {
 	result := make(map[string]string)
 	for key, svc := range c.services {
@@ -258,33 +1146,540 @@ func (c *PortMapperImpl) GetModel() map[string]string {
 
 func (c *PortMapperImpl) GetUsedL3Ports() ([]string, error) {
 	result := []string{}
+	idle := []string{}
 	for id, l3port := range c.l3ports {
-		if len(l3port.Allocations) == 0 {
-			delete(c.l3ports, id)
+		if l3port.IsUnused() {
+			idle = append(idle, id)
 			continue
 		}
+		delete(c.idleSince, id)
 		result = append(result, id)
 	}
+	return append(result, c.reclaimIdleL3Ports(idle)...), nil
+}
+
+// Release idle L3 ports, except for the idle port floor and ports which are
+// still within the grace period. Degraded ports are always released.
+//
+// Returns the IDs of the idle ports which are kept.
+func (c *PortMapperImpl) reclaimIdleL3Ports(idle []string) []string {
+	now := c.now()
+	for _, id := range idle {
+		if _, ok := c.idleSince[id]; !ok {
+			c.idleSince[id] = now
+		}
+	}
+
+	// prefer to keep the ports which became idle most recently
+	sort.Slice(idle, func(i, j int) bool {
+		si, sj := c.idleSince[idle[i]], c.idleSince[idle[j]]
+		if !si.Equal(sj) {
+			return si.After(sj)
+		}
+		return idle[i] < idle[j]
+	})
+
+	kept := []string{}
+	for _, id := range idle {
+		if !c.degraded[id] && (len(kept) < c.idlePortFloor || now.Sub(c.idleSince[id]) < c.idlePortGracePeriod) {
+			kept = append(kept, id)
+			continue
+		}
+		klog.V(4).Infof("releasing idle port %s", id)
+		delete(c.l3ports, id)
+		delete(c.idleSince, id)
+		c.recordTransition(model.TransitionRelease, "", id)
+	}
+	return kept
+}
+
+func (c *PortMapperImpl) GetL3PortCount() int {
+	return len(c.l3ports)
+}
+
+func (c *PortMapperImpl) GetPortFreeCapacity(portID string) (int, error) {
+	l3port, ok := c.l3ports[portID]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownL3Port, portID)
+	}
+	if c.degraded[portID] {
+		return 0, nil
+	}
+
+	used := make(map[model.L4Port]bool)
+	for l4port := range l3port.Allocations {
+		used[l4port] = true
+	}
+	for l4port := range l3port.SharedAllocations {
+		used[l4port] = true
+	}
+	for _, protocol := range capacityProtocols {
+		for port := range c.reserved {
+			used[model.L4Port{Protocol: protocol, Port: port}] = true
+		}
+	}
+
+	free := len(capacityProtocols) * int(c.l4PortCeiling)
+	for l4port := range used {
+		if slices.Contains(capacityProtocols, l4port.Protocol) && l4port.Port > 0 && l4port.Port <= c.l4PortCeiling {
+			free--
+		}
+	}
+	return free, nil
+}
+
+func (c *PortMapperImpl) GetAllocationCounts() map[corev1.Protocol]int {
+	result := make(map[corev1.Protocol]int)
+	for _, l3port := range c.l3ports {
+		for protocol, count := range l3port.AllocationCounts() {
+			result[protocol] += count
+		}
+	}
+	return result
+}
+
+func (c *PortMapperImpl) GetAllocationCountsByPort() map[string]int {
+	result := make(map[string]int, len(c.l3ports))
+	for id, l3port := range c.l3ports {
+		result[id] = allocationCount(l3port)
+	}
+	return result
+}
+
+func (c *PortMapperImpl) GetFullAssignment() ([]model.FIPAssignment, error) {
+	keys := make([]string, 0, len(c.services))
+	for key := range c.services {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	servicesByPort := make(map[string][]model.ServiceAssignment)
+	for _, key := range keys {
+		svcModel := c.services[key]
+		id, err := model.FromKey(key)
+		if err != nil {
+			return nil, err
+		}
+		servicesByPort[svcModel.L3PortID] = append(
+			servicesByPort[svcModel.L3PortID],
+			model.ServiceAssignment{
+				Service:               id,
+				Ports:                 svcModel.Ports,
+				ExternalTrafficPolicy: svcModel.ExternalTrafficPolicy,
+			},
+		)
+	}
+
+	result := []model.FIPAssignment{}
+	for _, l3port := range c.sortedL3Ports() {
+		address, _, err := c.l3manager.GetExternalAddress(l3port.ID)
+		if err != nil {
+			return nil, err
+		}
+		services := servicesByPort[l3port.ID]
+		if services == nil {
+			services = []model.ServiceAssignment{}
+		}
+		result = append(result, model.FIPAssignment{
+			Address:  address,
+			L3PortID: l3port.ID,
+			Services: services,
+		})
+	}
 	return result, nil
 }
 
+func (c *PortMapperImpl) EvacuatePort(portID string) ([]model.ServiceIdentifier, error) {
+	if _, known := c.l3ports[portID]; !known {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownL3Port, portID)
+	}
+
+	klog.Warningf("port %s is degraded, evacuating its services", portID)
+	c.degraded[portID] = true
+
+	return c.relocateServicesFrom(portID, fmt.Sprintf("port %s is degraded", portID))
+}
+
+// Move all services mapped to the given L3 port to other ports, which must
+// not include the given port.
+//
+// A service which cannot be moved stays where it is; it will be relocated
+// when it is mapped the next time. The services moved so far are returned
+// together with the error in that case.
+func (c *PortMapperImpl) relocateServicesFrom(portID string, reason string) ([]model.ServiceIdentifier, error) {
+	keys := []string{}
+	for key, svcModel := range c.services {
+		if svcModel.L3PortID == portID {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := make([]model.ServiceIdentifier, 0, len(keys))
+	// new port of each shared IP group, so that its services stay together
+	groupPorts := map[string]string{}
+	for _, key := range keys {
+		svcModel := c.services[key]
+		newPortID, placed := groupPorts[svcModel.SharedIPKey]
+		if !placed {
+			ports := svcModel.Ports
+			if svcModel.SharedIPKey != "" {
+				ports = []model.L4Port{}
+				for _, member := range c.sharedIPMembers("", svcModel.SharedIPKey) {
+					ports = append(ports, c.services[member].Ports...)
+				}
+			}
+			var err error
+			newPortID, err = c.selectL3PortFor(key, ports, svcModel.SharedListenerGroup)
+			if err != nil {
+				return result, err
+			}
+			if svcModel.SharedIPKey != "" {
+				groupPorts[svcModel.SharedIPKey] = newPortID
+			}
+		}
+
+		klog.Infof("moving service %q from port %s to %s: %s", key, portID, newPortID, reason)
+		c.releaseAllocations(key)
+		svcModel.L3PortID = newPortID
+		c.allocate(key, svcModel)
+		c.setConflict(key, model.ConflictRelocated, newPortID, reason)
+
+		event := newAllocationEvent(key, svcModel)
+		result = append(result, event.Service)
+		c.recordTransition(model.TransitionMap, key, newPortID)
+		logPublishError("mapped", key, c.publisher.PublishMapped(event))
+	}
+
+	return result, nil
+}
+
+func (c *PortMapperImpl) RevalidatePorts() ([]model.ServiceIdentifier, error) {
+	result := []model.ServiceIdentifier{}
+	for _, l3port := range c.sortedL3Ports() {
+		if l3port.IsUnused() {
+			continue
+		}
+		exists, err := c.l3manager.CheckPortExists(l3port.ID)
+		if err != nil {
+			return result, err
+		}
+		if exists {
+			continue
+		}
+
+		klog.Warningf("port %s does not exist anymore, relocating its services", l3port.ID)
+		delete(c.l3ports, l3port.ID)
+		delete(c.idleSince, l3port.ID)
+		c.recordTransition(model.TransitionRelease, "", l3port.ID)
+
+		moved, err := c.relocateServicesFrom(l3port.ID, fmt.Sprintf("port %s does not exist anymore", l3port.ID))
+		result = append(result, moved...)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (c *PortMapperImpl) Consolidate() ([]model.ServiceIdentifier, error) {
+	// Plan all moves on a copy first, so that a port is either emptied
+	// completely or left alone and no service is ever without a port.
+	plan := c.cloneWith(c.l3manager)
+	evacuated := map[string]bool{}
+	moves := map[string]string{}
+	for _, source := range plan.consolidationSources() {
+		trial := plan.cloneWith(c.l3manager)
+		trialMoves, ok := trial.evacuateForConsolidation(source, evacuated)
+		if !ok {
+			continue
+		}
+		plan = trial
+		evacuated[source] = true
+		for key, portID := range trialMoves {
+			moves[key] = portID
+		}
+	}
+
+	keys := make([]string, 0, len(moves))
+	for key := range moves {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]model.ServiceIdentifier, 0, len(keys))
+	for _, key := range keys {
+		svcModel := c.services[key]
+		klog.Infof("moving service %q from port %s to %s: consolidating ports", key, svcModel.L3PortID, moves[key])
+		c.releaseAllocations(key)
+		svcModel.L3PortID = moves[key]
+		c.allocate(key, svcModel)
+
+		event := newAllocationEvent(key, svcModel)
+		result = append(result, event.Service)
+		c.recordTransition(model.TransitionMap, key, svcModel.L3PortID)
+		logPublishError("mapped", key, c.publisher.PublishMapped(event))
+	}
+
+	sources := make([]string, 0, len(evacuated))
+	for portID := range evacuated {
+		sources = append(sources, portID)
+	}
+	sort.Strings(sources)
+	c.releaseIfIdle(sources...)
+
+	return result, nil
+}
+
+// Return the number of L4 ports allocated on the L3 port.
+func allocationCount(l3port model.L3Port) int {
+	return len(l3port.Allocations) + len(l3port.SharedAllocations)
+}
+
+// Return the used, non-degraded L3 ports in the order in which consolidation
+// tries to empty them: least allocations first.
+func (c *PortMapperImpl) consolidationSources() []string {
+	candidates := []model.L3Port{}
+	for _, l3port := range c.sortedL3Ports() {
+		if !l3port.IsUnused() && !c.degraded[l3port.ID] {
+			candidates = append(candidates, l3port)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return allocationCount(candidates[i]) < allocationCount(candidates[j])
+	})
+
+	result := make([]string, len(candidates))
+	for i, l3port := range candidates {
+		result[i] = l3port.ID
+	}
+	return result
+}
+
+// Move all services away from the source port onto other used ports which
+// are neither degraded nor evacuated, fullest port first.
+//
+// Returns the new L3 port by service key and whether all services could be
+// moved. If not, the port mapper is left in an intermediate state and must
+// be discarded. Ports with services of a shared IP group or a shared
+// listener group are never evacuated, so that the group is not split up.
+func (c *PortMapperImpl) evacuateForConsolidation(source string, evacuated map[string]bool) (map[string]string, bool) {
+	keys := []string{}
+	for key, svcModel := range c.services {
+		if svcModel.L3PortID == source {
+			if svcModel.SharedIPKey != "" || svcModel.SharedListenerGroup != "" {
+				return nil, false
+			}
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	moves := make(map[string]string, len(keys))
+	for _, key := range keys {
+		svcModel := c.services[key]
+		targets := []model.L3Port{}
+		for _, l3port := range c.sortedL3Ports() {
+			if l3port.ID == source || evacuated[l3port.ID] || c.degraded[l3port.ID] || l3port.IsUnused() {
+				continue
+			}
+			targets = append(targets, l3port)
+		}
+		sort.SliceStable(targets, func(i, j int) bool {
+			return allocationCount(targets[i]) > allocationCount(targets[j])
+		})
+
+		target := ""
+		opts := AllocationOptions{ServiceKey: key, SharedListenerGroup: svcModel.SharedListenerGroup, MaxServices: c.maxServicesPerPort}
+		for _, l3port := range targets {
+			if IsPortSuitableFor(l3port, svcModel.Ports, opts) {
+				target = l3port.ID
+				break
+			}
+		}
+		if target == "" {
+			return nil, false
+		}
+
+		c.releaseAllocations(key)
+		svcModel.L3PortID = target
+		c.allocate(key, svcModel)
+		moves[key] = target
+	}
+	return moves, true
+}
+
+func (c *PortMapperImpl) ClearDegradedPort(portID string) {
+	delete(c.degraded, portID)
+}
+
+func (c *PortMapperImpl) setConflict(key string, conflictType model.ConflictType, portID string, details string) {
+	id, _ := model.FromKey(key)
+	c.conflicts[key] = model.Conflict{
+		Type:     conflictType,
+		Service:  id,
+		L3PortID: portID,
+		Details:  details,
+	}
+}
+
+func (c *PortMapperImpl) GetUnplaceableServiceCount() int {
+	result := 0
+	for _, conflict := range c.conflicts {
+		if conflict.Type == model.ConflictCapacityBlocked {
+			result++
+		}
+	}
+	return result
+}
+
+func (c *PortMapperImpl) GetConflicts() []model.Conflict {
+	keys := make([]string, 0, len(c.conflicts))
+	for key := range c.conflicts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]model.Conflict, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, c.conflicts[key])
+	}
+	return result
+}
+
+func (c *PortMapperImpl) GetRecentTransitions(n int) []model.Transition {
+	return c.transitions.recent(n)
+}
+
+func (c *PortMapperImpl) Generation() uint64 {
+	return c.generation
+}
+
 func (c *PortMapperImpl) UnmapService(id model.ServiceIdentifier) error {
 	key := id.ToKey()
+	delete(c.conflicts, key)
+	svcModel, exists := c.services[key]
+	c.releaseAllocations(key)
+	if exists {
+		c.recordTransition(model.TransitionUnmap, key, svcModel.L3PortID)
+		logPublishError("unmapped", key, c.publisher.PublishUnmapped(newAllocationEvent(key, svcModel)))
+		c.releaseIfIdle(svcModel.L3PortID)
+	}
+	return nil
+}
+
+// Release the given L3 ports in the backend right away if they are unused
+// and not kept by the idle port floor or grace period. Ports which are kept
+// are reclaimed lazily by GetUsedL3Ports.
+func (c *PortMapperImpl) releaseIfIdle(portIDs ...string) {
+	candidates := []string{}
+	for _, portID := range portIDs {
+		if l3port, ok := c.l3ports[portID]; ok && l3port.IsUnused() {
+			candidates = append(candidates, portID)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	idle := []string{}
+	for id, l3port := range c.l3ports {
+		if l3port.IsUnused() {
+			idle = append(idle, id)
+		}
+	}
+	c.reclaimIdleL3Ports(idle)
+
+	for _, portID := range candidates {
+		if _, kept := c.l3ports[portID]; kept {
+			continue
+		}
+		if err := c.l3manager.ReleasePort(portID); err != nil {
+			klog.Warningf("Failed to release unused port %q: %s. The operation will be retried later.", portID, err.Error())
+		}
+	}
+}
+
+// Remove the service and all of its allocations from the internal state.
+func (c *PortMapperImpl) releaseAllocations(key string) {
+	if _, ok := c.services[key]; ok {
+		c.generation++
+	}
 	delete(c.services, key)
 	for _, l3port := range c.l3ports {
-		for portNumber, user := range l3port.Allocations {
+		for l4port, user := range l3port.Allocations {
 			if user == key {
-				delete(l3port.Allocations, portNumber)
+				delete(l3port.Allocations, l4port)
+			}
+		}
+		for l4port, shared := range l3port.SharedAllocations {
+			remaining := make([]string, 0, len(shared.Services))
+			for _, user := range shared.Services {
+				if user != key {
+					remaining = append(remaining, user)
+				}
+			}
+			if len(remaining) == 0 {
+				delete(l3port.SharedAllocations, l4port)
+				continue
 			}
+			shared.Services = remaining
+			l3port.SharedAllocations[l4port] = shared
 		}
 	}
-	return nil
 }
 
 // SetAvailableL3Ports marks a list of l3 ports as available.
 // All other l3 ports are removed from the l3ports list.
 // All services that belong to other ports are removed from the services list and will be returned.
 func (c *PortMapperImpl) SetAvailableL3Ports(portIDs []string) ([]model.ServiceIdentifier, error) {
+	evicted := c.evictUnavailableL3Ports(portIDs)
+	result := make([]model.ServiceIdentifier, 0, len(evicted))
+	for _, eviction := range evicted {
+		result = append(result, eviction.id)
+	}
+	return result, nil
+}
+
+func (c *PortMapperImpl) SetAvailableL3PortsWithSuggestions(portIDs []string) ([]model.Eviction, error) {
+	evicted := c.evictUnavailableL3Ports(portIDs)
+	sort.Slice(evicted, func(i, j int) bool {
+		return evicted[i].key < evicted[j].key
+	})
+
+	// place the services on a copy, so that later suggestions take the
+	// earlier ones into account
+	plan := c.cloneWith(c.l3manager)
+	result := make([]model.Eviction, 0, len(evicted))
+	for _, eviction := range evicted {
+		svcModel := eviction.svcModel
+		portID, _ := plan.allocator.SelectPort(
+			plan.placementCandidates(),
+			svcModel.Ports,
+			AllocationOptions{SharedListenerGroup: svcModel.SharedListenerGroup, MaxServices: plan.maxServicesPerPort},
+		)
+		if _, known := plan.l3ports[portID]; !known || plan.degraded[portID] {
+			portID = ""
+		}
+		if portID != "" {
+			svcModel.L3PortID = portID
+			plan.allocate(eviction.key, svcModel)
+		}
+		result = append(result, model.Eviction{Service: eviction.id, SuggestedL3PortID: portID})
+	}
+	return result, nil
+}
+
+// A service which was removed because its L3 port is not available anymore
+type evictedService struct {
+	key      string
+	id       model.ServiceIdentifier
+	svcModel model.ServiceModel
+}
+
+// Remove all L3 ports which are not in the given list together with the
+// services mapped to them and return the removed services.
+func (c *PortMapperImpl) evictUnavailableL3Ports(portIDs []string) []evictedService {
 	vlog := klog.V(4)
 
 	validPorts := make(map[string]bool)
@@ -296,7 +1691,7 @@ func (c *PortMapperImpl) SetAvailableL3Ports(portIDs []string) ([]model.ServiceI
 	}
 	vlog.Infof("%d ports are considered available", len(validPorts))
 
-	result := make([]model.ServiceIdentifier, 0)
+	result := make([]evictedService, 0)
 	for portID, l3port := range c.l3ports {
 		// check if port is in the set of available ports
 		if _, ok := validPorts[portID]; ok {
@@ -310,23 +1705,32 @@ func (c *PortMapperImpl) SetAvailableL3Ports(portIDs []string) ([]model.ServiceI
 		)
 
 		// it is not! we have to force-evict the affected services
+		serviceKeys := make([]string, 0, len(l3port.Allocations))
 		for _, serviceKey := range l3port.Allocations {
+			serviceKeys = append(serviceKeys, serviceKey)
+		}
+		for _, shared := range l3port.SharedAllocations {
+			serviceKeys = append(serviceKeys, shared.Services...)
+		}
+		for _, serviceKey := range serviceKeys {
 			vlog.Infof("evicting service %q", serviceKey)
-			_, exists := c.services[serviceKey]
+			svcModel, exists := c.services[serviceKey]
 			// we check for existence here to avoid returning the same service
 			// more than once if it has multiple allocations
 			if exists {
+				c.generation++
 				delete(c.services, serviceKey)
-				id, err := model.FromKey(serviceKey)
-				if err != nil {
-					panic(fmt.Sprintf("internal error: key %q is not valid", serviceKey))
-				}
-				result = append(result, id)
+				delete(c.conflicts, serviceKey)
+				event := newAllocationEvent(serviceKey, svcModel)
+				result = append(result, evictedService{key: serviceKey, id: event.Service, svcModel: svcModel})
+				c.recordTransition(model.TransitionEvict, serviceKey, portID)
+				logPublishError("evicted", serviceKey, c.publisher.PublishEvicted(event))
 			}
 		}
 
 		delete(c.l3ports, portID)
+		delete(c.idleSince, portID)
 	}
 
-	return result, nil
+	return result
 }
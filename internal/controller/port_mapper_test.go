@@ -15,36 +15,55 @@
 package controller
 
 import (
+	"bytes"
 	"errors"
+	"flag"
 	"fmt"
+	"os"
 	"testing"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
 
+	"github.com/gophercloud/gophercloud"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 
+	controllertesting "github.com/cloudandheat/ch-k8s-lbaas/internal/controller/testing"
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
 	ostesting "github.com/cloudandheat/ch-k8s-lbaas/internal/openstack/testing"
 )
 
 type portMapperFixture struct {
 	l3portmanager *ostesting.MockL3PortManager
+	publisher     *controllertesting.InMemoryEventPublisher
 	portmapper    PortMapper
 }
 
-func newPortMapperFixture() *portMapperFixture {
+func newPortMapperFixture(opts ...PortMapperOption) *portMapperFixture {
 	l3portmanager := ostesting.NewMockL3PortManager()
+	publisher := controllertesting.NewInMemoryEventPublisher()
 
 	l3portmanager.On("GetAvailablePorts").Return([]string{}, nil).Times(1)
+	// ports emptied by UnmapService are released right away
+	l3portmanager.On("ReleasePort", mock.Anything).Return(nil).Maybe()
 
-	portmapper, _ := NewPortMapper(l3portmanager)
+	opts = append([]PortMapperOption{WithEventPublisher(publisher)}, opts...)
+	portmapper, _ := NewPortMapper(l3portmanager, opts...)
 
 	return &portMapperFixture{
 		l3portmanager: l3portmanager,
+		publisher:     publisher,
 		portmapper:    portmapper,
 	}
 }
 
+// Return only the error of a MapService call.
+func mapError(_ model.MapResult, err error) error {
+	return err
+}
+
 func newPortMapperService(name string) *corev1.Service {
 	svc := newService(name)
 	svc.Spec.Ports = []corev1.ServicePort{
@@ -84,9 +103,9 @@ func TestMapFirstUnknownServiceAssignsNewPort(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id", nil)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil)
 
-	err := f.portmapper.MapService(s)
+	_, err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
@@ -99,9 +118,9 @@ func TestMapServicePropagatesPortAllocationError(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("dummy", provisionError)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("dummy", provisionError)
 
-	err := f.portmapper.MapService(s)
+	_, err := f.portmapper.MapService(s)
 	assert.Equal(t, err, provisionError)
 }
 
@@ -110,9 +129,9 @@ func TestPortAllocationErrorLeavesServiceUnmapped(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("dummy", provisionError)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("dummy", provisionError)
 
-	err := f.portmapper.MapService(s)
+	_, err := f.portmapper.MapService(s)
 	assert.Equal(t, err, provisionError)
 
 	_, err = f.portmapper.GetServiceL3Port(model.FromService(s))
@@ -130,17 +149,17 @@ func TestMapServiceWithNonConflictingL4PortsReusesL3Port(t *testing.T) {
 		},
 	}
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("", fmt.Errorf("no more ports"))
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("", fmt.Errorf("no more ports"))
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s1))
 	assert.Nil(t, err)
 	assert.Equal(t, "port-id-1", portID)
 
-	err = f.portmapper.MapService(s2)
+	_, err = f.portmapper.MapService(s2)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s2))
@@ -148,22 +167,224 @@ func TestMapServiceWithNonConflictingL4PortsReusesL3Port(t *testing.T) {
 	assert.Equal(t, "port-id-1", portID)
 }
 
+func newPortMapperServiceWithPort(name string, protocol corev1.Protocol, port int32) *corev1.Service {
+	svc := newService(name)
+	svc.Spec.Ports = []corev1.ServicePort{
+		corev1.ServicePort{
+			Protocol: protocol,
+			Port:     port,
+		},
+	}
+	return svc
+}
+
+func TestMapServiceTracksTCPAndUDPOnSamePortNumberIndependently(t *testing.T) {
+	f := newPortMapperFixture()
+	tcp1 := newPortMapperServiceWithPort("test-service-tcp-1", corev1.ProtocolTCP, 53)
+	udp1 := newPortMapperServiceWithPort("test-service-udp-1", corev1.ProtocolUDP, 53)
+	tcp2 := newPortMapperServiceWithPort("test-service-tcp-2", corev1.ProtocolTCP, 53)
+	udp2 := newPortMapperServiceWithPort("test-service-udp-2", corev1.ProtocolUDP, 53)
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	for _, s := range []*corev1.Service{tcp1, udp1, tcp2, udp2} {
+		assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	}
+
+	// each protocol fills up on its own: the second TCP/53 and UDP/53
+	// services share the second port
+	expected := map[*corev1.Service]string{
+		tcp1: "port-id-1",
+		udp1: "port-id-1",
+		tcp2: "port-id-2",
+		udp2: "port-id-2",
+	}
+	for s, expectedPortID := range expected {
+		portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+		assert.Nil(t, err)
+		assert.Equal(t, expectedPortID, portID)
+	}
+
+	l3port := f.portmapper.(*PortMapperImpl).l3ports["port-id-1"]
+	assert.Equal(t, map[corev1.Protocol]int{corev1.ProtocolTCP: 1, corev1.ProtocolUDP: 1}, l3port.AllocationCounts())
+	assert.Equal(t, map[corev1.Protocol]int{corev1.ProtocolTCP: 2, corev1.ProtocolUDP: 2}, f.portmapper.GetAllocationCounts())
+
+	// freeing the TCP slot leaves the UDP slot in place
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(tcp1)))
+	assert.Equal(t, map[corev1.Protocol]int{corev1.ProtocolTCP: 1, corev1.ProtocolUDP: 2}, f.portmapper.GetAllocationCounts())
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 2)
+}
+
+func TestMapServiceCarriesSCTPPortsThrough(t *testing.T) {
+	f := newPortMapperFixture()
+	tcp := newPortMapperServiceWithPort("test-service-tcp", corev1.ProtocolTCP, 3868)
+	sctp1 := newPortMapperServiceWithPort("test-service-sctp-1", corev1.ProtocolSCTP, 3868)
+	sctp2 := newPortMapperServiceWithPort("test-service-sctp-2", corev1.ProtocolSCTP, 3868)
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	for _, s := range []*corev1.Service{tcp, sctp1, sctp2} {
+		assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	}
+
+	ports, err := f.portmapper.GetServiceL4Ports(model.FromService(sctp1))
+	assert.Nil(t, err)
+	assert.Equal(t, []model.L4Port{{Protocol: corev1.ProtocolSCTP, Port: 3868}}, ports)
+
+	// SCTP does not conflict with TCP, but with SCTP on the same port
+	expected := map[*corev1.Service]string{
+		tcp:   "port-id-1",
+		sctp1: "port-id-1",
+		sctp2: "port-id-2",
+	}
+	for s, expectedPortID := range expected {
+		portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+		assert.Nil(t, err)
+		assert.Equal(t, expectedPortID, portID)
+	}
+}
+
+func TestMapServiceRejectsUnknownProtocols(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperServiceWithPort("test-service", corev1.Protocol("ICMP"), 0)
+
+	_, err := f.portmapper.MapService(s)
+	assert.True(t, errors.Is(err, ErrUnsupportedProtocol))
+	assert.Contains(t, err.Error(), `"ICMP"`)
+
+	conflicts := f.portmapper.GetConflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, model.ConflictRejected, conflicts[0].Type)
+
+	_, err = f.portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Equal(t, ErrServiceNotMapped, err)
+	f.l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+}
+
+func TestMapServiceAllocatesPortRangeOnOneL3Port(t *testing.T) {
+	f := newPortMapperFixture(WithPortRanges(true))
+	s := newPortMapperServiceWithPort("test-service", corev1.ProtocolTCP, 21)
+	s.Annotations = map[string]string{AnnotationPortRange: "30000-30002/udp"}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	ports, err := f.portmapper.GetServiceL4Ports(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, []model.L4Port{
+		{Protocol: corev1.ProtocolTCP, Port: 21},
+		{Protocol: corev1.ProtocolUDP, Port: 30000},
+		{Protocol: corev1.ProtocolUDP, Port: 30001},
+		{Protocol: corev1.ProtocolUDP, Port: 30002},
+	}, ports)
+
+	l3port := f.portmapper.(*PortMapperImpl).l3ports["port-id-1"]
+	assert.Equal(t, map[corev1.Protocol]int{corev1.ProtocolTCP: 1, corev1.ProtocolUDP: 3}, l3port.AllocationCounts())
+}
+
+func TestMapServiceDoesNotPartiallyAllocatePortRange(t *testing.T) {
+	portmapper, l3portmanager := newPortMapperWithAllocator(t, ReuseOnlyPortAllocator{}, []string{"port-id-1"}, WithIdlePortFloor(1), WithPortRanges(true))
+	l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil)
+
+	s1 := newPortMapperServiceWithPort("test-service-1", corev1.ProtocolTCP, 30001)
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolTCP, 21)
+	s2.Annotations = map[string]string{AnnotationPortRange: "30000-30002"}
+
+	assert.Nil(t, mapError(portmapper.MapService(s1)))
+	assert.Equal(t, ErrNoSuitablePort, mapError(portmapper.MapService(s2)))
+
+	// none of the free ports of the range was taken
+	l3port := portmapper.(*PortMapperImpl).l3ports["port-id-1"]
+	assert.Equal(t, map[model.L4Port]string{
+		{Protocol: corev1.ProtocolTCP, Port: 30001}: model.FromService(s1).ToKey(),
+	}, l3port.Allocations)
+
+	// releasing the conflicting port makes room for the whole range
+	assert.Nil(t, portmapper.UnmapService(model.FromService(s1)))
+	assert.Nil(t, mapError(portmapper.MapService(s2)))
+}
+
+func TestUnmapServiceReleasesWholePortRange(t *testing.T) {
+	f := newPortMapperFixture(WithIdlePortFloor(1), WithPortRanges(true))
+	s1 := newPortMapperServiceWithPort("test-service-1", corev1.ProtocolTCP, 21)
+	s1.Annotations = map[string]string{AnnotationPortRange: "30000-30009"}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s1)))
+
+	l3port := f.portmapper.(*PortMapperImpl).l3ports["port-id-1"]
+	assert.True(t, l3port.IsUnused())
+}
+
+func TestMapServiceRejectsPortRangeIfBackendLayerCannotForwardIt(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperServiceWithPort("test-service", corev1.ProtocolTCP, 21)
+	s.Annotations = map[string]string{AnnotationPortRange: "30000-30002"}
+
+	assert.True(t, errors.Is(mapError(f.portmapper.MapService(s)), ErrPortRangeUnsupported))
+
+	conflicts := f.portmapper.GetConflicts()
+	if assert.Equal(t, 1, len(conflicts)) {
+		assert.Equal(t, model.ConflictRejected, conflicts[0].Type)
+	}
+	_, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Equal(t, ErrServiceNotMapped, err)
+	f.l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+}
+
+func TestMapServiceRejectsInvalidPortRanges(t *testing.T) {
+	cases := []string{
+		"30000",
+		"30000-29999",
+		"0-10",
+		"65000-65536",
+		"a-b",
+		"30000-30002/icmp",
+		"1-2000",
+		// overlaps with the service port
+		"80-82",
+		// contains a reserved port
+		"20-22",
+	}
+	for _, value := range cases {
+		l3portmanager := ostesting.NewMockL3PortManager()
+		l3portmanager.On("GetAvailablePorts").Return([]string{}, nil).Times(1)
+		portmapper, err := NewPortMapper(l3portmanager, WithReservedPorts([]int32{22}), WithPortRanges(true))
+		assert.Nil(t, err)
+
+		s := newPortMapperServiceWithPort("test-service", corev1.ProtocolTCP, 80)
+		s.Annotations = map[string]string{AnnotationPortRange: value}
+
+		assert.NotNil(t, mapError(portmapper.MapService(s)), value)
+		conflicts := portmapper.GetConflicts()
+		if assert.Equal(t, 1, len(conflicts), value) {
+			assert.Equal(t, model.ConflictRejected, conflicts[0].Type, value)
+		}
+		l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+	}
+}
+
 func TestMapServiceWithConflictingL4PortsAllocatesNewL3Port(t *testing.T) {
 	f := newPortMapperFixture()
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s1))
 	assert.Nil(t, err)
 	assert.Equal(t, "port-id-1", portID)
 
-	err = f.portmapper.MapService(s2)
+	_, err = f.portmapper.MapService(s2)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s2))
@@ -171,15 +392,139 @@ func TestMapServiceWithConflictingL4PortsAllocatesNewL3Port(t *testing.T) {
 	assert.Equal(t, "port-id-2", portID)
 }
 
+func TestMapServicesOfSameSharedListenerGroupShareL3Port(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-1"}
+	s2 := newPortMapperService("test-service-2")
+	s2.Annotations = map[string]string{
+		AnnotationSharedListenerGroup:  "group-1",
+		AnnotationSharedListenerWeight: "3",
+	}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	_, err := f.portmapper.MapService(s1)
+	assert.Nil(t, err)
+
+	_, err = f.portmapper.MapService(s2)
+	assert.Nil(t, err)
+
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s2))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 1)
+}
+
+func TestMapServiceJoinsL3PortOfSharedListenerGroup(t *testing.T) {
+	f := newPortMapperFixture()
+	s0 := newPortMapperServiceWithPort("test-service-0", corev1.ProtocolTCP, 443)
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-1"}
+	// TCP/80 is free on port-id-1 as well
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolTCP, 80)
+	s2.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-1"}
+	s3 := newPortMapperServiceWithPort("test-service-3", corev1.ProtocolTCP, 80)
+	s3.Annotations = map[string]string{
+		AnnotationSharedListenerGroup: "group-1",
+		AnnotationInboundPort:         "port-id-1",
+	}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s0)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s3)))
+
+	for _, s := range []*corev1.Service{s1, s2, s3} {
+		portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+		assert.Nil(t, err)
+		assert.Equal(t, "port-id-2", portID, s.Name)
+	}
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 2)
+}
+
+func TestMapServicesOfDifferentSharedListenerGroupsAllocatesNewL3Port(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-1"}
+	s2 := newPortMapperService("test-service-2")
+	s2.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-2"}
+	s3 := newPortMapperService("test-service-3")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-3", nil).Times(1)
+
+	_, err := f.portmapper.MapService(s1)
+	assert.Nil(t, err)
+
+	_, err = f.portmapper.MapService(s2)
+	assert.Nil(t, err)
+
+	_, err = f.portmapper.MapService(s3)
+	assert.Nil(t, err)
+
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s2))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", portID)
+
+	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s3))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-3", portID)
+}
+
+func TestMapServiceRejectsInvalidSharedListenerWeight(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+	s.Annotations = map[string]string{
+		AnnotationSharedListenerGroup:  "group-1",
+		AnnotationSharedListenerWeight: "0",
+	}
+
+	_, err := f.portmapper.MapService(s)
+	assert.NotNil(t, err)
+
+	_, err = f.portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Equal(t, ErrServiceNotMapped, err)
+}
+
+func TestUnmapServiceKeepsSharedAllocationOfRemainingGroupMembers(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-1"}
+	s2 := newPortMapperService("test-service-2")
+	s2.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-1"}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s1)))
+
+	usedPorts, err := f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port-id-1"}, usedPorts)
+
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s2)))
+
+	usedPorts, err = f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, usedPorts)
+}
+
 func TestRemappingTheSameServiceDoesNotChangePorts(t *testing.T) {
 	f := newPortMapperFixture()
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s1))
@@ -187,7 +532,7 @@ func TestRemappingTheSameServiceDoesNotChangePorts(t *testing.T) {
 	assert.Equal(t, "port-id-1", portID)
 	setPortAnnotation(s1, portID)
 
-	err = f.portmapper.MapService(s2)
+	_, err = f.portmapper.MapService(s2)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s2))
@@ -196,7 +541,7 @@ func TestRemappingTheSameServiceDoesNotChangePorts(t *testing.T) {
 
 	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil).Times(1)
 
-	err = f.portmapper.MapService(s1)
+	_, err = f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s1))
@@ -209,18 +554,18 @@ func TestRemappingTheSameServiceWithoutAnnotationIsHandledGracefully(t *testing.
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-3", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-3", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s1))
 	assert.Nil(t, err)
 	assert.Equal(t, "port-id-1", portID)
 
-	err = f.portmapper.MapService(s2)
+	_, err = f.portmapper.MapService(s2)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s2))
@@ -229,7 +574,7 @@ func TestRemappingTheSameServiceWithoutAnnotationIsHandledGracefully(t *testing.
 
 	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil).Times(1)
 
-	err = f.portmapper.MapService(s1)
+	_, err = f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s1))
@@ -247,9 +592,9 @@ func TestRemappingAnUpdatedServiceWithAnnotationDoesNotAllocateANewPort(t *testi
 	f := newPortMapperFixture()
 	s1 := newPortMapperService("test-service-1")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s1))
@@ -261,7 +606,7 @@ func TestRemappingAnUpdatedServiceWithAnnotationDoesNotAllocateANewPort(t *testi
 
 	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil).Times(1)
 
-	err = f.portmapper.MapService(s1)
+	_, err = f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s1))
@@ -273,9 +618,9 @@ func TestRemappingAnUpdatedServiceWithoutAnnotationDoesNotAllocateANewPort(t *te
 	f := newPortMapperFixture()
 	s1 := newPortMapperService("test-service-1")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s1))
@@ -286,7 +631,7 @@ func TestRemappingAnUpdatedServiceWithoutAnnotationDoesNotAllocateANewPort(t *te
 
 	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil).Times(1)
 
-	err = f.portmapper.MapService(s1)
+	_, err = f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s1))
@@ -298,9 +643,9 @@ func TestRemappingAnUpdatedServiceWithStaleAnnotationDoesNotAllocateANewPort(t *
 	f := newPortMapperFixture()
 	s1 := newPortMapperService("test-service-1")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s1))
@@ -312,7 +657,7 @@ func TestRemappingAnUpdatedServiceWithStaleAnnotationDoesNotAllocateANewPort(t *
 
 	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil).Times(1)
 
-	err = f.portmapper.MapService(s1)
+	_, err = f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s1))
@@ -325,9 +670,9 @@ func TestRemappingAnUpdatedServiceWithAnnotationClearsOldAllocations(t *testing.
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s1))
@@ -339,14 +684,14 @@ func TestRemappingAnUpdatedServiceWithAnnotationClearsOldAllocations(t *testing.
 
 	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil).Times(2)
 
-	err = f.portmapper.MapService(s1)
+	_, err = f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s1))
 	assert.Nil(t, err)
 	assert.Equal(t, "port-id-1", portID)
 
-	err = f.portmapper.MapService(s2)
+	_, err = f.portmapper.MapService(s2)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s2))
@@ -357,9 +702,9 @@ func TestRemappingAnUpdatedServiceWithAnnotationClearsOldAllocations(t *testing.
 func TestUnmapServiceRemovesPortAssignment(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service-1")
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
-	err := f.portmapper.MapService(s)
+	_, err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
 
 	err = f.portmapper.UnmapService(model.FromService(s))
@@ -371,18 +716,26 @@ func TestUnmapServiceRemovesPortAssignment(t *testing.T) {
 
 func TestUnmapServiceRemovesPortAllocations(t *testing.T) {
 	f := newPortMapperFixture()
+	// keeps the port in use
+	s0 := newService("test-service-0")
+	s0.Spec.Ports = []corev1.ServicePort{
+		{Protocol: corev1.ProtocolTCP, Port: 8080},
+	}
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	_, err := f.portmapper.MapService(s0)
+	assert.Nil(t, err)
 
-	err := f.portmapper.MapService(s1)
+	_, err = f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	err = f.portmapper.UnmapService(model.FromService(s1))
 	assert.Nil(t, err)
 
-	err = f.portmapper.MapService(s2)
+	_, err = f.portmapper.MapService(s2)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s2))
@@ -390,6 +743,41 @@ func TestUnmapServiceRemovesPortAllocations(t *testing.T) {
 	assert.Equal(t, "port-id-1", portID)
 }
 
+func TestUnmapServiceReleasesEmptiedPortImmediately(t *testing.T) {
+	l3portmanager := ostesting.NewMockL3PortManager()
+	l3portmanager.On("GetAvailablePorts").Return([]string{}, nil).Times(1)
+	l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	l3portmanager.On("ReleasePort", "port-id-1").Return(nil).Times(1)
+	portmapper, err := NewPortMapper(l3portmanager)
+	assert.Nil(t, err)
+
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolUDP, 53)
+	assert.Nil(t, mapError(portmapper.MapService(s1)))
+	assert.Nil(t, mapError(portmapper.MapService(s2)))
+
+	// the port is still used by the other service
+	assert.Nil(t, portmapper.UnmapService(model.FromService(s1)))
+	l3portmanager.AssertNotCalled(t, "ReleasePort", mock.Anything)
+	assert.Equal(t, 1, portmapper.GetL3PortCount())
+
+	assert.Nil(t, portmapper.UnmapService(model.FromService(s2)))
+	assert.Equal(t, 0, portmapper.GetL3PortCount())
+	l3portmanager.AssertExpectations(t)
+}
+
+func TestUnmapServiceKeepsEmptiedPortWithinGracePeriod(t *testing.T) {
+	f := newPortMapperFixture(WithIdlePortGracePeriod(time.Minute))
+	s := newPortMapperService("test-service-1")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s)))
+
+	assert.Equal(t, 1, f.portmapper.GetL3PortCount())
+	f.l3portmanager.AssertNotCalled(t, "ReleasePort", mock.Anything)
+}
+
 func TestGetUsedL3PortsIsEmptyByDefault(t *testing.T) {
 	f := newPortMapperFixture()
 
@@ -403,17 +791,17 @@ func TestGetUsedL3PortsContainsMappedPorts(t *testing.T) {
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	ports, err := f.portmapper.GetUsedL3Ports()
 	assert.Nil(t, err)
 	assert.Equal(t, ports, []string{"port-id-1"})
 
-	err = f.portmapper.MapService(s2)
+	_, err = f.portmapper.MapService(s2)
 	assert.Nil(t, err)
 
 	ports, err = f.portmapper.GetUsedL3Ports()
@@ -428,17 +816,17 @@ func TestGetUsedL3PortsDoesNotReturnUnusedPorts(t *testing.T) {
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	ports, err := f.portmapper.GetUsedL3Ports()
 	assert.Nil(t, err)
 	assert.Equal(t, ports, []string{"port-id-1"})
 
-	err = f.portmapper.MapService(s2)
+	_, err = f.portmapper.MapService(s2)
 	assert.Nil(t, err)
 
 	ports, err = f.portmapper.GetUsedL3Ports()
@@ -467,10 +855,10 @@ func TestGetUsedL3PortsCleansUpUnusedPorts(t *testing.T) {
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	err = f.portmapper.UnmapService(model.FromService(s1))
@@ -478,7 +866,7 @@ func TestGetUsedL3PortsCleansUpUnusedPorts(t *testing.T) {
 
 	f.portmapper.GetUsedL3Ports()
 
-	err = f.portmapper.MapService(s2)
+	_, err = f.portmapper.MapService(s2)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s2))
@@ -495,14 +883,14 @@ func TestUnmapServiceWithUnknownServiceReturnsNil(t *testing.T) {
 }
 
 func TestMapServiceWithAnnotationInjectsThePortWithoutAllocation(t *testing.T) {
-	f := newPortMapperFixture()
+	f := newPortMapperFixture(WithTrustPreferredPort(true))
 	s := newPortMapperService("test-service-1")
 	s.Annotations = make(map[string]string)
 	s.Annotations[AnnotationInboundPort] = "port-id-x"
 
 	f.l3portmanager.On("CheckPortExists", "port-id-x").Return(true, nil).Times(1)
 
-	err := f.portmapper.MapService(s)
+	_, err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
@@ -510,6 +898,27 @@ func TestMapServiceWithAnnotationInjectsThePortWithoutAllocation(t *testing.T) {
 	assert.Equal(t, "port-id-x", portID)
 }
 
+func TestMapServiceWithAnnotationRejectsUnknownPortByDefault(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+	s.Annotations = make(map[string]string)
+	s.Annotations[AnnotationInboundPort] = "port-id-x"
+
+	f.l3portmanager.On("CheckPortExists", "port-id-x").Return(true, nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	_, err := f.portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+
+	usedPorts, err := f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port-id-1"}, usedPorts)
+}
+
 func TestMapServiceWithAnnotationRejectsInvalidPort(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service-1")
@@ -517,9 +926,9 @@ func TestMapServiceWithAnnotationRejectsInvalidPort(t *testing.T) {
 	s.Annotations[AnnotationInboundPort] = "port-id-x"
 
 	f.l3portmanager.On("CheckPortExists", "port-id-x").Return(false, nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
-	err := f.portmapper.MapService(s)
+	_, err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
@@ -535,10 +944,10 @@ func TestMapServiceWithAnnotationIsMovedToAnotherPortOnConflict(t *testing.T) {
 	s2.Annotations = make(map[string]string)
 	s2.Annotations[AnnotationInboundPort] = "port-id-1"
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s1))
@@ -547,7 +956,7 @@ func TestMapServiceWithAnnotationIsMovedToAnotherPortOnConflict(t *testing.T) {
 
 	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil).Times(1)
 
-	err = f.portmapper.MapService(s2)
+	_, err = f.portmapper.MapService(s2)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s2))
@@ -559,9 +968,9 @@ func TestSetAvailableL3PortsWithSameSetOfPortsHasNoVisibleEffect(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id", nil)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil)
 
-	err := f.portmapper.MapService(s)
+	_, err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
 
 	evicted, err := f.portmapper.SetAvailableL3Ports([]string{"port-id"})
@@ -581,9 +990,9 @@ func TestSetAvailableL3PortsWithMorePortsHasNoVisibleEffect(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id", nil)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil)
 
-	err := f.portmapper.MapService(s)
+	_, err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
 
 	evicted, err := f.portmapper.SetAvailableL3Ports([]string{"some-port", "port-id"})
@@ -603,9 +1012,9 @@ func TestSetAvailableL3PortsWithMissingPortEvictsService(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id", nil)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil)
 
-	err := f.portmapper.MapService(s)
+	_, err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
 
 	evicted, err := f.portmapper.SetAvailableL3Ports([]string{})
@@ -620,9 +1029,9 @@ func TestSetAvailableL3PortsWithMissingPortRemovesPort(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id", nil)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil)
 
-	err := f.portmapper.MapService(s)
+	_, err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
 
 	evicted, err := f.portmapper.SetAvailableL3Ports([]string{})
@@ -639,13 +1048,13 @@ func TestSetAvailableL3PortsWithMissingPortOnlyEvictsAffectedService(t *testing.
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
-	err = f.portmapper.MapService(s2)
+	_, err = f.portmapper.MapService(s2)
 	assert.Nil(t, err)
 
 	evicted, err := f.portmapper.SetAvailableL3Ports([]string{"port-id-2"})
@@ -673,13 +1082,13 @@ func TestMapServiceMakesServiceAppearInModel(t *testing.T) {
 	s2i := model.FromService(s2)
 	s2k := s2i.ToKey()
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
-	err = f.portmapper.MapService(s2)
+	_, err = f.portmapper.MapService(s2)
 	assert.Nil(t, err)
 
 	pmmodel := f.portmapper.GetModel()
@@ -705,15 +1114,15 @@ func TestServiceWithInvalidPortIsRemapped(t *testing.T) {
 	f := newPortMapperFixture()
 	s1 := newPortMapperService("test-service-1")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
-	err := f.portmapper.MapService(s1)
+	_, err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	// Port exists, expect no change
 	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil).Times(1)
 
-	err = f.portmapper.MapService(s1)
+	_, err = f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s1))
@@ -722,12 +1131,1631 @@ func TestServiceWithInvalidPortIsRemapped(t *testing.T) {
 
 	// Port does not exist, expect change
 	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(false, nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
-	err = f.portmapper.MapService(s1)
+	_, err = f.portmapper.MapService(s1)
 	assert.Nil(t, err)
 
 	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s1))
 	assert.Nil(t, err)
 	assert.Equal(t, "port-id-2", portID)
 }
+
+func TestMapServicePublishesMappedEvent(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil).Times(1)
+
+	_, err := f.portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []model.AllocationEvent{
+		{
+			Service:  model.FromService(s),
+			L3PortID: "port-id",
+			Ports: []model.L4Port{
+				{Protocol: corev1.ProtocolTCP, Port: 80},
+				{Protocol: corev1.ProtocolTCP, Port: 443},
+			},
+		},
+	}, f.publisher.Mapped)
+}
+
+func TestRemappingTheSameServiceDoesNotPublishAgain(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", "port-id").Return(true, nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	assert.Equal(t, 1, len(f.publisher.Mapped))
+	assert.Equal(t, 0, len(f.publisher.Unmapped))
+}
+
+func TestUnmapServicePublishesUnmappedEventOnlyForMappedServices(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s1)))
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s2)))
+
+	assert.Equal(t, 1, len(f.publisher.Unmapped))
+	assert.Equal(t, model.FromService(s1), f.publisher.Unmapped[0].Service)
+	assert.Equal(t, "port-id", f.publisher.Unmapped[0].L3PortID)
+}
+
+func TestSetAvailableL3PortsPublishesEvictedEvent(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	_, err := f.portmapper.SetAvailableL3Ports([]string{})
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, len(f.publisher.Evicted))
+	assert.Equal(t, model.FromService(s), f.publisher.Evicted[0].Service)
+	assert.Equal(t, "port-id", f.publisher.Evicted[0].L3PortID)
+}
+
+func TestMapServiceWithUnchangedServiceIsANoop(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", "port-id").Return(true, nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id", portID)
+
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 1)
+	f.l3portmanager.AssertExpectations(t)
+}
+
+func TestMapServiceRejectsReservedPorts(t *testing.T) {
+	l3portmanager := ostesting.NewMockL3PortManager()
+	l3portmanager.On("GetAvailablePorts").Return([]string{}, nil).Times(1)
+	l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil).Times(1)
+
+	portmapper, err := NewPortMapper(l3portmanager, WithReservedPorts([]int32{22, 443}))
+	assert.Nil(t, err)
+
+	s1 := newPortMapperService("test-service-1")
+	s2 := newService("test-service-2")
+	s2.Spec.Ports = []corev1.ServicePort{
+		{Protocol: corev1.ProtocolTCP, Port: 80},
+	}
+
+	_, err = portmapper.MapService(s1)
+	assert.True(t, errors.Is(err, ErrReservedPort))
+
+	_, err = portmapper.GetServiceL3Port(model.FromService(s1))
+	assert.Equal(t, ErrServiceNotMapped, err)
+
+	_, err = portmapper.MapService(s2)
+	assert.Nil(t, err)
+
+	portID, err := portmapper.GetServiceL3Port(model.FromService(s2))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id", portID)
+}
+
+func TestGetFullAssignmentGroupsServicesByPort(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-1"}
+	s2 := newPortMapperService("test-service-2")
+	s2.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-1"}
+	s3 := newPortMapperService("test-service-3")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("GetExternalAddress", "port-id-1").Return("203.0.113.1", "", nil).Times(1)
+	f.l3portmanager.On("GetExternalAddress", "port-id-2").Return("203.0.113.2", "", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s3)))
+
+	ports := []model.L4Port{
+		{Protocol: corev1.ProtocolTCP, Port: 80},
+		{Protocol: corev1.ProtocolTCP, Port: 443},
+	}
+
+	assignment, err := f.portmapper.GetFullAssignment()
+	assert.Nil(t, err)
+	assert.Equal(t, []model.FIPAssignment{
+		{
+			Address:  "203.0.113.1",
+			L3PortID: "port-id-1",
+			Services: []model.ServiceAssignment{
+				{Service: model.FromService(s1), Ports: ports, ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyCluster},
+				{Service: model.FromService(s2), Ports: ports, ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyCluster},
+			},
+		},
+		{
+			Address:  "203.0.113.2",
+			L3PortID: "port-id-2",
+			Services: []model.ServiceAssignment{
+				{Service: model.FromService(s3), Ports: ports, ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyCluster},
+			},
+		},
+	}, assignment)
+}
+
+func TestGetFullAssignmentReportsExternalTrafficPolicy(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+	s.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyLocal
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil)
+	f.l3portmanager.On("GetExternalAddress", "port-id-1").Return("203.0.113.1", "", nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	assignment, err := f.portmapper.GetFullAssignment()
+	assert.Nil(t, err)
+	assert.Equal(t, corev1.ServiceExternalTrafficPolicyLocal, assignment[0].Services[0].ExternalTrafficPolicy)
+
+	// switching the policy keeps the service on its port
+	s.Spec.ExternalTrafficPolicy = ""
+	result, err := f.portmapper.MapService(s)
+	assert.Nil(t, err)
+	assert.Equal(t, model.MapResult{Outcome: model.MapOutcomeUnchanged, L3PortID: "port-id-1"}, result)
+
+	assignment, err = f.portmapper.GetFullAssignment()
+	assert.Nil(t, err)
+	assert.Equal(t, corev1.ServiceExternalTrafficPolicyCluster, assignment[0].Services[0].ExternalTrafficPolicy)
+}
+
+func TestGetFullAssignmentPropagatesAddressError(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+
+	someError := fmt.Errorf("random error")
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("GetExternalAddress", "port-id-1").Return("", "", someError).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	assignment, err := f.portmapper.GetFullAssignment()
+	assert.Nil(t, assignment)
+	assert.Equal(t, someError, err)
+}
+
+func TestEvacuatePortMovesServicesAway(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s2.Spec.Ports[0].Port = 8080
+	s2.Spec.Ports[1].Port = 8443
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+
+	moved, err := f.portmapper.EvacuatePort("port-id-1")
+	assert.Nil(t, err)
+	assert.Equal(t, []model.ServiceIdentifier{model.FromService(s1), model.FromService(s2)}, moved)
+
+	for _, s := range []*corev1.Service{s1, s2} {
+		portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+		assert.Nil(t, err)
+		assert.Equal(t, "port-id-2", portID)
+	}
+
+	usedPorts, err := f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port-id-2"}, usedPorts)
+	assert.Equal(t, 4, len(f.publisher.Mapped))
+}
+
+func TestEvacuatedPortIsNotReused(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s2.Spec.Ports[0].Port = 8080
+	s2.Spec.Ports[1].Port = 8443
+	s2.Annotations = map[string]string{AnnotationInboundPort: "port-id-1"}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", "port-id-2").Return(true, nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+
+	_, err := f.portmapper.EvacuatePort("port-id-1")
+	assert.Nil(t, err)
+
+	// the moved service stays away even if its annotation still points to
+	// the degraded port
+	s1.Annotations = map[string]string{AnnotationInboundPort: "port-id-1"}
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	// new services are not placed on the degraded port either
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+
+	for _, s := range []*corev1.Service{s1, s2} {
+		portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+		assert.Nil(t, err)
+		assert.Equal(t, "port-id-2", portID)
+	}
+}
+
+func TestServiceLeftOnDegradedPortIsRelocatedWhenRemapped(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("", errors.New("quota exceeded")).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", mock.Anything).Return(true, nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	_, err := f.portmapper.EvacuatePort("port-id-1")
+	assert.NotNil(t, err)
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+
+	result, err := f.portmapper.MapService(s)
+	assert.Nil(t, err)
+	assert.NotEqual(t, model.MapOutcomeUnchanged, result.Outcome)
+	assert.Equal(t, "port-id-2", result.L3PortID)
+
+	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", portID)
+}
+
+func TestClearDegradedPortAllowsReuse(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	_, err := f.portmapper.EvacuatePort("port-id-1")
+	assert.Nil(t, err)
+
+	f.portmapper.ClearDegradedPort("port-id-1")
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s2))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+}
+
+func TestGetPortFreeCapacityCountsUnallocatedPortsBelowCeiling(t *testing.T) {
+	f := newPortMapperFixture(WithL4PortCeiling(1024), WithReservedPorts([]int32{22}))
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolUDP, 53)
+	s3 := newPortMapperServiceWithPort("test-service-3", corev1.ProtocolTCP, 8080)
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s3)))
+
+	free, err := f.portmapper.GetPortFreeCapacity("port-id-1")
+	assert.Nil(t, err)
+	// TCP and UDP up to 1024, minus TCP/80, TCP/443, UDP/53 and the
+	// reserved port 22 for both protocols; TCP/8080 is above the ceiling
+	assert.Equal(t, 2*1024-3-2, free)
+}
+
+func TestGetPortFreeCapacityCountsAllPortsByDefault(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	free, err := f.portmapper.GetPortFreeCapacity("port-id-1")
+	assert.Nil(t, err)
+	assert.Equal(t, 2*65535-2, free)
+}
+
+func TestGetPortFreeCapacityIsZeroForDegradedPort(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	_, err := f.portmapper.EvacuatePort("port-id-1")
+	assert.Nil(t, err)
+
+	free, err := f.portmapper.GetPortFreeCapacity("port-id-1")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, free)
+}
+
+func TestGetPortFreeCapacityRejectsUnknownPort(t *testing.T) {
+	f := newPortMapperFixture()
+
+	_, err := f.portmapper.GetPortFreeCapacity("port-id-x")
+	assert.True(t, errors.Is(err, ErrUnknownL3Port))
+}
+
+func TestEvacuatePortRejectsUnknownPort(t *testing.T) {
+	f := newPortMapperFixture()
+
+	moved, err := f.portmapper.EvacuatePort("port-id-x")
+	assert.Nil(t, moved)
+	assert.True(t, errors.Is(err, ErrUnknownL3Port))
+}
+
+func TestMapServiceRejectsInvalidEmptyBackendsAnnotation(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+	s.Annotations = map[string]string{AnnotationEmptyBackends: "maybe"}
+
+	_, err := f.portmapper.MapService(s)
+	assert.NotNil(t, err)
+
+	conflicts := f.portmapper.GetConflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, model.ConflictRejected, conflicts[0].Type)
+	f.l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+}
+
+const testAnnotationSSLPolicy = "example.com/ssl-policy"
+
+// requireSSLPolicy rejects services exposing HTTPS which do not set an SSL
+// policy.
+type requireSSLPolicy struct {
+	seen []ServiceAnnotations
+}
+
+func (p *requireSSLPolicy) Validate(svc *corev1.Service, annotations ServiceAnnotations) error {
+	p.seen = append(p.seen, annotations)
+	for _, port := range svc.Spec.Ports {
+		if port.Port == 443 && svc.Annotations[testAnnotationSSLPolicy] == "" {
+			return fmt.Errorf("HTTPS services must set the %s annotation", testAnnotationSSLPolicy)
+		}
+	}
+	return nil
+}
+
+func TestPlacementPolicyRejectsHTTPSServiceWithoutSSLPolicy(t *testing.T) {
+	f := newPortMapperFixture(WithPlacementPolicy(&requireSSLPolicy{}))
+	s := newPortMapperService("test-service-1")
+
+	_, err := f.portmapper.MapService(s)
+	assert.NotNil(t, err)
+
+	conflicts := f.portmapper.GetConflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, model.ConflictRejected, conflicts[0].Type)
+	assert.Contains(t, conflicts[0].Details, testAnnotationSSLPolicy)
+
+	_, err = f.portmapper.GetServiceL3Port(model.FromService(s))
+	assert.NotNil(t, err)
+	f.l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+}
+
+func TestPlacementPolicyAcceptsHTTPSServiceWithSSLPolicy(t *testing.T) {
+	policy := &requireSSLPolicy{}
+	f := newPortMapperFixture(WithPlacementPolicy(policy))
+	s := newPortMapperService("test-service-1")
+	s.Annotations = map[string]string{
+		testAnnotationSSLPolicy:        "modern",
+		AnnotationSharedListenerGroup:  "group-1",
+		AnnotationSharedListenerWeight: "3",
+	}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	assert.Equal(t, 0, len(f.portmapper.GetConflicts()))
+
+	assert.Equal(t, []ServiceAnnotations{
+		{
+			SharedListenerGroup:  "group-1",
+			SharedListenerWeight: 3,
+			EmptyBackends:        EmptyBackendsKeep,
+		},
+	}, policy.seen)
+}
+
+func TestPlacementPolicyIsNotConsultedForInvalidAnnotations(t *testing.T) {
+	policy := &requireSSLPolicy{}
+	f := newPortMapperFixture(WithPlacementPolicy(policy))
+	s := newPortMapperService("test-service-1")
+	s.Annotations = map[string]string{AnnotationEmptyBackends: "maybe"}
+
+	assert.NotNil(t, mapError(f.portmapper.MapService(s)))
+	assert.Equal(t, 0, len(policy.seen))
+}
+
+func TestRevalidatePortsRelocatesServicesFromVanishedPort(t *testing.T) {
+	f := newPortMapperFixture(WithTrustPreferredPort(true))
+	s := newPortMapperService("test-service-1")
+	s.Annotations = map[string]string{AnnotationInboundPort: "port-id-x"}
+
+	f.l3portmanager.On("CheckPortExists", "port-id-x").Return(true, nil).Times(2)
+	f.l3portmanager.On("CheckPortExists", "port-id-x").Return(false, nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	// the port still exists on the first validation
+	moved, err := f.portmapper.RevalidatePorts()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(moved))
+
+	moved, err = f.portmapper.RevalidatePorts()
+	assert.Nil(t, err)
+	assert.Equal(t, []model.ServiceIdentifier{model.FromService(s)}, moved)
+
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+
+	usedPorts, err := f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port-id-1"}, usedPorts)
+
+	conflicts := f.portmapper.GetConflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, model.ConflictRelocated, conflicts[0].Type)
+	f.l3portmanager.AssertExpectations(t)
+}
+
+func TestMapServiceRetriesIfProvisionedPortIsInUse(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(2)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s1))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+
+	portID, err = f.portmapper.GetServiceL3Port(model.FromService(s2))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", portID)
+
+	l3port := f.portmapper.(*PortMapperImpl).l3ports["port-id-1"]
+	assert.Equal(t, map[model.L4Port]string{
+		{Protocol: corev1.ProtocolTCP, Port: 80}:  model.FromService(s1).ToKey(),
+		{Protocol: corev1.ProtocolTCP, Port: 443}: model.FromService(s1).ToKey(),
+	}, l3port.Allocations)
+
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 3)
+}
+
+func TestMapServiceGivesUpIfProvisionedPortIsAlwaysInUse(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+
+	_, err := f.portmapper.MapService(s2)
+	assert.Equal(t, ErrL3PortInUse, err)
+
+	_, err = f.portmapper.GetServiceL3Port(model.FromService(s2))
+	assert.Equal(t, ErrServiceNotMapped, err)
+
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s1))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+	assert.Equal(t, 2, len(f.portmapper.(*PortMapperImpl).l3ports["port-id-1"].Allocations))
+}
+
+func TestMapServicesColocatesServicesWithSamePreferredPort(t *testing.T) {
+	f := newPortMapperFixture(WithTrustPreferredPort(true))
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationInboundPort: "port-id-x"}
+	s2 := newPortMapperService("test-service-2")
+	s2.Spec.Ports[0].Port = 8080
+	s2.Spec.Ports[1].Port = 8443
+	s2.Annotations = map[string]string{AnnotationInboundPort: "port-id-x"}
+
+	f.l3portmanager.On("CheckPortExists", "port-id-x").Return(true, nil)
+
+	err := f.portmapper.MapServices([]*corev1.Service{s2, s1})
+	assert.Nil(t, err)
+
+	for _, s := range []*corev1.Service{s1, s2} {
+		portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+		assert.Nil(t, err)
+		assert.Equal(t, "port-id-x", portID)
+	}
+	f.l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+}
+
+func TestMapServicesRelocatesConflictingServicesDeterministically(t *testing.T) {
+	for _, order := range [][]string{
+		{"test-service-1", "test-service-2"},
+		{"test-service-2", "test-service-1"},
+	} {
+		f := newPortMapperFixture(WithTrustPreferredPort(true))
+		svcs := []*corev1.Service{}
+		for _, name := range order {
+			s := newPortMapperService(name)
+			s.Annotations = map[string]string{AnnotationInboundPort: "port-id-x"}
+			svcs = append(svcs, s)
+		}
+
+		f.l3portmanager.On("CheckPortExists", "port-id-x").Return(true, nil)
+		f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+		err := f.portmapper.MapServices(svcs)
+		assert.Nil(t, err)
+
+		portID, err := f.portmapper.GetServiceL3Port(model.ServiceIdentifier{Namespace: "default", Name: "test-service-1"})
+		assert.Nil(t, err)
+		assert.Equal(t, "port-id-x", portID)
+
+		portID, err = f.portmapper.GetServiceL3Port(model.ServiceIdentifier{Namespace: "default", Name: "test-service-2"})
+		assert.Nil(t, err)
+		assert.Equal(t, "port-id-1", portID)
+	}
+}
+
+func TestMapServiceSelectsTheSamePortRegardlessOfPortOrder(t *testing.T) {
+	orders := [][]string{
+		{"port-id-1", "port-id-2", "port-id-3"},
+		{"port-id-3", "port-id-2", "port-id-1"},
+		{"port-id-2", "port-id-3", "port-id-1"},
+	}
+
+	for i := 0; i < 10; i++ {
+		for _, order := range orders {
+			l3portmanager := ostesting.NewMockL3PortManager()
+			l3portmanager.On("GetAvailablePorts").Return(order, nil).Times(1)
+
+			portmapper, err := NewPortMapper(l3portmanager)
+			assert.Nil(t, err)
+
+			s1 := newPortMapperService("test-service-1")
+			s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolTCP, 80)
+			assert.Nil(t, mapError(portmapper.MapService(s1)))
+			assert.Nil(t, mapError(portmapper.MapService(s2)))
+
+			portID, err := portmapper.GetServiceL3Port(model.FromService(s1))
+			assert.Nil(t, err)
+			assert.Equal(t, "port-id-1", portID)
+
+			// port-id-1 is taken for TCP/80, the next port by ID is used
+			portID, err = portmapper.GetServiceL3Port(model.FromService(s2))
+			assert.Nil(t, err)
+			assert.Equal(t, "port-id-2", portID)
+
+			l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+		}
+	}
+}
+
+func TestMapServicesMapsRemainingServicesOnError(t *testing.T) {
+	f := newPortMapperFixture(WithReservedPorts([]int32{443}))
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s2.Spec.Ports = s2.Spec.Ports[:1]
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	err := f.portmapper.MapServices([]*corev1.Service{s1, s2})
+	assert.True(t, errors.Is(err, ErrReservedPort))
+
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s2))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+}
+
+func TestMapServicePassesServiceKeyToProvisionPort(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+
+	f.l3portmanager.On("ProvisionPort", "default/test-service-1").Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	f.l3portmanager.AssertExpectations(t)
+}
+
+func TestMapServiceMigratesAllocationsOnProtocolChange(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+	s.Spec.Ports = s.Spec.Ports[:1]
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil)
+	f.l3portmanager.On("GetExternalAddress", "port-id-1").Return("203.0.113.1", "", nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	s.Spec.Ports[0].Protocol = corev1.ProtocolUDP
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	udpOnly := []model.L4Port{{Protocol: corev1.ProtocolUDP, Port: 80}}
+
+	assignment, err := f.portmapper.GetFullAssignment()
+	assert.Nil(t, err)
+	assert.Equal(t, []model.FIPAssignment{
+		{
+			Address:  "203.0.113.1",
+			L3PortID: "port-id-1",
+			Services: []model.ServiceAssignment{
+				{Service: model.FromService(s), Ports: udpOnly, ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyCluster},
+			},
+		},
+	}, assignment)
+
+	assert.Equal(t, 2, len(f.publisher.Mapped))
+	assert.Equal(t, udpOnly, f.publisher.Mapped[1].Ports)
+
+	// no stale TCP allocation keeps the port in use
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s)))
+	usedPorts, err := f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, usedPorts)
+
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 1)
+}
+
+func TestEstimateProvisionsMatchesActualProvisions(t *testing.T) {
+	f := newPortMapperFixture()
+	existing := newPortMapperService("test-service-0")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-3", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(existing)))
+
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s3 := newPortMapperService("test-service-3")
+	s3.Spec.Ports[0].Port = 8080
+	s3.Spec.Ports[1].Port = 8443
+	svcs := []*corev1.Service{s1, s2, s3}
+
+	estimate, err := f.portmapper.EstimateProvisions(svcs)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, estimate)
+
+	// the estimate must not have touched the state
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 1)
+	_, err = f.portmapper.GetServiceL3Port(model.FromService(s1))
+	assert.Equal(t, ErrServiceNotMapped, err)
+	assert.Equal(t, 1, len(f.publisher.Mapped))
+
+	assert.Nil(t, f.portmapper.MapServices(svcs))
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 1+estimate)
+}
+
+func TestEstimateProvisionsForwardsMappingErrors(t *testing.T) {
+	f := newPortMapperFixture(WithReservedPorts([]int32{443}))
+	s := newPortMapperService("test-service-1")
+
+	estimate, err := f.portmapper.EstimateProvisions([]*corev1.Service{s})
+	assert.Equal(t, 0, estimate)
+	assert.True(t, errors.Is(err, ErrReservedPort))
+}
+
+type fakeClock struct {
+	current time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.current
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.current = c.current.Add(d)
+}
+
+func newIdlePortFixture(t *testing.T, opts ...PortMapperOption) (*portMapperFixture, *fakeClock) {
+	f := newPortMapperFixture(opts...)
+	clock := &fakeClock{current: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	f.portmapper.(*PortMapperImpl).now = clock.now
+
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s1)))
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s2)))
+
+	return f, clock
+}
+
+func TestGetUsedL3PortsKeepsIdlePortFloor(t *testing.T) {
+	f, _ := newIdlePortFixture(t, WithIdlePortFloor(1))
+
+	usedPorts, err := f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port-id-1"}, usedPorts)
+	assert.Equal(t, 1, f.portmapper.GetL3PortCount())
+
+	// the floor is kept indefinitely
+	usedPorts, err = f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port-id-1"}, usedPorts)
+}
+
+func TestGetUsedL3PortsKeepsIdlePortsWithinGracePeriod(t *testing.T) {
+	f, clock := newIdlePortFixture(t, WithIdlePortGracePeriod(10*time.Minute))
+
+	usedPorts, err := f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"port-id-1", "port-id-2"}, usedPorts)
+
+	clock.advance(9 * time.Minute)
+	usedPorts, err = f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"port-id-1", "port-id-2"}, usedPorts)
+
+	clock.advance(time.Minute)
+	usedPorts, err = f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, usedPorts)
+	assert.Equal(t, 0, f.portmapper.GetL3PortCount())
+}
+
+func TestGetUsedL3PortsReleasesIdlePortsBeyondFloorAfterGracePeriod(t *testing.T) {
+	f, clock := newIdlePortFixture(t, WithIdlePortFloor(1), WithIdlePortGracePeriod(10*time.Minute))
+
+	usedPorts, err := f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(usedPorts))
+
+	clock.advance(time.Hour)
+	usedPorts, err = f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port-id-1"}, usedPorts)
+}
+
+func TestWarmIdlePortIsReusedWithoutProvisioning(t *testing.T) {
+	f, _ := newIdlePortFixture(t, WithIdlePortFloor(1))
+
+	_, err := f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+
+	s3 := newPortMapperService("test-service-3")
+	assert.Nil(t, mapError(f.portmapper.MapService(s3)))
+
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s3))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 2)
+}
+
+func TestGetConflictsIsEmptyByDefault(t *testing.T) {
+	f := newPortMapperFixture()
+	assert.Equal(t, []model.Conflict{}, f.portmapper.GetConflicts())
+}
+
+func TestGetConflictsReportsRelocatedAndCapacityBlockedServices(t *testing.T) {
+	portmapper, l3portmanager := newPortMapperWithAllocator(t, ReuseOnlyPortAllocator{}, []string{"port-id-1", "port-id-2"})
+	s1 := newPortMapperService("test-service-1")
+
+	s2 := newPortMapperService("test-service-2")
+	s2.Annotations = map[string]string{AnnotationInboundPort: "port-id-1"}
+
+	s3 := newPortMapperService("test-service-3")
+
+	l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil)
+	l3portmanager.On("CheckPortExists", "port-id-2").Return(true, nil)
+
+	assert.Nil(t, mapError(portmapper.MapService(s1)))
+	assert.Nil(t, mapError(portmapper.MapService(s2)))
+	assert.Equal(t, ErrNoSuitablePort, mapError(portmapper.MapService(s3)))
+
+	conflicts := portmapper.GetConflicts()
+	assert.Equal(t, 2, len(conflicts))
+
+	assert.Equal(t, model.ConflictRelocated, conflicts[0].Type)
+	assert.Equal(t, model.FromService(s2), conflicts[0].Service)
+	assert.Equal(t, "port-id-2", conflicts[0].L3PortID)
+	assert.Contains(t, conflicts[0].Details, "port-id-1")
+
+	assert.Equal(t, model.ConflictCapacityBlocked, conflicts[1].Type)
+	assert.Equal(t, model.FromService(s3), conflicts[1].Service)
+	assert.Equal(t, "", conflicts[1].L3PortID)
+
+	// the relocation stays visible while the service remains on the new port
+	s2.Annotations[AnnotationInboundPort] = "port-id-2"
+	assert.Nil(t, mapError(portmapper.MapService(s2)))
+	assert.Equal(t, 2, len(portmapper.GetConflicts()))
+
+	assert.Nil(t, portmapper.UnmapService(model.FromService(s2)))
+	assert.Nil(t, portmapper.UnmapService(model.FromService(s3)))
+	assert.Equal(t, []model.Conflict{}, portmapper.GetConflicts())
+}
+
+func TestGetConflictsReportsRejectedService(t *testing.T) {
+	f := newPortMapperFixture(WithReservedPorts([]int32{443}))
+	s := newPortMapperService("test-service-1")
+
+	assert.True(t, errors.Is(mapError(f.portmapper.MapService(s)), ErrReservedPort))
+
+	conflicts := f.portmapper.GetConflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, model.ConflictRejected, conflicts[0].Type)
+	assert.Equal(t, model.FromService(s), conflicts[0].Service)
+
+	// once the service is changed to be acceptable, the conflict goes away
+	s.Spec.Ports = s.Spec.Ports[:1]
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	assert.Equal(t, []model.Conflict{}, f.portmapper.GetConflicts())
+}
+
+func TestMapServiceRejectsNodePortCollisionWithOtherService(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s1.Spec.Ports[0].NodePort = 30080
+	s1.Spec.Ports[1].NodePort = 30443
+	s2 := newPortMapperService("test-service-2")
+	s2.Spec.Ports[0].NodePort = 30081
+	s2.Spec.Ports[1].NodePort = 30443
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+
+	_, err := f.portmapper.MapService(s2)
+	assert.True(t, errors.Is(err, ErrNodePortConflict))
+	assert.Contains(t, err.Error(), "default/test-service-1")
+
+	_, err = f.portmapper.GetServiceL3Port(model.FromService(s2))
+	assert.Equal(t, ErrServiceNotMapped, err)
+
+	// once the other service is gone, the NodePort is free to use
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s1)))
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+}
+
+func TestMapServiceRejectsDuplicateNodePortWithinService(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+	s.Spec.Ports[0].NodePort = 30080
+	s.Spec.Ports[1].NodePort = 30080
+
+	_, err := f.portmapper.MapService(s)
+	assert.True(t, errors.Is(err, ErrNodePortConflict))
+}
+
+func TestMapServiceAllowsSameNodePortForDifferentProtocols(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+	s.Spec.Ports = s.Spec.Ports[:1]
+	s.Spec.Ports[0].NodePort = 30080
+	s2 := newPortMapperService("test-service-2")
+	s2.Spec.Ports = s2.Spec.Ports[1:]
+	s2.Spec.Ports[0].Protocol = corev1.ProtocolUDP
+	s2.Spec.Ports[0].NodePort = 30080
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+}
+
+// Map two services which conflict with each other, so that port-id-2 is
+// provisioned before port-id-1, and return the port a third service which
+// fits on both is placed on.
+func placeServiceAmongPortsOfDifferentAge(t *testing.T, opts ...PortMapperOption) string {
+	f := newPortMapperFixture(opts...)
+	clock := &fakeClock{current: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	f.portmapper.(*PortMapperImpl).now = clock.now
+
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s3 := newPortMapperServiceWithPort("test-service-3", corev1.ProtocolTCP, 8080)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	clock.advance(time.Minute)
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s3)))
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 2)
+
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s3))
+	assert.Nil(t, err)
+	return portID
+}
+
+func TestMapServicePrefersPortsByIDByDefault(t *testing.T) {
+	assert.Equal(t, "port-id-1", placeServiceAmongPortsOfDifferentAge(t))
+}
+
+func TestMapServiceWithPlacementAgeOldestPrefersOldestPort(t *testing.T) {
+	assert.Equal(t, "port-id-2", placeServiceAmongPortsOfDifferentAge(t, WithPlacementAge(PlacementAgeOldest)))
+}
+
+func TestMapServiceWithPlacementAgeNewestPrefersNewestPort(t *testing.T) {
+	assert.Equal(t, "port-id-1", placeServiceAmongPortsOfDifferentAge(t, WithPlacementAge(PlacementAgeNewest)))
+}
+
+func TestPlacementAgeTreatsPreexistingPortsAsOldest(t *testing.T) {
+	l3portmanager := ostesting.NewMockL3PortManager()
+	l3portmanager.On("GetAvailablePorts").Return([]string{"port-id-2"}, nil).Times(1)
+	l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	portmapper, err := NewPortMapper(l3portmanager, WithPlacementAge(PlacementAgeOldest))
+	assert.Nil(t, err)
+
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s3 := newPortMapperServiceWithPort("test-service-3", corev1.ProtocolTCP, 8080)
+	for _, s := range []*corev1.Service{s1, s2, s3} {
+		assert.Nil(t, mapError(portmapper.MapService(s)))
+	}
+
+	portID, err := portmapper.GetServiceL3Port(model.FromService(s3))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", portID)
+}
+
+// Capture the log output at the given verbosity until the returned function
+// is called.
+func captureLogs(t *testing.T, verbosity string) (*bytes.Buffer, func()) {
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	assert.Nil(t, flags.Set("logtostderr", "false"))
+	assert.Nil(t, flags.Set("v", verbosity))
+
+	buf := &bytes.Buffer{}
+	klog.SetOutput(buf)
+	return buf, func() {
+		klog.SetOutput(os.Stderr)
+		flags.Set("v", "0")
+		flags.Set("logtostderr", "true")
+	}
+}
+
+func TestMapServiceLogsAllocationAtV2(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("GetExternalAddress", "port-id-1").Return("203.0.113.1", "", nil).Times(1)
+
+	logs, restore := captureLogs(t, "2")
+	_, err := f.portmapper.MapService(s)
+	restore()
+	assert.Nil(t, err)
+
+	assert.Contains(t, logs.String(), `mapped service service="default/test-service-1" l3-port="port-id-1" address="203.0.113.1" ports="TCP/80,TCP/443" provisioned=true`)
+	f.l3portmanager.AssertExpectations(t)
+}
+
+func TestMapServiceDoesNotLookUpAddressBelowV2(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	logs, restore := captureLogs(t, "1")
+	_, err := f.portmapper.MapService(s)
+	restore()
+	assert.Nil(t, err)
+
+	assert.NotContains(t, logs.String(), "mapped service")
+	f.l3portmanager.AssertNotCalled(t, "GetExternalAddress", mock.Anything)
+}
+
+func TestConsolidateRepacksFragmentedPorts(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s3 := newPortMapperService("test-service-3")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-3", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", mock.Anything).Return(true, nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s3)))
+
+	// the services stop conflicting, but stay on their ports
+	s2.Spec.Ports[0].Port = 8080
+	s2.Spec.Ports[1].Port = 8443
+	s3.Spec.Ports[0].Port = 9080
+	s3.Spec.Ports[1].Port = 9443
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s3)))
+	assert.Equal(t, 3, f.portmapper.GetL3PortCount())
+
+	moved, err := f.portmapper.Consolidate()
+	assert.Nil(t, err)
+	assert.Equal(t, []model.ServiceIdentifier{model.FromService(s1), model.FromService(s2)}, moved)
+
+	for _, s := range []*corev1.Service{s1, s2, s3} {
+		portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+		assert.Nil(t, err)
+		assert.Equal(t, "port-id-3", portID)
+	}
+
+	usedPorts, err := f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port-id-3"}, usedPorts)
+	assert.Equal(t, 1, f.portmapper.GetL3PortCount())
+	f.l3portmanager.AssertCalled(t, "ReleasePort", "port-id-1")
+	f.l3portmanager.AssertCalled(t, "ReleasePort", "port-id-2")
+}
+
+func TestConsolidateKeepsPortsWhichCannotBeEmptied(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s3 := newPortMapperService("test-service-3")
+	s3.Spec.Ports[0].Port = 8080
+	s3.Spec.Ports = s3.Spec.Ports[:1]
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s3)))
+
+	// s3 would fit onto port-id-2, but s1 cannot follow it
+	moved, err := f.portmapper.Consolidate()
+	assert.Nil(t, err)
+	assert.Equal(t, []model.ServiceIdentifier{}, moved)
+	assert.Equal(t, 2, f.portmapper.GetL3PortCount())
+	assert.Equal(t, map[string]string{
+		model.FromService(s1).ToKey(): "port-id-1",
+		model.FromService(s2).ToKey(): "port-id-2",
+		model.FromService(s3).ToKey(): "port-id-1",
+	}, f.portmapper.GetModel())
+	f.l3portmanager.AssertNotCalled(t, "ReleasePort", mock.Anything)
+}
+
+func TestConsolidateDoesNotSplitSharedListenerGroup(t *testing.T) {
+	f := newPortMapperFixture(WithMaxServicesPerPort(2))
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	m1 := newPortMapperServiceWithPort("test-member-1", corev1.ProtocolTCP, 80)
+	m1.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-1"}
+	m2 := newPortMapperServiceWithPort("test-member-2", corev1.ProtocolTCP, 80)
+	m2.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-1"}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-3", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", mock.Anything).Return(true, nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, mapError(f.portmapper.MapService(m1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(m2)))
+
+	// port-id-1 and port-id-2 each have room for one member of the group only
+	s1.Spec.Ports[0].Port = 8080
+	s1.Spec.Ports[1].Port = 8443
+	s2.Spec.Ports[0].Port = 9080
+	s2.Spec.Ports[1].Port = 9443
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+
+	moved, err := f.portmapper.Consolidate()
+	assert.Nil(t, err)
+	assert.Equal(t, []model.ServiceIdentifier{model.FromService(s1)}, moved)
+	assert.Equal(t, map[string]string{
+		model.FromService(s1).ToKey(): "port-id-2",
+		model.FromService(s2).ToKey(): "port-id-2",
+		model.FromService(m1).ToKey(): "port-id-3",
+		model.FromService(m2).ToKey(): "port-id-3",
+	}, f.portmapper.GetModel())
+}
+
+func TestMapServiceReportsOutcome(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s2.Spec.Ports[0].Port = 8080
+	s2.Spec.Ports[1].Port = 8443
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(false, nil)
+
+	result, err := f.portmapper.MapService(s1)
+	assert.Nil(t, err)
+	assert.Equal(t, model.MapResult{Outcome: model.MapOutcomeNew, L3PortID: "port-id-1", Provisioned: true}, result)
+
+	result, err = f.portmapper.MapService(s2)
+	assert.Nil(t, err)
+	assert.Equal(t, model.MapResult{Outcome: model.MapOutcomeNew, L3PortID: "port-id-1"}, result)
+
+	result, err = f.portmapper.MapService(s1)
+	assert.Nil(t, err)
+	assert.Equal(t, model.MapResult{Outcome: model.MapOutcomeUnchanged, L3PortID: "port-id-1"}, result)
+
+	// the port vanished from the backend
+	result, err = f.portmapper.MapService(s1)
+	assert.Nil(t, err)
+	assert.Equal(t, model.MapResult{
+		Outcome:     model.MapOutcomeMoved,
+		L3PortID:    "port-id-2",
+		Provisioned: true,
+		Relocation:  "port port-id-1 does not exist anymore",
+	}, result)
+}
+
+func newServiceUnavailableError() error {
+	return gophercloud.ErrDefault503{
+		ErrUnexpectedResponseCode: gophercloud.ErrUnexpectedResponseCode{Actual: 503},
+	}
+}
+
+func TestProvisionPortIsRetriedWithBackoff(t *testing.T) {
+	f := newPortMapperFixture(WithProvisionRetries(4, time.Second))
+	sleeps := []time.Duration{}
+	f.portmapper.(*PortMapperImpl).sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	s := newPortMapperService("test-service-1")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("", newServiceUnavailableError()).Times(2)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	result, err := f.portmapper.MapService(s)
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", result.L3PortID)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, sleeps)
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 3)
+}
+
+func TestProvisionPortGivesUpAfterMaxAttempts(t *testing.T) {
+	f := newPortMapperFixture(WithProvisionRetries(3, time.Second))
+	sleeps := []time.Duration{}
+	f.portmapper.(*PortMapperImpl).sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	s := newPortMapperService("test-service-1")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("", newServiceUnavailableError())
+
+	_, err := f.portmapper.MapService(s)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "after 3 attempts")
+	var respErr gophercloud.ErrDefault503
+	assert.True(t, errors.As(err, &respErr))
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, sleeps)
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 3)
+	assert.Equal(t, 0, f.portmapper.GetL3PortCount())
+}
+
+func TestProvisionPortIsNotRetriedOnPermanentErrors(t *testing.T) {
+	f := newPortMapperFixture(WithProvisionRetries(3, time.Second))
+	f.portmapper.(*PortMapperImpl).sleep = func(d time.Duration) {
+		t.Errorf("unexpected retry after %s", d)
+	}
+	s := newPortMapperService("test-service-1")
+	forbidden := gophercloud.ErrDefault403{
+		ErrUnexpectedResponseCode: gophercloud.ErrUnexpectedResponseCode{Actual: 403},
+	}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("", forbidden)
+
+	_, err := f.portmapper.MapService(s)
+	assert.Equal(t, forbidden, err)
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 1)
+}
+
+func TestSetAvailableL3PortsSuggestsConflictFreeTargets(t *testing.T) {
+	portmapper, l3portmanager := newPortMapperWithAllocator(t, FirstFitPortAllocator{}, []string{"port-id-1", "port-id-2", "port-id-3"})
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s2.Spec.Ports[0].Port = 8080
+	s2.Spec.Ports[1].Port = 8443
+	s3 := newPortMapperService("test-service-3")
+	s3.Annotations = map[string]string{AnnotationInboundPort: "port-id-2"}
+
+	l3portmanager.On("CheckPortExists", mock.Anything).Return(true, nil)
+
+	assert.Nil(t, mapError(portmapper.MapService(s1)))
+	assert.Nil(t, mapError(portmapper.MapService(s2)))
+	assert.Nil(t, mapError(portmapper.MapService(s3)))
+
+	evictions, err := portmapper.SetAvailableL3PortsWithSuggestions([]string{"port-id-2", "port-id-3"})
+	assert.Nil(t, err)
+	// s1 conflicts with s3 on port-id-2
+	assert.Equal(t, []model.Eviction{
+		{Service: model.FromService(s1), SuggestedL3PortID: "port-id-3"},
+		{Service: model.FromService(s2), SuggestedL3PortID: "port-id-2"},
+	}, evictions)
+
+	// the suggestions can be taken as they are
+	for _, eviction := range evictions {
+		s := newPortMapperService(eviction.Service.Name)
+		if s.Name == s2.Name {
+			s.Spec.Ports = s2.Spec.Ports
+		}
+		s.Annotations = map[string]string{AnnotationInboundPort: eviction.SuggestedL3PortID}
+		result, err := portmapper.MapService(s)
+		assert.Nil(t, err)
+		assert.Equal(t, eviction.SuggestedL3PortID, result.L3PortID)
+	}
+	assert.Empty(t, portmapper.GetConflicts())
+}
+
+func TestSetAvailableL3PortsSuggestsNothingIfNoPortFits(t *testing.T) {
+	portmapper, _ := newPortMapperWithAllocator(t, ReuseOnlyPortAllocator{}, []string{"port-id-1", "port-id-2", "port-id-3"})
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+
+	assert.Nil(t, mapError(portmapper.MapService(s1)))
+	assert.Nil(t, mapError(portmapper.MapService(s2)))
+
+	// both services need the same L4 ports, but only one port remains
+	evictions, err := portmapper.SetAvailableL3PortsWithSuggestions([]string{"port-id-3"})
+	assert.Nil(t, err)
+	assert.Equal(t, []model.Eviction{
+		{Service: model.FromService(s1), SuggestedL3PortID: "port-id-3"},
+		{Service: model.FromService(s2)},
+	}, evictions)
+	assert.Equal(t, map[string]string{}, portmapper.GetModel())
+}
+
+func TestMapServiceRemapsServiceWithMissingPreferredPortByDefault(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+	s.Annotations = map[string]string{AnnotationInboundPort: "port-id-x"}
+
+	f.l3portmanager.On("CheckPortExists", "port-id-x").Return(false, nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	result, err := f.portmapper.MapService(s)
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", result.L3PortID)
+	assert.Equal(t, "port port-id-x does not exist anymore", result.Relocation)
+}
+
+func TestMapServiceRefusesServiceWithMissingPreferredPortUnderFailPolicy(t *testing.T) {
+	f := newPortMapperFixture(WithMissingPortPolicy(MissingPortFail))
+	s := newPortMapperService("test-service-1")
+	s.Annotations = map[string]string{AnnotationInboundPort: "port-id-x"}
+
+	f.l3portmanager.On("CheckPortExists", "port-id-x").Return(false, nil).Times(1)
+
+	_, err := f.portmapper.MapService(s)
+	assert.True(t, errors.Is(err, ErrPreferredPortMissing))
+	assert.Contains(t, err.Error(), "port-id-x")
+	f.l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+
+	_, err = f.portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Equal(t, ErrServiceNotMapped, err)
+	conflicts := f.portmapper.GetConflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, model.ConflictRejected, conflicts[0].Type)
+}
+
+func TestMapServiceRelocatesMappedServiceWithVanishedPortUnderFailPolicy(t *testing.T) {
+	f := newPortMapperFixture(WithMissingPortPolicy(MissingPortFail))
+	s := newPortMapperService("test-service-1")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	// the policy only applies when restoring a service from its annotation
+	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(false, nil)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	result, err := f.portmapper.MapService(s)
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", result.L3PortID)
+}
+
+func TestMapServiceDoesNotTrustNonExistentPreferredPort(t *testing.T) {
+	f := newPortMapperFixture(WithTrustPreferredPort(true))
+	s := newPortMapperService("test-service-1")
+	s.Annotations = map[string]string{AnnotationInboundPort: "port-id-x"}
+
+	f.l3portmanager.On("CheckPortExists", "port-id-x").Return(false, nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	result, err := f.portmapper.MapService(s)
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", result.L3PortID)
+	assert.Equal(t, "port port-id-x does not exist anymore", result.Relocation)
+
+	// the port from the annotation was never taken over
+	assert.Equal(t, 1, f.portmapper.GetL3PortCount())
+	_, err = f.portmapper.GetPortFreeCapacity("port-id-x")
+	assert.NotNil(t, err)
+}
+
+func TestMapServicePlacesSharedIPGroupOnOnePort(t *testing.T) {
+	f := newPortMapperFixture()
+	s0 := newPortMapperService("test-service-0")
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationSharedIPKey: "a"}
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolTCP, 8080)
+	s2.Annotations = map[string]string{AnnotationSharedIPKey: "a"}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", mock.Anything).Return(true, nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s0)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+
+	// s2 would fit onto port-id-1, but follows s1
+	result, err := f.portmapper.MapService(s2)
+	assert.Nil(t, err)
+	assert.Equal(t, model.MapResult{Outcome: model.MapOutcomeNew, L3PortID: "port-id-2"}, result)
+	assert.Equal(t, 2, f.portmapper.GetL3PortCount())
+}
+
+func TestMapServiceRejectsConflictWithinSharedIPGroup(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationSharedIPKey: "a"}
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolTCP, 443)
+	s2.Annotations = map[string]string{AnnotationSharedIPKey: "a"}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+
+	_, err := f.portmapper.MapService(s2)
+	assert.True(t, errors.Is(err, ErrSharedIPConflict))
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 1)
+
+	_, err = f.portmapper.GetServiceL3Port(model.FromService(s2))
+	assert.Equal(t, ErrServiceNotMapped, err)
+	conflicts := f.portmapper.GetConflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, model.ConflictRejected, conflicts[0].Type)
+}
+
+func TestMapServiceMovesSharedIPGroupOnConflict(t *testing.T) {
+	f := newPortMapperFixture()
+	s0 := newPortMapperServiceWithPort("test-service-0", corev1.ProtocolTCP, 8080)
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationSharedIPKey: "a"}
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolTCP, 8080)
+	s2.Annotations = map[string]string{AnnotationSharedIPKey: "a"}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", mock.Anything).Return(true, nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s0)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+
+	// s2 conflicts with s0 on port-id-1, so the group moves away
+	result, err := f.portmapper.MapService(s2)
+	assert.Nil(t, err)
+	assert.Equal(t, model.MapResult{
+		Outcome:     model.MapOutcomeNew,
+		L3PortID:    "port-id-2",
+		Provisioned: true,
+		Moved:       []model.ServiceIdentifier{model.FromService(s1)},
+	}, result)
+	assert.Equal(t, map[string]string{
+		model.FromService(s0).ToKey(): "port-id-1",
+		model.FromService(s1).ToKey(): "port-id-2",
+		model.FromService(s2).ToKey(): "port-id-2",
+	}, f.portmapper.GetModel())
+
+	conflicts := f.portmapper.GetConflicts()
+	assert.Equal(t, 1, len(conflicts))
+	assert.Equal(t, model.ConflictRelocated, conflicts[0].Type)
+	assert.Equal(t, model.FromService(s1), conflicts[0].Service)
+}
+
+func TestMapServiceDoesNotMoveSharedIPGroupIfPlacementFails(t *testing.T) {
+	f := newPortMapperFixture()
+	s0 := newPortMapperServiceWithPort("test-service-0", corev1.ProtocolTCP, 8080)
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationSharedIPKey: "a"}
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolTCP, 8080)
+	s2.Annotations = map[string]string{AnnotationSharedIPKey: "a"}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil)
+	f.l3portmanager.On("CheckPortExists", "port-id-2").Return(false, errors.New("backend unavailable"))
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s0)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	mapped := len(f.publisher.Mapped)
+
+	// the group would move to port-id-2, but s2 cannot be placed there
+	_, err := f.portmapper.MapService(s2)
+	assert.NotNil(t, err)
+	assert.Equal(t, map[string]string{
+		model.FromService(s0).ToKey(): "port-id-1",
+		model.FromService(s1).ToKey(): "port-id-1",
+	}, f.portmapper.GetModel())
+	assert.Equal(t, mapped, len(f.publisher.Mapped))
+	assert.Equal(t, 0, len(f.portmapper.GetConflicts()))
+}
+
+func TestUnmapServiceReleasesSharedIPPortWithLastMember(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationSharedIPKey: "a"}
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolTCP, 8080)
+	s2.Annotations = map[string]string{AnnotationSharedIPKey: "a"}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", mock.Anything).Return(true, nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s1)))
+	f.l3portmanager.AssertNotCalled(t, "ReleasePort", mock.Anything)
+
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s2)))
+	f.l3portmanager.AssertCalled(t, "ReleasePort", "port-id-1")
+}
+
+func TestEvacuatePortKeepsSharedIPGroupTogether(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationSharedIPKey: "a"}
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolTCP, 8080)
+	s2.Annotations = map[string]string{AnnotationSharedIPKey: "a"}
+	s3 := newPortMapperServiceWithPort("test-service-3", corev1.ProtocolTCP, 8080)
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-3", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", mock.Anything).Return(true, nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s3)))
+
+	// s1 alone would fit onto port-id-2, but s2 could not follow it
+	moved, err := f.portmapper.EvacuatePort("port-id-1")
+	assert.Nil(t, err)
+	assert.Equal(t, []model.ServiceIdentifier{model.FromService(s1), model.FromService(s2)}, moved)
+	assert.Equal(t, map[string]string{
+		model.FromService(s1).ToKey(): "port-id-3",
+		model.FromService(s2).ToKey(): "port-id-3",
+		model.FromService(s3).ToKey(): "port-id-2",
+	}, f.portmapper.GetModel())
+}
+
+func TestMapServiceProvisionsNewPortOnceMaxServicesIsReached(t *testing.T) {
+	f := newPortMapperFixture(WithMaxServicesPerPort(2))
+	s1 := newPortMapperServiceWithPort("test-service-1", corev1.ProtocolTCP, 80)
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolTCP, 81)
+	s3 := newPortMapperServiceWithPort("test-service-3", corev1.ProtocolTCP, 82)
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", mock.Anything).Return(true, nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 1)
+
+	// the L4 ports do not conflict, but port-id-1 is full
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	result, err := f.portmapper.MapService(s3)
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", result.L3PortID)
+	assert.True(t, result.Provisioned)
+	f.l3portmanager.AssertNumberOfCalls(t, "ProvisionPort", 2)
+
+	// services which are on the full port already stay there when they
+	// change
+	s1.Spec.Ports[0].Port = 90
+	result, err = f.portmapper.MapService(s1)
+	assert.Nil(t, err)
+	assert.Equal(t, model.MapResult{Outcome: model.MapOutcomeUnchanged, L3PortID: "port-id-1"}, result)
+}
+
+func TestGenerationIncrementsOnMapAndUnmap(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil)
+	f.l3portmanager.On("ReleasePort", "port-id-1").Return(nil)
+
+	assert.Equal(t, uint64(0), f.portmapper.Generation())
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	mapped := f.portmapper.Generation()
+	assert.Greater(t, mapped, uint64(0))
+
+	changed := s.DeepCopy()
+	changed.Spec.Ports = changed.Spec.Ports[:1]
+	assert.Nil(t, mapError(f.portmapper.MapService(changed)))
+	remapped := f.portmapper.Generation()
+	assert.Greater(t, remapped, mapped)
+
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s)))
+	assert.Greater(t, f.portmapper.Generation(), remapped)
+}
+
+func TestGenerationIsKeptByNoOpCalls(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	generation := f.portmapper.Generation()
+
+	result, err := f.portmapper.MapService(s)
+	assert.Nil(t, err)
+	assert.Equal(t, model.MapOutcomeUnchanged, result.Outcome)
+	assert.Equal(t, generation, f.portmapper.Generation())
+
+	// unmapping an unknown service changes nothing
+	assert.Nil(t, f.portmapper.UnmapService(model.ServiceIdentifier{Namespace: "default", Name: "unknown"}))
+	assert.Equal(t, generation, f.portmapper.Generation())
+
+	evicted, err := f.portmapper.SetAvailableL3Ports([]string{"port-id-1"})
+	assert.Nil(t, err)
+	assert.Empty(t, evicted)
+	assert.Equal(t, generation, f.portmapper.Generation())
+}
+
+func TestGenerationIncrementsOnEviction(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+	generation := f.portmapper.Generation()
+
+	evicted, err := f.portmapper.SetAvailableL3Ports([]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, []model.ServiceIdentifier{model.FromService(s)}, evicted)
+	assert.Greater(t, f.portmapper.Generation(), generation)
+}
+
+func TestMapServiceRejectsInvalidMinBackends(t *testing.T) {
+	f := newPortMapperFixture()
+
+	for _, val := range []string{"-1", "two"} {
+		s := newPortMapperService("test-service")
+		s.Annotations = map[string]string{AnnotationMinBackends: val}
+
+		_, err := f.portmapper.MapService(s)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), AnnotationMinBackends)
+	}
+	assert.Equal(t, model.ConflictRejected, f.portmapper.GetConflicts()[0].Type)
+	f.l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+}
@@ -18,10 +18,74 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+var addressPairsMetric = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "lbaas_agent_address_pairs",
+		Help: "Estimated number of allowed address pairs needed on each agent port",
+	},
+)
+
+var addressPairsThresholdMetric = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "lbaas_agent_address_pairs_warning_threshold",
+		Help: "Number of allowed address pairs per agent port at which a warning is emitted",
+	},
+)
+
+var controllerInfoMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "lbaas_controller_info",
+		Help: "Identity of the load balancer controller; the value is always 1",
+	},
+	[]string{"identity"},
+)
+
+var portProvisioningMetric = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "lbaas_port_provisioning_attempts_total",
+		Help: "Number of attempts to provision an L3 port, by result",
+	},
+	[]string{"result"},
+)
+
+var convergenceMetric = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "lbaas_last_convergence_duration_seconds",
+		Help: "Time from the first change to the configuration push after which no work was left, for the last convergence",
+	},
+)
+
+// Upper bounds of the buckets of the allocations-per-port histogram
+var allocationsPerPortBuckets = []float64{1, 2, 4, 8, 16, 32, 64}
+
+func init() {
+	prometheus.MustRegister(addressPairsMetric, addressPairsThresholdMetric, controllerInfoMetric, portProvisioningMetric, convergenceMetric)
+}
+
+// Count an attempt to provision an L3 port.
+func countProvisioningAttempt(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	portProvisioningMetric.With(prometheus.Labels{"result": result}).Inc()
+}
+
+// Report the identity of the controller through the info metric.
+func setControllerInfo(identity string) {
+	controllerInfoMetric.Reset()
+	controllerInfoMetric.With(prometheus.Labels{"identity": identity}).Set(1)
+}
+
 type Collector struct {
 	portmapper PortMapper
 
-	servicesMetric *prometheus.GaugeVec
+	servicesMetric     *prometheus.GaugeVec
+	floatingIPsMetric  prometheus.Gauge
+	unplaceableMetric  prometheus.Gauge
+	allocationsMetric  *prometheus.GaugeVec
+	packingMetric      prometheus.Gauge
+	allocationsPerPort *prometheus.Desc
 }
 
 func NewCollector(portmapper PortMapper) *Collector {
@@ -34,16 +98,98 @@ func NewCollector(portmapper PortMapper) *Collector {
 			},
 			[]string{"state"},
 		),
+		floatingIPsMetric: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "lbaas_floating_ips_total",
+				Help: "Number of L3 ports (floating IPs) currently held by the controller",
+			},
+		),
+		unplaceableMetric: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "lbaas_unplaceable_services",
+				Help: "Number of services which could not be mapped because no suitable L3 port was available",
+			},
+		),
+		allocationsMetric: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "lbaas_l4_port_allocations",
+				Help: "Number of L4 ports allocated on the L3 ports held by the controller, by protocol",
+			},
+			[]string{"protocol"},
+		),
+		packingMetric: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "lbaas_packing_efficiency",
+				Help: "Average number of mapped services per L3 port held by the controller",
+			},
+		),
+		allocationsPerPort: prometheus.NewDesc(
+			"lbaas_allocations_per_l3_port",
+			"Distribution of the number of allocated L4 ports over the L3 ports held by the controller",
+			nil, nil,
+		),
 	}
 }
 
 func (c *Collector) Describe(out chan<- *prometheus.Desc) {
 	c.servicesMetric.Describe(out)
+	c.floatingIPsMetric.Describe(out)
+	c.unplaceableMetric.Describe(out)
+	c.allocationsMetric.Describe(out)
+	c.packingMetric.Describe(out)
+	out <- c.allocationsPerPort
 }
 
 func (c *Collector) Collect(out chan<- prometheus.Metric) {
 	model := c.portmapper.GetModel()
 	c.servicesMetric.With(prometheus.Labels{"state": "mapped"}).Set(float64(len(model)))
 
+	l3PortCount := c.portmapper.GetL3PortCount()
+	c.floatingIPsMetric.Set(float64(l3PortCount))
+	c.unplaceableMetric.Set(float64(c.portmapper.GetUnplaceableServiceCount()))
+
+	c.allocationsMetric.Reset()
+	for protocol, count := range c.portmapper.GetAllocationCounts() {
+		c.allocationsMetric.With(prometheus.Labels{"protocol": string(protocol)}).Set(float64(count))
+	}
+
+	if l3PortCount > 0 {
+		c.packingMetric.Set(float64(len(model)) / float64(l3PortCount))
+	} else {
+		c.packingMetric.Set(0)
+	}
+
 	c.servicesMetric.Collect(out)
+	c.floatingIPsMetric.Collect(out)
+	c.unplaceableMetric.Collect(out)
+	c.allocationsMetric.Collect(out)
+	c.packingMetric.Collect(out)
+	out <- c.allocationsPerPortHistogram()
+}
+
+// Build the allocations-per-port histogram over the held L3 ports. An L4 port
+// shared by several services counts once.
+func (c *Collector) allocationsPerPortHistogram() prometheus.Metric {
+	perPort := c.portmapper.GetAllocationCountsByPort()
+
+	buckets := make(map[float64]uint64, len(allocationsPerPortBuckets))
+	for _, bound := range allocationsPerPortBuckets {
+		buckets[bound] = 0
+	}
+	sum := 0
+	for _, count := range perPort {
+		sum += count
+		for _, bound := range allocationsPerPortBuckets {
+			if float64(count) <= bound {
+				buckets[bound]++
+			}
+		}
+	}
+
+	return prometheus.MustNewConstHistogram(
+		c.allocationsPerPort,
+		uint64(len(perPort)),
+		float64(sum),
+		buckets,
+	)
 }
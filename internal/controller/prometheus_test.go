@@ -0,0 +1,238 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+func assertFloatingIPsMetric(t *testing.T, c *Collector, expected string) {
+	err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP lbaas_floating_ips_total Number of L3 ports (floating IPs) currently held by the controller
+# TYPE lbaas_floating_ips_total gauge
+lbaas_floating_ips_total `+expected+`
+`), "lbaas_floating_ips_total")
+	assert.Nil(t, err)
+}
+
+func TestFloatingIPsMetricFollowsHeldL3Ports(t *testing.T) {
+	f := newPortMapperFixture()
+	c := NewCollector(f.portmapper)
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	assertFloatingIPsMetric(t, c, "0")
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assertFloatingIPsMetric(t, c, "1")
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assertFloatingIPsMetric(t, c, "2")
+
+	// the port of an unmapped service is released right away
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s1)))
+	assertFloatingIPsMetric(t, c, "1")
+
+	_, err := f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+	assertFloatingIPsMetric(t, c, "1")
+}
+
+func TestAllocationsMetricIsReportedPerProtocol(t *testing.T) {
+	f := newPortMapperFixture()
+	c := NewCollector(f.portmapper)
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolUDP, 53)
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+
+	err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP lbaas_l4_port_allocations Number of L4 ports allocated on the L3 ports held by the controller, by protocol
+# TYPE lbaas_l4_port_allocations gauge
+lbaas_l4_port_allocations{protocol="TCP"} 2
+lbaas_l4_port_allocations{protocol="UDP"} 1
+`), "lbaas_l4_port_allocations")
+	assert.Nil(t, err)
+}
+
+func assertUnplaceableMetric(t *testing.T, c *Collector, expected string) {
+	err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP lbaas_unplaceable_services Number of services which could not be mapped because no suitable L3 port was available
+# TYPE lbaas_unplaceable_services gauge
+lbaas_unplaceable_services `+expected+`
+`), "lbaas_unplaceable_services")
+	assert.Nil(t, err)
+}
+
+func TestUnplaceableMetricUnderReuseOnlyPolicy(t *testing.T) {
+	// the idle port floor keeps the only port when it becomes unused
+	portmapper, l3portmanager := newPortMapperWithAllocator(t, ReuseOnlyPortAllocator{}, []string{"port-id-1"}, WithIdlePortFloor(1))
+	c := NewCollector(portmapper)
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s3 := newPortMapperService("test-service-3")
+
+	assertUnplaceableMetric(t, c, "0")
+
+	assert.Nil(t, mapError(portmapper.MapService(s1)))
+	assert.Equal(t, ErrNoSuitablePort, mapError(portmapper.MapService(s2)))
+	assert.Equal(t, ErrNoSuitablePort, mapError(portmapper.MapService(s3)))
+	assertUnplaceableMetric(t, c, "2")
+
+	assert.Nil(t, portmapper.UnmapService(model.FromService(s2)))
+	assertUnplaceableMetric(t, c, "1")
+
+	// once capacity is freed, the service can be placed
+	assert.Nil(t, portmapper.UnmapService(model.FromService(s1)))
+	assert.Nil(t, mapError(portmapper.MapService(s3)))
+	assertUnplaceableMetric(t, c, "0")
+
+	l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+}
+
+func assertPackingMetric(t *testing.T, c *Collector, expected string) {
+	err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP lbaas_packing_efficiency Average number of mapped services per L3 port held by the controller
+# TYPE lbaas_packing_efficiency gauge
+lbaas_packing_efficiency `+expected+`
+`), "lbaas_packing_efficiency")
+	assert.Nil(t, err)
+}
+
+func TestPackingMetricReflectsServicesPerL3Port(t *testing.T) {
+	f := newPortMapperFixture()
+	c := NewCollector(f.portmapper)
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s3 := newPortMapperService("test-service-3")
+	s3.Spec.Ports[0].Port = 8080
+	s3.Spec.Ports[1].Port = 8443
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	assertPackingMetric(t, c, "0")
+
+	// s1 and s3 share port-id-1, s2 conflicts with s1 and gets port-id-2
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s3)))
+	assertPackingMetric(t, c, "1.5")
+
+	assert.Nil(t, f.portmapper.UnmapService(model.FromService(s2)))
+	assertPackingMetric(t, c, "2")
+}
+
+func TestControllerInfoMetricReportsIdentity(t *testing.T) {
+	setControllerInfo("old")
+	setControllerInfo("prod-1")
+
+	err := testutil.CollectAndCompare(controllerInfoMetric, strings.NewReader(`
+# HELP lbaas_controller_info Identity of the load balancer controller; the value is always 1
+# TYPE lbaas_controller_info gauge
+lbaas_controller_info{identity="prod-1"} 1
+`))
+	assert.Nil(t, err)
+}
+
+func TestAllocationsPerPortMetricIsHistogramOverHeldL3Ports(t *testing.T) {
+	f := newPortMapperFixture()
+	c := NewCollector(f.portmapper)
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperServiceWithPort("test-service-2", corev1.ProtocolUDP, 53)
+	s3 := newPortMapperServiceWithPort("test-service-3", corev1.ProtocolTCP, 8080)
+	s4 := newPortMapperServiceWithPort("test-service-4", corev1.ProtocolTCP, 80)
+	s5 := newPortMapperServiceWithPort("test-service-5", corev1.ProtocolTCP, 9090)
+	s5.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-1"}
+	s6 := newPortMapperServiceWithPort("test-service-6", corev1.ProtocolTCP, 9090)
+	s6.Annotations = map[string]string{AnnotationSharedListenerGroup: "group-1"}
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s1)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s2)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s3)))
+	// conflicts with test-service-1
+	assert.Nil(t, mapError(f.portmapper.MapService(s4)))
+	// TCP/9090 on port-id-1 is allocated once for both services
+	assert.Nil(t, mapError(f.portmapper.MapService(s5)))
+	assert.Nil(t, mapError(f.portmapper.MapService(s6)))
+
+	err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP lbaas_allocations_per_l3_port Distribution of the number of allocated L4 ports over the L3 ports held by the controller
+# TYPE lbaas_allocations_per_l3_port histogram
+lbaas_allocations_per_l3_port_bucket{le="1"} 1
+lbaas_allocations_per_l3_port_bucket{le="2"} 1
+lbaas_allocations_per_l3_port_bucket{le="4"} 1
+lbaas_allocations_per_l3_port_bucket{le="8"} 2
+lbaas_allocations_per_l3_port_bucket{le="16"} 2
+lbaas_allocations_per_l3_port_bucket{le="32"} 2
+lbaas_allocations_per_l3_port_bucket{le="64"} 2
+lbaas_allocations_per_l3_port_bucket{le="+Inf"} 2
+lbaas_allocations_per_l3_port_sum 6
+lbaas_allocations_per_l3_port_count 2
+`), "lbaas_allocations_per_l3_port")
+	assert.Nil(t, err)
+}
+
+func TestPortProvisioningMetricCountsAttemptsByResult(t *testing.T) {
+	portProvisioningMetric.Reset()
+	f := newPortMapperFixture(WithProvisionRetries(3, time.Second))
+	f.portmapper.(*PortMapperImpl).sleep = func(time.Duration) {}
+	s := newPortMapperService("test-service-1")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("", newServiceUnavailableError()).Times(2)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	err := testutil.CollectAndCompare(portProvisioningMetric, strings.NewReader(`
+# HELP lbaas_port_provisioning_attempts_total Number of attempts to provision an L3 port, by result
+# TYPE lbaas_port_provisioning_attempts_total counter
+lbaas_port_provisioning_attempts_total{result="failure"} 2
+lbaas_port_provisioning_attempts_total{result="success"} 1
+`))
+	assert.Nil(t, err)
+}
+
+func TestPortProvisioningMetricIgnoresEstimates(t *testing.T) {
+	portProvisioningMetric.Reset()
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+
+	estimate, err := f.portmapper.EstimateProvisions([]*corev1.Service{s1, s2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, estimate)
+
+	assert.Equal(t, 0, testutil.CollectAndCount(portProvisioningMetric))
+	f.l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+}
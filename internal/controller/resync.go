@@ -0,0 +1,191 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	goerrors "errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// Time to wait for a resync to be executed if the handler does not set one
+const defaultResyncTimeout = 2 * time.Minute
+
+var (
+	ErrResyncTimeout = goerrors.New("resync was not executed in time")
+)
+
+// ResyncSummary describes the changes made by a ResyncJob.
+type ResyncSummary struct {
+	// Number of services which were synced
+	Synced int `json:"synced"`
+	// Services which were not mapped before, with their new L3 port
+	Mapped map[string]string `json:"mapped"`
+	// Services which were mapped to another L3 port before, with their new
+	// L3 port
+	Moved map[string]string `json:"moved"`
+	// Services which are not mapped anymore
+	Unmapped []string `json:"unmapped"`
+	// Services which could not be synced, with the error
+	Failed map[string]string `json:"failed"`
+	// Error from checking the L3 ports in use, if any
+	Error string `json:"error,omitempty"`
+}
+
+// Compare the port mapper model before and after a resync.
+func (s *ResyncSummary) diff(before, after map[string]string) {
+	for key, portID := range after {
+		oldPortID, ok := before[key]
+		if !ok {
+			s.Mapped[key] = portID
+		} else if oldPortID != portID {
+			s.Moved[key] = portID
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			s.Unmapped = append(s.Unmapped, key)
+		}
+	}
+	sort.Strings(s.Unmapped)
+}
+
+// ResyncJob checks the L3 ports in use and syncs all services right away,
+// instead of waiting for the informers to report changes. Services which
+// fail to sync are requeued like after a regular sync. If Result is set, the
+// summary is sent to it once the job is done.
+//
+// Running the job again without intermediate changes is a no-op.
+type ResyncJob struct {
+	Result chan<- ResyncSummary
+}
+
+func (j *ResyncJob) Run(w *Worker) (RequeueMode, error) {
+	summary := ResyncSummary{
+		Mapped:   map[string]string{},
+		Moved:    map[string]string{},
+		Unmapped: []string{},
+		Failed:   map[string]string{},
+	}
+	before := w.portmapper.GetModel()
+
+	_, revalidateErr := (&RevalidatePortsJob{}).Run(w)
+	if revalidateErr != nil {
+		summary.Error = revalidateErr.Error()
+	}
+
+	svcs, err := w.servicesLister.List(labels.Everything())
+	if err != nil {
+		return RequeueTail, err
+	}
+	sort.Slice(svcs, func(i, k int) bool {
+		return model.FromService(svcs[i]).ToKey() < model.FromService(svcs[k]).ToKey()
+	})
+
+	for _, svc := range svcs {
+		sync := &SyncServiceJob{model.FromService(svc)}
+		requeue, err := sync.Run(w)
+		summary.Synced++
+		if err != nil {
+			summary.Failed[sync.Service.ToKey()] = err.Error()
+		}
+		if requeue != Drop {
+			w.RequeueJob(sync)
+		}
+	}
+
+	summary.diff(before, w.portmapper.GetModel())
+	klog.Infof("Resynced %d services: %d mapped, %d moved, %d unmapped, %d failed",
+		summary.Synced, len(summary.Mapped), len(summary.Moved), len(summary.Unmapped), len(summary.Failed))
+
+	w.EnqueueJob(&UpdateConfigJob{})
+	if j.Result != nil {
+		j.Result <- summary
+	}
+	return Drop, revalidateErr
+}
+
+func (j *ResyncJob) ToString() string {
+	return "ResyncJob"
+}
+
+// Resync enqueues a ResyncJob and waits for its summary, but at most for the
+// given timeout.
+func (w *Worker) Resync(timeout time.Duration) (ResyncSummary, error) {
+	result := make(chan ResyncSummary, 1)
+	w.EnqueueJob(&ResyncJob{Result: result})
+	select {
+	case summary := <-result:
+		return summary, nil
+	case <-time.After(timeout):
+		return ResyncSummary{}, ErrResyncTimeout
+	}
+}
+
+type Resyncer interface {
+	Resync(timeout time.Duration) (ResyncSummary, error)
+}
+
+// ResyncHandler serves POST requests which force a resync and returns the
+// summary as JSON. Requests have to carry the Token as bearer token.
+type ResyncHandler struct {
+	Resyncer Resyncer
+	Token    string
+	Timeout  time.Duration
+}
+
+// Return true if the request carries the expected, non-empty bearer token.
+func hasBearerToken(r *http.Request, expected string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func (h *ResyncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(405) // Method Not Allowed
+		return
+	}
+	if !hasBearerToken(r, h.Token) {
+		klog.V(5).Infof("unauthorized resync request from %s", r.RemoteAddr)
+		w.WriteHeader(401) // Unauthorized
+		return
+	}
+
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = defaultResyncTimeout
+	}
+
+	klog.Infof("Resync requested by %s", r.RemoteAddr)
+	summary, err := h.Resyncer.Resync(timeout)
+	if err != nil {
+		klog.Warningf("Resync failed: %s", err.Error())
+		w.WriteHeader(504) // Gateway Timeout
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
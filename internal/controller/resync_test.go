@@ -0,0 +1,114 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+type fakeResyncer struct {
+	calls   int
+	summary ResyncSummary
+}
+
+func (r *fakeResyncer) Resync(timeout time.Duration) (ResyncSummary, error) {
+	r.calls++
+	return r.summary, nil
+}
+
+func newResyncRequest(method string, token string) *http.Request {
+	r := httptest.NewRequest(method, "/resync", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestResyncJobSyncsAllServicesAndReportsChanges(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = map[string]string{AnnotationManaged: "true"}
+	setPortAnnotation(s, "port-id-1")
+	addFinalizer(s, ownFinalizer(DefaultControllerIdentity))
+	f.addService(s)
+
+	f.portmapper.On("GetModel").Return(map[string]string{"default/stale-service": "port-id-2"}).Times(1)
+	f.portmapper.On("RevalidatePorts").Return([]model.ServiceIdentifier{}, nil).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
+	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("GetExternalAddress", "port-id-1").Return("some-ip", "", nil).Times(1)
+	f.portmapper.On("GetModel").Return(map[string]string{model.FromService(s).ToKey(): "port-id-1"}).Times(1)
+
+	updatedS := s.DeepCopy()
+	updatedS.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "some-ip"}}
+	f.expectUpdateServiceStatusAction(updatedS)
+
+	result := make(chan ResyncSummary, 1)
+	f.runWith(true, func(w *Worker) {
+		requeue, err := (&ResyncJob{Result: result}).Run(w)
+		assert.Nil(t, err)
+		assert.Equal(t, Drop, requeue)
+	})
+
+	summary := <-result
+	assert.Equal(t, 1, summary.Synced)
+	assert.Equal(t, map[string]string{model.FromService(s).ToKey(): "port-id-1"}, summary.Mapped)
+	assert.Empty(t, summary.Moved)
+	assert.Equal(t, []string{"default/stale-service"}, summary.Unmapped)
+	assert.Empty(t, summary.Failed)
+}
+
+func TestResyncHandlerTriggersResyncAndReturnsSummary(t *testing.T) {
+	resyncer := &fakeResyncer{summary: ResyncSummary{
+		Synced: 2,
+		Moved:  map[string]string{"default/test-service": "port-id-2"},
+	}}
+	h := &ResyncHandler{Resyncer: resyncer, Token: "secret"}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newResyncRequest(http.MethodPost, "secret"))
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, 1, resyncer.calls)
+	summary := ResyncSummary{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &summary))
+	assert.Equal(t, resyncer.summary, summary)
+}
+
+func TestResyncHandlerRejectsUnauthenticatedRequests(t *testing.T) {
+	resyncer := &fakeResyncer{}
+	h := &ResyncHandler{Resyncer: resyncer, Token: "secret"}
+
+	for _, token := range []string{"", "wrong"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newResyncRequest(http.MethodPost, token))
+		assert.Equal(t, 401, rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newResyncRequest(http.MethodGet, "secret"))
+	assert.Equal(t, 405, rec.Code)
+
+	assert.Equal(t, 0, resyncer.calls)
+}
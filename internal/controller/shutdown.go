@@ -0,0 +1,78 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"sync"
+	"time"
+)
+
+// ShutdownCoordinator keeps track of in-flight operations so that the
+// controller can wait for them to finish before it exits.
+//
+// Once draining has started, no new operations are admitted. Draining never
+// releases any ports; the last configuration pushed to the agents stays in
+// place so that traffic keeps flowing.
+type ShutdownCoordinator struct {
+	mutex    sync.Mutex
+	inFlight sync.WaitGroup
+	draining bool
+}
+
+func NewShutdownCoordinator() *ShutdownCoordinator {
+	return &ShutdownCoordinator{}
+}
+
+// Begin registers a new in-flight operation.
+//
+// Returns false if the coordinator is draining, in which case the operation
+// must not be started. Each successful Begin must be paired with an End.
+func (s *ShutdownCoordinator) Begin() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.draining {
+		return false
+	}
+	s.inFlight.Add(1)
+	return true
+}
+
+// End marks an in-flight operation as finished.
+func (s *ShutdownCoordinator) End() {
+	s.inFlight.Done()
+}
+
+// Drain stops admitting new operations and waits for the in-flight ones to
+// finish, but at most for the given timeout.
+//
+// Returns true if all in-flight operations finished in time.
+func (s *ShutdownCoordinator) Drain(timeout time.Duration) bool {
+	s.mutex.Lock()
+	s.draining = true
+	s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
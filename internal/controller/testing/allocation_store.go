@@ -0,0 +1,55 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package testing
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// InMemoryAllocationStore keeps all appended allocation records in memory.
+type InMemoryAllocationStore struct {
+	mu      sync.Mutex
+	records []model.AllocationRecord
+}
+
+func NewInMemoryAllocationStore() *InMemoryAllocationStore {
+	return &InMemoryAllocationStore{}
+}
+
+func (s *InMemoryAllocationStore) Append(record model.AllocationRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *InMemoryAllocationStore) Query(from time.Time, to time.Time) ([]model.AllocationRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []model.AllocationRecord{}
+	for _, record := range s.records {
+		if !record.Time.Before(from) && record.Time.Before(to) {
+			result = append(result, record)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+	return result, nil
+}
@@ -0,0 +1,45 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package testing
+
+import (
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// InMemoryEventPublisher records all published allocation events.
+type InMemoryEventPublisher struct {
+	Mapped   []model.AllocationEvent
+	Unmapped []model.AllocationEvent
+	Evicted  []model.AllocationEvent
+}
+
+func NewInMemoryEventPublisher() *InMemoryEventPublisher {
+	return &InMemoryEventPublisher{}
+}
+
+func (p *InMemoryEventPublisher) PublishMapped(event model.AllocationEvent) error {
+	p.Mapped = append(p.Mapped, event)
+	return nil
+}
+
+func (p *InMemoryEventPublisher) PublishUnmapped(event model.AllocationEvent) error {
+	p.Unmapped = append(p.Unmapped, event)
+	return nil
+}
+
+func (p *InMemoryEventPublisher) PublishEvicted(event model.AllocationEvent) error {
+	p.Evicted = append(p.Evicted, event)
+	return nil
+}
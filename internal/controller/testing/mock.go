@@ -53,11 +53,21 @@ func NewMockPortMapper() *MockPortMapper {
 	return new(MockPortMapper)
 }
 
-func (m *MockPortMapper) MapService(svc *corev1.Service) error {
+func (m *MockPortMapper) MapService(svc *corev1.Service) (model.MapResult, error) {
 	a := m.Called(svc)
+	return a.Get(0).(model.MapResult), a.Error(1)
+}
+
+func (m *MockPortMapper) MapServices(svcs []*corev1.Service) error {
+	a := m.Called(svcs)
 	return a.Error(0)
 }
 
+func (m *MockPortMapper) EstimateProvisions(svcs []*corev1.Service) (int, error) {
+	a := m.Called(svcs)
+	return a.Int(0), a.Error(1)
+}
+
 func (m *MockPortMapper) UnmapService(id model.ServiceIdentifier) error {
 	a := m.Called(id)
 	return a.Error(0)
@@ -68,6 +78,15 @@ func (m *MockPortMapper) GetServiceL3Port(id model.ServiceIdentifier) (string, e
 	return a.String(0), a.Error(1)
 }
 
+func (m *MockPortMapper) GetServiceL4Ports(id model.ServiceIdentifier) ([]model.L4Port, error) {
+	a := m.Called(id)
+	tmp := a.Get(0)
+	if tmp == nil {
+		return nil, a.Error(1)
+	}
+	return tmp.([]model.L4Port), a.Error(1)
+}
+
 func (m *MockPortMapper) GetModel() map[string]string {
 	a := m.Called()
 	tmp := a.Get(0)
@@ -87,6 +106,98 @@ func (m *MockPortMapper) SetAvailableL3Ports(portIDs []string) ([]model.ServiceI
 	return softCastServiceIdentifierArray(a.Get(0)), a.Error(1)
 }
 
+func (m *MockPortMapper) SetAvailableL3PortsWithSuggestions(portIDs []string) ([]model.Eviction, error) {
+	a := m.Called(portIDs)
+	if a.Get(0) == nil {
+		return nil, a.Error(1)
+	}
+	return a.Get(0).([]model.Eviction), a.Error(1)
+}
+
+func (m *MockPortMapper) GetL3PortCount() int {
+	a := m.Called()
+	return a.Int(0)
+}
+
+func (m *MockPortMapper) GetAllocationCounts() map[corev1.Protocol]int {
+	a := m.Called()
+	tmp := a.Get(0)
+	if tmp == nil {
+		return nil
+	}
+	return tmp.(map[corev1.Protocol]int)
+}
+
+func (m *MockPortMapper) GetAllocationCountsByPort() map[string]int {
+	a := m.Called()
+	tmp := a.Get(0)
+	if tmp == nil {
+		return nil
+	}
+	return tmp.(map[string]int)
+}
+
+func (m *MockPortMapper) GetPortFreeCapacity(portID string) (int, error) {
+	a := m.Called(portID)
+	return a.Int(0), a.Error(1)
+}
+
+func (m *MockPortMapper) GetFullAssignment() ([]model.FIPAssignment, error) {
+	a := m.Called()
+	tmp := a.Get(0)
+	if tmp == nil {
+		return nil, a.Error(1)
+	}
+	return tmp.([]model.FIPAssignment), a.Error(1)
+}
+
+func (m *MockPortMapper) EvacuatePort(portID string) ([]model.ServiceIdentifier, error) {
+	a := m.Called(portID)
+	return softCastServiceIdentifierArray(a.Get(0)), a.Error(1)
+}
+
+func (m *MockPortMapper) ClearDegradedPort(portID string) {
+	m.Called(portID)
+}
+
+func (m *MockPortMapper) GetUnplaceableServiceCount() int {
+	a := m.Called()
+	return a.Int(0)
+}
+
+func (m *MockPortMapper) GetConflicts() []model.Conflict {
+	a := m.Called()
+	tmp := a.Get(0)
+	if tmp == nil {
+		return nil
+	}
+	return tmp.([]model.Conflict)
+}
+
+func (m *MockPortMapper) GetRecentTransitions(n int) []model.Transition {
+	a := m.Called(n)
+	tmp := a.Get(0)
+	if tmp == nil {
+		return nil
+	}
+	return tmp.([]model.Transition)
+}
+
+func (m *MockPortMapper) Generation() uint64 {
+	a := m.Called()
+	return a.Get(0).(uint64)
+}
+
+func (m *MockPortMapper) RevalidatePorts() ([]model.ServiceIdentifier, error) {
+	a := m.Called()
+	return softCastServiceIdentifierArray(a.Get(0)), a.Error(1)
+}
+
+func (m *MockPortMapper) Consolidate() ([]model.ServiceIdentifier, error) {
+	a := m.Called()
+	return softCastServiceIdentifierArray(a.Get(0)), a.Error(1)
+}
+
 func NewMockLoadBalancerModelGenerator() *MockLoadBalancerModelGenerator {
 	return new(MockLoadBalancerModelGenerator)
 }
@@ -0,0 +1,70 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+const defaultTransitionLogSize = 100
+
+// transitionLog is a ring buffer holding the most recent allocation state
+// transitions.
+//
+// The zero value is a disabled log which records nothing.
+type transitionLog struct {
+	entries []model.Transition
+	// index at which the next entry is written
+	next int
+	// number of valid entries
+	count int
+}
+
+func newTransitionLog(size int) *transitionLog {
+	if size < 0 {
+		size = 0
+	}
+	return &transitionLog{entries: make([]model.Transition, size)}
+}
+
+func (l *transitionLog) record(t model.Transition) {
+	if len(l.entries) == 0 {
+		return
+	}
+	l.entries[l.next] = t
+	l.next = (l.next + 1) % len(l.entries)
+	if l.count < len(l.entries) {
+		l.count++
+	}
+}
+
+// Return up to n of the most recent transitions, oldest first.
+func (l *transitionLog) recent(n int) []model.Transition {
+	if n > l.count {
+		n = l.count
+	}
+	if n < 0 {
+		n = 0
+	}
+	result := make([]model.Transition, n)
+	start := l.next - n
+	if start < 0 {
+		start += len(l.entries)
+	}
+	for i := 0; i < n; i++ {
+		result[i] = l.entries[(start+i)%len(l.entries)]
+	}
+	return result
+}
@@ -0,0 +1,118 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+func transitionOnPort(portID string) model.Transition {
+	return model.Transition{Type: model.TransitionProvision, L3PortID: portID}
+}
+
+func TestTransitionLogReturnsEntriesOldestFirst(t *testing.T) {
+	l := newTransitionLog(5)
+	l.record(transitionOnPort("port-id-1"))
+	l.record(transitionOnPort("port-id-2"))
+	l.record(transitionOnPort("port-id-3"))
+
+	assert.Equal(t, []model.Transition{
+		transitionOnPort("port-id-1"),
+		transitionOnPort("port-id-2"),
+		transitionOnPort("port-id-3"),
+	}, l.recent(10))
+	assert.Equal(t, []model.Transition{
+		transitionOnPort("port-id-2"),
+		transitionOnPort("port-id-3"),
+	}, l.recent(2))
+}
+
+func TestTransitionLogIsBounded(t *testing.T) {
+	l := newTransitionLog(2)
+	l.record(transitionOnPort("port-id-1"))
+	l.record(transitionOnPort("port-id-2"))
+	l.record(transitionOnPort("port-id-3"))
+
+	assert.Equal(t, []model.Transition{
+		transitionOnPort("port-id-2"),
+		transitionOnPort("port-id-3"),
+	}, l.recent(10))
+}
+
+func TestDisabledTransitionLogRecordsNothing(t *testing.T) {
+	l := newTransitionLog(0)
+	l.record(transitionOnPort("port-id-1"))
+	assert.Equal(t, []model.Transition{}, l.recent(10))
+
+	zero := &transitionLog{}
+	zero.record(transitionOnPort("port-id-1"))
+	assert.Equal(t, []model.Transition{}, zero.recent(10))
+}
+
+func TestPortMapperRecordsTransitionsInOrder(t *testing.T) {
+	// the grace period defers the release to GetUsedL3Ports
+	f, clock := newIdlePortFixture(t, WithTransitionLogSize(10), WithIdlePortGracePeriod(time.Second))
+	s1 := model.ServiceIdentifier{Namespace: "default", Name: "test-service-1"}
+	s2 := model.ServiceIdentifier{Namespace: "default", Name: "test-service-2"}
+
+	clock.advance(time.Minute)
+	_, err := f.portmapper.GetUsedL3Ports()
+	assert.Nil(t, err)
+
+	transitions := f.portmapper.GetRecentTransitions(10)
+	types := []model.TransitionType{}
+	for _, transition := range transitions {
+		types = append(types, transition.Type)
+	}
+	assert.Equal(t, []model.TransitionType{
+		model.TransitionProvision,
+		model.TransitionMap,
+		model.TransitionProvision,
+		model.TransitionMap,
+		model.TransitionUnmap,
+		model.TransitionUnmap,
+		model.TransitionRelease,
+		model.TransitionRelease,
+	}, types)
+
+	assert.Equal(t, s1, transitions[0].Service)
+	assert.Equal(t, "port-id-1", transitions[1].L3PortID)
+	assert.Equal(t, s2, transitions[3].Service)
+	assert.Equal(t, clock.current, transitions[7].Time)
+	assert.True(t, transitions[0].Time.Before(transitions[7].Time))
+}
+
+func TestPortMapperRecordsEvictions(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service-1")
+
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	assert.Nil(t, mapError(f.portmapper.MapService(s)))
+
+	_, err := f.portmapper.SetAvailableL3Ports([]string{})
+	assert.Nil(t, err)
+
+	transitions := f.portmapper.GetRecentTransitions(1)
+	assert.Equal(t, 1, len(transitions))
+	assert.Equal(t, model.TransitionEvict, transitions[0].Type)
+	assert.Equal(t, model.FromService(s), transitions[0].Service)
+	assert.Equal(t, "port-id-1", transitions[0].L3PortID)
+}
@@ -15,12 +15,44 @@
 package controller
 
 import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
 	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
 )
 
 const (
-	AnnotationManaged     = "cah-loadbalancer.k8s.cloudandheat.com/managed"
-	AnnotationInboundPort = "cah-loadbalancer.k8s.cloudandheat.com/inbound-port"
+	AnnotationManaged              = "cah-loadbalancer.k8s.cloudandheat.com/managed"
+	AnnotationInboundPort          = "cah-loadbalancer.k8s.cloudandheat.com/inbound-port"
+	AnnotationSharedListenerGroup  = "cah-loadbalancer.k8s.cloudandheat.com/shared-listener-group"
+	AnnotationSharedListenerWeight = "cah-loadbalancer.k8s.cloudandheat.com/shared-listener-weight"
+	AnnotationEmptyBackends        = "cah-loadbalancer.k8s.cloudandheat.com/empty-backends"
+	AnnotationPortRange            = "cah-loadbalancer.k8s.cloudandheat.com/port-range"
+	AnnotationSharedIPKey          = "cah-loadbalancer.k8s.cloudandheat.com/shared-ip-key"
+	AnnotationMinBackends          = "cah-loadbalancer.k8s.cloudandheat.com/min-backends"
+
+	// Keep the forwards of a service without backends; its traffic is
+	// dropped on the agents
+	EmptyBackendsKeep = "keep"
+	// Remove the forwards of a service without backends
+	EmptyBackendsRemove = "remove"
+
+	// Finalizers of load balancer controllers are named FinalizerPrefix
+	// followed by the identity of the controller.
+	FinalizerPrefix = "finalizer.cah-loadbalancer.k8s.cloudandheat.com/"
+
+	DefaultControllerIdentity = "default"
+
+	// Annotation of the events emitted by a load balancer controller which
+	// carries the identity of the controller
+	EventAnnotationControllerIdentity = "cah-loadbalancer.k8s.cloudandheat.com/controller-identity"
+
+	// Maximum number of L4 ports in the port range of a service
+	maxPortRangeSize = 1024
 )
 
 func isServiceManaged(svc *corev1.Service) bool {
@@ -48,6 +80,44 @@ func canServiceBeManaged(svc *corev1.Service) bool {
 	return val != "false"
 }
 
+// Return the first load balancer finalizer on the service which does not
+// belong to the controller with the given identity, or the empty string if
+// there is none.
+func getForeignFinalizer(svc *corev1.Service, identity string) string {
+	own := ownFinalizer(identity)
+	for _, finalizer := range svc.Finalizers {
+		if strings.HasPrefix(finalizer, FinalizerPrefix) && finalizer != own {
+			return finalizer
+		}
+	}
+	return ""
+}
+
+// Return the finalizer of the controller with the given identity.
+func ownFinalizer(identity string) string {
+	return FinalizerPrefix + identity
+}
+
+func hasFinalizer(svc *corev1.Service, finalizer string) bool {
+	return slices.Contains(svc.Finalizers, finalizer)
+}
+
+// Add the finalizer to the service unless it is already present; the
+// finalizers of others are left alone.
+func addFinalizer(svc *corev1.Service, finalizer string) {
+	if !hasFinalizer(svc, finalizer) {
+		svc.Finalizers = append(svc.Finalizers, finalizer)
+	}
+}
+
+// Remove the finalizer from the service; the finalizers of others are left
+// alone.
+func removeFinalizer(svc *corev1.Service, finalizer string) {
+	svc.Finalizers = slices.DeleteFunc(svc.Finalizers, func(f string) bool {
+		return f == finalizer
+	})
+}
+
 func getPortAnnotation(svc *corev1.Service) string {
 	if svc.Annotations == nil {
 		return ""
@@ -68,3 +138,195 @@ func clearPortAnnotation(svc *corev1.Service) {
 	}
 	delete(svc.Annotations, AnnotationInboundPort)
 }
+
+func getSharedListenerGroup(svc *corev1.Service) string {
+	if svc.Annotations == nil {
+		return ""
+	}
+	return svc.Annotations[AnnotationSharedListenerGroup]
+}
+
+// Return the external traffic policy of the service. Defaults to Cluster.
+func getExternalTrafficPolicy(svc *corev1.Service) corev1.ServiceExternalTrafficPolicy {
+	if svc.Spec.ExternalTrafficPolicy == "" {
+		return corev1.ServiceExternalTrafficPolicyCluster
+	}
+	return svc.Spec.ExternalTrafficPolicy
+}
+
+func getSharedIPKey(svc *corev1.Service) string {
+	if svc.Annotations == nil {
+		return ""
+	}
+	return svc.Annotations[AnnotationSharedIPKey]
+}
+
+// Return how forwards of the service are handled when it has no backends.
+// Defaults to EmptyBackendsKeep.
+func getEmptyBackendsBehavior(svc *corev1.Service) (string, error) {
+	val, ok := svc.Annotations[AnnotationEmptyBackends]
+	if !ok {
+		return EmptyBackendsKeep, nil
+	}
+	switch val {
+	case EmptyBackendsKeep, EmptyBackendsRemove:
+		return val, nil
+	default:
+		return "", fmt.Errorf("invalid %s annotation %q: must be %q or %q", AnnotationEmptyBackends, val, EmptyBackendsKeep, EmptyBackendsRemove)
+	}
+}
+
+// Return true if the forwards of the service are kept when it has no
+// backends. Invalid annotations are rejected when mapping the service, so
+// they fall back to the default here.
+func keepsEmptyBackends(svc *corev1.Service) bool {
+	behavior, _ := getEmptyBackendsBehavior(svc)
+	return behavior != EmptyBackendsRemove
+}
+
+// Return the number of ready backends the service needs before it is marked
+// ready. Defaults to 0.
+func getMinBackends(svc *corev1.Service) (int, error) {
+	val, ok := svc.Annotations[AnnotationMinBackends]
+	if !ok {
+		return 0, nil
+	}
+	minBackends, err := strconv.ParseInt(val, 10, 32)
+	if err != nil || minBackends < 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q: must be a non-negative integer", AnnotationMinBackends, val)
+	}
+	return int(minBackends), nil
+}
+
+// Return the number of distinct ready addresses of the endpoints.
+func countReadyBackends(ep *corev1.Endpoints) int {
+	addresses := map[string]bool{}
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			addresses[addr.IP] = true
+		}
+	}
+	return len(addresses)
+}
+
+// Return the weight with which the service takes part in its shared listener
+// group.
+//
+// Returns 0 if the service is not part of a shared listener group and 1 if the
+// service is part of a group but does not specify a weight.
+func getSharedListenerWeight(svc *corev1.Service) (int32, error) {
+	if getSharedListenerGroup(svc) == "" {
+		return 0, nil
+	}
+	val, ok := svc.Annotations[AnnotationSharedListenerWeight]
+	if !ok {
+		return 1, nil
+	}
+	weight, err := strconv.ParseInt(val, 10, 32)
+	if err != nil || weight <= 0 {
+		return 0, fmt.Errorf("invalid %s annotation %q: must be a positive integer", AnnotationSharedListenerWeight, val)
+	}
+	return int32(weight), nil
+}
+
+// PortRange is a contiguous range of L4 ports which is forwarded to the
+// same port numbers on the backends, in addition to the ports of a service.
+type PortRange struct {
+	Protocol corev1.Protocol
+	First    int32
+	Last     int32
+}
+
+// Return all L4 ports in the range, in ascending order.
+func (r PortRange) L4Ports() []model.L4Port {
+	result := make([]model.L4Port, 0, r.Last-r.First+1)
+	for port := r.First; port <= r.Last; port++ {
+		result = append(result, model.L4Port{Protocol: r.Protocol, Port: port})
+	}
+	return result
+}
+
+// Return the port range of the service, or nil if it has none.
+//
+// The annotation has the form `<first>-<last>[/<protocol>]`; the protocol
+// defaults to TCP.
+func getPortRange(svc *corev1.Service) (*PortRange, error) {
+	val, ok := svc.Annotations[AnnotationPortRange]
+	if !ok {
+		return nil, nil
+	}
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid %s annotation %q: %s", AnnotationPortRange, val, reason)
+	}
+
+	result := &PortRange{Protocol: corev1.ProtocolTCP}
+	ports, protocol, hasProtocol := strings.Cut(val, "/")
+	if hasProtocol {
+		result.Protocol = corev1.Protocol(strings.ToUpper(protocol))
+		if !slices.Contains(supportedProtocols, result.Protocol) {
+			return nil, invalid("unsupported protocol")
+		}
+	}
+
+	first, last, ok := strings.Cut(ports, "-")
+	if !ok {
+		return nil, invalid("must have the form <first>-<last>[/<protocol>]")
+	}
+	firstPort, err := strconv.ParseInt(first, 10, 32)
+	if err != nil {
+		return nil, invalid("first port is not a number")
+	}
+	lastPort, err := strconv.ParseInt(last, 10, 32)
+	if err != nil {
+		return nil, invalid("last port is not a number")
+	}
+	if firstPort <= 0 || lastPort > maxL4Port || firstPort > lastPort {
+		return nil, invalid(fmt.Sprintf("must be ascending ports between 1 and %d", maxL4Port))
+	}
+	if lastPort-firstPort+1 > maxPortRangeSize {
+		return nil, invalid(fmt.Sprintf("must not contain more than %d ports", maxPortRangeSize))
+	}
+	result.First = int32(firstPort)
+	result.Last = int32(lastPort)
+	return result, nil
+}
+
+// ServiceAnnotations holds the parsed load balancer annotations of a service.
+type ServiceAnnotations struct {
+	InboundPort          string
+	SharedListenerGroup  string
+	SharedListenerWeight int32
+	EmptyBackends        string
+	PortRange            *PortRange
+	SharedIPKey          string
+	MinBackends          int
+}
+
+// Parse and validate all load balancer annotations of the service.
+func parseServiceAnnotations(svc *corev1.Service) (ServiceAnnotations, error) {
+	weight, err := getSharedListenerWeight(svc)
+	if err != nil {
+		return ServiceAnnotations{}, err
+	}
+	emptyBackends, err := getEmptyBackendsBehavior(svc)
+	if err != nil {
+		return ServiceAnnotations{}, err
+	}
+	portRange, err := getPortRange(svc)
+	if err != nil {
+		return ServiceAnnotations{}, err
+	}
+	minBackends, err := getMinBackends(svc)
+	if err != nil {
+		return ServiceAnnotations{}, err
+	}
+	return ServiceAnnotations{
+		InboundPort:          getPortAnnotation(svc),
+		SharedListenerGroup:  getSharedListenerGroup(svc),
+		SharedListenerWeight: weight,
+		EmptyBackends:        emptyBackends,
+		PortRange:            portRange,
+		SharedIPKey:          getSharedIPKey(svc),
+		MinBackends:          minBackends,
+	}, nil
+}
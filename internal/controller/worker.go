@@ -16,8 +16,10 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
 	goerrors "errors"
 	"fmt"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 
@@ -33,6 +35,7 @@ import (
 	"k8s.io/klog"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/openstack"
 )
 
 type RequeueMode int
@@ -52,6 +55,18 @@ const (
 	EventServiceUnassignedForRemapping = "UnassignedForRemapping"
 	EventServiceUnassignedStale        = "UnassignedStale"
 	EventServiceUnmapped               = "Unmapped"
+	EventServiceRejected               = "Rejected"
+	EventServiceForeignOwner           = "ForeignOwner"
+	EventServiceUnplaceable            = "Unplaceable"
+	EventServicePortVanished           = "PortVanished"
+	EventServiceAddressPairLimit       = "AddressPairLimit"
+	EventServicePortsExhausted         = "PortsExhausted"
+	EventServiceFloatingIPsExhausted   = "FloatingIPsExhausted"
+	EventServiceRenderFailed           = "RenderFailed"
+	EventServiceParked                 = "Parked"
+	EventServicePortRelocated          = "PortRelocated"
+	EventServiceMappingFailed          = "MappingFailed"
+	EventServiceWaitingForBackends     = "WaitingForBackends"
 
 	MessageEventServiceTakenOver              = "Service taken over by cah-loadbalancer-controller"
 	MessageEventServiceReleased               = "Service released by cah-loadbalancer-controller"
@@ -62,6 +77,18 @@ const (
 	MessageEventServiceUnassignedDrop         = "Cleared IP address information because we release control over the Service"
 	MessageEventServiceRemapped               = "Service mapping changed from port %q to %q (due to conflict)"
 	MessageEventServiceUnmapped               = "Service unmapped"
+	MessageEventServiceRejected               = "Service cannot be mapped: %s"
+	MessageEventServiceForeignOwner           = "Service is owned by another load balancer controller (finalizer %q)"
+	MessageEventServiceUnplaceable            = "Service cannot be placed: no L3 port with sufficient free capacity is available"
+	MessageEventServicePortVanished           = "L3 port %q does not exist anymore, service is being relocated"
+	MessageEventServiceAddressPairLimit       = "Agent ports need an estimated %d allowed address pairs, reaching the warning threshold of %d"
+	MessageEventServicePortsExhausted         = "Service cannot be placed: no L3 port can be created because the subnet or the port quota is exhausted"
+	MessageEventServiceFloatingIPsExhausted   = "Service cannot be placed: no floating IP can be allocated because the external network or the floating IP quota is exhausted"
+	MessageEventServiceRenderFailed           = "Service was left out of the load balancer configuration: %s"
+	MessageEventServiceParked                 = "Service is not retried after %d failed mapping attempts until it is changed: %s"
+	MessageEventServicePortRelocated          = "Service was not placed on its preferred L3 port: %s"
+	MessageEventServiceMappingFailed          = "Service could not be mapped: %s"
+	MessageEventServiceWaitingForBackends     = "Service is not marked ready: %d of %d required backends are ready"
 )
 
 var (
@@ -78,8 +105,41 @@ type Worker struct {
 	agentController AgentController
 
 	workqueue workqueue.RateLimitingInterface
+	shutdown  *ShutdownCoordinator
 
 	AllowCleanups bool
+
+	// Identity of this controller; services carrying the finalizer of a
+	// controller with a different identity are not touched.
+	Identity string
+
+	// AddressPairs is used to warn when the agent ports approach the limit
+	// of allowed address pairs.
+	AddressPairs AddressPairBudget
+
+	// AllocationStatus maintains a LoadBalancerAllocation resource per
+	// mapped service; nil if disabled.
+	AllocationStatus *AllocationStatusReconciler
+
+	// MaxMappingAttempts is the number of consecutive failed attempts to map
+	// a service after which it is parked until it changes; 0 retries
+	// forever.
+	MaxMappingAttempts int
+
+	// Endpoints is used to count the ready backends of services with a
+	// minimum backend count; nil disables the check.
+	Endpoints corelisters.EndpointsLister
+
+	mappingAttempts mappingAttempts
+	convergence     convergenceTimer
+}
+
+// Update the address pair metrics and return the current number of L3 ports.
+func (w *Worker) updateAddressPairMetrics() int {
+	l3PortCount := w.portmapper.GetL3PortCount()
+	addressPairsMetric.Set(float64(w.AddressPairs.Estimate(l3PortCount)))
+	addressPairsThresholdMetric.Set(float64(w.AddressPairs.WarningThreshold))
+	return l3PortCount
 }
 
 func (w *Worker) takeOverService(svcSrc *corev1.Service) error {
@@ -123,9 +183,16 @@ func (w *Worker) releaseService(svcSrc *corev1.Service) error {
 		w.recorder.Event(svcSrc, corev1.EventTypeNormal, EventServiceUnmapped, MessageEventServiceUnmapped)
 	}
 
+	if w.AllocationStatus != nil {
+		if err := w.AllocationStatus.Delete(model.FromService(svcSrc)); err != nil {
+			return err
+		}
+	}
+
 	svc := svcSrc.DeepCopy()
 	delete(svc.Annotations, AnnotationManaged)
 	clearPortAnnotation(svc)
+	removeFinalizer(svc, ownFinalizer(w.Identity))
 
 	klog.Infof("Releasing service %s/%s", svcSrc.Namespace, svcSrc.Name)
 
@@ -156,21 +223,59 @@ func (w *Worker) mapService(svcSrc *corev1.Service) (updated bool, err error) {
 		return true, err
 	}
 
+	l3PortCount := 0
+	if w.AddressPairs.Enabled() {
+		l3PortCount = w.portmapper.GetL3PortCount()
+	}
+
 	id := model.FromService(svcSrc)
-	err = w.portmapper.MapService(svcSrc)
+	result, err := w.portmapper.MapService(svcSrc)
 	if err != nil {
+		if goerrors.Is(err, ErrReservedPort) || goerrors.Is(err, ErrNodePortConflict) || goerrors.Is(err, ErrUnsupportedProtocol) || goerrors.Is(err, ErrPreferredPortMissing) || goerrors.Is(err, ErrSharedIPConflict) {
+			w.recorder.Event(svcSrc, corev1.EventTypeWarning, EventServiceRejected, fmt.Sprintf(MessageEventServiceRejected, err.Error()))
+		} else if goerrors.Is(err, ErrNoSuitablePort) {
+			w.recorder.Event(svcSrc, corev1.EventTypeWarning, EventServiceUnplaceable, MessageEventServiceUnplaceable)
+		} else if goerrors.Is(err, openstack.ErrNoPortAvailable) {
+			w.recorder.Event(svcSrc, corev1.EventTypeWarning, EventServicePortsExhausted, MessageEventServicePortsExhausted)
+		} else if goerrors.Is(err, openstack.ErrNoFIPAvailable) {
+			w.recorder.Event(svcSrc, corev1.EventTypeWarning, EventServiceFloatingIPsExhausted, MessageEventServiceFloatingIPsExhausted)
+		} else {
+			w.recorder.Event(svcSrc, corev1.EventTypeWarning, EventServiceMappingFailed, fmt.Sprintf(MessageEventServiceMappingFailed, err.Error()))
+		}
 		return false, err
 	}
+	if result.Relocation != "" {
+		w.recorder.Event(svcSrc, corev1.EventTypeWarning, EventServicePortRelocated, fmt.Sprintf(MessageEventServicePortRelocated, result.Relocation))
+	}
+	for _, other := range result.Moved {
+		// the sync updates the port annotation and the load balancer status
+		w.EnqueueJob(&SyncServiceJob{other})
+	}
 
 	newPortID, err := w.portmapper.GetServiceL3Port(id)
 	if err != nil {
 		return false, err
 	}
 
+	if w.AddressPairs.Enabled() {
+		// only warn on the service which caused a new port to be provisioned
+		newL3PortCount := w.updateAddressPairMetrics()
+		if newL3PortCount > l3PortCount && w.AddressPairs.Exceeded(newL3PortCount) {
+			w.recorder.Event(svcSrc, corev1.EventTypeWarning, EventServiceAddressPairLimit, fmt.Sprintf(
+				MessageEventServiceAddressPairLimit,
+				w.AddressPairs.Estimate(newL3PortCount),
+				w.AddressPairs.WarningThreshold,
+			))
+		}
+	}
+
 	if oldPortID != newPortID {
 		svc := svcSrc.DeepCopy()
 		if svc.Status.LoadBalancer.Ingress == nil {
 			setPortAnnotation(svc, newPortID)
+			// the finalizer makes sure that the deletion of the service
+			// is not missed, so that its allocations are released
+			addFinalizer(svc, ownFinalizer(w.Identity))
 			_, err = w.kubeclientset.CoreV1().Services(svcSrc.Namespace).Update(context.TODO(), svc, metav1.UpdateOptions{})
 
 			if oldPortID == "" {
@@ -187,9 +292,39 @@ func (w *Worker) mapService(svcSrc *corev1.Service) (updated bool, err error) {
 		return true, err
 	}
 
+	// services mapped before the finalizer was introduced
+	if finalizer := ownFinalizer(w.Identity); !hasFinalizer(svcSrc, finalizer) {
+		svc := svcSrc.DeepCopy()
+		addFinalizer(svc, finalizer)
+		_, err = w.kubeclientset.CoreV1().Services(svcSrc.Namespace).Update(context.TODO(), svc, metav1.UpdateOptions{})
+		return true, err
+	}
+
 	return false, err
 }
 
+// Unmap a service which is being deleted and remove the finalizer of this
+// controller afterwards, so that the deletion can proceed.
+func (w *Worker) finalizeService(svcSrc *corev1.Service) error {
+	id := model.FromService(svcSrc)
+	if err := w.portmapper.UnmapService(id); err != nil {
+		return err
+	}
+
+	if w.AllocationStatus != nil {
+		if err := w.AllocationStatus.Delete(id); err != nil {
+			return err
+		}
+	}
+
+	klog.Infof("Finalizing deleted service %s/%s", svcSrc.Namespace, svcSrc.Name)
+
+	svc := svcSrc.DeepCopy()
+	removeFinalizer(svc, ownFinalizer(w.Identity))
+	_, err := w.kubeclientset.CoreV1().Services(svcSrc.Namespace).Update(context.TODO(), svc, metav1.UpdateOptions{})
+	return err
+}
+
 // Update the load balancer status information
 //
 //   - Return true and no error if the resource was updated.
@@ -220,17 +355,72 @@ func (w *Worker) updateServiceStatus(svcSrc *corev1.Service) (updated bool, err
 	return false, err
 }
 
+// Return the number of ready backends the service needs and the number of
+// ready backends it has. Services without a minimum backend count are always
+// ready.
+func (w *Worker) backendReadiness(svc *corev1.Service) (required int, ready int) {
+	// invalid annotations are rejected when mapping the service
+	required, _ = getMinBackends(svc)
+	if required == 0 || w.Endpoints == nil {
+		return required, required
+	}
+	ep, err := w.Endpoints.Endpoints(svc.Namespace).Get(svc.Name)
+	if err != nil {
+		// no endpoints exist during bootstrapping of a service
+		return required, 0
+	}
+	return required, countReadyBackends(ep)
+}
+
+// Return true if the forwards of the service are left out of the
+// configuration because it does not have enough ready backends yet. Only
+// services which also remove their forwards when they have no backends at all
+// are withheld; the others are forwarded to the backends they have.
+func (w *Worker) withholdsListener(svc *corev1.Service) bool {
+	if keepsEmptyBackends(svc) {
+		return false
+	}
+	required, ready := w.backendReadiness(svc)
+	return ready < required
+}
+
+// Remove the load balancer status of a service which does not have enough
+// ready backends yet.
+func (w *Worker) withholdServiceStatus(svcSrc *corev1.Service, required int, ready int) error {
+	klog.V(2).Infof(
+		"not marking service %s/%s ready: %d of %d required backends are ready",
+		svcSrc.Namespace,
+		svcSrc.Name,
+		ready,
+		required)
+	w.recorder.Event(svcSrc, corev1.EventTypeNormal, EventServiceWaitingForBackends, fmt.Sprintf(MessageEventServiceWaitingForBackends, ready, required))
+	if len(svcSrc.Status.LoadBalancer.Ingress) == 0 {
+		return nil
+	}
+	svc := svcSrc.DeepCopy()
+	svc.Status.LoadBalancer.Ingress = nil
+	_, err := w.kubeclientset.CoreV1().Services(svcSrc.Namespace).UpdateStatus(context.TODO(), svc, metav1.UpdateOptions{})
+	return err
+}
+
 func (w *Worker) cleanupPorts() error {
 	usedPorts, err := w.portmapper.GetUsedL3Ports()
 	if err != nil {
 		return err
 	}
 
-	err = w.l3portmanager.CleanUnusedPorts(usedPorts)
+	deleted, err := w.l3portmanager.CleanOrphanedPorts(usedPorts)
+	if len(deleted) > 0 {
+		klog.Infof("Deleted orphaned L3 ports %q", deleted)
+	}
 	if err != nil {
 		return err
 	}
 
+	if w.AddressPairs.Enabled() {
+		w.updateAddressPairMetrics()
+	}
+
 	return nil
 }
 
@@ -256,11 +446,33 @@ func NewWorker(
 		generator:       generator,
 		agentController: agentController,
 		workqueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Jobs"),
+		shutdown:        NewShutdownCoordinator(),
 		AllowCleanups:   false,
+		Identity:        DefaultControllerIdentity,
+	}
+}
+
+// Render the part of the load balancer configuration which belongs to a
+// single service, as it would be pushed to the agents. This is meant for
+// debugging only.
+//
+// Returns ErrServiceNotMapped if the service is not mapped to any port.
+func (w *Worker) RenderServiceConfig(id model.ServiceIdentifier) ([]byte, error) {
+	portID, err := w.portmapper.GetServiceL3Port(id)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := w.generator.GenerateModel(map[string]string{id.ToKey(): portID})
+	if err != nil {
+		return nil, err
 	}
+
+	return json.MarshalIndent(m, "", "  ")
 }
 
 func (w *Worker) EnqueueJob(j WorkerJob) {
+	w.convergence.changed()
 	w.workqueue.Add(j)
 }
 
@@ -272,6 +484,16 @@ func (w *Worker) ShutDown() {
 	w.workqueue.ShutDown()
 }
 
+// Drain stops executing new jobs, waits for the currently executing job to
+// finish (but at most for the given timeout) and shuts the worker down.
+//
+// Returns true if no job was still executing when the worker was shut down.
+func (w *Worker) Drain(timeout time.Duration) bool {
+	drained := w.shutdown.Drain(timeout)
+	w.ShutDown()
+	return drained
+}
+
 func (w *Worker) Run() {
 	klog.Infof("Worker started")
 	for w.processNextJob() {
@@ -281,6 +503,12 @@ func (w *Worker) Run() {
 func (w *Worker) executeJob(job WorkerJob) error {
 	defer w.workqueue.Done(job)
 
+	if !w.shutdown.Begin() {
+		klog.Infof("Not executing job %s: shutting down", job.ToString())
+		return nil
+	}
+	defer w.shutdown.End()
+
 	requeue, err := job.Run(w)
 	if err != nil {
 		if requeue != Drop {
@@ -363,6 +591,29 @@ func (j *SyncServiceJob) Run(w *Worker) (RequeueMode, error) {
 		return RequeueTail, err
 	}
 
+	// a deleted service is finalized even if another controller claims it,
+	// too; otherwise our finalizer would block its deletion forever
+	if svc.DeletionTimestamp != nil {
+		// the service is unmapped by the RemoveServiceJob once it is gone,
+		// unless it carries our finalizer
+		if hasFinalizer(svc, ownFinalizer(w.Identity)) {
+			if err := w.finalizeService(svc); err != nil {
+				return RequeueTail, err
+			}
+		}
+		return Drop, nil
+	}
+
+	if finalizer := getForeignFinalizer(svc, w.Identity); finalizer != "" {
+		klog.Warningf(
+			"skipping service %s/%s because it carries the foreign finalizer %q",
+			svc.Namespace,
+			svc.Name,
+			finalizer)
+		w.recorder.Event(svc, corev1.EventTypeWarning, EventServiceForeignOwner, fmt.Sprintf(MessageEventServiceForeignOwner, finalizer))
+		return Drop, nil
+	}
+
 	isManaged := isServiceManaged(svc)
 	canManage := canServiceBeManaged(svc)
 
@@ -421,19 +672,52 @@ func (j *SyncServiceJob) Run(w *Worker) (RequeueMode, error) {
 	// which is already on the resource; instead it removes the Ingress IP (and
 	// returns true to indicate that it updated the resource).
 
+	if w.mappingAttempts.isParked(svc, w.MaxMappingAttempts) {
+		klog.V(4).Infof("skipping parked service %s/%s", svc.Namespace, svc.Name)
+		return Drop, nil
+	}
+
 	updated, err := w.mapService(svc)
 	if err != nil {
+		if goerrors.Is(err, ErrReservedPort) {
+			// retrying will not help; the service has to be changed, which
+			// will trigger a new sync
+			return Drop, err
+		}
+		attempts := w.mappingAttempts.recordFailure(svc)
+		if w.MaxMappingAttempts > 0 && attempts >= w.MaxMappingAttempts {
+			klog.Warningf(
+				"parking service %s/%s after %d failed mapping attempts: %s",
+				svc.Namespace,
+				svc.Name,
+				attempts,
+				err.Error())
+			w.recorder.Event(svc, corev1.EventTypeWarning, EventServiceParked, fmt.Sprintf(MessageEventServiceParked, attempts, err.Error()))
+			return Drop, err
+		}
 		return RequeueTail, err
 	}
+	w.mappingAttempts.reset(j.Service)
 	if updated {
 		return Drop, nil
 	}
 
-	updated, err = w.updateServiceStatus(svc)
+	// the service is synced again when its endpoints change
+	if required, ready := w.backendReadiness(svc); ready < required {
+		err = w.withholdServiceStatus(svc, required, ready)
+	} else {
+		_, err = w.updateServiceStatus(svc)
+	}
 	if err != nil {
 		return RequeueTail, err
 	}
 
+	if w.AllocationStatus != nil {
+		if err := w.AllocationStatus.Reconcile(svc, w.portmapper, w.l3portmanager); err != nil {
+			return RequeueTail, err
+		}
+	}
+
 	// The work queue deduplicates jobs. In addition, the cleanup barrier will
 	// prevent execution of the update config job (with requeue) so that no
 	// harmful config will be generated during initial sync.
@@ -451,6 +735,8 @@ type RemoveServiceJob struct {
 }
 
 func (j *RemoveServiceJob) Run(w *Worker) (RequeueMode, error) {
+	w.mappingAttempts.reset(j.Service)
+
 	if j.Annotations == nil {
 		return Drop, nil
 	}
@@ -463,6 +749,12 @@ func (j *RemoveServiceJob) Run(w *Worker) (RequeueMode, error) {
 		return RequeueTail, err
 	}
 
+	if w.AllocationStatus != nil {
+		if err := w.AllocationStatus.Delete(j.Service); err != nil {
+			return RequeueTail, err
+		}
+	}
+
 	w.EnqueueJob(&CleanupJob{})
 	w.EnqueueJob(&UpdateConfigJob{})
 	return Drop, nil
@@ -492,25 +784,99 @@ func (j *CleanupJob) ToString() string {
 
 type UpdateConfigJob struct{}
 
+// Return the port assignment without the services whose forwards are
+// withheld until they have enough ready backends.
+func (w *Worker) configuredAssignment() map[string]string {
+	assignment := w.portmapper.GetModel()
+	for key := range assignment {
+		id, err := model.FromKey(key)
+		if err != nil {
+			continue
+		}
+		svc, err := w.servicesLister.Services(id.Namespace).Get(id.Name)
+		if err != nil {
+			continue
+		}
+		if w.withholdsListener(svc) {
+			klog.V(2).Infof("leaving service %q out of the configuration until it has enough ready backends", key)
+			delete(assignment, key)
+		}
+	}
+	return assignment
+}
+
 func (j *UpdateConfigJob) Run(w *Worker) (RequeueMode, error) {
-	model, err := w.generator.GenerateModel(w.portmapper.GetModel())
-	if err != nil {
+	model, err := w.generator.GenerateModel(w.configuredAssignment())
+	var partialErr *PartialModelError
+	if goerrors.As(err, &partialErr) {
+		// push the configuration of the other services anyway, but retry
+		// the failed ones later
+		w.recordRenderFailures(partialErr)
+	} else if err != nil {
 		return RequeueTail, err
 	}
 
-	err = w.agentController.PushConfig(model)
-	if err != nil {
+	pushErr := w.agentController.PushConfig(model)
+	if pushErr != nil {
 		// TODO: should we post this as an event somewhere?
+		return RequeueTail, pushErr
+	}
+	if err != nil {
 		return RequeueTail, err
 	}
 
+	if w.workqueue.Len() == 0 {
+		if elapsed, ok := w.convergence.converged(); ok {
+			convergenceMetric.Set(elapsed.Seconds())
+		}
+	}
+
 	return Drop, nil
 }
 
+func (w *Worker) recordRenderFailures(partialErr *PartialModelError) {
+	for _, key := range partialErr.Services() {
+		id, err := model.FromKey(key)
+		if err != nil {
+			continue
+		}
+		svc, err := w.servicesLister.Services(id.Namespace).Get(id.Name)
+		if err != nil {
+			continue
+		}
+		w.recorder.Event(svc, corev1.EventTypeWarning, EventServiceRenderFailed, fmt.Sprintf(MessageEventServiceRenderFailed, partialErr.Failed[key].Error()))
+	}
+}
+
 func (j *UpdateConfigJob) ToString() string {
 	return "UpdateConfigJob"
 }
 
+type RevalidatePortsJob struct{}
+
+func (j *RevalidatePortsJob) Run(w *Worker) (RequeueMode, error) {
+	moved, err := w.portmapper.RevalidatePorts()
+	for _, id := range moved {
+		svc, getErr := w.servicesLister.Services(id.Namespace).Get(id.Name)
+		if getErr == nil {
+			w.recorder.Event(svc, corev1.EventTypeWarning, EventServicePortVanished, fmt.Sprintf(MessageEventServicePortVanished, getPortAnnotation(svc)))
+		}
+		// the sync updates the port annotation and the load balancer status
+		w.EnqueueJob(&SyncServiceJob{id})
+	}
+	if len(moved) > 0 {
+		w.EnqueueJob(&UpdateConfigJob{})
+	}
+	if err != nil {
+		return RequeueTail, err
+	}
+	return Drop, nil
+}
+
+func (j *RevalidatePortsJob) ToString() string {
+	return "RevalidatePortsJob"
+}
+
 type EnsureAgentsStateJob struct{}
 
 func (j *EnsureAgentsStateJob) Run(w *Worker) (RequeueMode, error) {
@@ -15,20 +15,32 @@
 package controller
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	kubeinformers "k8s.io/client-go/informers"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 
 	controllertesting "github.com/cloudandheat/ch-k8s-lbaas/internal/controller/testing"
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/openstack"
 	ostesting "github.com/cloudandheat/ch-k8s-lbaas/internal/openstack/testing"
 )
 
@@ -37,6 +49,7 @@ type workerFixture struct {
 
 	kubeclient    *k8sfake.Clientset
 	serviceLister []*corev1.Service
+	endpoints     []*corev1.Endpoints
 	kubeactions   []core.Action
 	kubeobjects   []runtime.Object
 
@@ -69,6 +82,12 @@ func (f *workerFixture) newWorker() (*Worker, kubeinformers.SharedInformerFactor
 
 	w := NewWorker(f.l3portmanager, f.portmapper, f.kubeclient, k8sI.Core().V1().Services().Lister(), f.generator, f.agentController)
 	w.AllowCleanups = f.willAllowCleanups
+	if f.endpoints != nil {
+		for _, ep := range f.endpoints {
+			k8sI.Core().V1().Endpoints().Informer().GetIndexer().Add(ep)
+		}
+		w.Endpoints = k8sI.Core().V1().Endpoints().Lister()
+	}
 	return w, k8sI
 }
 
@@ -147,6 +166,11 @@ func (f *workerFixture) addService(svc *corev1.Service) {
 	f.kubeobjects = append(f.kubeobjects, svc)
 }
 
+func (f *workerFixture) addEndpoints(ep *corev1.Endpoints) {
+	f.endpoints = append(f.endpoints, ep)
+	f.kubeobjects = append(f.kubeobjects, ep)
+}
+
 func TestWorkerInit(t *testing.T) {
 	f := newWorkerFixture(t)
 	w, _ := f.newWorker()
@@ -223,6 +247,28 @@ func TestSyncServiceRemovesManagedAnnotationAndUnmapsIfNotManageable(t *testing.
 	assert.Equal(t, Drop, requeue)
 }
 
+func TestSyncServiceRemovesOwnFinalizerIfNotManageable(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Spec.Type = "not-a-load-balancer"
+	s.Annotations = map[string]string{AnnotationManaged: "true"}
+	s.Finalizers = []string{
+		ownFinalizer(DefaultControllerIdentity),
+		"kubernetes.io/some-other-finalizer",
+	}
+	f.addService(s)
+
+	f.portmapper.On("UnmapService", model.FromService(s)).Return(nil).Times(1)
+
+	updatedS := s.DeepCopy()
+	updatedS.Annotations = make(map[string]string)
+	updatedS.Finalizers = []string{"kubernetes.io/some-other-finalizer"}
+	f.expectUpdateServiceAction(updatedS)
+
+	_, requeue := f.run(&SyncServiceJob{model.FromService(s)})
+	assert.Equal(t, Drop, requeue)
+}
+
 func TestSyncServiceIgnoresUnmanageableAndUnmanagedService(t *testing.T) {
 	f := newWorkerFixture(t)
 	s := newService("test-service")
@@ -267,11 +313,12 @@ func TestSyncServiceCallsMapServiceForManagedServiceAndAnnotatesPort(t *testing.
 	s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
 	f.addService(s)
 
-	f.portmapper.On("MapService", s).Return(nil).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
 	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
 
 	updatedS := s.DeepCopy()
 	setPortAnnotation(updatedS, "random-port-id")
+	addFinalizer(updatedS, ownFinalizer(DefaultControllerIdentity))
 	f.expectUpdateServiceAction(updatedS)
 
 	j := &SyncServiceJob{model.FromService(s)}
@@ -280,15 +327,122 @@ func TestSyncServiceCallsMapServiceForManagedServiceAndAnnotatesPort(t *testing.
 	assert.Equal(t, Drop, requeue)
 }
 
+func TestSyncServiceRecordsEventIfServiceWasRelocated(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = map[string]string{
+		AnnotationManaged:     "true",
+		AnnotationInboundPort: "vanished-port-id",
+	}
+	f.addService(s)
+
+	f.portmapper.On("MapService", s).Return(model.MapResult{
+		Outcome:    model.MapOutcomeNew,
+		L3PortID:   "random-port-id",
+		Relocation: "port vanished-port-id does not exist anymore",
+	}, nil).Times(1)
+	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
+
+	updatedS := s.DeepCopy()
+	setPortAnnotation(updatedS, "random-port-id")
+	addFinalizer(updatedS, ownFinalizer(DefaultControllerIdentity))
+	f.expectUpdateServiceAction(updatedS)
+
+	j := &SyncServiceJob{model.FromService(s)}
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.recorder = recorder
+		requeue, err := j.Run(w)
+		assert.Nil(t, err)
+		assert.Equal(t, Drop, requeue)
+	})
+
+	assert.Equal(t, 2, len(recorder.Events))
+	event := <-recorder.Events
+	assert.Contains(t, event, "Warning "+EventServicePortRelocated)
+	assert.Contains(t, event, "port vanished-port-id does not exist anymore")
+	assert.Contains(t, <-recorder.Events, EventServiceRemapped)
+}
+
+func TestSyncServiceWarnsIfProvisionedPortReachesAddressPairThreshold(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = make(map[string]string)
+	s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
+	f.addService(s)
+
+	f.portmapper.On("GetL3PortCount").Return(1).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
+	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
+	f.portmapper.On("GetL3PortCount").Return(2).Times(1)
+
+	updatedS := s.DeepCopy()
+	setPortAnnotation(updatedS, "random-port-id")
+	addFinalizer(updatedS, ownFinalizer(DefaultControllerIdentity))
+	f.expectUpdateServiceAction(updatedS)
+
+	j := &SyncServiceJob{model.FromService(s)}
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.recorder = recorder
+		w.AddressPairs = AddressPairBudget{Static: 1, WarningThreshold: 3}
+		requeue, err := j.Run(w)
+		assert.Nil(t, err)
+		assert.Equal(t, Drop, requeue)
+	})
+
+	assert.Equal(t, float64(3), testutil.ToFloat64(addressPairsMetric))
+	assert.Equal(t, float64(3), testutil.ToFloat64(addressPairsThresholdMetric))
+	assert.Equal(t, 2, len(recorder.Events))
+	assert.Contains(t, <-recorder.Events, EventServiceAddressPairLimit)
+	assert.Contains(t, <-recorder.Events, EventServiceMapped)
+}
+
+func TestSyncServiceDoesNotWarnAboutAddressPairsWithoutNewPort(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = make(map[string]string)
+	s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
+	f.addService(s)
+
+	f.portmapper.On("GetL3PortCount").Return(5).Times(2)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
+	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
+
+	updatedS := s.DeepCopy()
+	setPortAnnotation(updatedS, "random-port-id")
+	addFinalizer(updatedS, ownFinalizer(DefaultControllerIdentity))
+	f.expectUpdateServiceAction(updatedS)
+
+	j := &SyncServiceJob{model.FromService(s)}
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.recorder = recorder
+		w.AddressPairs = AddressPairBudget{Static: 1, WarningThreshold: 3}
+		requeue, err := j.Run(w)
+		assert.Nil(t, err)
+		assert.Equal(t, Drop, requeue)
+	})
+
+	// the threshold is exceeded, but the service did not add to it
+	assert.Equal(t, float64(6), testutil.ToFloat64(addressPairsMetric))
+	assert.Equal(t, 1, len(recorder.Events))
+	assert.Contains(t, <-recorder.Events, EventServiceMapped)
+}
+
 func TestSyncServiceSetsLoadBalancerStatusOnUnchangedMapping(t *testing.T) {
 	f := newWorkerFixture(t)
 	s := newService("test-service")
 	s.Annotations = make(map[string]string)
 	s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
 	setPortAnnotation(s, "random-port-id")
+	addFinalizer(s, ownFinalizer(DefaultControllerIdentity))
 	f.addService(s)
 
-	f.portmapper.On("MapService", s).Return(nil).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
 	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
 	f.l3portmanager.On("GetExternalAddress", "random-port-id").Return("some-ip", "some-hostname", nil).Times(1)
 
@@ -310,10 +464,11 @@ func TestSyncServiceRequeuesIfExternalAddressCannotBeObtained(t *testing.T) {
 	s.Annotations = make(map[string]string)
 	s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
 	setPortAnnotation(s, "random-port-id")
+	addFinalizer(s, ownFinalizer(DefaultControllerIdentity))
 	f.addService(s)
 
 	someError := fmt.Errorf("some error")
-	f.portmapper.On("MapService", s).Return(nil).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
 	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
 	f.l3portmanager.On("GetExternalAddress", "random-port-id").Return("", "", someError).Times(1)
 
@@ -335,7 +490,7 @@ func TestSyncServiceClearsLoadBalancerStatusIfMappingHasChanged(t *testing.T) {
 	}
 	f.addService(s)
 
-	f.portmapper.On("MapService", s).Return(nil).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
 	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
 
 	updatedS := s.DeepCopy()
@@ -357,7 +512,7 @@ func TestSyncServiceRequeuesIfMapServiceFails(t *testing.T) {
 
 	someError := fmt.Errorf("some error")
 
-	f.portmapper.On("MapService", s).Return(someError).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, someError).Times(1)
 
 	j := &SyncServiceJob{model.FromService(s)}
 
@@ -366,6 +521,345 @@ func TestSyncServiceRequeuesIfMapServiceFails(t *testing.T) {
 	assert.Equal(t, RequeueTail, requeue)
 }
 
+func TestSyncServiceRecordsEventIfMapServiceFails(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = map[string]string{AnnotationManaged: "true"}
+	f.addService(s)
+
+	someError := fmt.Errorf("some error")
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, someError).Times(1)
+
+	j := &SyncServiceJob{model.FromService(s)}
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.recorder = recorder
+		_, err := j.Run(w)
+		assert.Equal(t, someError, err)
+	})
+
+	assert.Equal(t, 1, len(recorder.Events))
+	event := <-recorder.Events
+	assert.Contains(t, event, "Warning "+EventServiceMappingFailed)
+	assert.Contains(t, event, "some error")
+}
+
+func TestSyncServiceDropsAndRecordsEventIfPortIsReserved(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = make(map[string]string)
+	s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
+	f.addService(s)
+
+	reservedError := fmt.Errorf("%w: %d", ErrReservedPort, 22)
+
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, reservedError).Times(1)
+
+	j := &SyncServiceJob{model.FromService(s)}
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.recorder = recorder
+		requeue, err := j.Run(w)
+		assert.Equal(t, reservedError, err)
+		assert.Equal(t, Drop, requeue)
+	})
+
+	assert.Equal(t, 1, len(recorder.Events))
+	assert.Contains(t, <-recorder.Events, EventServiceRejected)
+}
+
+func TestSyncServiceRequeuesAndRecordsEventIfNoPortIsAvailable(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = make(map[string]string)
+	s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
+	f.addService(s)
+
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, ErrNoSuitablePort).Times(1)
+
+	j := &SyncServiceJob{model.FromService(s)}
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.recorder = recorder
+		requeue, err := j.Run(w)
+		assert.Equal(t, ErrNoSuitablePort, err)
+		assert.Equal(t, RequeueTail, requeue)
+	})
+
+	assert.Equal(t, 1, len(recorder.Events))
+	assert.Contains(t, <-recorder.Events, EventServiceUnplaceable)
+}
+
+func TestSyncServiceParksServiceAfterMaxMappingAttempts(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = make(map[string]string)
+	s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
+	f.addService(s)
+
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, ErrNoSuitablePort).Times(3)
+
+	j := &SyncServiceJob{model.FromService(s)}
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.recorder = recorder
+		w.MaxMappingAttempts = 3
+
+		for i := 0; i < 2; i++ {
+			requeue, err := j.Run(w)
+			assert.Equal(t, ErrNoSuitablePort, err)
+			assert.Equal(t, RequeueTail, requeue)
+		}
+
+		requeue, err := j.Run(w)
+		assert.Equal(t, ErrNoSuitablePort, err)
+		assert.Equal(t, Drop, requeue)
+
+		// parked: not attempted anymore
+		requeue, err = j.Run(w)
+		assert.Nil(t, err)
+		assert.Equal(t, Drop, requeue)
+	})
+
+	assert.Equal(t, 4, len(recorder.Events))
+	for i := 0; i < 3; i++ {
+		assert.Contains(t, <-recorder.Events, EventServiceUnplaceable)
+	}
+	assert.Contains(t, <-recorder.Events, EventServiceParked)
+}
+
+func TestSyncServiceUnparksServiceOnSpecChange(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = make(map[string]string)
+	s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
+	s.Spec.Ports = []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80}}
+	f.addService(s)
+
+	changed := s.DeepCopy()
+	changed.Spec.Ports[0].Port = 8080
+
+	someError := fmt.Errorf("random error")
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, someError).Times(1)
+	f.portmapper.On("MapService", changed).Return(model.MapResult{}, someError).Times(1)
+
+	j := &SyncServiceJob{model.FromService(s)}
+
+	f.runWith(true, func(w *Worker) {
+		w.recorder = record.NewFakeRecorder(10)
+		w.MaxMappingAttempts = 1
+
+		requeue, err := j.Run(w)
+		assert.Equal(t, someError, err)
+		assert.Equal(t, Drop, requeue)
+
+		requeue, err = j.Run(w)
+		assert.Nil(t, err)
+		assert.Equal(t, Drop, requeue)
+
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		assert.Nil(t, indexer.Add(changed))
+		w.servicesLister = corelisters.NewServiceLister(indexer)
+
+		requeue, err = j.Run(w)
+		assert.Equal(t, someError, err)
+		assert.Equal(t, Drop, requeue)
+	})
+}
+
+func TestSyncServiceRecordsEventIfResourcesAreExhausted(t *testing.T) {
+	cases := []struct {
+		err    error
+		reason string
+	}{
+		{fmt.Errorf("%w: quota", openstack.ErrNoPortAvailable), EventServicePortsExhausted},
+		{fmt.Errorf("%w: quota", openstack.ErrNoFIPAvailable), EventServiceFloatingIPsExhausted},
+	}
+
+	for _, c := range cases {
+		f := newWorkerFixture(t)
+		s := newService("test-service")
+		s.Annotations = make(map[string]string)
+		s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
+		f.addService(s)
+
+		f.portmapper.On("MapService", s).Return(model.MapResult{}, c.err).Times(1)
+
+		j := &SyncServiceJob{model.FromService(s)}
+
+		recorder := record.NewFakeRecorder(10)
+		f.runWith(true, func(w *Worker) {
+			w.recorder = recorder
+			requeue, err := j.Run(w)
+			assert.Equal(t, c.err, err)
+			assert.Equal(t, RequeueTail, requeue)
+		})
+
+		assert.Equal(t, 1, len(recorder.Events))
+		assert.Contains(t, <-recorder.Events, c.reason)
+	}
+}
+
+func TestRevalidatePortsJobRecordsEventAndResyncsMovedServices(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = map[string]string{AnnotationInboundPort: "port-id-x"}
+	f.addService(s)
+
+	f.portmapper.On("RevalidatePorts").Return([]model.ServiceIdentifier{model.FromService(s)}, nil).Times(1)
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.recorder = recorder
+		requeue, err := (&RevalidatePortsJob{}).Run(w)
+		assert.Nil(t, err)
+		assert.Equal(t, Drop, requeue)
+		// one sync for the moved service and one config update
+		assert.Equal(t, 2, w.workqueue.Len())
+	})
+
+	assert.Equal(t, 1, len(recorder.Events))
+	assert.Contains(t, <-recorder.Events, EventServicePortVanished)
+}
+
+func TestRevalidatePortsJobDoesNothingIfAllPortsExist(t *testing.T) {
+	f := newWorkerFixture(t)
+
+	f.portmapper.On("RevalidatePorts").Return([]model.ServiceIdentifier{}, nil).Times(1)
+
+	f.runWith(true, func(w *Worker) {
+		requeue, err := (&RevalidatePortsJob{}).Run(w)
+		assert.Nil(t, err)
+		assert.Equal(t, Drop, requeue)
+		assert.Equal(t, 0, w.workqueue.Len())
+	})
+}
+
+func TestSyncServiceSkipsServiceWithForeignFinalizer(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = make(map[string]string)
+	s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
+	s.Finalizers = []string{"finalizer.cah-loadbalancer.k8s.cloudandheat.com/other"}
+	f.addService(s)
+
+	j := &SyncServiceJob{model.FromService(s)}
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.recorder = recorder
+		requeue, err := j.Run(w)
+		assert.Nil(t, err)
+		assert.Equal(t, Drop, requeue)
+	})
+
+	assert.Equal(t, 1, len(recorder.Events))
+	assert.Contains(t, <-recorder.Events, EventServiceForeignOwner)
+}
+
+func TestSyncServiceProcessesServiceWithOwnFinalizer(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Finalizers = []string{
+		"finalizer.cah-loadbalancer.k8s.cloudandheat.com/mine",
+		"kubernetes.io/some-other-finalizer",
+	}
+	f.addService(s)
+	j := &SyncServiceJob{model.FromService(s)}
+
+	updatedS := s.DeepCopy()
+	updatedS.Annotations = make(map[string]string)
+	updatedS.Annotations[AnnotationManaged] = "true"
+	f.expectUpdateServiceAction(updatedS)
+
+	f.runWith(true, func(w *Worker) {
+		w.Identity = "mine"
+		requeue, err := j.Run(w)
+		assert.Nil(t, err)
+		assert.Equal(t, Drop, requeue)
+	})
+}
+
+func TestSyncServiceUnmapsDeletedServiceAndRemovesOwnFinalizer(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = map[string]string{AnnotationManaged: "true"}
+	setPortAnnotation(s, "some-port")
+	s.Finalizers = []string{
+		"kubernetes.io/some-other-finalizer",
+		ownFinalizer(DefaultControllerIdentity),
+	}
+	now := metav1.Now()
+	s.DeletionTimestamp = &now
+	f.addService(s)
+
+	f.portmapper.On("UnmapService", model.FromService(s)).Return(nil).Times(1)
+
+	updatedS := s.DeepCopy()
+	updatedS.Finalizers = []string{"kubernetes.io/some-other-finalizer"}
+	f.expectUpdateServiceAction(updatedS)
+
+	_, requeue := f.run(&SyncServiceJob{model.FromService(s)})
+	assert.Equal(t, Drop, requeue)
+}
+
+func TestSyncServiceRemovesOwnFinalizerOfDeletedServiceWithForeignFinalizer(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = map[string]string{AnnotationManaged: "true"}
+	setPortAnnotation(s, "some-port")
+	s.Finalizers = []string{
+		ownFinalizer(DefaultControllerIdentity),
+		ownFinalizer("other"),
+	}
+	now := metav1.Now()
+	s.DeletionTimestamp = &now
+	f.addService(s)
+
+	f.portmapper.On("UnmapService", model.FromService(s)).Return(nil).Times(1)
+
+	updatedS := s.DeepCopy()
+	updatedS.Finalizers = []string{ownFinalizer("other")}
+	f.expectUpdateServiceAction(updatedS)
+
+	_, requeue := f.run(&SyncServiceJob{model.FromService(s)})
+	assert.Equal(t, Drop, requeue)
+}
+
+func TestSyncServiceKeepsFinalizerIfUnmappingDeletedServiceFails(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = map[string]string{AnnotationManaged: "true"}
+	s.Finalizers = []string{ownFinalizer(DefaultControllerIdentity)}
+	now := metav1.Now()
+	s.DeletionTimestamp = &now
+	f.addService(s)
+
+	someError := fmt.Errorf("some error")
+	f.portmapper.On("UnmapService", model.FromService(s)).Return(someError).Times(1)
+
+	_, requeue, err := f.runExpectError(&SyncServiceJob{model.FromService(s)})
+	assert.Equal(t, someError, err)
+	assert.Equal(t, RequeueTail, requeue)
+}
+
+func TestSyncServiceLeavesDeletedServiceWithoutOwnFinalizerAlone(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = map[string]string{AnnotationManaged: "true"}
+	s.Finalizers = []string{"kubernetes.io/some-other-finalizer"}
+	now := metav1.Now()
+	s.DeletionTimestamp = &now
+	f.addService(s)
+
+	_, requeue := f.run(&SyncServiceJob{model.FromService(s)})
+	assert.Equal(t, Drop, requeue)
+}
+
 func TestSyncServiceDoesNothingIfDeleted(t *testing.T) {
 	f := newWorkerFixture(t)
 	s := newService("test-service")
@@ -394,6 +888,34 @@ func TestRemoveServiceUnmapsManagedService(t *testing.T) {
 	assert.Equal(t, Drop, requeue)
 }
 
+func TestRemoveServiceDeletesAllocationStatus(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = make(map[string]string)
+	s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
+
+	allocation := newAllocationObject(s)
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{AllocationResource: AllocationKind + "List"},
+		allocation,
+	)
+
+	f.portmapper.On("UnmapService", model.FromService(s)).Return(nil).Times(1)
+
+	j := &RemoveServiceJob{model.FromService(s), s.Annotations}
+
+	f.runWith(true, func(w *Worker) {
+		w.AllocationStatus = NewAllocationStatusReconciler(client)
+		requeue, err := j.Run(w)
+		assert.Nil(t, err)
+		assert.Equal(t, Drop, requeue)
+	})
+
+	_, err := client.Resource(AllocationResource).Namespace(s.Namespace).Get(context.TODO(), s.Name, metav1.GetOptions{})
+	assert.True(t, k8serrors.IsNotFound(err))
+}
+
 func TestRemoveServiceRetiresIfUnmappingFails(t *testing.T) {
 	f := newWorkerFixture(t)
 	s := newService("test-service")
@@ -437,7 +959,7 @@ func TestCleanupJobAsksPortmanagerToRemoveUnusedPorts(t *testing.T) {
 	f.willAllowCleanups = true
 
 	f.portmapper.On("GetUsedL3Ports").Return([]string{"a", "b"}, nil).Times(1)
-	f.l3portmanager.On("CleanUnusedPorts", []string{"a", "b"}).Return(nil).Times(1)
+	f.l3portmanager.On("CleanOrphanedPorts", []string{"a", "b"}).Return([]string{"c"}, nil).Times(1)
 
 	j := &CleanupJob{}
 
@@ -465,7 +987,7 @@ func TestCleanupJobRetriesOnErrorFromPortmanager(t *testing.T) {
 
 	someError := fmt.Errorf("fnord")
 	f.portmapper.On("GetUsedL3Ports").Return([]string{"a", "b"}, nil).Times(1)
-	f.l3portmanager.On("CleanUnusedPorts", []string{"a", "b"}).Return(someError).Times(1)
+	f.l3portmanager.On("CleanOrphanedPorts", []string{"a", "b"}).Return([]string{}, someError).Times(1)
 
 	j := &CleanupJob{}
 
@@ -481,7 +1003,7 @@ func TestPmapServiceRemovesLBStatusAndReturnsTrueIfMappingChangesAndLBStatusIsPr
 	s.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "ip", Hostname: "hostname"}}
 	f.addService(s)
 
-	f.portmapper.On("MapService", s).Return(nil).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
 	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("new-port", nil).Times(1)
 
 	updatedS := s.DeepCopy()
@@ -499,10 +1021,11 @@ func TestPmapServiceDoesNothingAndReturnsFalseIfMappingIsUnchangedAndLBStatusIsP
 	f := newWorkerFixture(t)
 	s := newService("test-service")
 	setPortAnnotation(s, "old-port")
+	addFinalizer(s, ownFinalizer(DefaultControllerIdentity))
 	s.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "ip", Hostname: "hostname"}}
 	f.addService(s)
 
-	f.portmapper.On("MapService", s).Return(nil).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
 	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("old-port", nil).Times(1)
 
 	f.runWith(true, func(w *Worker) {
@@ -512,6 +1035,31 @@ func TestPmapServiceDoesNothingAndReturnsFalseIfMappingIsUnchangedAndLBStatusIsP
 	})
 }
 
+func TestPmapServiceAddsFinalizerAndReturnsTrueIfMappingIsUnchangedAndFinalizerIsMissing(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	setPortAnnotation(s, "old-port")
+	s.Finalizers = []string{"kubernetes.io/some-other-finalizer"}
+	s.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "ip", Hostname: "hostname"}}
+	f.addService(s)
+
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
+	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("old-port", nil).Times(1)
+
+	updatedS := s.DeepCopy()
+	updatedS.Finalizers = []string{
+		"kubernetes.io/some-other-finalizer",
+		ownFinalizer(DefaultControllerIdentity),
+	}
+	f.expectUpdateServiceAction(updatedS)
+
+	f.runWith(true, func(w *Worker) {
+		updated, err := w.mapService(s)
+		assert.Nil(t, err)
+		assert.True(t, updated)
+	})
+}
+
 func TestPmapServiceUpdatesAnnotationAndReturnsTrueIfMappingChangesAndLBStatusIsNotPresent(t *testing.T) {
 	f := newWorkerFixture(t)
 	s := newService("test-service")
@@ -519,11 +1067,12 @@ func TestPmapServiceUpdatesAnnotationAndReturnsTrueIfMappingChangesAndLBStatusIs
 	s.Status.LoadBalancer.Ingress = nil
 	f.addService(s)
 
-	f.portmapper.On("MapService", s).Return(nil).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
 	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("new-port", nil).Times(1)
 
 	updatedS := s.DeepCopy()
 	setPortAnnotation(updatedS, "new-port")
+	addFinalizer(updatedS, ownFinalizer(DefaultControllerIdentity))
 	f.expectUpdateServiceAction(updatedS)
 
 	f.runWith(true, func(w *Worker) {
@@ -540,11 +1089,12 @@ func TestPmapServiceUpdatesAnnotationAndReturnsTrueIfMappedAndLBStatusIsNotPrese
 	s.Status.LoadBalancer.Ingress = nil
 	f.addService(s)
 
-	f.portmapper.On("MapService", s).Return(nil).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
 	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("new-port", nil).Times(1)
 
 	updatedS := s.DeepCopy()
 	setPortAnnotation(updatedS, "new-port")
+	addFinalizer(updatedS, ownFinalizer(DefaultControllerIdentity))
 	f.expectUpdateServiceAction(updatedS)
 
 	f.runWith(true, func(w *Worker) {
@@ -562,7 +1112,7 @@ func TestPmapServiceForwardsErrorFromMapService(t *testing.T) {
 	f.addService(s)
 
 	someError := fmt.Errorf("some error")
-	f.portmapper.On("MapService", s).Return(someError).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, someError).Times(1)
 
 	f.runWith(true, func(w *Worker) {
 		updated, err := w.mapService(s)
@@ -579,7 +1129,7 @@ func TestPmapServiceForwardsErrorFromGetServiceL3Port(t *testing.T) {
 	f.addService(s)
 
 	someError := fmt.Errorf("some error")
-	f.portmapper.On("MapService", s).Return(nil).Times(1)
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
 	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("", someError).Times(1)
 
 	f.runWith(true, func(w *Worker) {
@@ -731,6 +1281,46 @@ func TestUpdateConfigJobPushesConfigToAgents(t *testing.T) {
 	assert.Equal(t, Drop, requeue)
 }
 
+func TestUpdateConfigJobReportsConvergenceDuration(t *testing.T) {
+	f := newWorkerFixture(t)
+
+	lbm := &model.LoadBalancer{}
+	pm := make(map[string]string)
+
+	f.portmapper.On("GetModel").Return(pm)
+	f.generator.On("GenerateModel", pm).Return(lbm, nil)
+	f.portmapper.On("RevalidatePorts").Return([]model.ServiceIdentifier{}, nil)
+	f.agentController.On("PushConfig", lbm).Return(nil).Times(3)
+
+	f.runWith(false, func(w *Worker) {
+		clock := &fakeClock{current: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+		w.convergence.now = clock.now
+		convergenceMetric.Set(0)
+
+		w.EnqueueJob(&UpdateConfigJob{})
+		clock.advance(5 * time.Second)
+		w.EnqueueJob(&RevalidatePortsJob{})
+
+		// work is left after the first push
+		clock.advance(10 * time.Second)
+		assert.True(t, w.processNextJob())
+		assert.True(t, w.processNextJob())
+		assert.Equal(t, float64(0), testutil.ToFloat64(convergenceMetric))
+
+		clock.advance(20 * time.Second)
+		w.EnqueueJob(&UpdateConfigJob{})
+		assert.True(t, w.processNextJob())
+		assert.Equal(t, float64(35), testutil.ToFloat64(convergenceMetric))
+
+		// the next change starts a new convergence
+		clock.advance(time.Minute)
+		w.EnqueueJob(&UpdateConfigJob{})
+		clock.advance(2 * time.Second)
+		assert.True(t, w.processNextJob())
+		assert.Equal(t, float64(2), testutil.ToFloat64(convergenceMetric))
+	})
+}
+
 func TestUpdateConfigJobRequeuesIfPushFails(t *testing.T) {
 	f := newWorkerFixture(t)
 
@@ -750,6 +1340,40 @@ func TestUpdateConfigJobRequeuesIfPushFails(t *testing.T) {
 	assert.Equal(t, someError, err)
 }
 
+func TestUpdateConfigJobPushesPartialConfigAndReportsFailedServices(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	f.addService(s)
+
+	lbm := &model.LoadBalancer{}
+	pm := map[string]string{
+		model.FromService(s).ToKey(): "port-id-1",
+		"default/other-service":      "port-id-2",
+	}
+	partialErr := &PartialModelError{Failed: map[string]error{
+		model.FromService(s).ToKey(): fmt.Errorf("random error"),
+	}}
+
+	f.portmapper.On("GetModel").Return(pm).Times(1)
+	f.generator.On("GenerateModel", pm).Return(lbm, partialErr).Times(1)
+	f.agentController.On("PushConfig", lbm).Return(nil).Times(1)
+
+	j := &UpdateConfigJob{}
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.recorder = recorder
+		requeue, err := j.Run(w)
+		assert.Equal(t, partialErr, err)
+		assert.Equal(t, RequeueTail, requeue)
+	})
+
+	assert.Equal(t, 1, len(recorder.Events))
+	event := <-recorder.Events
+	assert.Contains(t, event, EventServiceRenderFailed)
+	assert.Contains(t, event, "random error")
+}
+
 func TestUpdateConfigJobRequeuesIfModelGenerationFails(t *testing.T) {
 	f := newWorkerFixture(t)
 
@@ -766,3 +1390,197 @@ func TestUpdateConfigJobRequeuesIfModelGenerationFails(t *testing.T) {
 	assert.Equal(t, RequeueTail, requeue)
 	assert.Equal(t, someError, err)
 }
+
+func TestRenderServiceConfigOnlyIncludesTheService(t *testing.T) {
+	f := newWorkerFixture(t)
+
+	id := model.ServiceIdentifier{Namespace: "default", Name: "svc-1"}
+	lbm := &model.LoadBalancer{
+		Ingress: []model.IngressIP{
+			{
+				Address: "172.23.42.1",
+				Ports: []model.PortForward{
+					{
+						Protocol:             corev1.ProtocolTCP,
+						InboundPort:          80,
+						DestinationAddresses: []string{"192.168.0.1"},
+						DestinationPort:      30080,
+					},
+				},
+			},
+		},
+	}
+
+	f.portmapper.On("GetServiceL3Port", id).Return("port-id-1", nil).Times(1)
+	f.generator.On("GenerateModel", map[string]string{"default/svc-1": "port-id-1"}).Return(lbm, nil).Times(1)
+
+	f.runWith(false, func(w *Worker) {
+		out, err := w.RenderServiceConfig(id)
+		assert.Nil(t, err)
+
+		rendered := &model.LoadBalancer{}
+		assert.Nil(t, json.Unmarshal(out, rendered))
+		assert.Equal(t, lbm, rendered)
+	})
+}
+
+func TestRenderServiceConfigFailsForUnmappedService(t *testing.T) {
+	f := newWorkerFixture(t)
+
+	id := model.ServiceIdentifier{Namespace: "default", Name: "svc-1"}
+	f.portmapper.On("GetServiceL3Port", id).Return("", ErrServiceNotMapped).Times(1)
+
+	f.runWith(false, func(w *Worker) {
+		out, err := w.RenderServiceConfig(id)
+		assert.Nil(t, out)
+		assert.True(t, errors.Is(err, ErrServiceNotMapped))
+	})
+}
+
+type blockingJob struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (j *blockingJob) Run(w *Worker) (RequeueMode, error) {
+	close(j.started)
+	<-j.release
+	return Drop, nil
+}
+
+func (j *blockingJob) ToString() string {
+	return "blockingJob"
+}
+
+func TestDrainWaitsForInFlightJob(t *testing.T) {
+	f := newWorkerFixture(t)
+
+	f.runWith(false, func(w *Worker) {
+		j := &blockingJob{started: make(chan struct{}), release: make(chan struct{})}
+		w.EnqueueJob(j)
+		go w.processNextJob()
+		<-j.started
+
+		drained := make(chan bool)
+		go func() {
+			drained <- w.Drain(time.Minute)
+		}()
+
+		select {
+		case <-drained:
+			t.Fatal("Drain returned while a job was in flight")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(j.release)
+		assert.True(t, <-drained)
+
+		// no further jobs are executed after the worker has been drained
+		w.EnqueueJob(&UpdateConfigJob{})
+		assert.False(t, w.processNextJob())
+	})
+}
+
+func TestDrainGivesUpAfterTimeout(t *testing.T) {
+	f := newWorkerFixture(t)
+
+	f.runWith(false, func(w *Worker) {
+		j := &blockingJob{started: make(chan struct{}), release: make(chan struct{})}
+		defer close(j.release)
+		w.EnqueueJob(j)
+		go w.processNextJob()
+		<-j.started
+
+		assert.False(t, w.Drain(10*time.Millisecond))
+	})
+}
+
+func newMinBackendsService(minBackends string) *corev1.Service {
+	s := newService("test-service")
+	s.Annotations = map[string]string{
+		AnnotationManaged:     "true",
+		AnnotationMinBackends: minBackends,
+	}
+	setPortAnnotation(s, "random-port-id")
+	addFinalizer(s, ownFinalizer(DefaultControllerIdentity))
+	return s
+}
+
+func TestSyncServiceDoesNotMarkServiceReadyWithTooFewBackends(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newMinBackendsService("2")
+	f.addService(s)
+	f.addEndpoints(newEndpointsOnNodes(s, "kubernetes-node-1"))
+
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
+	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
+
+	f.runWith(true, func(w *Worker) {
+		requeue, err := (&SyncServiceJob{model.FromService(s)}).Run(w)
+		assert.Nil(t, err)
+		assert.Equal(t, Drop, requeue)
+		assert.Equal(t, 1, w.workqueue.Len())
+	})
+}
+
+func TestSyncServiceMarksServiceReadyOnceEnoughBackendsAreReady(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newMinBackendsService("2")
+	f.addService(s)
+	f.addEndpoints(newEndpointsOnNodes(s, "kubernetes-node-1", "kubernetes-node-2"))
+
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
+	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
+	f.l3portmanager.On("GetExternalAddress", "random-port-id").Return("some-ip", "", nil).Times(1)
+
+	updatedS := s.DeepCopy()
+	updatedS.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "some-ip"}}
+	f.expectUpdateServiceStatusAction(updatedS)
+
+	_, requeue := f.run(&SyncServiceJob{model.FromService(s)})
+	assert.Equal(t, Drop, requeue)
+}
+
+func TestSyncServiceClearsStatusIfBackendsDropBelowMinimum(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newMinBackendsService("2")
+	s.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "some-ip"}}
+	f.addService(s)
+	f.addEndpoints(newEndpointsOnNodes(s, "kubernetes-node-1"))
+
+	f.portmapper.On("MapService", s).Return(model.MapResult{}, nil).Times(1)
+	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
+
+	updatedS := s.DeepCopy()
+	updatedS.Status.LoadBalancer.Ingress = nil
+	f.expectUpdateServiceStatusAction(updatedS)
+
+	_, requeue := f.run(&SyncServiceJob{model.FromService(s)})
+	assert.Equal(t, Drop, requeue)
+}
+
+func TestUpdateConfigWithholdsListenerOfServiceWithTooFewBackends(t *testing.T) {
+	f := newWorkerFixture(t)
+	waiting := newMinBackendsService("2")
+	waiting.Annotations[AnnotationEmptyBackends] = EmptyBackendsRemove
+	f.addService(waiting)
+	f.addEndpoints(newEndpointsOnNodes(waiting, "kubernetes-node-1"))
+
+	// keeps its forwards to the backends it has
+	kept := newMinBackendsService("2")
+	kept.Name = "kept-service"
+	f.addService(kept)
+
+	f.portmapper.On("GetModel").Return(map[string]string{
+		model.FromService(waiting).ToKey(): "port-id-1",
+		model.FromService(kept).ToKey():    "port-id-1",
+	}).Times(1)
+	m := &model.LoadBalancer{}
+	f.generator.On("GenerateModel", map[string]string{
+		model.FromService(kept).ToKey(): "port-id-1",
+	}).Return(m, nil).Times(1)
+	f.agentController.On("PushConfig", m).Return(nil).Times(1)
+
+	_, requeue := f.run(&UpdateConfigJob{})
+	assert.Equal(t, Drop, requeue)
+}
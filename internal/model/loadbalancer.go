@@ -15,6 +15,8 @@
 package model
 
 import (
+	"time"
+
 	corev1 "k8s.io/api/core/v1"
 
 	"github.com/golang-jwt/jwt"
@@ -26,7 +28,7 @@ type IPBlockFilter struct {
 }
 
 type PortFilter struct {
-	Protocol corev1.Protocol `json:"protocol" validate:"required,oneof=TCP UDP"`
+	Protocol corev1.Protocol `json:"protocol" validate:"required,oneof=TCP UDP SCTP"`
 
 	// Don't filter by port number if empty (only by protocol)
 	Port    *int32 `json:"port,omitempty" validate:"required_with=EndPort,omitempty,gte=0,lte=65535"`
@@ -58,11 +60,16 @@ type PolicyAssignment struct {
 }
 
 type PortForward struct {
-	Protocol             corev1.Protocol `json:"protocol" validate:"required,oneof=TCP UDP"`
-	InboundPort          int32           `json:"inbound-port" validate:"gte=0,lte=65535"`
-	DestinationAddresses []string        `json:"destination-addresses" validate:"required,dive,required,ip"`
-	DestinationPort      int32           `json:"destination-port" validate:"gte=0,lte=65535"`
-	BalancePolicy        string          `json:"policy"`
+	Protocol    corev1.Protocol `json:"protocol" validate:"required,oneof=TCP UDP SCTP"`
+	InboundPort int32           `json:"inbound-port" validate:"gte=0,lte=65535"`
+	// Traffic to the inbound port is dropped if there are no destination
+	// addresses
+	DestinationAddresses []string `json:"destination-addresses" validate:"dive,required,ip"`
+	DestinationPort      int32    `json:"destination-port" validate:"gte=0,lte=65535"`
+	BalancePolicy        string   `json:"policy"`
+	// Relative weight of this forward if multiple forwards share the same
+	// inbound protocol and port (see shared listener groups). Zero means 1.
+	Weight int32 `json:"weight,omitempty" validate:"gte=0"`
 }
 
 type IngressIP struct {
@@ -80,3 +87,13 @@ type ConfigClaim struct {
 	Config LoadBalancer `json:"load-balancer-config" validate:"required"`
 	jwt.StandardClaims
 }
+
+// AgentStatus is the controller's view of a load balancer agent.
+type AgentStatus struct {
+	URL string `json:"url"`
+	// Point in time at which the agent last accepted a configuration; zero
+	// if it never did
+	LastSeen time.Time `json:"last-seen"`
+	// The agent was not seen within the configured timeout
+	Stale bool `json:"stale"`
+}
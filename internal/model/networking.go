@@ -15,6 +15,8 @@
 package model
 
 import (
+	"time"
+
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -26,13 +28,166 @@ type L4Port struct {
 type ServiceModel struct {
 	L3PortID string
 	Ports    []L4Port
+	// Name of the shared listener group the service opted in to. Services of
+	// the same group may use the same L4 ports on the same L3 port.
+	SharedListenerGroup string
+	// Key of the shared IP group of the service; all services with the same
+	// key are kept on the same L3 port. Empty if the service has none.
+	SharedIPKey string
+	// NodePorts used by the service; empty if the service has none
+	NodePorts []L4Port
+	// How external traffic is routed to the backends of the service;
+	// Cluster if the service does not set it
+	ExternalTrafficPolicy corev1.ServiceExternalTrafficPolicy
+}
+
+// SharedAllocation is an L4 port which is deliberately used by multiple
+// services of the same shared listener group.
+type SharedAllocation struct {
+	Group    string
+	Services []string
 }
 
+// L3Port tracks the L4 port allocations on an L3 port. Allocations are keyed
+// by protocol and port number, so TCP and UDP on the same port number are
+// independent of each other.
 type L3Port struct {
-	Allocations map[int32]string
+	ID                string
+	Allocations       map[L4Port]string
+	SharedAllocations map[L4Port]SharedAllocation
+	// Point in time at which the port was provisioned; zero if the port was
+	// created outside of the port mapper
+	CreatedAt time.Time
 }
 
 func (p *L3Port) L4PortFree(pl4 L4Port) bool {
-	_, inuse := p.Allocations[pl4.Port]
-	return !inuse
+	_, inuse := p.Allocations[pl4]
+	_, shared := p.SharedAllocations[pl4]
+	return !inuse && !shared
+}
+
+// AllocationCounts returns the number of L4 ports in use on the port, by
+// protocol. A shared L4 port is counted once.
+func (p *L3Port) AllocationCounts() map[corev1.Protocol]int {
+	result := make(map[corev1.Protocol]int)
+	for l4port := range p.Allocations {
+		result[l4port.Protocol]++
+	}
+	for l4port := range p.SharedAllocations {
+		result[l4port.Protocol]++
+	}
+	return result
+}
+
+// IsUnused returns true if no service has any allocation on the port.
+func (p *L3Port) IsUnused() bool {
+	return len(p.Allocations) == 0 && len(p.SharedAllocations) == 0
+}
+
+// ServiceAssignment lists the L4 ports a service occupies on an L3 port.
+type ServiceAssignment struct {
+	Service               ServiceIdentifier                   `json:"service"`
+	Ports                 []L4Port                            `json:"ports"`
+	ExternalTrafficPolicy corev1.ServiceExternalTrafficPolicy `json:"external-traffic-policy"`
+}
+
+// FIPAssignment describes an L3 port together with its external address and
+// all services mapped to it.
+type FIPAssignment struct {
+	Address  string              `json:"address"`
+	L3PortID string              `json:"l3-port-id"`
+	Services []ServiceAssignment `json:"services"`
+}
+
+type ConflictType string
+
+const (
+	// The service was moved away from its preferred L3 port
+	ConflictRelocated ConflictType = "Relocated"
+	// No L3 port with sufficient free capacity was available for the service
+	ConflictCapacityBlocked ConflictType = "CapacityBlocked"
+	// The service cannot be mapped in its current form
+	ConflictRejected ConflictType = "Rejected"
+)
+
+// Conflict describes why a service is not placed the way it asked for.
+type Conflict struct {
+	Type    ConflictType      `json:"type"`
+	Service ServiceIdentifier `json:"service"`
+	// L3 port the service is mapped to, if any
+	L3PortID string `json:"l3-port-id,omitempty"`
+	Details  string `json:"details"`
+}
+
+// Eviction is a service which lost its L3 port because the port is not
+// available anymore.
+type Eviction struct {
+	Service ServiceIdentifier `json:"service"`
+	// L3 port among the remaining ones on which the service fits; empty if
+	// it fits on none of them
+	SuggestedL3PortID string `json:"suggested-l3-port-id,omitempty"`
+}
+
+type MapOutcome string
+
+const (
+	// The service was not mapped before
+	MapOutcomeNew MapOutcome = "New"
+	// The service was moved to a different L3 port
+	MapOutcomeMoved MapOutcome = "Moved"
+	// The service stays on its L3 port; its L4 ports may have changed
+	MapOutcomeUnchanged MapOutcome = "Unchanged"
+)
+
+// MapResult describes what mapping a service did.
+type MapResult struct {
+	Outcome MapOutcome
+	// L3 port the service is mapped to
+	L3PortID string
+	// Whether the L3 port was provisioned for the service
+	Provisioned bool
+	// Why the service was not placed on its preferred L3 port; empty if it
+	// was or had none
+	Relocation string
+	// Other services of the shared IP group of the service which were moved
+	// to the L3 port together with it
+	Moved []ServiceIdentifier
+}
+
+type TransitionType string
+
+const (
+	TransitionMap       TransitionType = "Map"
+	TransitionUnmap     TransitionType = "Unmap"
+	TransitionProvision TransitionType = "Provision"
+	TransitionRelease   TransitionType = "Release"
+	TransitionEvict     TransitionType = "Evict"
+)
+
+// Transition is a change of the allocation state of the port mapper.
+type Transition struct {
+	Time time.Time      `json:"time"`
+	Type TransitionType `json:"type"`
+	// Service affected by the transition; for provisioning, the service
+	// which caused the port to be created. Empty for releases.
+	Service  ServiceIdentifier `json:"service"`
+	L3PortID string            `json:"l3-port-id"`
+}
+
+// AllocationEvent describes a change of the allocations of a service.
+type AllocationEvent struct {
+	Service  ServiceIdentifier `json:"service"`
+	L3PortID string            `json:"l3-port-id"`
+	Ports    []L4Port          `json:"ports"`
+}
+
+// AllocationRecord is a change of the allocations of a service as kept for
+// long-term reporting. Type is TransitionMap, TransitionUnmap or
+// TransitionEvict.
+type AllocationRecord struct {
+	Time     time.Time         `json:"time"`
+	Type     TransitionType    `json:"type"`
+	Service  ServiceIdentifier `json:"service"`
+	L3PortID string            `json:"l3-port-id"`
+	Ports    []L4Port          `json:"ports"`
 }
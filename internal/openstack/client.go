@@ -24,11 +24,24 @@ import (
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
 	tokens3 "github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
+	"github.com/prometheus/client_golang/prometheus"
 
 	netutil "k8s.io/apimachinery/pkg/util/net"
 	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/klog"
 )
 
+var reauthenticationsMetric = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "lbaas_openstack_reauthentications_total",
+		Help: "Number of times the controller re-authenticated against OpenStack after its token was rejected",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(reauthenticationsMetric)
+}
+
 type OpenStackClient struct {
 	provider  *gophercloud.ProviderClient
 	region    string
@@ -65,8 +78,33 @@ func NewProviderClient(cfg *config.AuthOpts) (*gophercloud.ProviderClient, error
 
 	opts := cfg.ToAuthOptions()
 	err = openstack.Authenticate(provider, opts)
+	if err != nil {
+		return provider, err
+	}
 
-	return provider, err
+	countReauthentications(provider, reauthenticationsMetric)
+	return provider, nil
+}
+
+// Count and log every re-authentication of the provider client.
+//
+// The provider client re-authenticates once if a request is rejected with a
+// 401 and then retries the request. If re-authentication itself fails (e.g.
+// because the credentials are invalid), the request fails right away.
+func countReauthentications(provider *gophercloud.ProviderClient, counter prometheus.Counter) {
+	reauth := provider.ReauthFunc
+	if reauth == nil {
+		return
+	}
+	provider.ReauthFunc = func() error {
+		counter.Inc()
+		klog.Info("OpenStack token was rejected, re-authenticating")
+		err := reauth()
+		if err != nil {
+			klog.Warningf("failed to re-authenticate against OpenStack: %s", err.Error())
+		}
+		return err
+	}
 }
 
 func NewClient(cfg *config.AuthOpts) (*OpenStackClient, error) {
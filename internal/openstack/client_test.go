@@ -0,0 +1,94 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package openstack
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type reauthFixture struct {
+	provider *gophercloud.ProviderClient
+	counter  prometheus.Counter
+	server   *httptest.Server
+	requests int
+	reauths  int
+}
+
+func newReauthFixture(t *testing.T, reauthErr error) *reauthFixture {
+	f := &reauthFixture{
+		counter: prometheus.NewCounter(prometheus.CounterOpts{Name: "test_reauthentications_total"}),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.requests++
+		if r.Header.Get("X-Auth-Token") != "fresh-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(f.server.Close)
+
+	f.provider = &gophercloud.ProviderClient{}
+	f.provider.SetToken("expired-token")
+	f.provider.ReauthFunc = func() error {
+		f.reauths++
+		if reauthErr != nil {
+			return reauthErr
+		}
+		f.provider.SetToken("fresh-token")
+		return nil
+	}
+	countReauthentications(f.provider, f.counter)
+	return f
+}
+
+func (f *reauthFixture) get() error {
+	_, err := f.provider.Request("GET", f.server.URL, &gophercloud.RequestOpts{
+		OkCodes: []int{http.StatusOK},
+	})
+	return err
+}
+
+func TestExpiredTokenIsRenewedOnceAndRequestRetried(t *testing.T) {
+	f := newReauthFixture(t, nil)
+
+	assert.Nil(t, f.get())
+	assert.Equal(t, 1, f.reauths)
+	assert.Equal(t, 2, f.requests)
+	assert.Equal(t, float64(1), testutil.ToFloat64(f.counter))
+
+	// the fresh token is used from now on
+	assert.Nil(t, f.get())
+	assert.Equal(t, 1, f.reauths)
+	assert.Equal(t, 3, f.requests)
+}
+
+func TestPermanentAuthFailureFailsFast(t *testing.T) {
+	f := newReauthFixture(t, errors.New("invalid credentials"))
+
+	err := f.get()
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, f.reauths)
+	assert.Equal(t, 1, f.requests)
+	assert.Equal(t, float64(1), testutil.ToFloat64(f.counter))
+}
@@ -0,0 +1,75 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package openstack
+
+import (
+	"sync"
+	"time"
+)
+
+type fipCacheEntry struct {
+	address string
+	expires time.Time
+}
+
+// fipCache caches the floating IP address of L3 ports for a limited time.
+//
+// The zero value is a disabled cache which never returns a hit.
+type fipCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]fipCacheEntry
+}
+
+func newFIPCache(ttl time.Duration) fipCache {
+	return fipCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]fipCacheEntry),
+	}
+}
+
+func (c *fipCache) get(portID string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[portID]
+	if !ok {
+		return "", false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, portID)
+		return "", false
+	}
+	return entry.address, true
+}
+
+func (c *fipCache) set(portID string, address string) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[portID] = fipCacheEntry{
+		address: address,
+		expires: c.now().Add(c.ttl),
+	}
+}
+
+func (c *fipCache) invalidate(portID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, portID)
+}
@@ -15,8 +15,13 @@
 package openstack
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
 	"github.com/gophercloud/gophercloud"
@@ -25,11 +30,15 @@ import (
 	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
 	subnetsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
 	"github.com/gophercloud/gophercloud/pagination"
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/klog"
 )
 
 const (
 	TagLBManagedPort         = "cah-loadbalancer.k8s.cloudandheat.com/managed"
+	TagLBManagedBy           = "lbaas:managed-by=cah-loadbalancer"
+	TagPrefixLBCreatedBy     = "lbaas:created-by="
+	TagPrefixLBCluster       = "lbaas:cluster="
 	DescriptionLBManagedPort = "Managed by cah-loadbalancer"
 )
 
@@ -39,8 +48,38 @@ var (
 	ErrPortIsNil           = errors.New("Port is nil")
 	ErrNoFloatingIPCreated = errors.New("No floating IP was created by OpenStack")
 	ErrVRRPSetupFailed     = errors.New("Failed to update address pairs of all agents")
+	ErrNoPortAvailable     = errors.New("No port available: the subnet or the port quota is exhausted")
+	ErrNoFIPAvailable      = errors.New("No floating IP available: the external network or the floating IP quota is exhausted")
 )
 
+// Neutron error types which indicate that no further resources can be
+// allocated until some are released
+var neutronExhaustionErrors = map[string]bool{
+	"OverQuota":                  true,
+	"IpAddressGenerationFailure": true,
+	"ExternalIpAddressExhausted": true,
+}
+
+var (
+	portsProvisionedMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "lbaas_ports_provisioned_total",
+			Help: "Number of L3 ports successfully provisioned in OpenStack",
+		},
+	)
+	portsReleasedMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "lbaas_ports_released_total",
+			Help: "Number of unused L3 ports successfully released in OpenStack",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(portsProvisionedMetric)
+	prometheus.MustRegister(portsReleasedMetric)
+}
+
 // We need options which are not included in the default gophercloud struct
 type CustomCreateOpts struct {
 	NetworkID           string                `json:"network_id" required:"true"`
@@ -72,9 +111,22 @@ type OpenStackL3PortManager struct {
 	additionalAddressPairs []string
 	agents                 []config.Agent
 	ports                  PortClient
+	fipCache               fipCache
+	clusterIdentity        string
 }
 
-func (client *OpenStackClient) NewOpenStackL3PortManager(networkConfig *config.NetworkingOpts, agents []config.Agent, additionalAddressPairs []string) (*OpenStackL3PortManager, error) {
+type PortManagerOption func(*OpenStackL3PortManager)
+
+// Mark the ports and floating IPs provisioned by the port manager with the
+// given identity, so that the resources of several clusters sharing a
+// project can be told apart. By default, resources are not marked.
+func WithClusterIdentity(name string) PortManagerOption {
+	return func(pm *OpenStackL3PortManager) {
+		pm.clusterIdentity = name
+	}
+}
+
+func (client *OpenStackClient) NewOpenStackL3PortManager(networkConfig *config.NetworkingOpts, agents []config.Agent, additionalAddressPairs []string, opts ...PortManagerOption) (*OpenStackL3PortManager, error) {
 
 	networkingclient, err := client.NewNetworkV2()
 	if err != nil {
@@ -88,7 +140,7 @@ func (client *OpenStackClient) NewOpenStackL3PortManager(networkConfig *config.N
 
 	networkID := subnet.NetworkID
 
-	return &OpenStackL3PortManager{
+	pm := &OpenStackL3PortManager{
 		client:                 networkingclient,
 		cfg:                    networkConfig,
 		networkID:              networkID,
@@ -101,14 +153,35 @@ func (client *OpenStackClient) NewOpenStackL3PortManager(networkConfig *config.N
 			networkConfig.UseFloatingIPs,
 			client.projectID,
 		),
-	}, nil
+		fipCache: newFIPCache(time.Duration(networkConfig.FIPCacheTTL) * time.Second),
+	}
+	for _, opt := range opts {
+		opt(pm)
+	}
+	return pm, nil
+}
+
+// Return the description of the ports and floating IPs provisioned by the
+// port manager.
+func (pm *OpenStackL3PortManager) resourceDescription() string {
+	if pm.clusterIdentity == "" {
+		return DescriptionLBManagedPort
+	}
+	return fmt.Sprintf("%s (cluster %s)", DescriptionLBManagedPort, pm.clusterIdentity)
+}
+
+// InvalidateFIPCache drops the cached floating IP address of the given port.
+//
+// It must be called whenever a floating IP is (re-)associated with the port.
+func (pm *OpenStackL3PortManager) InvalidateFIPCache(portID string) {
+	pm.fipCache.invalidate(portID)
 }
 
 func (pm *OpenStackL3PortManager) provisionFloatingIP(portID string) error {
 	fip, err := floatingipsv2.Create(
 		pm.client,
 		floatingipsv2.CreateOpts{
-			Description:       DescriptionLBManagedPort,
+			Description:       pm.resourceDescription(),
 			FloatingNetworkID: pm.cfg.FloatingIPNetworkID,
 			PortID:            portID,
 		},
@@ -117,6 +190,7 @@ func (pm *OpenStackL3PortManager) provisionFloatingIP(portID string) error {
 	if err != nil {
 		return err
 	}
+	pm.InvalidateFIPCache(portID)
 
 	cleanupFip := func() {
 		deleteErr := floatingipsv2.Delete(pm.client, fip.ID).ExtractErr()
@@ -129,7 +203,7 @@ func (pm *OpenStackL3PortManager) provisionFloatingIP(portID string) error {
 	}
 
 	_, err = tags.ReplaceAll(pm.client, "floatingips", fip.ID, tags.ReplaceAllOpts{
-		Tags: []string{TagLBManagedPort},
+		Tags: provisionedPortTags("", pm.clusterIdentity),
 	}).Extract()
 
 	if err != nil {
@@ -140,6 +214,55 @@ func (pm *OpenStackL3PortManager) provisionFloatingIP(portID string) error {
 	return nil
 }
 
+// Return true if Neutron refused to allocate a resource because the network
+// or the quota is exhausted.
+func isExhaustionError(err error) bool {
+	var respErr gophercloud.ErrUnexpectedResponseCode
+	if !errors.As(err, &respErr) {
+		return false
+	}
+
+	var body struct {
+		NeutronError struct {
+			Type string `json:"type"`
+		} `json:"NeutronError"`
+	}
+	if json.Unmarshal(respErr.Body, &body) != nil {
+		return false
+	}
+	return neutronExhaustionErrors[body.NeutronError.Type]
+}
+
+// HTTP status codes of OpenStack API responses which indicate a transient
+// failure
+var retryableStatusCodes = map[int]bool{
+	401: true, // the token expired and could not be renewed right away
+	408: true,
+	429: true,
+	500: true,
+	502: true,
+	503: true,
+	504: true,
+}
+
+// IsRetryableError returns true if err is a transient failure of the
+// OpenStack API which may go away when the request is repeated.
+func IsRetryableError(err error) bool {
+	var afterReauth *gophercloud.ErrErrorAfterReauthentication
+	if errors.As(err, &afterReauth) {
+		return IsRetryableError(afterReauth.ErrOriginal)
+	}
+
+	var respErr gophercloud.ErrUnexpectedResponseCode
+	if errors.As(err, &respErr) {
+		return retryableStatusCodes[respErr.Actual]
+	}
+
+	var timeout *gophercloud.ErrTimeOut
+	var reauth *gophercloud.ErrUnableToReauthenticate
+	return errors.As(err, &timeout) || errors.As(err, &reauth)
+}
+
 func boolPtr(v bool) *bool {
 	return &v
 }
@@ -160,12 +283,26 @@ func (pm *OpenStackL3PortManager) CheckPortExists(portID string) (bool, error) {
 	return true, nil
 }
 
-func (pm *OpenStackL3PortManager) ProvisionPort() (string, error) {
+// Return the tags to set on a port provisioned for the given service by the
+// controller with the given cluster identity. Floating IPs carry the same
+// tags, without the service.
+func provisionedPortTags(serviceKey string, clusterIdentity string) []string {
+	result := []string{TagLBManagedPort, TagLBManagedBy}
+	if serviceKey != "" {
+		result = append(result, TagPrefixLBCreatedBy+serviceKey)
+	}
+	if clusterIdentity != "" {
+		result = append(result, TagPrefixLBCluster+clusterIdentity)
+	}
+	return result
+}
+
+func (pm *OpenStackL3PortManager) ProvisionPort(serviceKey string) (string, error) {
 	port, err := pm.ports.Create(
 		pm.client,
 		CustomCreateOpts{
 			NetworkID:   pm.networkID,
-			Description: DescriptionLBManagedPort,
+			Description: pm.resourceDescription(),
 			FixedIPs: []portsv2.IP{
 				{SubnetID: pm.cfg.SubnetID},
 			},
@@ -178,6 +315,9 @@ func (pm *OpenStackL3PortManager) ProvisionPort() (string, error) {
 	// If this is a problem, we’ll have to switch to matching based on the name
 	// or description instead.
 	if err != nil {
+		if isExhaustionError(err) {
+			return "", fmt.Errorf("%w: %s", ErrNoPortAvailable, err)
+		}
 		return "", err
 	}
 
@@ -192,7 +332,7 @@ func (pm *OpenStackL3PortManager) ProvisionPort() (string, error) {
 	}
 
 	_, err = tags.ReplaceAll(pm.client, "ports", port.ID, tags.ReplaceAllOpts{
-		Tags: []string{TagLBManagedPort},
+		Tags: provisionedPortTags(serviceKey, pm.clusterIdentity),
 	}).Extract()
 
 	if err != nil {
@@ -205,6 +345,9 @@ func (pm *OpenStackL3PortManager) ProvisionPort() (string, error) {
 		if err != nil {
 			klog.Warningf("Couldn't provide floating ip for port=%v: %s", port.ID, err)
 			cleanupPort()
+			if isExhaustionError(err) {
+				return "", fmt.Errorf("%w: %s", ErrNoFIPAvailable, err)
+			}
 			return "", ErrNoFloatingIPCreated
 		}
 	}
@@ -214,6 +357,7 @@ func (pm *OpenStackL3PortManager) ProvisionPort() (string, error) {
 		klog.Warningf("VRRP setup for port=%v failed during provisioning: %s", port.ID, err)
 	}
 
+	portsProvisionedMetric.Inc()
 	return port.ID, nil
 }
 
@@ -233,6 +377,9 @@ func (pm *OpenStackL3PortManager) deleteUnusedFloatingIPs() error {
 			return false, err
 		}
 		for _, fip := range fips {
+			if !pm.isOwnResource(fip.Tags) {
+				continue
+			}
 			if fip.PortID == "" {
 				// no assigned port, delete
 				toDelete = append(toDelete, fip.ID)
@@ -257,40 +404,111 @@ func (pm *OpenStackL3PortManager) deleteUnusedFloatingIPs() error {
 	return err
 }
 
-func (pm *OpenStackL3PortManager) CleanUnusedPorts(usedPorts []string) error {
+// Return true if a port or floating IP with the given tags belongs to this
+// cluster: it carries the tag of the cluster identity or no cluster tag at
+// all. Resources created before the cluster tag was introduced have none and
+// must stay in use after an upgrade, so they are considered own.
+func (pm *OpenStackL3PortManager) isOwnResource(resourceTags []string) bool {
+	hasClusterTag := slices.ContainsFunc(resourceTags, func(tag string) bool {
+		return strings.HasPrefix(tag, TagPrefixLBCluster)
+	})
+	if !hasClusterTag {
+		return true
+	}
+	return pm.clusterIdentity != "" && slices.Contains(resourceTags, TagPrefixLBCluster+pm.clusterIdentity)
+}
+
+func (pm *OpenStackL3PortManager) isOwnPort(port portsv2.Port) bool {
+	return pm.isOwnResource(port.Tags)
+}
+
+// Return the managed ports which belong to this cluster.
+func (pm *OpenStackL3PortManager) getOwnPorts() ([]portsv2.Port, error) {
 	ports, err := pm.ports.GetPorts()
-	klog.Infof("Used ports=%q", usedPorts)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	result := make([]portsv2.Port, 0, len(ports))
+	for _, port := range ports {
+		if pm.isOwnPort(port) {
+			result = append(result, port)
+		}
+	}
+	return result, nil
+}
+
+func (pm *OpenStackL3PortManager) CleanOrphanedPorts(knownIDs []string) ([]string, error) {
+	ports, err := pm.ports.GetPorts()
+	klog.Infof("Known ports=%q", knownIDs)
+	if err != nil {
+		return nil, err
 	}
 
-	usedPortsMap := make(map[string]bool)
-	for _, portID := range usedPorts {
-		usedPortsMap[portID] = true
+	known := make(map[string]bool)
+	for _, portID := range knownIDs {
+		known[portID] = true
 	}
 
+	deleted := []string{}
 	anyDeleted := false
 	for _, port := range ports {
-		if _, inUse := usedPortsMap[port.ID]; inUse {
+		if known[port.ID] {
+			continue
+		}
+		if !pm.isOwnPort(port) {
+			klog.V(4).Infof("Not deleting port %q because it belongs to another cluster", port.ID)
 			continue
 		}
 
-		// port not in use, issue deletion
+		// port not known, issue deletion
 		err := pm.deletePort(port.ID)
 		if err != nil {
-			klog.Warningf("Failed to delete unused port %q: %s. The operation will be retried later.", port.ID, err)
+			klog.Warningf("Failed to delete orphaned port %q: %s. The operation will be retried later.", port.ID, err)
+		} else {
+			portsReleasedMetric.Inc()
+			deleted = append(deleted, port.ID)
 		}
 		anyDeleted = true
 	}
 
 	if anyDeleted {
-		return pm.deleteUnusedFloatingIPs()
+		return deleted, pm.deleteUnusedFloatingIPs()
+	}
+	return deleted, nil
+}
+
+func (pm *OpenStackL3PortManager) ReleasePort(portID string) error {
+	port, fip, err := pm.ports.GetPortByID(portID)
+	if err != nil {
+		if _, notFound := err.(gophercloud.ErrDefault404); notFound {
+			return nil
+		}
+		return err
+	}
+	if !slices.Contains(port.Tags, TagLBManagedPort) {
+		klog.Infof("Not deleting port %q because it is not managed by us", portID)
+		return nil
+	}
+	if !pm.isOwnPort(*port) {
+		klog.Infof("Not deleting port %q because it belongs to another cluster", portID)
+		return nil
+	}
+
+	err = pm.deletePort(portID)
+	if err != nil {
+		return err
+	}
+	portsReleasedMetric.Inc()
+
+	if fip != nil {
+		klog.Infof("Trying to delete floating ip %q", fip.ID)
+		return floatingipsv2.Delete(pm.client, fip.ID).ExtractErr()
 	}
 	return nil
 }
 
 func (pm *OpenStackL3PortManager) GetAvailablePorts() ([]string, error) {
-	ports, err := pm.ports.GetPorts()
+	ports, err := pm.getOwnPorts()
 	if err != nil {
 		return nil, err
 	}
@@ -308,7 +526,7 @@ func (pm *OpenStackL3PortManager) GetAvailablePorts() ([]string, error) {
 // are configured as allowed address pair of all agent nodes. Should be run periodically
 // to ensure a correct setup in case an agent was unresponsive earlier
 func (pm *OpenStackL3PortManager) EnsureAgentsState() error {
-	ports, err := pm.ports.GetPorts()
+	ports, err := pm.getOwnPorts()
 	if err != nil {
 		klog.Warningf("Failed to get L3 ports during VRRP setup: %s", err)
 		return err
@@ -360,6 +578,12 @@ func (pm *OpenStackL3PortManager) EnsureAgentsState() error {
 }
 
 func (pm *OpenStackL3PortManager) GetExternalAddress(portID string) (string, string, error) {
+	if pm.cfg.UseFloatingIPs {
+		if address, ok := pm.fipCache.get(portID); ok {
+			return address, "", nil
+		}
+	}
+
 	port, fip, err := pm.ports.GetPortByID(portID)
 	if err != nil {
 		return "", "", err
@@ -375,6 +599,7 @@ func (pm *OpenStackL3PortManager) GetExternalAddress(portID string) (string, str
 			return "", "", ErrFloatingIPMissing
 		}
 
+		pm.fipCache.set(portID, fip.FloatingIP)
 		return fip.FloatingIP, "", nil
 	}
 
@@ -406,6 +631,7 @@ func (pm *OpenStackL3PortManager) deletePort(portID string) error {
 	klog.Infof("Trying to delete port %q", portID)
 
 	err := pm.ports.Delete(pm.client, portID).ExtractErr()
+	pm.InvalidateFIPCache(portID)
 
 	if err == nil {
 		pm.EnsureAgentsState()
@@ -1,12 +1,19 @@
 package openstack
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
+	"github.com/gophercloud/gophercloud"
+	floatingipsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
 	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 
@@ -107,6 +114,25 @@ func TestEnsureAgentsStateUpdateAddressPairsCorrectly(t *testing.T) {
 	f.client.AssertExpectations(t)
 }
 
+func TestEnsureAgentsStateKeepsPortsWithoutClusterTagAfterUpgrade(t *testing.T) {
+	f := newFixture(t)
+	f.pm.clusterIdentity = "cluster-a"
+
+	// ports created before the cluster tag was introduced
+	for i := range f.l3Ports {
+		f.l3Ports[i].Tags = []string{TagLBManagedPort}
+	}
+	f.client.On("GetPorts").Return(f.l3Ports, nil).Times(1)
+
+	for _, agent := range f.agents {
+		f.client.On("Update", mock.Anything, agent.PortId, mock.MatchedBy(getMatchIpFn(f.expectedAddressPairs))).Return(&portsv2.Port{}, nil).Times(1)
+	}
+
+	err := f.pm.EnsureAgentsState()
+	assert.Nil(t, err)
+	f.client.AssertExpectations(t)
+}
+
 func TestEnsureAgentsStateReturnsErrorIfPortsCannotBeFetched(t *testing.T) {
 	f := newFixture(t)
 
@@ -135,3 +161,465 @@ func TestEnsureAgentsStateReturnsErrorIfUpdateFails(t *testing.T) {
 	assert.NotNil(t, err)
 	f.client.AssertExpectations(t)
 }
+
+func newFIPCacheFixture(t *testing.T) (*fixture, *time.Time) {
+	f := newFixture(t)
+	now := time.Unix(1000, 0)
+	f.pm.cfg.UseFloatingIPs = true
+	f.pm.fipCache = newFIPCache(30 * time.Second)
+	f.pm.fipCache.now = func() time.Time { return now }
+	return f, &now
+}
+
+func TestGetExternalAddressCachesFloatingIP(t *testing.T) {
+	f, _ := newFIPCacheFixture(t)
+
+	f.client.On("GetPortByID", "port-id").Return(&portsv2.Port{}, &floatingipsv2.FloatingIP{FloatingIP: "203.0.113.1"}, nil).Times(1)
+
+	for i := 0; i < 2; i++ {
+		addr, _, err := f.pm.GetExternalAddress("port-id")
+		assert.Nil(t, err)
+		assert.Equal(t, "203.0.113.1", addr)
+	}
+
+	f.client.AssertExpectations(t)
+}
+
+func TestGetExternalAddressCacheExpiresAfterTTL(t *testing.T) {
+	f, now := newFIPCacheFixture(t)
+
+	f.client.On("GetPortByID", "port-id").Return(&portsv2.Port{}, &floatingipsv2.FloatingIP{FloatingIP: "203.0.113.1"}, nil).Times(1)
+	f.client.On("GetPortByID", "port-id").Return(&portsv2.Port{}, &floatingipsv2.FloatingIP{FloatingIP: "203.0.113.2"}, nil).Times(1)
+
+	addr, _, err := f.pm.GetExternalAddress("port-id")
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.1", addr)
+
+	*now = now.Add(30 * time.Second)
+
+	addr, _, err = f.pm.GetExternalAddress("port-id")
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.2", addr)
+
+	f.client.AssertExpectations(t)
+}
+
+func TestInvalidateFIPCacheForcesRefresh(t *testing.T) {
+	f, _ := newFIPCacheFixture(t)
+
+	f.client.On("GetPortByID", "port-id").Return(&portsv2.Port{}, &floatingipsv2.FloatingIP{FloatingIP: "203.0.113.1"}, nil).Times(1)
+	f.client.On("GetPortByID", "port-id").Return(&portsv2.Port{}, &floatingipsv2.FloatingIP{FloatingIP: "203.0.113.2"}, nil).Times(1)
+
+	addr, _, err := f.pm.GetExternalAddress("port-id")
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.1", addr)
+
+	f.pm.InvalidateFIPCache("port-id")
+
+	addr, _, err = f.pm.GetExternalAddress("port-id")
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.2", addr)
+
+	f.client.AssertExpectations(t)
+}
+
+func TestProvisionedPortTagsIncludeCreatingService(t *testing.T) {
+	assert.Equal(t, []string{
+		TagLBManagedPort,
+		TagLBManagedBy,
+		"lbaas:created-by=default/test-service",
+	}, provisionedPortTags("default/test-service", ""))
+}
+
+func TestProvisionedPortTagsWithoutServiceOnlyMarkManaged(t *testing.T) {
+	assert.Equal(t, []string{TagLBManagedPort, TagLBManagedBy}, provisionedPortTags("", ""))
+}
+
+// Point the port manager at a fake networking API which accepts tag updates
+// and lists no floating IPs; everything else goes through the mock client.
+func (f *fixture) withNetworkingAPI() {
+	f.withNetworkingAPIHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodPut:
+			fmt.Fprint(w, `{"tags": []}`)
+		case http.MethodGet:
+			fmt.Fprint(w, `{"floatingips": []}`)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	})
+}
+
+func (f *fixture) withNetworkingAPIHandler(handler http.HandlerFunc) {
+	server := httptest.NewServer(handler)
+	f.t.Cleanup(server.Close)
+
+	f.pm.client = &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{},
+		Endpoint:       server.URL + "/",
+	}
+}
+
+func (f *fixture) expectAgentsStateUpdate() {
+	f.client.On("GetPorts").Return(f.l3Ports, nil).Once()
+	for _, agent := range f.agents {
+		f.client.On("Update", mock.Anything, agent.PortId, mock.Anything).Return(&portsv2.Port{}, nil).Once()
+	}
+}
+
+func TestProvisionPortIncrementsProvisionedCounterOnce(t *testing.T) {
+	f := newFixture(t)
+	f.withNetworkingAPI()
+
+	provisioned := testutil.ToFloat64(portsProvisionedMetric)
+	released := testutil.ToFloat64(portsReleasedMetric)
+
+	f.client.On("Create", mock.Anything, mock.Anything).Return(&portsv2.Port{ID: "new-port-id"}, nil).Times(1)
+	f.expectAgentsStateUpdate()
+
+	portID, err := f.pm.ProvisionPort("default/test-service")
+	assert.Nil(t, err)
+	assert.Equal(t, "new-port-id", portID)
+
+	assert.Equal(t, provisioned+1, testutil.ToFloat64(portsProvisionedMetric))
+	assert.Equal(t, released, testutil.ToFloat64(portsReleasedMetric))
+	f.client.AssertExpectations(t)
+}
+
+func TestProvisionPortMarksPortWithClusterIdentity(t *testing.T) {
+	f := newFixture(t)
+	WithClusterIdentity("prod-1")(f.pm)
+
+	var tags struct {
+		Tags []string `json:"tags"`
+	}
+	f.withNetworkingAPIHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&tags))
+		fmt.Fprint(w, `{"tags": []}`)
+	})
+
+	f.client.On("Create", mock.Anything, mock.MatchedBy(func(opts CustomCreateOpts) bool {
+		return opts.Description == "Managed by cah-loadbalancer (cluster prod-1)"
+	})).Return(&portsv2.Port{ID: "new-port-id"}, nil).Times(1)
+	f.expectAgentsStateUpdate()
+
+	_, err := f.pm.ProvisionPort("default/test-service")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		TagLBManagedPort,
+		"lbaas:managed-by=cah-loadbalancer",
+		"lbaas:created-by=default/test-service",
+		"lbaas:cluster=prod-1",
+	}, tags.Tags)
+	f.client.AssertExpectations(t)
+}
+
+func TestProvisionPortMarksFloatingIPWithClusterIdentity(t *testing.T) {
+	f := newFixture(t)
+	WithClusterIdentity("prod-1")(f.pm)
+	f.pm.cfg.UseFloatingIPs = true
+	f.pm.cfg.FloatingIPNetworkID = "public-network-id"
+	f.pm.fipCache = newFIPCache(0)
+
+	tagged := map[string][]string{}
+	f.withNetworkingAPIHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"floatingip": {"id": "fip-id"}}`)
+		case http.MethodPut:
+			var body struct {
+				Tags []string `json:"tags"`
+			}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			tagged[r.URL.Path] = body.Tags
+			fmt.Fprint(w, `{"tags": []}`)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	})
+
+	f.client.On("Create", mock.Anything, mock.Anything).Return(&portsv2.Port{ID: "new-port-id"}, nil).Times(1)
+	f.expectAgentsStateUpdate()
+
+	_, err := f.pm.ProvisionPort("default/test-service")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		TagLBManagedPort,
+		"lbaas:managed-by=cah-loadbalancer",
+		"lbaas:cluster=prod-1",
+	}, tagged["/floatingips/fip-id/tags"])
+	f.client.AssertExpectations(t)
+}
+
+func TestGetAvailablePortsSkipsPortsOfOtherClusters(t *testing.T) {
+	f := newFixture(t)
+	f.pm.clusterIdentity = "cluster-a"
+
+	f.client.On("GetPorts").Return([]portsv2.Port{
+		{ID: "own-port-id", Tags: []string{TagLBManagedPort, TagPrefixLBCluster + "cluster-a"}},
+		{ID: "foreign-port-id", Tags: []string{TagLBManagedPort, TagPrefixLBCluster + "cluster-b"}},
+		{ID: "untagged-port-id", Tags: []string{TagLBManagedPort}},
+	}, nil).Once()
+
+	ports, err := f.pm.GetAvailablePorts()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"own-port-id", "untagged-port-id"}, ports)
+	f.client.AssertExpectations(t)
+}
+
+func TestProvisionPortDoesNotCountFailedProvisioning(t *testing.T) {
+	f := newFixture(t)
+
+	provisioned := testutil.ToFloat64(portsProvisionedMetric)
+
+	f.client.On("Create", mock.Anything, mock.Anything).Return((*portsv2.Port)(nil), errors.New("quota exceeded")).Times(1)
+
+	_, err := f.pm.ProvisionPort("default/test-service")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, provisioned, testutil.ToFloat64(portsProvisionedMetric))
+	f.client.AssertExpectations(t)
+}
+
+func TestCleanOrphanedPortsIncrementsReleasedCounterOncePerPort(t *testing.T) {
+	f := newFixture(t)
+	f.withNetworkingAPI()
+
+	provisioned := testutil.ToFloat64(portsProvisionedMetric)
+	released := testutil.ToFloat64(portsReleasedMetric)
+
+	f.client.On("GetPorts").Return([]portsv2.Port{{ID: "used-port-id"}, {ID: "unused-port-id"}}, nil).Once()
+	f.client.On("Delete", mock.Anything, "unused-port-id").Return(portsv2.DeleteResult{}).Times(1)
+	f.expectAgentsStateUpdate()
+
+	deleted, err := f.pm.CleanOrphanedPorts([]string{"used-port-id"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"unused-port-id"}, deleted)
+
+	assert.Equal(t, released+1, testutil.ToFloat64(portsReleasedMetric))
+	assert.Equal(t, provisioned, testutil.ToFloat64(portsProvisionedMetric))
+	f.client.AssertExpectations(t)
+}
+
+func TestCleanOrphanedPortsDoesNotCountFailedRelease(t *testing.T) {
+	f := newFixture(t)
+	f.withNetworkingAPI()
+
+	released := testutil.ToFloat64(portsReleasedMetric)
+
+	result := portsv2.DeleteResult{}
+	result.Err = errors.New("conflict")
+	f.client.On("GetPorts").Return([]portsv2.Port{{ID: "unused-port-id"}}, nil).Once()
+	f.client.On("Delete", mock.Anything, "unused-port-id").Return(result).Times(1)
+
+	deleted, err := f.pm.CleanOrphanedPorts([]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, deleted)
+
+	assert.Equal(t, released, testutil.ToFloat64(portsReleasedMetric))
+	f.client.AssertExpectations(t)
+}
+
+func TestCleanOrphanedPortsOnlyDeletesPortsOfOwnCluster(t *testing.T) {
+	f := newFixture(t)
+	f.withNetworkingAPI()
+	f.pm.clusterIdentity = "cluster-a"
+
+	f.client.On("GetPorts").Return([]portsv2.Port{
+		{ID: "own-port-id", Tags: []string{TagLBManagedPort, TagPrefixLBCluster + "cluster-a"}},
+		{ID: "foreign-port-id", Tags: []string{TagLBManagedPort, TagPrefixLBCluster + "cluster-b"}},
+		{ID: "untagged-port-id", Tags: []string{TagLBManagedPort}},
+	}, nil).Once()
+	f.client.On("Delete", mock.Anything, "own-port-id").Return(portsv2.DeleteResult{}).Times(1)
+	f.client.On("Delete", mock.Anything, "untagged-port-id").Return(portsv2.DeleteResult{}).Times(1)
+	f.expectAgentsStateUpdate()
+	f.expectAgentsStateUpdate()
+
+	deleted, err := f.pm.CleanOrphanedPorts([]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"own-port-id", "untagged-port-id"}, deleted)
+	f.client.AssertExpectations(t)
+	f.client.AssertNotCalled(t, "Delete", mock.Anything, "foreign-port-id")
+}
+
+func TestCleanOrphanedPortsWithoutIdentitySkipsPortsOfIdentifiedClusters(t *testing.T) {
+	f := newFixture(t)
+	f.withNetworkingAPI()
+
+	f.client.On("GetPorts").Return([]portsv2.Port{
+		{ID: "foreign-port-id", Tags: []string{TagLBManagedPort, TagPrefixLBCluster + "cluster-b"}},
+	}, nil).Once()
+
+	deleted, err := f.pm.CleanOrphanedPorts([]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, deleted)
+	f.client.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything)
+}
+
+func TestReleasePortDeletesManagedPortAndItsFloatingIP(t *testing.T) {
+	f := newFixture(t)
+	deleted := []string{}
+	f.withNetworkingAPIHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		deleted = append(deleted, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	released := testutil.ToFloat64(portsReleasedMetric)
+
+	port := &portsv2.Port{ID: "port-id", Tags: []string{TagLBManagedPort}}
+	fip := &floatingipsv2.FloatingIP{ID: "fip-id", PortID: "port-id"}
+	f.client.On("GetPortByID", "port-id").Return(port, fip, nil).Once()
+	f.client.On("Delete", mock.Anything, "port-id").Return(portsv2.DeleteResult{}).Times(1)
+	f.expectAgentsStateUpdate()
+
+	err := f.pm.ReleasePort("port-id")
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"/floatingips/fip-id"}, deleted)
+	assert.Equal(t, released+1, testutil.ToFloat64(portsReleasedMetric))
+	f.client.AssertExpectations(t)
+}
+
+func TestReleasePortLeavesUnmanagedPortAlone(t *testing.T) {
+	f := newFixture(t)
+
+	port := &portsv2.Port{ID: "port-id"}
+	f.client.On("GetPortByID", "port-id").Return(port, (*floatingipsv2.FloatingIP)(nil), nil).Once()
+
+	err := f.pm.ReleasePort("port-id")
+	assert.Nil(t, err)
+
+	f.client.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything)
+	f.client.AssertExpectations(t)
+}
+
+func neutronError(code int, errorType string) gophercloud.ErrUnexpectedResponseCode {
+	return gophercloud.ErrUnexpectedResponseCode{
+		Actual: code,
+		Body:   []byte(fmt.Sprintf(`{"NeutronError": {"type": %q, "message": "", "detail": ""}}`, errorType)),
+	}
+}
+
+func TestProvisionPortReportsExhaustedPorts(t *testing.T) {
+	f := newFixture(t)
+
+	f.client.On("Create", mock.Anything, mock.Anything).Return(
+		(*portsv2.Port)(nil),
+		gophercloud.ErrDefault409{ErrUnexpectedResponseCode: neutronError(http.StatusConflict, "OverQuota")},
+	).Times(1)
+
+	_, err := f.pm.ProvisionPort("default/test-service")
+	assert.True(t, errors.Is(err, ErrNoPortAvailable))
+	assert.False(t, errors.Is(err, ErrNoFIPAvailable))
+	f.client.AssertExpectations(t)
+}
+
+func TestProvisionPortPassesOnOtherPortErrors(t *testing.T) {
+	f := newFixture(t)
+
+	f.client.On("Create", mock.Anything, mock.Anything).Return(
+		(*portsv2.Port)(nil),
+		gophercloud.ErrDefault400{ErrUnexpectedResponseCode: neutronError(http.StatusBadRequest, "InvalidInput")},
+	).Times(1)
+
+	_, err := f.pm.ProvisionPort("default/test-service")
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrNoPortAvailable))
+	f.client.AssertExpectations(t)
+}
+
+func newFloatingIPFailureFixture(t *testing.T, code int, errorType string) *fixture {
+	f := newFixture(t)
+	f.pm.cfg.UseFloatingIPs = true
+	f.pm.cfg.FloatingIPNetworkID = "public-network-id"
+	f.pm.fipCache = newFIPCache(0)
+	f.withNetworkingAPIHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodPut:
+			fmt.Fprint(w, `{"tags": []}`)
+		case http.MethodPost:
+			w.WriteHeader(code)
+			fmt.Fprintf(w, `{"NeutronError": {"type": %q, "message": "", "detail": ""}}`, errorType)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	})
+
+	f.client.On("Create", mock.Anything, mock.Anything).Return(&portsv2.Port{ID: "new-port-id"}, nil).Times(1)
+	// the port is cleaned up again
+	f.client.On("Delete", mock.Anything, "new-port-id").Return(portsv2.DeleteResult{}).Times(1)
+	f.expectAgentsStateUpdate()
+	return f
+}
+
+func TestProvisionPortReportsExhaustedFloatingIPs(t *testing.T) {
+	f := newFloatingIPFailureFixture(t, http.StatusBadRequest, "ExternalIpAddressExhausted")
+
+	_, err := f.pm.ProvisionPort("default/test-service")
+	assert.True(t, errors.Is(err, ErrNoFIPAvailable))
+	assert.False(t, errors.Is(err, ErrNoPortAvailable))
+	f.client.AssertExpectations(t)
+}
+
+func TestProvisionPortReportsFloatingIPQuota(t *testing.T) {
+	f := newFloatingIPFailureFixture(t, http.StatusConflict, "OverQuota")
+
+	_, err := f.pm.ProvisionPort("default/test-service")
+	assert.True(t, errors.Is(err, ErrNoFIPAvailable))
+	f.client.AssertExpectations(t)
+}
+
+func TestProvisionPortReportsOtherFloatingIPErrorsAsNotCreated(t *testing.T) {
+	f := newFloatingIPFailureFixture(t, http.StatusNotFound, "ExternalGatewayForFloatingIPNotFound")
+
+	_, err := f.pm.ProvisionPort("default/test-service")
+	assert.Equal(t, ErrNoFloatingIPCreated, err)
+	f.client.AssertExpectations(t)
+}
+
+func TestIsRetryableError(t *testing.T) {
+	responseError := func(code int) gophercloud.ErrUnexpectedResponseCode {
+		return gophercloud.ErrUnexpectedResponseCode{Actual: code}
+	}
+
+	assert.True(t, IsRetryableError(gophercloud.ErrDefault429{ErrUnexpectedResponseCode: responseError(429)}))
+	assert.True(t, IsRetryableError(gophercloud.ErrDefault503{ErrUnexpectedResponseCode: responseError(503)}))
+	assert.True(t, IsRetryableError(fmt.Errorf("wrapped: %w", responseError(502))))
+	assert.True(t, IsRetryableError(&gophercloud.ErrUnableToReauthenticate{}))
+	assert.True(t, IsRetryableError(&gophercloud.ErrErrorAfterReauthentication{
+		ErrOriginal: gophercloud.ErrDefault500{ErrUnexpectedResponseCode: responseError(500)},
+	}))
+
+	assert.False(t, IsRetryableError(gophercloud.ErrDefault400{ErrUnexpectedResponseCode: responseError(400)}))
+	assert.False(t, IsRetryableError(gophercloud.ErrDefault404{ErrUnexpectedResponseCode: responseError(404)}))
+	assert.False(t, IsRetryableError(fmt.Errorf("%w: quota", ErrNoPortAvailable)))
+	assert.False(t, IsRetryableError(errors.New("something else")))
+}
+
+func TestReleasePortDoesNotDeletePortOfOtherCluster(t *testing.T) {
+	f := newFixture(t)
+	f.pm.clusterIdentity = "cluster-a"
+
+	released := testutil.ToFloat64(portsReleasedMetric)
+
+	port := &portsv2.Port{ID: "port-id", Tags: []string{TagLBManagedPort, TagPrefixLBCluster + "cluster-b"}}
+	fip := &floatingipsv2.FloatingIP{ID: "fip-id", PortID: "port-id"}
+	f.client.On("GetPortByID", "port-id").Return(port, fip, nil).Once()
+
+	err := f.pm.ReleasePort("port-id")
+	assert.Nil(t, err)
+
+	assert.Equal(t, released, testutil.ToFloat64(portsReleasedMetric))
+	f.client.AssertExpectations(t)
+	f.client.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything)
+}
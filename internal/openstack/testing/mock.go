@@ -41,13 +41,18 @@ func (m *MockL3PortManager) CheckPortExists(portID string) (bool, error) {
 	return a.Bool(0), a.Error(1)
 }
 
-func (m *MockL3PortManager) ProvisionPort() (string, error) {
-	a := m.Called()
+func (m *MockL3PortManager) ProvisionPort(serviceKey string) (string, error) {
+	a := m.Called(serviceKey)
 	return a.String(0), a.Error(1)
 }
 
-func (m *MockL3PortManager) CleanUnusedPorts(usedPorts []string) error {
-	a := m.Called(usedPorts)
+func (m *MockL3PortManager) CleanOrphanedPorts(knownIDs []string) ([]string, error) {
+	a := m.Called(knownIDs)
+	return a.Get(0).([]string), a.Error(1)
+}
+
+func (m *MockL3PortManager) ReleasePort(portID string) error {
+	a := m.Called(portID)
 	return a.Error(0)
 }
 
@@ -38,11 +38,15 @@ func (pm *StaticL3PortManager) CheckPortExists(portID string) (bool, error) {
 	return true, nil
 }
 
-func (pm *StaticL3PortManager) ProvisionPort() (string, error) {
+func (pm *StaticL3PortManager) ProvisionPort(serviceKey string) (string, error) {
 	return "", fmt.Errorf("cannot provision new ports when using static port manager")
 }
 
-func (pm *StaticL3PortManager) CleanUnusedPorts(usedPorts []string) error {
+func (pm *StaticL3PortManager) CleanOrphanedPorts(knownIDs []string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (pm *StaticL3PortManager) ReleasePort(portID string) error {
 	return nil
 }
 
@@ -41,15 +41,16 @@ func TestCheckPortExists(t *testing.T) {
 func TestProvisionPort(t *testing.T) {
 	man := newStaticPortManagerFixture(t)
 
-	_, err := man.ProvisionPort()
+	_, err := man.ProvisionPort("default/some-service")
 	assert.NotNil(t, err)
 }
 
-func TestCleanUnusedPorts(t *testing.T) {
+func TestCleanOrphanedPorts(t *testing.T) {
 	man := newStaticPortManagerFixture(t)
 
-	err := man.CleanUnusedPorts([]string{})
+	deleted, err := man.CleanOrphanedPorts([]string{})
 	assert.Nil(t, err)
+	assert.Equal(t, []string{}, deleted)
 }
 
 func TestGetAvailablePorts(t *testing.T) {